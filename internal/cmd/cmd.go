@@ -3,22 +3,21 @@ package cmd
 
 import (
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"runtime"
-	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/service"
 	"github.com/ameshkov/snirelay/internal/config"
 	"github.com/ameshkov/snirelay/internal/dnssrv"
 	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/ameshkov/snirelay/internal/quota"
 	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/ameshkov/snirelay/internal/sockets"
 	"github.com/ameshkov/snirelay/internal/version"
 	goFlags "github.com/jessevdk/go-flags"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Main is the entry point of the program.
@@ -46,33 +45,88 @@ func Main() {
 	cfg, err := config.Load(o.ConfigPath)
 	check("load config file", err)
 
-	relayCfg, err := cfg.ToRelayConfig()
+	reloader := newReloader(o.ConfigPath, cfg)
+
+	rules, err := cfg.ExpandRules()
+	check("load domain rules", err)
+
+	relayCfg, err := cfg.ToRelayConfig(rules)
 	check("parse relay config", err)
 
-	dnsCfg, err := cfg.ToDNSConfig()
+	dnsCfg, err := cfg.ToDNSConfig(rules)
 	check("parse dns config", err)
 
+	socks, err := sockets.New()
+	check("inherit sockets", err)
+
+	upg, err := newUpgrader(socks)
+	check("init upgrader", err)
+
+	relayCfg.ListenConfig = socks
+	if dnsCfg != nil {
+		dnsCfg.ListenConfig = socks
+	}
+
+	if quotaCfg := cfg.ToQuotaConfig(); quotaCfg != nil {
+		relayCfg.Quotas = quota.New(quotaCfg)
+	}
+
 	relaySrv, err := relay.NewServer(relayCfg)
 	check("init relay server", err)
 
-	err = relaySrv.Start()
-	check("start relay server", err)
+	reloader.relaySrv = relaySrv
+
+	// The metrics server is started first and shut down last so that the
+	// metrics are available while the relay is draining connections.  The
+	// DNS server is shut down first so that no new clients are sent to the
+	// relay.  The quota store is shut down after the relay so that the traffic
+	// of the drained connections is stored.  The upgrader must be the last
+	// one, see its documentation.
+	var svcs []service.Interface
+	if cfg.Prometheus != nil {
+		metricsAddr := netutil.JoinHostPort(cfg.Prometheus.Addr, cfg.Prometheus.Port)
+		svcs = append(svcs, metrics.NewServer(metricsAddr, socks))
+	}
+
+	if relayCfg.Quotas != nil {
+		svcs = append(svcs, relayCfg.Quotas)
+	}
+
+	svcs = append(svcs, relaySrv)
 
 	if dnsCfg != nil {
-		dnsSrv, err := dnssrv.New(dnsCfg)
-		check("init dns server", err)
+		dnsSrv, dnsErr := dnssrv.New(dnsCfg)
+		check("init dns server", dnsErr)
 
-		err = dnsSrv.Start()
-		check("start dns server", err)
+		reloader.dnsSrv = dnsSrv
+		svcs = append(svcs, dnsSrv)
 	}
 
+	svcs = append(svcs, upg)
+
+	metrics.RulesTotal.Set(float64(len(relayCfg.Rules)))
 	metrics.SetUpGauge(version.Version(), "", "", runtime.Version())
 
-	if cfg.Prometheus != nil {
-		go serveMetrics(cfg.Prometheus.Addr, cfg.Prometheus.Port)
+	// Create the signal handler before starting the services so that the
+	// signals received during the startup are not lost.
+	sigHandler := newSignalHandler(
+		reloader.reloadConfig,
+		upg.upgrade,
+		relayCfg.ShutdownGracePeriod+shutdownTimeout,
+		svcs...,
+	)
+
+	err = startServices(svcs)
+	check("start services", err)
+
+	err = socks.CloseUnused()
+	check("close unused sockets", err)
+
+	err = reloader.watchLists()
+	if err != nil {
+		log.Error("lists: %s; list files are only reloaded with the configuration", err)
 	}
 
-	sigHandler := newSignalHandler(relaySrv)
 	os.Exit(sigHandler.handle())
 }
 
@@ -84,26 +138,3 @@ func check(operationName string, err error) {
 		os.Exit(1)
 	}
 }
-
-// serveMetrics starts
-func serveMetrics(listenAddr string, port uint16) {
-	metricsAddr := netutil.JoinHostPort(listenAddr, port)
-	log.Info("Starting metrics at %s", metricsAddr)
-
-	mux := &http.ServeMux{}
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/health-check", func(w http.ResponseWriter, _ *http.Request) {
-		_, _ = io.WriteString(w, "OK")
-	})
-
-	srv := &http.Server{
-		Addr:         metricsAddr,
-		Handler:      mux,
-		ReadTimeout:  time.Minute,
-		WriteTimeout: time.Minute,
-	}
-
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("Metrics failed to listen to %s: %v", metricsAddr, err)
-	}
-}
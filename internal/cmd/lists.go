@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/fsnotify/fsnotify"
+)
+
+// listSettleDelay is the time the list files must not change before the rules
+// are reloaded, so that a file is not read while it is being written.
+const listSettleDelay = time.Second
+
+// fileState is the state of a list file used to detect its changes.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchLists starts watching the list files of the domain rules in a separate
+// goroutine.  The parent directories of the files are watched, so that the
+// files replaced by renaming are noticed as well.  The rules are reloaded once
+// the files have not changed for r.settleDelay.
+func (r *reloader) watchLists() (err error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating watcher: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.watcher = w
+	r.updateWatches()
+
+	go r.handleListEvents(w)
+
+	return nil
+}
+
+// updateWatches makes r.watcher watch the directories of the current list
+// files and only them.  r.mu must be locked.
+func (r *reloader) updateWatches() {
+	if r.watcher == nil {
+		return
+	}
+
+	dirs := container.NewMapSet[string]()
+	for path := range r.loaded {
+		dirs.Add(filepath.Dir(path))
+
+		// Also watch the files inside the directories, such as the data
+		// directory of geosite lists.
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			dirs.Add(filepath.Clean(path))
+		}
+	}
+
+	for _, dir := range r.watcher.WatchList() {
+		if !dirs.Has(dir) {
+			err := r.watcher.Remove(dir)
+			if err != nil {
+				log.Debug("lists: unwatching %s: %s", dir, err)
+			}
+		}
+	}
+
+	dirs.Range(func(dir string) (cont bool) {
+		err := r.watcher.Add(dir)
+		if err != nil {
+			log.Error("lists: watching %s: %s", dir, err)
+		}
+
+		return true
+	})
+}
+
+// handleListEvents handles the events of w until it is closed.
+func (r *reloader) handleListEvents(w *fsnotify.Watcher) {
+	defer log.OnPanic("reloader.handleListEvents")
+
+	settle := time.NewTimer(r.settleDelay)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+
+			if r.isListEvent(ev) {
+				log.Debug("lists: %s", ev)
+				settle.Reset(r.settleDelay)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+
+			log.Error("lists: watching list files: %s", err)
+		case <-settle.C:
+			r.checkLists()
+		}
+	}
+}
+
+// isListEvent returns true if ev is an event of one of the list files or of a
+// file in a list directory.
+func (r *reloader) isListEvent(ev fsnotify.Event) (ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := filepath.Clean(ev.Name)
+	dir := filepath.Dir(name)
+	for path := range r.loaded {
+		path = filepath.Clean(path)
+		if name == path || dir == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkLists reloads the rules if the list files have changed.
+func (r *reloader) checkLists() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := make(map[string]fileState, len(r.loaded))
+	for path := range r.loaded {
+		current[path] = statFile(path)
+	}
+
+	if maps.Equal(current, r.loaded) {
+		return
+	}
+
+	log.Info("lists: list files changed, reloading rules")
+
+	err := r.reloadRules()
+	metrics.RulesReloadsInc(err == nil)
+	if err != nil {
+		log.Error("lists: reloading rules: %s; keeping the previous rules", err)
+
+		return
+	}
+
+	r.loaded = current
+
+	// A list directory may have been created or replaced.
+	r.updateWatches()
+}
+
+// reloadRules loads the rules and the lists and replaces the rules of the
+// servers.  The rules are only replaced if they are valid for both servers.
+// r.mu must be locked.
+func (r *reloader) reloadRules() (err error) {
+	rules, err := r.cfg.ExpandRules()
+	if err != nil {
+		return err
+	}
+
+	relayRules, err := rules.ToRelayRules()
+	if err != nil {
+		return err
+	}
+
+	dnsRules, err := rules.ToDNSRules()
+	if err != nil {
+		return err
+	}
+
+	err = r.relaySrv.SetRules(relayRules)
+	if err != nil {
+		return err
+	}
+
+	if r.dnsSrv != nil {
+		err = r.dnsSrv.SetRules(dnsRules)
+		if err != nil {
+			return err
+		}
+	}
+
+	metrics.RulesTotal.Set(float64(len(rules)))
+	log.Info("lists: loaded %d rules", len(rules))
+
+	return nil
+}
+
+// statFiles returns the states of the files.
+func statFiles(paths []string) (states map[string]fileState) {
+	states = make(map[string]fileState, len(paths))
+	for _, path := range paths {
+		states[path] = statFile(path)
+	}
+
+	return states
+}
+
+// statFile returns the state of the file.  The state of a directory is the
+// latest modification time and the total size of the files in it.  If the
+// file cannot be accessed, the state is empty.
+func statFile(path string) (st fileState) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Debug("lists: stat %s: %s", path, err)
+
+		return fileState{}
+	}
+
+	st = fileState{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+
+	if !fi.IsDir() {
+		return st
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		log.Debug("lists: reading dir %s: %s", path, err)
+
+		return fileState{}
+	}
+
+	for _, e := range entries {
+		fi, err = e.Info()
+		if err != nil {
+			// The file has been removed since the directory was read.
+			continue
+		}
+
+		if mt := fi.ModTime(); mt.After(st.modTime) {
+			st.modTime = mt
+		}
+
+		st.size += fi.Size()
+	}
+
+	return st
+}
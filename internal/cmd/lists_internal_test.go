@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/snirelay/internal/config"
+	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRedirectAddr is the address the test DNS server answers with for the
+// domains that match the rules.
+const testRedirectAddr = "127.0.0.2"
+
+// testConfig is the configuration file used in tests.  The upstream is not
+// reachable, so only the domains that match the rules are answered.
+const testConfig = `
+dns:
+  listen-addr: "127.0.0.1"
+  plain-port: 1
+  redirect-addr-v4: "` + testRedirectAddr + `"
+  upstream-addr: "127.0.0.1:1"
+relay:
+  listen-addr: "127.0.0.1"
+  http-port: 1
+  https-port: 1
+%s
+domain-rules:
+  - list: %q
+`
+
+// writeTestConfig writes the test configuration file with the list at
+// listPath and the additional relay settings to dir and returns its path.
+func writeTestConfig(t testing.TB, dir, listPath, relaySettings string) (path string) {
+	t.Helper()
+
+	path = filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(testConfig, relaySettings, listPath)), 0o600)
+	require.NoError(t, err)
+
+	return path
+}
+
+// newTestReloader creates the servers from the configuration file at
+// configPath the same way Main does and returns the reloader for them and the
+// address of the started DNS server.
+func newTestReloader(t testing.TB, configPath string) (r *reloader, dnsAddr net.Addr) {
+	t.Helper()
+
+	cfg, err := config.Load(configPath)
+	require.NoError(t, err)
+
+	r = newReloader(configPath, cfg)
+
+	rules, err := cfg.ExpandRules()
+	require.NoError(t, err)
+
+	relayCfg, err := cfg.ToRelayConfig(rules)
+	require.NoError(t, err)
+
+	dnsCfg, err := cfg.ToDNSConfig(rules)
+	require.NoError(t, err)
+
+	// Use any free port.
+	dnsCfg.UDPAddr = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+	dnsCfg.TCPAddr = nil
+
+	r.relaySrv, err = relay.NewServer(relayCfg)
+	require.NoError(t, err)
+
+	r.dnsSrv, err = dnssrv.New(dnsCfg)
+	require.NoError(t, err)
+
+	require.NoError(t, r.dnsSrv.Start(context.Background()))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return r.dnsSrv.Shutdown(context.Background())
+	})
+
+	return r, r.dnsSrv.Addr(proxy.ProtoUDP)
+}
+
+// redirected returns true if the DNS server at addr answers the A query for
+// host with testRedirectAddr.
+func redirected(t testing.TB, addr net.Addr, host string) (ok bool) {
+	t.Helper()
+
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(host), dns.TypeA)
+	resp, err := dns.Exchange(req, addr.String())
+	require.NoError(t, err)
+
+	for _, rr := range resp.Answer {
+		if a, isA := rr.(*dns.A); isA && a.A.String() == testRedirectAddr {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestReloader_watchLists(t *testing.T) {
+	const testTimeout = 5 * time.Second
+
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "list.txt")
+	require.NoError(t, os.WriteFile(listPath, []byte("www.example.org\n"), 0o600))
+
+	r, dnsAddr := newTestReloader(t, writeTestConfig(t, dir, listPath, ""))
+	r.settleDelay = 10 * time.Millisecond
+
+	require.NoError(t, r.watchLists())
+	testutil.CleanupAndRequireSuccess(t, r.watcher.Close)
+
+	require.True(t, redirected(t, dnsAddr, "www.example.org"))
+	require.False(t, redirected(t, dnsAddr, "www.example.net"))
+
+	t.Run("write", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(listPath, []byte("www.example.net\n"), 0o600))
+
+		assert.Eventually(t, func() (ok bool) {
+			return redirected(t, dnsAddr, "www.example.net")
+		}, testTimeout, r.settleDelay)
+		assert.False(t, redirected(t, dnsAddr, "www.example.org"))
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		tmpPath := filepath.Join(dir, "list.txt.tmp")
+		require.NoError(t, os.WriteFile(tmpPath, []byte("www.example.com\n"), 0o600))
+		require.NoError(t, os.Rename(tmpPath, listPath))
+
+		assert.Eventually(t, func() (ok bool) {
+			return redirected(t, dnsAddr, "www.example.com")
+		}, testTimeout, r.settleDelay)
+		assert.False(t, redirected(t, dnsAddr, "www.example.net"))
+	})
+}
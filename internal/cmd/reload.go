@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/config"
+	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloader applies the changes of the configuration file and of the list
+// files of the domain rules to the running servers.
+type reloader struct {
+	// mu protects cfg, loaded, and watcher, and serializes the reloads.
+	mu *sync.Mutex
+
+	// running is the configuration the servers were started with.  The
+	// changes that require a restart are detected relative to it.
+	running *config.File
+
+	// cfg is the current configuration.
+	cfg *config.File
+
+	// relaySrv is the relay server that gets the reloaded configuration.
+	relaySrv *relay.Server
+
+	// dnsSrv is the DNS server that gets the reloaded configuration.  It is
+	// nil if the DNS server is disabled.
+	dnsSrv *dnssrv.Server
+
+	// watcher watches the directories of the list files.  It is nil if the
+	// lists are not watched.
+	watcher *fsnotify.Watcher
+
+	// loaded are the states of the list files the current rules were loaded
+	// from.
+	loaded map[string]fileState
+
+	// configPath is the path to the configuration file.
+	configPath string
+
+	// settleDelay is the time the list files must not change before the
+	// rules are reloaded.
+	settleDelay time.Duration
+}
+
+// newReloader returns a new reloader for the configuration loaded from
+// configPath.  The states of the list files are taken at the moment of the
+// call, so it should be called right before the rules are loaded for the first
+// time.  The servers must be set before the reloader is used.
+func newReloader(configPath string, cfg *config.File) (r *reloader) {
+	loaded := statFiles(cfg.ListFiles())
+
+	return &reloader{
+		mu:          &sync.Mutex{},
+		running:     cfg,
+		cfg:         cfg,
+		loaded:      loaded,
+		configPath:  configPath,
+		settleDelay: listSettleDelay,
+	}
+}
+
+// reloadConfig loads the configuration file and applies the settings that can
+// be changed at runtime.  Changes of other settings are logged.  If the
+// configuration is invalid, nothing is applied.
+func (r *reloader) reloadConfig() (err error) {
+	defer func() {
+		metrics.ConfigReloadsInc(err == nil)
+	}()
+
+	restart, n, err := r.reload()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range restart {
+		log.Info("reload: %s has changed, restart to apply it", name)
+	}
+
+	log.Info("reload: configuration reloaded, %d rules", n)
+
+	return nil
+}
+
+// reload applies the configuration file the same way as reloadConfig and
+// returns the names of the changed settings that require a restart and the
+// number of the applied rules.
+func (r *reloader) reload() (restart []string, n int, err error) {
+	cfg, err := config.Load(r.configPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Take the states before the lists are read so that the changes made
+	// while reading them are picked up later.
+	states := statFiles(cfg.ListFiles())
+
+	rules, err := cfg.ExpandRules()
+	if err != nil {
+		return nil, 0, fmt.Errorf("load domain rules: %w", err)
+	}
+
+	relayCfg, err := cfg.ToRelayConfig(rules)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse relay config: %w", err)
+	}
+
+	dnsCfg, err := cfg.ToDNSConfig(rules)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse dns config: %w", err)
+	}
+
+	if (r.dnsSrv == nil) != (dnsCfg == nil) {
+		return nil, 0, errors.Error("dns section cannot be added or removed without a restart")
+	}
+
+	// Validate the configurations of both servers before applying any of them
+	// so that they are never reconfigured partially.
+	applyRelay, err := r.relaySrv.PrepareReconfigure(relayCfg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reconfigure relay server: %w", err)
+	}
+
+	applyDNS := func() {}
+	if r.dnsSrv != nil {
+		applyDNS, err = r.dnsSrv.PrepareReconfigure(dnsCfg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reconfigure dns server: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	applyRelay()
+	applyDNS()
+
+	r.cfg, r.loaded = cfg, states
+	r.updateWatches()
+	n = len(relayCfg.Rules)
+	metrics.RulesTotal.Set(float64(n))
+
+	return config.RestartChanges(r.running, cfg), n, nil
+}
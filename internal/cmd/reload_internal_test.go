@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader_reloadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	oldList := filepath.Join(dir, "old.txt")
+	require.NoError(t, os.WriteFile(oldList, []byte("www.example.org\n"), 0o600))
+
+	newList := filepath.Join(dir, "new.txt")
+	require.NoError(t, os.WriteFile(newList, []byte("www.example.net\n"), 0o600))
+
+	configPath := writeTestConfig(t, dir, oldList, "")
+	r, dnsAddr := newTestReloader(t, configPath)
+
+	require.True(t, redirected(t, dnsAddr, "www.example.org"))
+	require.False(t, redirected(t, dnsAddr, "www.example.net"))
+
+	t.Run("invalid", func(t *testing.T) {
+		writeTestConfig(t, dir, newList, "  limits:\n    max-conns: -1")
+
+		_, _, err := r.reload()
+		require.Error(t, err)
+
+		assert.True(t, redirected(t, dnsAddr, "www.example.org"))
+		assert.False(t, redirected(t, dnsAddr, "www.example.net"))
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		writeTestConfig(t, dir, newList, "  quic-port: 1\n  limits:\n    max-conns: 10")
+
+		restart, n, err := r.reload()
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []string{"relay.quic-port"}, restart)
+		assert.Equal(t, 10, r.cfg.Relay.Limits.MaxConns)
+
+		assert.True(t, redirected(t, dnsAddr, "www.example.net"))
+		assert.False(t, redirected(t, dnsAddr, "www.example.org"))
+	})
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/service"
+)
+
+const (
+	// startTimeout is the time the services are given to start.
+	startTimeout = 30 * time.Second
+
+	// shutdownTimeout is the time the services are given to shut down in
+	// addition to the shutdown grace period of the relay.
+	shutdownTimeout = 10 * time.Second
+)
+
+// startServices starts svcs in order.  If one of them fails to start, the
+// ones started before it are shut down in reverse order.
+func startServices(svcs []service.Interface) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	for i, svc := range svcs {
+		err = svc.Start(ctx)
+		if err != nil {
+			err = fmt.Errorf("starting service at index %d: %w", i, err)
+
+			return errors.WithDeferred(err, shutdownServices(svcs[:i], shutdownTimeout))
+		}
+	}
+
+	return nil
+}
+
+// shutdownServices shuts svcs down in reverse order.  All services share the
+// timeout, and the remaining services are still shut down if one of them
+// fails.
+func shutdownServices(svcs []service.Interface, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(svcs) - 1; i >= 0; i-- {
+		shutdownErr := svcs[i].Shutdown(ctx)
+		if shutdownErr != nil {
+			log.Error("cmd: shutting down service at index %d: %s", i, shutdownErr)
+			errs = append(errs, fmt.Errorf("shutting down service at index %d: %w", i, shutdownErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testService is a [service.Interface] implementation for tests that records
+// the calls to its methods in calls.
+type testService struct {
+	calls    *[]string
+	startErr error
+	name     string
+}
+
+// type check
+var _ service.Interface = (*testService)(nil)
+
+// Start implements the [service.Interface] interface for *testService.
+func (s *testService) Start(_ context.Context) (err error) {
+	*s.calls = append(*s.calls, "start "+s.name)
+
+	return s.startErr
+}
+
+// Shutdown implements the [service.Interface] interface for *testService.
+func (s *testService) Shutdown(ctx context.Context) (err error) {
+	*s.calls = append(*s.calls, "shutdown "+s.name)
+
+	_, ok := ctx.Deadline()
+	if !ok {
+		return errors.Error("no deadline")
+	}
+
+	return nil
+}
+
+func TestStartServices(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		failing    string
+		want       []string
+	}{{
+		name:       "success",
+		wantErrMsg: "",
+		failing:    "",
+		want:       []string{"start a", "start b", "start c"},
+	}, {
+		name:       "first",
+		wantErrMsg: "starting service at index 0: test error",
+		failing:    "a",
+		want:       []string{"start a"},
+	}, {
+		name:       "rollback",
+		wantErrMsg: "starting service at index 2: test error",
+		failing:    "c",
+		want:       []string{"start a", "start b", "start c", "shutdown b", "shutdown a"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls []string
+			var svcs []service.Interface
+			for _, name := range []string{"a", "b", "c"} {
+				svc := &testService{calls: &calls, name: name}
+				if name == tc.failing {
+					svc.startErr = testErr
+				}
+
+				svcs = append(svcs, svc)
+			}
+
+			err := startServices(svcs)
+			if tc.wantErrMsg == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, testErr)
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+			}
+
+			assert.Equal(t, tc.want, calls)
+		})
+	}
+}
+
+func TestShutdownServices(t *testing.T) {
+	var calls []string
+	svcs := []service.Interface{
+		&testService{calls: &calls, name: "a"},
+		&testService{calls: &calls, name: "b"},
+	}
+
+	require.NoError(t, shutdownServices(svcs, time.Second))
+	assert.Equal(t, []string{"shutdown b", "shutdown a"}, calls)
+}
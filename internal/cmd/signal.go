@@ -4,18 +4,30 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/AdguardTeam/golibs/service"
 )
 
-// signalHandler processes incoming signals and shuts services down.
+// signalHandler processes incoming signals, reloads the configuration, and
+// shuts services down.
 type signalHandler struct {
 	signal chan os.Signal
 
+	// reload reloads the configuration on SIGHUP.
+	reload func() (err error)
+
+	// upgrade starts a new process on [upgradeSignal].  If it succeeds, the
+	// services are shut down.
+	upgrade func() (err error)
+
 	// services are the services that are shut down before application
-	// exiting.
-	services []*relay.Server
+	// exiting, in reverse order.
+	services []service.Interface
+
+	// shutdownTimeout is the time the services are given to shut down.
+	shutdownTimeout time.Duration
 }
 
 // Exit status constants.
@@ -37,6 +49,18 @@ func (h *signalHandler) handle() (status int) {
 			syscall.SIGINT,
 			syscall.SIGTERM:
 			return h.shutdown()
+		case syscall.SIGHUP:
+			err := h.reload()
+			if err != nil {
+				log.Error("sighdlr: reloading configuration: %s", err)
+			}
+		case upgradeSignal:
+			err := h.upgrade()
+			if err == nil {
+				return h.shutdown()
+			}
+
+			log.Error("sighdlr: upgrading: %s; continuing", err)
 		}
 	}
 
@@ -48,14 +72,10 @@ func (h *signalHandler) handle() (status int) {
 // success and [statusError] on error.
 func (h *signalHandler) shutdown() (status int) {
 	log.Info("sighdlr: shutting down services")
-	status = statusSuccess
 
-	for i, service := range h.services {
-		err := service.Close()
-		if err != nil {
-			log.Error("sighdlr: shutting down service at index %d: %s", i, err)
-			status = statusError
-		}
+	status = statusSuccess
+	if shutdownServices(h.services, h.shutdownTimeout) != nil {
+		status = statusError
 	}
 
 	log.Info("sighdlr: shutting down")
@@ -63,14 +83,23 @@ func (h *signalHandler) shutdown() (status int) {
 	return status
 }
 
-// newSignalHandler returns a new signalHandler that shuts down svcs.
-func newSignalHandler(svcs ...*relay.Server) (h signalHandler) {
+// newSignalHandler returns a new signalHandler that calls reload on SIGHUP,
+// upgrade on [upgradeSignal], and shuts down svcs within shutdownTimeout.
+func newSignalHandler(
+	reload func() (err error),
+	upgrade func() (err error),
+	shutdownTimeout time.Duration,
+	svcs ...service.Interface,
+) (h signalHandler) {
 	h = signalHandler{
-		signal:   make(chan os.Signal, 1),
-		services: svcs,
+		signal:          make(chan os.Signal, 1),
+		reload:          reload,
+		upgrade:         upgrade,
+		services:        svcs,
+		shutdownTimeout: shutdownTimeout,
 	}
 
-	signal.Notify(h.signal, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(h.signal, signals...)
 
 	return h
 }
@@ -0,0 +1,20 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal is the signal that makes snirelay pass its listening sockets
+// to a new process and exit.
+const upgradeSignal = syscall.SIGUSR2
+
+// signals are the signals processed by [signalHandler].
+var signals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	upgradeSignal,
+}
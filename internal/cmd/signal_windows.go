@@ -0,0 +1,20 @@
+//go:build windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal is never received on Windows, since the listening sockets
+// cannot be passed to another process there.  It is only used to keep
+// [signalHandler.handle] the same on all platforms.
+const upgradeSignal = syscall.Signal(-1)
+
+// signals are the signals processed by [signalHandler].
+var signals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+}
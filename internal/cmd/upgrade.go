@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/service"
+	"github.com/ameshkov/snirelay/internal/sockets"
+)
+
+// envUpgradeFD is the environment variable with the file descriptor of the
+// ready pipe a new process gets from the previous one during an upgrade.
+const envUpgradeFD = "SNIRELAY_UPGRADE_FD"
+
+// upgradeTimeout is the time a new process is given to start during an
+// upgrade.
+const upgradeTimeout = time.Minute
+
+// upgrader hands the listening sockets over to a new snirelay process started
+// from the same executable, so that it can be upgraded without closing the
+// listeners.
+//
+// The new process notifies the previous one over the ready pipe when its
+// services have started on the passed sockets, and then the previous one shuts
+// down.  Therefore, upgrader must be the last one in the list of services.  The
+// relay server of the previous process stops reading the shared QUIC socket
+// when it shuts down, so that the new process receives all new QUIC flows.
+type upgrader struct {
+	// sockets are the listening sockets passed to the new process.
+	sockets *sockets.Set
+
+	// parentReady is the write end of the ready pipe inherited from the
+	// previous process.  It is nil if the process has not been started by an
+	// upgrade.
+	parentReady *os.File
+}
+
+// type check
+var _ service.Interface = (*upgrader)(nil)
+
+// newUpgrader returns a new upgrader for the sockets.  It takes the ready pipe
+// from the previous process, if the process has been started by an upgrade.
+func newUpgrader(s *sockets.Set) (u *upgrader, err error) {
+	u = &upgrader{
+		sockets: s,
+	}
+
+	v := os.Getenv(envUpgradeFD)
+	if v == "" {
+		return u, nil
+	}
+
+	err = os.Unsetenv(envUpgradeFD)
+	if err != nil {
+		return nil, err
+	}
+
+	readyFD, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envUpgradeFD, err)
+	}
+
+	u.parentReady = os.NewFile(uintptr(readyFD), "ready pipe")
+
+	return u, nil
+}
+
+// Start implements the [service.Interface] interface for *upgrader.  If the
+// process has been started by an upgrade, it notifies the previous process
+// that the services before it have started.
+func (u *upgrader) Start(_ context.Context) (err error) {
+	if u.parentReady == nil {
+		return nil
+	}
+
+	_, err = u.parentReady.Write([]byte{1})
+	err = errors.WithDeferred(err, u.parentReady.Close())
+	if err != nil {
+		return fmt.Errorf("notifying previous process: %w", err)
+	}
+
+	return nil
+}
+
+// Shutdown implements the [service.Interface] interface for *upgrader.
+func (u *upgrader) Shutdown(_ context.Context) (err error) {
+	return nil
+}
+
+// upgrade starts a new process from the executable of the current one, passes
+// the listening sockets to it, and waits until it has started.  If err is nil,
+// the current process must shut down.
+func (u *upgrader) upgrade() (err error) {
+	log.Info("upgrade: starting new process")
+
+	files, err := u.sockets.Files()
+	if err != nil {
+		return err
+	}
+
+	// Run the executable the current process has been started from even if
+	// it has been started by a relative path or by PATH lookup.
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("getting executable: %w", err), closeFiles(files))
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("creating ready pipe: %w", err), closeFiles(files))
+	}
+	defer func() { err = errors.WithDeferred(err, readyR.Close()) }()
+
+	// The descriptors of the inherited files are numbered from 3 in the order
+	// of ExtraFiles.
+	readyFD := sockets.FirstFD + len(files)
+	proc := exec.Command(exe, os.Args[1:]...)
+	proc.Stdout, proc.Stderr = os.Stdout, os.Stderr
+	proc.ExtraFiles = append(files, readyW)
+	proc.Env = append(
+		os.Environ(),
+		fmt.Sprintf("%s=%d", sockets.EnvListenFDs, len(files)),
+		fmt.Sprintf("%s=%d", envUpgradeFD, readyFD),
+	)
+
+	err = proc.Start()
+
+	nbErr := u.sockets.RestoreNonblock()
+	if nbErr != nil {
+		log.Error("upgrade: restoring non-blocking mode: %s", nbErr)
+	}
+
+	// Close the copies of the files passed to the new process so that the
+	// pipe is closed when it exits.
+	err = errors.WithDeferred(err, closeFiles(proc.ExtraFiles))
+	if err != nil {
+		return fmt.Errorf("starting new process: %w", err)
+	}
+
+	log.Info("upgrade: started new process with pid %d", proc.Process.Pid)
+
+	err = waitReady(readyR)
+	if err != nil {
+		err = fmt.Errorf("waiting for new process: %w", err)
+
+		return errors.WithDeferred(err, killProcess(proc))
+	}
+
+	go func() {
+		// Reap the new process if it exits before the current one.
+		_ = proc.Wait()
+	}()
+
+	log.Info("upgrade: new process has started")
+
+	return nil
+}
+
+// waitReady waits until the new process writes to the ready pipe r.  It
+// returns an error if the new process exits or does not start in time.
+func waitReady(r *os.File) (err error) {
+	err = r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = r.Read(make([]byte, 1))
+	if errors.Is(err, io.EOF) {
+		return errors.Error("new process exited")
+	}
+
+	return err
+}
+
+// closeFiles closes all files.
+func closeFiles(files []*os.File) (err error) {
+	var errs []error
+	for _, f := range files {
+		errs = append(errs, f.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// killProcess kills the process and waits until it exits.
+func killProcess(proc *exec.Cmd) (err error) {
+	err = proc.Process.Kill()
+	if err != nil {
+		return fmt.Errorf("killing new process: %w", err)
+	}
+
+	// The process has been killed, so the error is expected.
+	_ = proc.Wait()
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/snirelay/internal/sockets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Environment variables for the new process started by the upgrade test, which
+// is the test binary itself.
+const (
+	// envTestTCPAddr is the address of the TCP listener of the previous
+	// process.
+	envTestTCPAddr = "SNIRELAY_TEST_TCP_ADDR"
+
+	// envTestUDPAddr is the address of the UDP socket of the previous
+	// process.
+	envTestUDPAddr = "SNIRELAY_TEST_UDP_ADDR"
+
+	// envTestFail makes the new process exit without notifying the previous
+	// one.
+	envTestFail = "SNIRELAY_TEST_FAIL"
+)
+
+// testUpgradedMsg is the message the new process sends to the clients.
+const testUpgradedMsg = "upgraded"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envUpgradeFD) != "" {
+		os.Exit(runUpgraded())
+	}
+
+	os.Exit(m.Run())
+}
+
+// runUpgraded is the main function of the new process started by
+// TestUpgrader_upgrade.  It answers a single TCP connection and a single UDP
+// datagram on the inherited sockets.
+func runUpgraded() (code int) {
+	if os.Getenv(envTestFail) != "" {
+		return 1
+	}
+
+	err := serveUpgraded()
+	if err != nil {
+		log.Error("upgraded: %s", err)
+
+		return 1
+	}
+
+	return 0
+}
+
+// serveUpgraded takes the sockets from the previous process, notifies it, and
+// answers the clients.
+func serveUpgraded() (err error) {
+	const timeout = 10 * time.Second
+
+	socks, err := sockets.New()
+	if err != nil {
+		return err
+	}
+
+	u, err := newUpgrader(socks)
+	if err != nil {
+		return err
+	}
+
+	// The sockets are still open in the previous process, so creating new
+	// ones with the same addresses fails.
+	ctx := context.Background()
+	l, err := socks.Listen(ctx, "tcp", os.Getenv(envTestTCPAddr))
+	if err != nil {
+		return err
+	}
+
+	c, err := socks.ListenPacket(ctx, "udp", os.Getenv(envTestUDPAddr))
+	if err != nil {
+		return err
+	}
+
+	err = u.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	err = l.(*net.TCPListener).SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write([]byte(testUpgradedMsg))
+	err = errors.WithDeferred(err, conn.Close())
+	if err != nil {
+		return err
+	}
+
+	err = c.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	_, from, err := c.ReadFrom(make([]byte, 1))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.WriteTo([]byte(testUpgradedMsg), from)
+
+	return err
+}
+
+func TestUpgrader_upgrade(t *testing.T) {
+	const timeout = 10 * time.Second
+
+	ctx := context.Background()
+
+	newSockets := func(t *testing.T) (l net.Listener, c net.PacketConn, u *upgrader) {
+		t.Helper()
+
+		socks, err := sockets.New()
+		require.NoError(t, err)
+
+		l, err = socks.Listen(ctx, "tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		c, err = socks.ListenPacket(ctx, "udp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		t.Setenv(envTestTCPAddr, l.Addr().String())
+		t.Setenv(envTestUDPAddr, c.LocalAddr().String())
+
+		u, err = newUpgrader(socks)
+		require.NoError(t, err)
+
+		return l, c, u
+	}
+
+	t.Run("success", func(t *testing.T) {
+		l, c, u := newSockets(t)
+
+		require.NoError(t, u.upgrade())
+
+		// Close the sockets the same way the services of the current process
+		// do on shutdown, so that only the new process serves them.
+		require.NoError(t, l.Close())
+		require.NoError(t, c.Close())
+
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), timeout)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(timeout)))
+
+		msg, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, testUpgradedMsg, string(msg))
+
+		udpConn, err := net.Dial("udp", c.LocalAddr().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, udpConn.Close)
+
+		require.NoError(t, udpConn.SetDeadline(time.Now().Add(timeout)))
+
+		_, err = udpConn.Write([]byte{0})
+		require.NoError(t, err)
+
+		buf := make([]byte, len(testUpgradedMsg)+1)
+		n, err := udpConn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, testUpgradedMsg, string(buf[:n]))
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		l, c, u := newSockets(t)
+		testutil.CleanupAndRequireSuccess(t, l.Close)
+		testutil.CleanupAndRequireSuccess(t, c.Close)
+
+		t.Setenv(envTestFail, "1")
+
+		err := u.upgrade()
+		testutil.AssertErrorMsg(t, "waiting for new process: new process exited", err)
+
+		// The sockets of the current process must still be usable.
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), timeout)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		accepted, err := l.Accept()
+		require.NoError(t, err)
+		require.NoError(t, accepted.Close())
+	})
+}
@@ -5,11 +5,25 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/ameshkov/snirelay/internal/geosite"
 	"gopkg.in/yaml.v3"
 )
 
-// actionRelay is the action name for domain-rules.
-const actionRelay = "relay"
+// Action names for domain-rules.
+const (
+	// actionRelay re-routes the domain to the relay which then connects to
+	// the domain itself.
+	actionRelay = "relay"
+
+	// actionRewrite re-routes the domain to the relay which then connects to
+	// the target of the rule.
+	actionRewrite = "rewrite"
+
+	// actionBlock makes the DNS server block the domain and the relay reject
+	// connections to it.
+	actionBlock = "block"
+)
 
 // File represents a configuration file.
 type File struct {
@@ -24,19 +38,63 @@ type File struct {
 	// Prometheus
 	Prometheus *Prometheus `yaml:"prometheus"`
 
-	// DomainRules is the map that controls what the snirelay does with the
-	// domains. The key of this map is a wildcard and the value is the action.
+	// DomainRules is the ordered list of rules that controls what the snirelay
+	// does with the domains.  The first rule that matches the domain is used.
 	// Must be specified.
 	//
-	// If the domain is not specified in DomainRules, DNS queries for it will
-	// be simply proxied to the upstream DNS server and no re-routing occurs.
-	// Connections to the relay server for domains that are not listed will not
-	// be accepted.
+	// If the domain does not match any rule, DNS queries for it will be simply
+	// proxied to the upstream DNS server and no re-routing occurs.
+	// Connections to the relay server for such domains will not be accepted.
 	//
 	// If the action is "relay" then the DNS server will respond to A/AAAA
 	// queries and re-route traffic to the relay server. HTTPS queries will be
 	// suppressed in this case.
-	DomainRules map[string]string `yaml:"domain-rules"`
+	//
+	// If the action is "rewrite" then DNS queries are handled the same way,
+	// but the relay connects to the target host of the rule instead of the
+	// requested domain.
+	//
+	// If the action is "block" then the DNS server blocks the domain and the
+	// relay rejects connections to it.
+	//
+	// A pattern that starts with "!" is an exception: the domains that match
+	// it are handled as if they did not match any rule, unless an earlier rule
+	// matches them.
+	//
+	// For compatibility, DomainRules can also be a map of patterns to actions
+	// or DomainRule objects, see DomainRules.UnmarshalYAML.
+	DomainRules DomainRules `yaml:"domain-rules"`
+
+	// GeositePath is the path to a geosite.dat file or to the data directory
+	// of domain-list-community.  It is required if DomainRules reference
+	// geosite lists, e.g. "geosite:netflix".
+	GeositePath string `yaml:"geosite-path"`
+}
+
+// ListFiles returns the paths of the files the domain rules are loaded from
+// besides the configuration file.
+func (f *File) ListFiles() (paths []string) {
+	paths = f.DomainRules.listFiles()
+	if f.GeositePath != "" && f.DomainRules.hasGeosite() {
+		paths = append(paths, f.GeositePath)
+	}
+
+	return paths
+}
+
+// ExpandRules returns the domain rules with the rules that reference list
+// files and geosite lists replaced by the rules for every pattern from the
+// lists.
+func (f *File) ExpandRules() (rules DomainRules, err error) {
+	var sites *geosite.Sites
+	if f.DomainRules.hasGeosite() {
+		sites, err = geosite.Load(f.GeositePath)
+		if err != nil {
+			return nil, fmt.Errorf("loading geosite: %w", err)
+		}
+	}
+
+	return f.DomainRules.expand(sites)
 }
 
 // Prometheus represents the prometheus configuration.
@@ -77,10 +135,53 @@ func validate(cfg *File) (err error) {
 		return fmt.Errorf("no relay configured")
 	}
 
+	if cfg.Relay.QUICPort > 0 && cfg.Relay.ProxyURL != "" {
+		return fmt.Errorf("relay.quic-port cannot be used with relay.proxy-url")
+	}
+
+	if cfg.Relay.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("relay.shutdown-grace-period must not be negative")
+	}
+
+	if t := cfg.Relay.Timeouts; t != nil {
+		if err = t.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Relay.RateLimit < 0 || cfg.Relay.RateLimitBurst < 0 {
+		return fmt.Errorf("relay.rate-limit and relay.rate-limit-burst must not be negative")
+	}
+
+	if bw := cfg.Relay.Bandwidth; bw != nil && (bw.PerConn < 0 || bw.PerClient < 0) {
+		return fmt.Errorf("relay.bandwidth limits must not be negative")
+	}
+
+	if l := cfg.Relay.Limits; l != nil {
+		if err = l.validate(); err != nil {
+			return err
+		}
+	}
+
+	if q := cfg.Relay.Quotas; q != nil {
+		if err = q.validate(); err != nil {
+			return err
+		}
+	}
+
+	pp := cfg.Relay.ProxyProtocol
+	if pp != nil && (pp.HTTP || pp.HTTPS) && len(pp.TrustedCIDRs) == 0 {
+		return fmt.Errorf("relay.proxy-protocol.trusted-cidrs is required")
+	}
+
 	if cfg.DomainRules == nil {
 		return fmt.Errorf("no domain-rules configured")
 	}
 
+	if cfg.GeositePath == "" && cfg.DomainRules.hasGeosite() {
+		return fmt.Errorf("geosite-path is required for geosite domain-rules")
+	}
+
 	if cfg.DNS != nil {
 		if cfg.DNS.UpstreamAddr == "" {
 			return fmt.Errorf("dns upstream address is required")
@@ -101,6 +202,13 @@ func validate(cfg *File) (err error) {
 			return fmt.Errorf("at least one on dnssrv ports must be configured")
 		}
 
+		switch dnssrv.BlockMode(cfg.DNS.BlockMode) {
+		case "", dnssrv.BlockModeNXDOMAIN, dnssrv.BlockModeNullIP:
+			// Go on.
+		default:
+			return fmt.Errorf("invalid dns.block-mode %q", cfg.DNS.BlockMode)
+		}
+
 		if cfg.DNS.TLSPort > 0 ||
 			cfg.DNS.QUICPort > 0 ||
 			cfg.DNS.HTTPSPort > 0 {
@@ -0,0 +1,86 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ameshkov/snirelay/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_dist(t *testing.T) {
+	cfg, err := config.Load("../../config.yaml.dist")
+	require.NoError(t, err)
+
+	rules, err := cfg.ExpandRules()
+	require.NoError(t, err)
+
+	relayCfg, err := cfg.ToRelayConfig(rules)
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, relayCfg.Rules)
+}
+
+func TestRestartChanges(t *testing.T) {
+	newFile := func() (f *config.File) {
+		return &config.File{
+			Relay: &config.Relay{
+				ListenAddr: "0.0.0.0",
+				HTTPPort:   80,
+				HTTPSPort:  443,
+			},
+			DNS: &config.DNS{
+				ListenAddr: "0.0.0.0",
+				PlainPort:  53,
+			},
+			Prometheus: &config.Prometheus{
+				Addr: "127.0.0.1",
+				Port: 8123,
+			},
+		}
+	}
+
+	testCases := []struct {
+		modify func(f *config.File)
+		name   string
+		want   []string
+	}{{
+		modify: func(_ *config.File) {},
+		name:   "same",
+		want:   nil,
+	}, {
+		modify: func(f *config.File) {
+			f.DomainRules = config.DomainRules{{Pattern: "*", Action: "relay"}}
+			f.Relay.ProxyURL = "socks5://127.0.0.1:1080"
+			f.DNS.RedirectAddrV4 = "127.0.0.1"
+			f.Relay.Timeouts = &config.Timeouts{Idle: time.Minute}
+		},
+		name: "reloadable",
+		want: nil,
+	}, {
+		modify: func(f *config.File) {
+			f.Relay.HTTPSPort = 8443
+			f.DNS.PlainPort = 5353
+		},
+		name: "ports",
+		want: []string{"relay.https-port", "dns.plain-port"},
+	}, {
+		modify: func(f *config.File) {
+			f.DNS = nil
+			f.Prometheus.Port = 8124
+			f.Relay.Quotas = &config.Quotas{DB: "quotas.db"}
+		},
+		name: "sections",
+		want: []string{"relay.quotas", "dns", "prometheus"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			loaded := newFile()
+			tc.modify(loaded)
+
+			assert.Equal(t, tc.want, config.RestartChanges(newFile(), loaded))
+		})
+	}
+}
@@ -56,6 +56,11 @@ type DNS struct {
 	// RateLimitAllowlist is a list of IP addresses excluded from rate limiting.
 	RateLimitAllowlist []string `yaml:"rate-limit-allowlist"`
 
+	// BlockMode controls how the DNS server answers queries for domains with
+	// the "block" action: "nxdomain" or "null-ip".  If not specified,
+	// "nxdomain" is used.
+	BlockMode string `yaml:"block-mode"`
+
 	// TLSCertPath is the path to the TLS certificate. It is only required if
 	// one of the following properties are specified: TLSPort, HTTPSPort,
 	// QUICPort.
@@ -67,16 +72,18 @@ type DNS struct {
 	TLSKeyPath string `yaml:"tls-key-path"`
 }
 
-// ToDNSConfig transforms the configuration to the internal dnssrv.Config.
-// Note that this method can return nil if DNS section was not specified in the
+// ToDNSConfig transforms the configuration to the internal dnssrv.Config with
+// the domain rules, which must be expanded, see File.ExpandRules.  Note that
+// this method can return nil if DNS section was not specified in the
 // configuration.
-func (f *File) ToDNSConfig() (dnsCfg *dnssrv.Config, err error) {
+func (f *File) ToDNSConfig(rules DomainRules) (dnsCfg *dnssrv.Config, err error) {
 	if f.DNS == nil {
 		return nil, nil
 	}
 
 	dnsCfg = &dnssrv.Config{
 		RateLimit: f.DNS.RateLimit,
+		BlockMode: dnssrv.BlockMode(f.DNS.BlockMode),
 	}
 
 	dnsCfg.Upstream, err = upstream.AddressToUpstream(f.DNS.UpstreamAddr, &upstream.Options{
@@ -142,13 +149,9 @@ func (f *File) ToDNSConfig() (dnsCfg *dnssrv.Config, err error) {
 		}
 	}
 
-	for k, v := range f.DomainRules {
-		switch v {
-		case actionRelay:
-			dnsCfg.RedirectDomains = append(dnsCfg.RedirectDomains, k)
-		default:
-			return nil, fmt.Errorf("invalid relay rule: %s", v)
-		}
+	dnsCfg.Rules, err = rules.ToDNSRules()
+	if err != nil {
+		return nil, err
 	}
 
 	return dnsCfg, nil
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/netip"
 	"net/url"
+	"strings"
+	"time"
 
+	"github.com/ameshkov/snirelay/internal/quota"
 	"github.com/ameshkov/snirelay/internal/relay"
 )
 
@@ -22,20 +25,273 @@ type Relay struct {
 	// connections.
 	HTTPSPort uint16 `yaml:"https-port"`
 
+	// QUICPort is the UDP port where relay will expect to receive QUIC
+	// connections.  If zero, the QUIC listener is disabled.
+	QUICPort uint16 `yaml:"quic-port"`
+
+	// ProxyProtocol configures accepting PROXY protocol headers from load
+	// balancers in front of the relay.  Optional.
+	ProxyProtocol *ProxyProtocol `yaml:"proxy-protocol"`
+
 	// ProxyURL is the optional port for upstream connections by the relay.
 	// Format of the URL: [protocol://username:password@]host[:port]
 	ProxyURL string `yaml:"proxy-url"`
+
+	// FingerprintAllowlist is a list of JA3 or JA4 fingerprints.  If
+	// specified, the relay only accepts TLS connections with one of these
+	// fingerprints.
+	FingerprintAllowlist []string `yaml:"fingerprint-allowlist"`
+
+	// FingerprintDenylist is a list of JA3 or JA4 fingerprints.  The relay
+	// does not accept TLS connections with these fingerprints.
+	FingerprintDenylist []string `yaml:"fingerprint-denylist"`
+
+	// ClientAllowlist is a list of IP addresses and networks.  If specified,
+	// the relay only accepts connections from these clients.
+	ClientAllowlist []string `yaml:"client-allowlist"`
+
+	// ClientDenylist is a list of IP addresses and networks.  The relay does
+	// not accept connections from these clients.
+	ClientDenylist []string `yaml:"client-denylist"`
+
+	// Timeouts configures the timeouts of the relayed connections.
+	// Optional.
+	Timeouts *Timeouts `yaml:"timeouts"`
+
+	// Limits configures the limits of the concurrent connections.  Optional.
+	Limits *Limits `yaml:"limits"`
+
+	// Bandwidth configures the bandwidth limits of the relayed connections.
+	// Optional.
+	Bandwidth *Bandwidth `yaml:"bandwidth"`
+
+	// Quotas configures the daily and monthly traffic quotas of the clients.
+	// Optional.
+	Quotas *Quotas `yaml:"quotas"`
+
+	// RateLimit is the maximum number of new connections per second from a
+	// client subnet.  If zero, there is no rate limit.
+	RateLimit int `yaml:"rate-limit"`
+
+	// RateLimitBurst is the number of new connections from a client subnet
+	// allowed at once.  If zero, RateLimit is used.
+	RateLimitBurst int `yaml:"rate-limit-burst"`
+
+	// RateLimitAllowlist is a list of IP addresses and networks excluded from
+	// rate limiting.
+	RateLimitAllowlist []string `yaml:"rate-limit-allowlist"`
+
+	// ShutdownGracePeriod is the time the active connections are given to
+	// finish on shutdown before they are closed.  If zero, they are closed
+	// right away.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown-grace-period"`
+}
+
+// Limits represents the connection limits section of the relay
+// configuration.  Zero values mean no limit.
+type Limits struct {
+	// MaxConns is the maximum number of concurrent connections.
+	MaxConns int `yaml:"max-conns"`
+
+	// MaxConnsPerClient is the maximum number of concurrent connections from
+	// a client subnet.
+	MaxConnsPerClient int `yaml:"max-conns-per-client"`
+
+	// ClientSubnetV4 is the prefix length of the IPv4 client subnets.  If
+	// zero, 32 is used.
+	ClientSubnetV4 int `yaml:"client-subnet-v4"`
+
+	// ClientSubnetV6 is the prefix length of the IPv6 client subnets.  If
+	// zero, 64 is used.
+	ClientSubnetV6 int `yaml:"client-subnet-v6"`
+
+	// MaxConnsPerDestination is the maximum number of concurrent connections
+	// to a remote host.
+	MaxConnsPerDestination int `yaml:"max-conns-per-destination"`
+
+	// MaxQUICFlows is the maximum number of QUIC flows the relay keeps track
+	// of.  If zero, 10000 is used.
+	MaxQUICFlows int `yaml:"max-quic-flows"`
+}
+
+// Bandwidth represents the bandwidth limits section of the relay
+// configuration.  The limits are in bytes per second and apply to each
+// direction of the traffic separately.  Zero values mean no limit.
+type Bandwidth struct {
+	// PerConn is the limit of a connection.
+	PerConn int64 `yaml:"per-conn"`
+
+	// PerClient is the limit of all connections from a client IP.
+	PerClient int64 `yaml:"per-client"`
+}
+
+// Quotas represents the traffic quotas section of the relay configuration.
+// The quotas are in bytes of the traffic in both directions and zero values
+// mean no limit.
+type Quotas struct {
+	// DB is the path to the database file the usage is stored in.  Must be
+	// specified.
+	DB string `yaml:"db"`
+
+	// FlushInterval is the interval between writing the usage to the
+	// database.  If zero, the default of 10 seconds is used.
+	FlushInterval time.Duration `yaml:"flush-interval"`
+
+	// Daily is the quota of a client IP for a UTC day.
+	Daily int64 `yaml:"daily"`
+
+	// Monthly is the quota of a client IP for a UTC month.
+	Monthly int64 `yaml:"monthly"`
+
+	// CutExisting makes the relay close the active connections of a client
+	// when its quota is exhausted.
+	CutExisting bool `yaml:"cut-existing"`
+
+	// Users are the clients identified by their networks.  Their traffic is
+	// counted together and limited by their own quotas instead of Daily and
+	// Monthly.
+	Users []*QuotaUser `yaml:"users"`
+}
+
+// QuotaUser represents a user in the traffic quotas section of the relay
+// configuration.
+type QuotaUser struct {
+	// Name is the unique name of the user.
+	Name string `yaml:"name"`
+
+	// Networks is a list of IP addresses and networks of the user.
+	Networks []string `yaml:"networks"`
+
+	// Daily is the quota of the user for a UTC day.
+	Daily int64 `yaml:"daily"`
+
+	// Monthly is the quota of the user for a UTC month.
+	Monthly int64 `yaml:"monthly"`
+}
+
+// validate returns an error if the database is not specified, one of the
+// quotas is negative, or a user is invalid.
+func (q *Quotas) validate() (err error) {
+	switch {
+	case q.DB == "":
+		return fmt.Errorf("relay.quotas.db is required")
+	case q.FlushInterval < 0:
+		return fmt.Errorf("relay.quotas.flush-interval must not be negative")
+	case q.Daily < 0 || q.Monthly < 0:
+		return fmt.Errorf("relay.quotas limits must not be negative")
+	}
+
+	names := map[string]struct{}{}
+	for i, u := range q.Users {
+		switch {
+		case u.Name == "":
+			return fmt.Errorf("relay.quotas.users: user at index %d: name is required", i)
+		case len(u.Networks) == 0:
+			return fmt.Errorf("relay.quotas.users: user %q: networks are required", u.Name)
+		case u.Daily < 0 || u.Monthly < 0:
+			return fmt.Errorf("relay.quotas.users: user %q: limits must not be negative", u.Name)
+		}
+
+		if _, ok := names[u.Name]; ok {
+			return fmt.Errorf("relay.quotas.users: duplicate user %q", u.Name)
+		}
+
+		names[u.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// validate returns an error if one of the limits is negative or a prefix
+// length is out of range.
+func (l *Limits) validate() (err error) {
+	switch {
+	case l.MaxConns < 0:
+		return fmt.Errorf("relay.limits.max-conns must not be negative")
+	case l.MaxConnsPerClient < 0:
+		return fmt.Errorf("relay.limits.max-conns-per-client must not be negative")
+	case l.MaxConnsPerDestination < 0:
+		return fmt.Errorf("relay.limits.max-conns-per-destination must not be negative")
+	case l.MaxQUICFlows < 0:
+		return fmt.Errorf("relay.limits.max-quic-flows must not be negative")
+	case l.ClientSubnetV4 < 0 || l.ClientSubnetV4 > 32:
+		return fmt.Errorf("relay.limits.client-subnet-v4 must be between 0 and 32")
+	case l.ClientSubnetV6 < 0 || l.ClientSubnetV6 > 128:
+		return fmt.Errorf("relay.limits.client-subnet-v6 must be between 0 and 128")
+	default:
+		return nil
+	}
+}
+
+// Timeouts represents the timeouts section of the relay configuration.
+type Timeouts struct {
+	// Sniff is the time the client is given to send the TLS ClientHello or
+	// the HTTP request headers.  If zero, the default of 60 seconds is used.
+	Sniff time.Duration `yaml:"sniff"`
+
+	// Dial is the time the relay is given to connect to the remote server.
+	// If zero, the default of 30 seconds is used.
+	Dial time.Duration `yaml:"dial"`
+
+	// Idle is the time after which a connection without traffic in either
+	// direction is closed.  If zero, idle connections are not closed.
+	Idle time.Duration `yaml:"idle"`
+
+	// MaxLifetime is the time after which a connection is closed regardless
+	// of its traffic.  If zero, the lifetime is not limited.
+	MaxLifetime time.Duration `yaml:"max-lifetime"`
+}
+
+// validate returns an error if one of the timeouts is negative.
+func (t *Timeouts) validate() (err error) {
+	for _, v := range []struct {
+		name string
+		val  time.Duration
+	}{
+		{name: "sniff", val: t.Sniff},
+		{name: "dial", val: t.Dial},
+		{name: "idle", val: t.Idle},
+		{name: "max-lifetime", val: t.MaxLifetime},
+	} {
+		if v.val < 0 {
+			return fmt.Errorf("relay.timeouts.%s must not be negative", v.name)
+		}
+	}
+
+	return nil
+}
+
+// ProxyProtocol represents the PROXY protocol section of the relay
+// configuration.
+type ProxyProtocol struct {
+	// HTTP enables the PROXY protocol on the plain HTTP port.
+	HTTP bool `yaml:"http"`
+
+	// HTTPS enables the PROXY protocol on the HTTPS port.
+	HTTPS bool `yaml:"https"`
+
+	// TrustedCIDRs is a list of networks PROXY protocol headers are accepted
+	// from.  Must not be empty if the PROXY protocol is enabled.
+	TrustedCIDRs []string `yaml:"trusted-cidrs"`
 }
 
-// ToRelayConfig transforms the configuration to the internal relay.Config.
-func (f *File) ToRelayConfig() (relayCfg *relay.Config, err error) {
+// ToRelayConfig transforms the configuration to the internal relay.Config with
+// the domain rules, which must be expanded, see File.ExpandRules.  The same
+// rules must be passed to ToDNSConfig so that both servers use the same lists.
+func (f *File) ToRelayConfig(rules DomainRules) (relayCfg *relay.Config, err error) {
 	if f.Relay == nil {
 		return nil, fmt.Errorf("relay config is empty")
 	}
 
 	relayCfg = &relay.Config{
-		ListenPort:    f.Relay.HTTPPort,
-		ListenPortTLS: f.Relay.HTTPSPort,
+		ListenPort:           f.Relay.HTTPPort,
+		ListenPortTLS:        f.Relay.HTTPSPort,
+		ListenPortQUIC:       f.Relay.QUICPort,
+		FingerprintAllowlist: f.Relay.FingerprintAllowlist,
+		FingerprintDenylist:  f.Relay.FingerprintDenylist,
+		ShutdownGracePeriod:  f.Relay.ShutdownGracePeriod,
+		RateLimit:            f.Relay.RateLimit,
+		RateLimitBurst:       f.Relay.RateLimitBurst,
 	}
 
 	relayCfg.ListenAddr, err = netip.ParseAddr(f.Relay.ListenAddr)
@@ -50,14 +306,151 @@ func (f *File) ToRelayConfig() (relayCfg *relay.Config, err error) {
 		}
 	}
 
-	for k, v := range f.DomainRules {
-		switch v {
-		case actionRelay:
-			relayCfg.RedirectDomains = append(relayCfg.RedirectDomains, k)
-		default:
-			return nil, fmt.Errorf("invalid relay rule: %s", v)
+	if t := f.Relay.Timeouts; t != nil {
+		relayCfg.SniffTimeout = t.Sniff
+		relayCfg.DialTimeout = t.Dial
+		relayCfg.IdleTimeout = t.Idle
+		relayCfg.MaxLifetime = t.MaxLifetime
+	}
+
+	if bw := f.Relay.Bandwidth; bw != nil {
+		relayCfg.BandwidthPerConn = bw.PerConn
+		relayCfg.BandwidthPerClient = bw.PerClient
+	}
+
+	if l := f.Relay.Limits; l != nil {
+		relayCfg.MaxConns = l.MaxConns
+		relayCfg.MaxConnsPerClient = l.MaxConnsPerClient
+		relayCfg.ClientSubnetV4 = l.ClientSubnetV4
+		relayCfg.ClientSubnetV6 = l.ClientSubnetV6
+		relayCfg.MaxConnsPerDestination = l.MaxConnsPerDestination
+		relayCfg.MaxQUICFlows = l.MaxQUICFlows
+	}
+
+	if q := f.Relay.Quotas; q != nil {
+		relayCfg.QuotaDaily = q.Daily
+		relayCfg.QuotaMonthly = q.Monthly
+		relayCfg.QuotaCutExisting = q.CutExisting
+
+		relayCfg.QuotaUsers, err = toQuotaUsers(q.Users)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	relayCfg.ClientAllowlist, err = parsePrefixList(f.Relay.ClientAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in relay client allowlist: %w", err)
+	}
+
+	relayCfg.ClientDenylist, err = parsePrefixList(f.Relay.ClientDenylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in relay client denylist: %w", err)
+	}
+
+	for _, s := range f.Relay.RateLimitAllowlist {
+		var p netip.Prefix
+		p, err = parsePrefixOrAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in relay rate limit allowlist: %w", err)
+		}
+
+		relayCfg.RateLimitAllowlist = append(relayCfg.RateLimitAllowlist, p)
+	}
+
+	if pp := f.Relay.ProxyProtocol; pp != nil {
+		relayCfg.ProxyProtocolPlain = pp.HTTP
+		relayCfg.ProxyProtocolTLS = pp.HTTPS
+
+		for _, c := range pp.TrustedCIDRs {
+			var p netip.Prefix
+			p, err = netip.ParsePrefix(c)
+			if err != nil {
+				return nil, fmt.Errorf("parse relay proxy protocol trusted cidr: %w", err)
+			}
+
+			relayCfg.ProxyProtocolTrusted = append(relayCfg.ProxyProtocolTrusted, p.Masked())
 		}
 	}
 
+	relayCfg.Rules, err = rules.ToRelayRules()
+	if err != nil {
+		return nil, err
+	}
+
 	return relayCfg, nil
 }
+
+// ToQuotaConfig returns the configuration of the quota store.  It returns nil
+// if the traffic quotas are disabled.
+func (f *File) ToQuotaConfig() (c *quota.Config) {
+	q := f.Relay.Quotas
+	if q == nil {
+		return nil
+	}
+
+	return &quota.Config{
+		Path:          q.DB,
+		FlushInterval: q.FlushInterval,
+	}
+}
+
+// toQuotaUsers transforms the quota users to the relay ones.
+func toQuotaUsers(users []*QuotaUser) (res []*relay.QuotaUser, err error) {
+	for _, u := range users {
+		ru := &relay.QuotaUser{
+			Name:    u.Name,
+			Daily:   u.Daily,
+			Monthly: u.Monthly,
+		}
+
+		for _, s := range u.Networks {
+			var p netip.Prefix
+			p, err = parsePrefixOrAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network of relay quota user %q: %w", u.Name, err)
+			}
+
+			ru.Networks = append(ru.Networks, p)
+		}
+
+		res = append(res, ru)
+	}
+
+	return res, nil
+}
+
+// parsePrefixList parses the networks and IP addresses of list, see
+// parsePrefixOrAddr.
+func parsePrefixList(list []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range list {
+		var p netip.Prefix
+		p, err = parsePrefixOrAddr(s)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, p)
+	}
+
+	return prefixes, nil
+}
+
+// parsePrefixOrAddr parses s as a network in the CIDR notation or as a single
+// IP address.
+func parsePrefixOrAddr(s string) (p netip.Prefix, err error) {
+	if strings.Contains(s, "/") {
+		p, err = netip.ParsePrefix(s)
+
+		return p.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
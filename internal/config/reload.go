@@ -0,0 +1,91 @@
+package config
+
+import (
+	"slices"
+)
+
+// RestartChanges returns the names of the settings that differ between the
+// running configuration and the loaded one and cannot be applied without
+// restarting snirelay, e.g. the listen addresses.
+func RestartChanges(running, loaded *File) (names []string) {
+	rr, lr := running.Relay, loaded.Relay
+	names = appendChanged(names, "relay.listen-addr", rr.ListenAddr, lr.ListenAddr)
+	names = appendChanged(names, "relay.http-port", rr.HTTPPort, lr.HTTPPort)
+	names = appendChanged(names, "relay.https-port", rr.HTTPSPort, lr.HTTPSPort)
+	names = appendChanged(names, "relay.quic-port", rr.QUICPort, lr.QUICPort)
+	names = appendChanged(
+		names,
+		"relay.shutdown-grace-period",
+		rr.ShutdownGracePeriod,
+		lr.ShutdownGracePeriod,
+	)
+
+	names = append(names, quotasRestartChanges(rr.Quotas, lr.Quotas)...)
+	names = append(names, dnsRestartChanges(running.DNS, loaded.DNS)...)
+
+	rp, lp := running.Prometheus, loaded.Prometheus
+	if (rp == nil) != (lp == nil) || rp != nil && *rp != *lp {
+		names = append(names, "prometheus")
+	}
+
+	return names
+}
+
+// quotasRestartChanges returns the names of the traffic quota settings that
+// require a restart and differ between running and loaded.
+func quotasRestartChanges(running, loaded *Quotas) (names []string) {
+	if running == nil || loaded == nil {
+		if running != loaded {
+			names = append(names, "relay.quotas")
+		}
+
+		return names
+	}
+
+	names = appendChanged(names, "relay.quotas.db", running.DB, loaded.DB)
+	names = appendChanged(
+		names,
+		"relay.quotas.flush-interval",
+		running.FlushInterval,
+		loaded.FlushInterval,
+	)
+
+	return names
+}
+
+// dnsRestartChanges returns the names of the DNS server settings that require
+// a restart and differ between running and loaded.
+func dnsRestartChanges(running, loaded *DNS) (names []string) {
+	if running == nil || loaded == nil {
+		if running != loaded {
+			names = append(names, "dns")
+		}
+
+		return names
+	}
+
+	names = appendChanged(names, "dns.listen-addr", running.ListenAddr, loaded.ListenAddr)
+	names = appendChanged(names, "dns.plain-port", running.PlainPort, loaded.PlainPort)
+	names = appendChanged(names, "dns.tls-port", running.TLSPort, loaded.TLSPort)
+	names = appendChanged(names, "dns.https-port", running.HTTPSPort, loaded.HTTPSPort)
+	names = appendChanged(names, "dns.quic-port", running.QUICPort, loaded.QUICPort)
+	names = appendChanged(names, "dns.rate-limit", running.RateLimit, loaded.RateLimit)
+	names = appendChanged(names, "dns.tls-cert-path", running.TLSCertPath, loaded.TLSCertPath)
+	names = appendChanged(names, "dns.tls-key-path", running.TLSKeyPath, loaded.TLSKeyPath)
+
+	if !slices.Equal(running.RateLimitAllowlist, loaded.RateLimitAllowlist) {
+		names = append(names, "dns.rate-limit-allowlist")
+	}
+
+	return names
+}
+
+// appendChanged appends name to names if the running and the loaded values of
+// the setting differ.
+func appendChanged[T comparable](names []string, name string, running, loaded T) (res []string) {
+	if running != loaded {
+		return append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,599 @@
+package config
+
+import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/ameshkov/snirelay/internal/geosite"
+	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/ameshkov/snirelay/internal/rules"
+	"gopkg.in/yaml.v3"
+)
+
+// DomainRules is the ordered list of domain rules.
+type DomainRules []*DomainRule
+
+// type check
+var _ yaml.Unmarshaler = (*DomainRules)(nil)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for *DomainRules.
+// The value is either a sequence or, for compatibility, a map of patterns to
+// actions or DomainRule objects.
+//
+// Items of the sequence are either patterns, in which case the action is
+// "relay", or DomainRule objects with the pattern property.
+//
+// Since the map is unordered, its rules are sorted: block rules go first, then
+// rules with longer patterns, and then the rest in alphabetical order.
+func (rs *DomainRules) UnmarshalYAML(value *yaml.Node) (err error) {
+	switch value.Kind {
+	case yaml.SequenceNode:
+		return rs.unmarshalSequence(value)
+	case yaml.MappingNode:
+		return rs.unmarshalMap(value)
+	default:
+		return fmt.Errorf("line %d: domain-rules must be a list or a map", value.Line)
+	}
+}
+
+// unmarshalSequence decodes the sequence form of domain-rules.
+func (rs *DomainRules) unmarshalSequence(value *yaml.Node) (err error) {
+	list := make(DomainRules, 0, len(value.Content))
+	for i, n := range value.Content {
+		r := &DomainRule{}
+		if n.Kind == yaml.ScalarNode {
+			err = n.Decode(&r.Pattern)
+		} else {
+			err = r.UnmarshalYAML(n)
+		}
+
+		if err == nil {
+			err = r.validatePattern()
+		}
+
+		if err != nil {
+			return fmt.Errorf("domain-rules item at index %d: %w", i, err)
+		}
+
+		list = append(list, r)
+	}
+
+	*rs = list
+
+	return nil
+}
+
+// unmarshalMap decodes the legacy map form of domain-rules.
+func (rs *DomainRules) unmarshalMap(value *yaml.Node) (err error) {
+	m := map[string]*DomainRule{}
+	err = value.Decode(m)
+	if err != nil {
+		return err
+	}
+
+	list := make(DomainRules, 0, len(m))
+	for k, v := range m {
+		if v == nil {
+			return fmt.Errorf("empty domain-rules value for %s", k)
+		}
+
+		if v.List != "" || v.ListFormat != "" {
+			return fmt.Errorf("domain-rules value for %s: list requires the list form", k)
+		}
+
+		v.Pattern = k
+		list = append(list, v)
+	}
+
+	slices.SortFunc(list, func(a, b *DomainRule) (res int) {
+		aBlock, bBlock := a.action() == actionBlock, b.action() == actionBlock
+		if aBlock != bBlock {
+			if aBlock {
+				return -1
+			}
+
+			return 1
+		}
+
+		if c := cmp.Compare(len(b.Pattern), len(a.Pattern)); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.Pattern, b.Pattern)
+	})
+
+	*rs = list
+
+	return nil
+}
+
+// listFiles returns the paths of the list files referenced by the rules.
+func (rs DomainRules) listFiles() (paths []string) {
+	for _, r := range rs {
+		if r.List != "" && !slices.Contains(paths, r.List) {
+			paths = append(paths, r.List)
+		}
+	}
+
+	return paths
+}
+
+// hasGeosite returns true if any of the rules references a geosite list.
+func (rs DomainRules) hasGeosite() (ok bool) {
+	return slices.ContainsFunc(rs, (*DomainRule).geosite)
+}
+
+// expand returns the rules with every rule that references a list file or a
+// geosite list replaced by the rules with the same properties for every
+// pattern from the list.  sites must not be nil if the rules reference
+// geosite lists.
+func (rs DomainRules) expand(sites *geosite.Sites) (expanded DomainRules, err error) {
+	expanded = make(DomainRules, 0, len(rs))
+	for _, r := range rs {
+		var patterns []string
+		switch {
+		case r.List != "":
+			patterns, err = readList(r.List, rules.ListFormat(r.ListFormat))
+			if err != nil {
+				return nil, fmt.Errorf("reading list %s: %w", r.List, err)
+			}
+		case r.geosite():
+			patterns, err = r.geositePatterns(sites)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			expanded = append(expanded, r)
+
+			continue
+		}
+
+		for _, p := range patterns {
+			expanded = append(expanded, r.withPattern(p))
+		}
+	}
+
+	return expanded, nil
+}
+
+// readList reads the patterns from the list file in the specified format.
+func readList(path string, format rules.ListFormat) (patterns []string, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return rules.ParseList(f, format)
+}
+
+// ToRelayRules converts the rules to relay rules.  The rules must be expanded,
+// see File.ExpandRules.
+func (rs DomainRules) ToRelayRules() (relayRules []*relay.Rule, err error) {
+	relayRules = make([]*relay.Rule, 0, len(rs))
+	for _, r := range rs {
+		var rule *relay.Rule
+		rule, err = r.toRelayRule()
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay rule for %s: %w", r.Pattern, err)
+		}
+
+		relayRules = append(relayRules, rule)
+	}
+
+	return relayRules, nil
+}
+
+// ToDNSRules converts the rules to DNS server rules.  The rules must be
+// expanded, see File.ExpandRules.
+func (rs DomainRules) ToDNSRules() (dnsRules []*dnssrv.Rule, err error) {
+	dnsRules = make([]*dnssrv.Rule, 0, len(rs))
+	for _, r := range rs {
+		var rule *dnssrv.Rule
+		rule, err = r.toDNSRule()
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns rule for %s: %w", r.Pattern, err)
+		}
+
+		dnsRules = append(dnsRules, rule)
+	}
+
+	return dnsRules, nil
+}
+
+// DomainRule is a domain rule.  In the legacy map form of domain-rules its
+// value is either an action name or an object with the action and additional
+// conditions.
+type DomainRule struct {
+	// Pattern is the pattern for domains the rule applies to.  If it starts
+	// with "!", the rule is an exception and must not have other properties.
+	// A pattern like "geosite:netflix" references a geosite list, see
+	// File.GeositePath.  Either Pattern or List must be specified.
+	Pattern string `yaml:"pattern"`
+
+	// List is the path to a file with patterns.  The rule applies to all of
+	// them, and the file is reloaded when it changes.
+	List string `yaml:"list"`
+
+	// ListFormat is the format of List: "plain", "hosts", "dnsmasq" or
+	// "adblock".  If not specified, "plain" is used.
+	ListFormat string `yaml:"list-format"`
+
+	// Action is what snirelay does with the matching domains.  If not
+	// specified, "relay" is used.
+	Action string `yaml:"action"`
+
+	// ALPN is a list of ALPN protocols.  If specified, only TLS connections
+	// that offer at least one of them are relayed.
+	ALPN []string `yaml:"alpn"`
+
+	// TLSVersions is a list of TLS versions, e.g. "1.2" or "1.3".  If
+	// specified, only TLS connections that support at least one of them are
+	// relayed.
+	TLSVersions []string `yaml:"tls-versions"`
+
+	// CipherSuites is a list of TLS cipher suites either by their IANA name,
+	// e.g. "TLS_AES_128_GCM_SHA256", or by their hex code, e.g. "0x1301".  If
+	// specified, only TLS connections that offer at least one of them are
+	// relayed.
+	CipherSuites []string `yaml:"cipher-suites"`
+
+	// ProxyProtocol is the version of the PROXY protocol header, "v1" or
+	// "v2", that the relay sends to the remote server.  If not specified, no
+	// header is sent.
+	ProxyProtocol string `yaml:"proxy-protocol"`
+
+	// Target is the host or host:port the relay connects to instead of the
+	// requested domain.  It is required for the "rewrite" action and not
+	// allowed for others.  The port, if specified, is used for both plain
+	// HTTP and TLS connections unless HTTPPort or HTTPSPort are set.
+	Target string `yaml:"target"`
+
+	// HTTPPort is the port the relay connects to for plain HTTP connections.
+	// If not specified, 80 is used.
+	HTTPPort uint16 `yaml:"http-port"`
+
+	// HTTPSPort is the port the relay connects to for TLS and QUIC
+	// connections.  If not specified, 443 is used.
+	HTTPSPort uint16 `yaml:"https-port"`
+
+	// Bandwidth is the maximum rate, in bytes per second, of the traffic in
+	// each direction of all relayed TCP connections that match the rule.  If
+	// not specified, the rate is not limited.
+	Bandwidth int64 `yaml:"bandwidth"`
+
+	// ClientAllowlist is a list of IP addresses and networks.  If specified,
+	// the relay rejects the connections from other clients that match the
+	// rule.
+	ClientAllowlist []string `yaml:"client-allowlist"`
+
+	// ClientDenylist is a list of IP addresses and networks.  The relay
+	// rejects the connections from these clients that match the rule.
+	ClientDenylist []string `yaml:"client-denylist"`
+
+	// source is the list file or the geosite pattern the rule has been
+	// expanded from.  It is empty for the rules from the configuration file.
+	source string
+}
+
+// type check
+var _ yaml.Unmarshaler = (*DomainRule)(nil)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for *DomainRule.
+func (r *DomainRule) UnmarshalYAML(value *yaml.Node) (err error) {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&r.Action)
+	}
+
+	// Use a type alias to avoid the infinite recursion.
+	type domainRule DomainRule
+
+	return value.Decode((*domainRule)(r))
+}
+
+// validatePattern returns an error if the rule has neither a pattern nor a
+// valid list.
+func (r *DomainRule) validatePattern() (err error) {
+	switch {
+	case r.List != "" && r.Pattern != "":
+		return fmt.Errorf("pattern and list cannot be used together")
+	case r.List != "":
+		// Go on.
+	case r.Pattern == "":
+		return fmt.Errorf("empty pattern")
+	case r.ListFormat != "":
+		return fmt.Errorf("list-format requires list")
+	default:
+		return nil
+	}
+
+	switch f := rules.ListFormat(r.ListFormat); f {
+	case
+		"",
+		rules.ListFormatPlain,
+		rules.ListFormatHosts,
+		rules.ListFormatDnsmasq,
+		rules.ListFormatAdblock:
+		return nil
+	default:
+		return fmt.Errorf("invalid list-format %q", f)
+	}
+}
+
+// geosite returns true if the pattern of the rule references a geosite list.
+func (r *DomainRule) geosite() (ok bool) {
+	p := strings.TrimPrefix(r.Pattern, rules.ExceptionPrefix)
+
+	return strings.HasPrefix(p, geosite.RefPrefix)
+}
+
+// geositePatterns returns the patterns of the geosite list referenced by the
+// rule.  The patterns are exceptions if the rule is an exception.
+func (r *DomainRule) geositePatterns(sites *geosite.Sites) (patterns []string, err error) {
+	p, exception := strings.CutPrefix(r.Pattern, rules.ExceptionPrefix)
+	patterns, err = sites.Patterns(strings.TrimPrefix(p, geosite.RefPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if exception {
+		for i, p := range patterns {
+			patterns[i] = rules.ExceptionPrefix + p
+		}
+	}
+
+	return patterns, nil
+}
+
+// withPattern returns a copy of the list rule r for the pattern from the list.
+func (r *DomainRule) withPattern(p string) (rule *DomainRule) {
+	if strings.HasPrefix(p, rules.ExceptionPrefix) {
+		return &DomainRule{Pattern: p}
+	}
+
+	c := *r
+	c.Pattern, c.List, c.ListFormat = p, "", ""
+	c.source = cmp.Or(r.List, r.Pattern)
+
+	return &c
+}
+
+// exception returns true if the rule is an exception.
+func (r *DomainRule) exception() (ok bool) {
+	return strings.HasPrefix(r.Pattern, rules.ExceptionPrefix)
+}
+
+// validateException returns an error if the exception rule has properties
+// other than the pattern.
+func (r *DomainRule) validateException() (err error) {
+	if r.Action != "" ||
+		len(r.ALPN) > 0 ||
+		len(r.TLSVersions) > 0 ||
+		len(r.CipherSuites) > 0 ||
+		r.ProxyProtocol != "" ||
+		r.Target != "" ||
+		r.HTTPPort != 0 ||
+		r.HTTPSPort != 0 ||
+		r.Bandwidth != 0 ||
+		len(r.ClientAllowlist) > 0 ||
+		len(r.ClientDenylist) > 0 {
+		return fmt.Errorf("exception %q cannot have other properties", r.Pattern)
+	}
+
+	return nil
+}
+
+// action returns the action of the rule with the default applied.
+func (r *DomainRule) action() (a string) {
+	if r.Action == "" {
+		return actionRelay
+	}
+
+	return r.Action
+}
+
+// toRelayRule converts r to a relay rule.
+func (r *DomainRule) toRelayRule() (rule *relay.Rule, err error) {
+	if r.exception() {
+		return &relay.Rule{Pattern: r.Pattern}, r.validateException()
+	}
+
+	switch a := r.action(); a {
+	case actionRelay, actionRewrite:
+		// Go on.
+	case actionBlock:
+		return r.toBlockRule()
+	default:
+		return nil, fmt.Errorf("invalid action %q", a)
+	}
+
+	if r.Bandwidth < 0 {
+		return nil, fmt.Errorf("bandwidth must not be negative")
+	}
+
+	rule = &relay.Rule{
+		Pattern:   r.Pattern,
+		ALPN:      r.ALPN,
+		Bandwidth: r.Bandwidth,
+		Source:    r.source,
+	}
+
+	err = r.setTarget(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.ProxyProtocol {
+	case "":
+		rule.ProxyProtocol = relay.ProxyProtocolNone
+	case "v1":
+		rule.ProxyProtocol = relay.ProxyProtocolV1
+	case "v2":
+		rule.ProxyProtocol = relay.ProxyProtocolV2
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol version %q", r.ProxyProtocol)
+	}
+
+	rule.ClientAllowlist, err = parsePrefixList(r.ClientAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in client-allowlist: %w", err)
+	}
+
+	rule.ClientDenylist, err = parsePrefixList(r.ClientDenylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in client-denylist: %w", err)
+	}
+
+	for _, v := range r.TLSVersions {
+		ver, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls version %q", v)
+		}
+
+		rule.TLSVersions = append(rule.TLSVersions, ver)
+	}
+
+	for _, v := range r.CipherSuites {
+		var id uint16
+		id, err = parseCipherSuite(v)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.CipherSuites = append(rule.CipherSuites, id)
+	}
+
+	return rule, nil
+}
+
+// toBlockRule converts r with the block action to a relay rule.  Block rules
+// cannot have any other options, since the DNS server blocks the domains
+// regardless of them.
+func (r *DomainRule) toBlockRule() (rule *relay.Rule, err error) {
+	if len(r.ALPN) > 0 ||
+		len(r.TLSVersions) > 0 ||
+		len(r.CipherSuites) > 0 ||
+		r.ProxyProtocol != "" ||
+		r.Target != "" ||
+		r.HTTPPort != 0 ||
+		r.HTTPSPort != 0 ||
+		r.Bandwidth != 0 ||
+		len(r.ClientAllowlist) > 0 ||
+		len(r.ClientDenylist) > 0 {
+		return nil, fmt.Errorf("action %q does not support other options", actionBlock)
+	}
+
+	return &relay.Rule{
+		Pattern: r.Pattern,
+		Block:   true,
+	}, nil
+}
+
+// toDNSRule converts r to a DNS server rule.
+func (r *DomainRule) toDNSRule() (rule *dnssrv.Rule, err error) {
+	if r.exception() {
+		return &dnssrv.Rule{Pattern: r.Pattern}, r.validateException()
+	}
+
+	switch a := r.action(); a {
+	case actionRelay, actionRewrite:
+		return &dnssrv.Rule{Pattern: r.Pattern, Action: dnssrv.ActionRedirect}, nil
+	case actionBlock:
+		return &dnssrv.Rule{Pattern: r.Pattern, Action: dnssrv.ActionBlock}, nil
+	default:
+		return nil, fmt.Errorf("invalid action %q", a)
+	}
+}
+
+// setTarget sets the target host and ports of the relay rule.
+func (r *DomainRule) setTarget(rule *relay.Rule) (err error) {
+	a := r.action()
+	if r.Target == "" {
+		if a == actionRewrite {
+			return fmt.Errorf("target is required for action %q", a)
+		}
+	} else if a != actionRewrite {
+		return fmt.Errorf("target is not allowed for action %q", a)
+	} else {
+		var port uint16
+		rule.Target, port, err = splitTarget(r.Target)
+		if err != nil {
+			return fmt.Errorf("invalid target %q: %w", r.Target, err)
+		}
+
+		rule.PortPlain, rule.PortTLS = port, port
+	}
+
+	if r.HTTPPort != 0 {
+		rule.PortPlain = r.HTTPPort
+	}
+
+	if r.HTTPSPort != 0 {
+		rule.PortTLS = r.HTTPSPort
+	}
+
+	return nil
+}
+
+// splitTarget splits the target into the host and the optional port.
+func splitTarget(target string) (host string, port uint16, err error) {
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		// No port.
+		host = target
+	} else {
+		host, port, err = netutil.SplitHostPort(target)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	if ip, ipErr := netip.ParseAddr(strings.Trim(host, "[]")); ipErr == nil {
+		return ip.String(), port, nil
+	}
+
+	return host, port, netutil.ValidateHostname(host)
+}
+
+// tlsVersions maps the TLS version names that can be used in the
+// configuration file to their values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuite parses the cipher suite either by its name or by its hex
+// code.
+func parseCipherSuite(s string) (id uint16, err error) {
+	if hex, ok := strings.CutPrefix(s, "0x"); ok {
+		var v uint64
+		v, err = strconv.ParseUint(hex, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cipher suite %q: %w", s, err)
+		}
+
+		return uint16(v), nil
+	}
+
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, c := range list {
+			if c.Name == s {
+				return c.ID, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite %q", s)
+}
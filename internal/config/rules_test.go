@@ -0,0 +1,268 @@
+package config_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ameshkov/snirelay/internal/config"
+	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDomainRules_UnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name         string
+		yaml         string
+		wantErr      string
+		wantPatterns []string
+		wantActions  []string
+	}{{
+		name: "list",
+		yaml: `
+- "!*.bank.example.org"
+- pattern: "ads.example.org"
+  action: "block"
+- "*"
+`,
+		wantPatterns: []string{"!*.bank.example.org", "ads.example.org", "*"},
+		wantActions:  []string{"", "block", ""},
+	}, {
+		name: "map",
+		yaml: `
+"*": "relay"
+"*.example.org": "relay"
+"ads.example.org": "block"
+"b.example.org": "relay"
+"a.example.org":
+  alpn: [ "h2" ]
+`,
+		wantPatterns: []string{
+			"ads.example.org",
+			"*.example.org",
+			"a.example.org",
+			"b.example.org",
+			"*",
+		},
+		wantActions: []string{"block", "relay", "", "relay", "relay"},
+	}, {
+		name:    "map_empty_value",
+		yaml:    `"*":`,
+		wantErr: "empty domain-rules value for *",
+	}, {
+		name:    "list_empty_pattern",
+		yaml:    `- action: "relay"`,
+		wantErr: "domain-rules item at index 0: empty pattern",
+	}, {
+		name:    "scalar",
+		yaml:    `"*"`,
+		wantErr: "line 1: domain-rules must be a list or a map",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rules config.DomainRules
+			err := yaml.Unmarshal([]byte(tc.yaml), &rules)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			var patterns, actions []string
+			for _, r := range rules {
+				patterns = append(patterns, r.Pattern)
+				actions = append(actions, r.Action)
+			}
+
+			assert.Equal(t, tc.wantPatterns, patterns)
+			assert.Equal(t, tc.wantActions, actions)
+		})
+	}
+}
+
+func TestFile_ToRelayConfig_exception(t *testing.T) {
+	f := &config.File{
+		Relay: &config.Relay{ListenAddr: "127.0.0.1"},
+		DomainRules: config.DomainRules{{
+			Pattern: "!*.bank.example.org",
+			Action:  "relay",
+		}},
+	}
+
+	_, err := f.ToRelayConfig(f.DomainRules)
+	require.Error(t, err)
+
+	f.DomainRules[0].Action = ""
+	relayCfg, err := f.ToRelayConfig(f.DomainRules)
+	require.NoError(t, err)
+	require.Len(t, relayCfg.Rules, 1)
+
+	assert.Equal(t, "!*.bank.example.org", relayCfg.Rules[0].Pattern)
+}
+
+func TestFile_ToRelayConfig_clientLists(t *testing.T) {
+	f := &config.File{
+		Relay: &config.Relay{
+			ListenAddr:     "127.0.0.1",
+			ClientDenylist: []string{"192.0.2.1"},
+		},
+		DomainRules: config.DomainRules{{
+			Pattern:         "*.example.org",
+			ClientAllowlist: []string{"198.51.100.1/24"},
+		}},
+	}
+
+	relayCfg, err := f.ToRelayConfig(f.DomainRules)
+	require.NoError(t, err)
+	require.Len(t, relayCfg.Rules, 1)
+
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}, relayCfg.ClientDenylist)
+	assert.Equal(
+		t,
+		[]netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+		relayCfg.Rules[0].ClientAllowlist,
+	)
+
+	f.DomainRules[0].Action = "block"
+	_, err = f.ToRelayConfig(f.DomainRules)
+	require.Error(t, err)
+
+	f.DomainRules[0].Action = ""
+	f.DomainRules[0].ClientAllowlist = []string{"invalid"}
+	_, err = f.ToRelayConfig(f.DomainRules)
+	require.Error(t, err)
+}
+
+func TestFile_ExpandRules(t *testing.T) {
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "hosts")
+	adblockPath := filepath.Join(dir, "adblock.txt")
+
+	err := os.WriteFile(hostsPath, []byte("0.0.0.0 ads.example.org\n"), 0o600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(adblockPath, []byte("||example.net^\n@@||www.example.net^\n"), 0o600)
+	require.NoError(t, err)
+
+	var rules config.DomainRules
+	err = yaml.Unmarshal([]byte(`
+- list: "`+hostsPath+`"
+  list-format: "hosts"
+  action: "block"
+- list: "`+adblockPath+`"
+  list-format: "adblock"
+  https-port: 8443
+  bandwidth: 1000
+- list: "`+hostsPath+`"
+  list-format: "hosts"
+- "*"
+`), &rules)
+	require.NoError(t, err)
+
+	f := &config.File{DomainRules: rules}
+	assert.Equal(t, []string{hostsPath, adblockPath}, f.ListFiles())
+
+	expanded, err := f.ExpandRules()
+	require.NoError(t, err)
+
+	relayRules, err := expanded.ToRelayRules()
+	require.NoError(t, err)
+
+	assert.Equal(t, []*relay.Rule{
+		{Pattern: "full:ads.example.org", Block: true},
+		{Pattern: "domain:example.net", PortTLS: 8443, Bandwidth: 1000, Source: adblockPath},
+		{Pattern: "!domain:www.example.net"},
+		{Pattern: "full:ads.example.org", Source: hostsPath},
+		{Pattern: "*"},
+	}, relayRules)
+
+	require.NoError(t, os.Remove(adblockPath))
+
+	_, err = f.ExpandRules()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFile_ExpandRules_geosite(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "netflix"), []byte("netflix.com\nfull:www.nflx.net @cdn\n"), 0o600)
+	require.NoError(t, err)
+
+	f := &config.File{
+		GeositePath: dir,
+		DomainRules: config.DomainRules{{
+			Pattern: "!geosite:netflix@cdn",
+		}, {
+			Pattern: "geosite:netflix",
+			Action:  "block",
+		}},
+	}
+
+	assert.Equal(t, []string{dir}, f.ListFiles())
+
+	expanded, err := f.ExpandRules()
+	require.NoError(t, err)
+
+	dnsRules, err := expanded.ToDNSRules()
+	require.NoError(t, err)
+
+	assert.Equal(t, []*dnssrv.Rule{
+		{Pattern: "!full:www.nflx.net"},
+		{Pattern: "domain:netflix.com", Action: dnssrv.ActionBlock},
+		{Pattern: "full:www.nflx.net", Action: dnssrv.ActionBlock},
+	}, dnsRules)
+
+	f.DomainRules[1].Pattern = "geosite:unknown"
+	_, err = f.ExpandRules()
+	assert.EqualError(t, err, `geosite list "unknown" not found`)
+}
+
+func TestDomainRules_UnmarshalYAML_list(t *testing.T) {
+	testCases := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{{
+		name: "pattern_and_list",
+		yaml: `
+- pattern: "*"
+  list: "list.txt"
+`,
+		wantErr: "domain-rules item at index 0: pattern and list cannot be used together",
+	}, {
+		name: "bad_format",
+		yaml: `
+- list: "list.txt"
+  list-format: "unknown"
+`,
+		wantErr: `domain-rules item at index 0: invalid list-format "unknown"`,
+	}, {
+		name: "format_without_list",
+		yaml: `
+- pattern: "*"
+  list-format: "hosts"
+`,
+		wantErr: "domain-rules item at index 0: list-format requires list",
+	}, {
+		name: "map",
+		yaml: `
+"*":
+  list: "list.txt"
+`,
+		wantErr: "domain-rules value for *: list requires the list form",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rules config.DomainRules
+			err := yaml.Unmarshal([]byte(tc.yaml), &rules)
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
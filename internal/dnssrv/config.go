@@ -6,6 +6,7 @@ import (
 	"net/netip"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/ameshkov/snirelay/internal/sockets"
 )
 
 // Config represents the DNS server configuration.
@@ -15,16 +16,20 @@ type Config struct {
 	Upstream upstream.Upstream
 
 	// RedirectAddrIPv4 is the IP address where type=A queries must be
-	// redirected for domains that match RedirectDomains.
+	// redirected for domains that match rules with ActionRedirect.
 	RedirectAddrIPv4 net.IP
 
 	// RedirectAddrIPv4 is the IP address where type=AAAA queries must be
-	// redirected for domains that match RedirectDomains.
+	// redirected for domains that match rules with ActionRedirect.
 	RedirectAddrIPv6 net.IP
 
-	// RedirectDomains is a list of wildcards for domains that needs to be
-	// redirected.
-	RedirectDomains []string
+	// Rules is an ordered list of rules for domains that need to be
+	// redirected or blocked.  The first matching rule is used.
+	Rules []*Rule
+
+	// BlockMode controls how queries for blocked domains are answered.  If
+	// empty, BlockModeNXDOMAIN is used.
+	BlockMode BlockMode
 
 	// TCPAddr is the address for the plain DNS TCP server.
 	TCPAddr *net.TCPAddr
@@ -49,4 +54,47 @@ type Config struct {
 
 	// RateLimitAllowlist is a list of IP addresses excluded from rate limiting.
 	RateLimitAllowlist []netip.Addr
+
+	// ListenConfig creates the listening sockets.  If nil, a default
+	// [net.ListenConfig] is used.
+	ListenConfig sockets.ListenConfig
+}
+
+// BlockMode controls how the DNS server answers queries for blocked domains.
+type BlockMode string
+
+// Supported BlockMode values.
+const (
+	// BlockModeNXDOMAIN means that blocked domains are answered with
+	// NXDOMAIN.
+	BlockModeNXDOMAIN BlockMode = "nxdomain"
+
+	// BlockModeNullIP means that type=A and type=AAAA queries for blocked
+	// domains are answered with 0.0.0.0 and ::, other queries are answered
+	// with empty NOERROR.
+	BlockModeNullIP BlockMode = "null-ip"
+)
+
+// Action is what the DNS server does with the domains that match a rule.
+type Action uint8
+
+// Supported Action values.
+const (
+	// ActionRedirect means that the domain is redirected to the relay.
+	ActionRedirect Action = iota
+
+	// ActionBlock means that the domain is blocked according to BlockMode.
+	ActionBlock
+)
+
+// Rule is a DNS server rule.
+type Rule struct {
+	// Pattern is a pattern for domains this rule applies to in the syntax of
+	// package rules.  If it starts with "!", the rule is an exception, and
+	// domains that match it are resolved normally unless an earlier rule
+	// matches them.
+	Pattern string
+
+	// Action is what the DNS server does with the matching domains.
+	Action Action
 }
@@ -3,104 +3,344 @@ package dnssrv
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/IGLOU-EU/go-wildcard"
+	"github.com/AdguardTeam/golibs/service"
 	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/ameshkov/snirelay/internal/ratelimit"
+	"github.com/ameshkov/snirelay/internal/rules"
+	"github.com/ameshkov/snirelay/internal/sockets"
 	"github.com/miekg/dns"
 )
 
 const (
-	defaultTTL             = 300
-	defaultCacheSizeBytes  = 16 * 1024
-	ratelimitSubnetLenIPv4 = 24
-	ratelimitSubnetLenIPv6 = 56
+	defaultTTL            = 300
+	defaultCacheSizeBytes = 16 * 1024
+
+	// upstreamCloseDelay is the time after which the upstream replaced by
+	// Reconfigure is closed, so that the queries to it can finish.
+	upstreamCloseDelay = time.Minute
 )
 
 // Server is the DNS server that is able to re-route domains to the SNI relay.
+//
+// The server creates its listening sockets with its listen config, so that
+// they can be passed to a new process during an upgrade.  dnsproxy only
+// resolves the queries and handles the DoH requests, since it cannot serve the
+// sockets it has not created.  The queries received over the other protocols
+// are checked the same way dnsproxy checks them, see handle and
+// serveQUICStream.
 type Server struct {
-	proxy            *proxy.Proxy
-	redirectDomains  []string
+	proxy    *proxy.Proxy
+	ruleSet  *atomic.Pointer[ruleSet]
+	settings *atomic.Pointer[settings]
+
+	// listenConfig creates the listening sockets.
+	listenConfig sockets.ListenConfig
+
+	// tlsConfig is the TLS configuration for DoT, DoH, and DoQ.
+	tlsConfig *tls.Config
+
+	// udpAddr, tcpAddr, tlsAddr, httpsAddr, and quicAddr are the addresses of
+	// the plain DNS, DoT, DoH, and DoQ servers.  They are nil if the
+	// corresponding server is disabled.
+	udpAddr   *net.UDPAddr
+	tcpAddr   *net.TCPAddr
+	tlsAddr   *net.TCPAddr
+	httpsAddr *net.TCPAddr
+	quicAddr  *net.UDPAddr
+
+	// mu protects listeners.
+	mu *sync.Mutex
+
+	// listeners are the started listeners.
+	listeners []*listener
+
+	// rateLimiter limits the rate of the plain DNS queries over UDP.
+	rateLimiter *ratelimit.Limiter
+
+	// rateLimitAllowlist are the addresses excluded from rate limiting.
+	rateLimitAllowlist *container.MapSet[netip.Addr]
+
+	// requestID is the identifier of the last query used in logs.
+	requestID *atomic.Uint64
+
+	// rateLimit is the number of the plain DNS queries per second allowed
+	// from a client subnet.  If zero, the queries are not rate limited.
+	rateLimit float64
+}
+
+// type check
+var _ service.Interface = (*Server)(nil)
+
+// settings are the settings of the DNS server that can be changed at runtime.
+// settings must not be modified after creation.
+type settings struct {
+	// upstream is the upstream configuration that replaces the one the
+	// server was created with.  It is nil if the upstream has not been
+	// reconfigured.
+	upstream *proxy.CustomUpstreamConfig
+
+	// upstreamAddr is the address of the upstream in use.  The upstream is
+	// only replaced on reconfiguration if the address changes, so that the
+	// cache is kept.
+	upstreamAddr string
+
 	redirectAddrIPv4 net.IP
 	redirectAddrIPv6 net.IP
+	blockMode        BlockMode
 }
 
 // New creates a new DNS server with the specified configuration.
 func New(config *Config) (srv *Server, err error) {
 	proxyCfg := &proxy.Config{}
 
-	proxyCfg.Ratelimit = config.RateLimit
-	proxyCfg.RatelimitSubnetLenIPv4 = ratelimitSubnetLenIPv4
-	proxyCfg.RatelimitSubnetLenIPv6 = ratelimitSubnetLenIPv6
-	proxyCfg.RatelimitWhitelist = config.RateLimitAllowlist
-
 	proxyCfg.CacheEnabled = true
 	proxyCfg.CacheSizeBytes = defaultCacheSizeBytes
 
 	proxyCfg.TLSConfig = config.TLSConfig
 
-	proxyCfg.UpstreamConfig = &proxy.UpstreamConfig{
-		Upstreams:                []upstream.Upstream{config.Upstream},
-		DomainReservedUpstreams:  map[string][]upstream.Upstream{},
-		SpecifiedDomainUpstreams: map[string][]upstream.Upstream{},
-		SubdomainExclusions:      container.NewMapSet[string](),
+	proxyCfg.UpstreamConfig = newUpstreamConfig(config.Upstream)
+
+	blockMode, err := validBlockMode(config.BlockMode)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.TCPAddr != nil {
-		proxyCfg.TCPListenAddr = append(proxyCfg.TCPListenAddr, config.TCPAddr)
+	srv = &Server{
+		ruleSet:            &atomic.Pointer[ruleSet]{},
+		settings:           &atomic.Pointer[settings]{},
+		listenConfig:       config.ListenConfig,
+		tlsConfig:          config.TLSConfig,
+		udpAddr:            config.UDPAddr,
+		tcpAddr:            config.TCPAddr,
+		tlsAddr:            config.TLSAddr,
+		httpsAddr:          config.HTTPSAddr,
+		quicAddr:           config.QUICAddr,
+		mu:                 &sync.Mutex{},
+		rateLimiter:        ratelimit.NewLimiter(),
+		rateLimitAllowlist: container.NewMapSet(config.RateLimitAllowlist...),
+		requestID:          &atomic.Uint64{},
+		rateLimit:          float64(config.RateLimit),
 	}
 
-	if config.UDPAddr != nil {
-		proxyCfg.UDPListenAddr = append(proxyCfg.UDPListenAddr, config.UDPAddr)
+	if srv.listenConfig == nil {
+		srv.listenConfig = &net.ListenConfig{}
 	}
 
-	if config.TLSAddr != nil {
-		proxyCfg.TLSListenAddr = append(proxyCfg.TLSListenAddr, config.TLSAddr)
+	srv.settings.Store(&settings{
+		upstreamAddr:     config.Upstream.Address(),
+		blockMode:        blockMode,
+		redirectAddrIPv4: config.RedirectAddrIPv4,
+		redirectAddrIPv6: config.RedirectAddrIPv6,
+	})
+
+	err = srv.SetRules(config.Rules)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.HTTPSAddr != nil {
-		proxyCfg.HTTPSListenAddr = append(proxyCfg.HTTPSListenAddr, config.HTTPSAddr)
+	proxyCfg.RequestHandler = srv.requestHandler
+
+	srv.proxy, err = proxy.New(proxyCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new DNS proxy: %w", err)
 	}
 
-	if config.QUICAddr != nil {
-		proxyCfg.QUICListenAddr = append(proxyCfg.QUICListenAddr, config.QUICAddr)
+	return srv, nil
+}
+
+// validBlockMode returns the block mode with the default applied or an error
+// if it is invalid.
+func validBlockMode(m BlockMode) (res BlockMode, err error) {
+	switch m {
+	case "":
+		return BlockModeNXDOMAIN, nil
+	case BlockModeNXDOMAIN, BlockModeNullIP:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid block mode %q", m)
+	}
+}
+
+// Reconfigure atomically replaces the rules and the settings of the server
+// that can be changed at runtime: the upstream, the redirect addresses, and
+// the block mode.  Other fields of config are ignored, since changing them
+// requires restarting the server.
+func (s *Server) Reconfigure(config *Config) (err error) {
+	apply, err := s.PrepareReconfigure(config)
+	if err != nil {
+		return err
 	}
 
-	srv = &Server{
-		redirectDomains:  config.RedirectDomains,
+	apply()
+
+	return nil
+}
+
+// PrepareReconfigure validates config and returns the function that applies
+// it the same way as Reconfigure.  Nothing is changed until apply is called,
+// so that the configurations of several servers can be validated before any
+// of them is applied.
+func (s *Server) PrepareReconfigure(config *Config) (apply func(), err error) {
+	blockMode, err := validBlockMode(config.BlockMode)
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := newRuleSet(config.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		s.ruleSet.Store(set)
+		s.swapSettings(config, blockMode)
+	}, nil
+}
+
+// swapSettings replaces the runtime settings of the server with the ones from
+// config.  The current upstream and its cache are kept if the upstream address
+// has not changed, otherwise the previous upstream is closed once the queries
+// in flight are likely to be finished.
+func (s *Server) swapSettings(config *Config, blockMode BlockMode) {
+	next := &settings{
+		upstreamAddr:     config.Upstream.Address(),
+		blockMode:        blockMode,
 		redirectAddrIPv4: config.RedirectAddrIPv4,
 		redirectAddrIPv6: config.RedirectAddrIPv6,
 	}
 
-	proxyCfg.RequestHandler = srv.requestHandler
+	cur := s.settings.Load()
+	if next.upstreamAddr == cur.upstreamAddr {
+		next.upstream = cur.upstream
+		s.settings.Store(next)
 
-	srv.proxy, err = proxy.New(proxyCfg)
+		closeErr := config.Upstream.Close()
+		if closeErr != nil {
+			log.Debug("dnssrv: closing unused upstream: %s", closeErr)
+		}
+
+		return
+	}
+
+	upsConf := newUpstreamConfig(config.Upstream)
+	next.upstream = proxy.NewCustomUpstreamConfig(upsConf, true, defaultCacheSizeBytes, false)
+
+	prev := s.settings.Swap(next)
+	if prev.upstream != nil {
+		time.AfterFunc(upstreamCloseDelay, func() {
+			closeErr := prev.upstream.Close()
+			if closeErr != nil {
+				log.Debug("dnssrv: closing previous upstream: %s", closeErr)
+			}
+		})
+	}
+}
+
+// newUpstreamConfig returns the upstream configuration with the single
+// upstream.
+func newUpstreamConfig(u upstream.Upstream) (c *proxy.UpstreamConfig) {
+	return &proxy.UpstreamConfig{
+		Upstreams:                []upstream.Upstream{u},
+		DomainReservedUpstreams:  map[string][]upstream.Upstream{},
+		SpecifiedDomainUpstreams: map[string][]upstream.Upstream{},
+		SubdomainExclusions:      container.NewMapSet[string](),
+	}
+}
+
+// ruleSet is an immutable list of rules with the compiled matcher for their
+// patterns.
+type ruleSet struct {
+	// matcher matches domains against the patterns of rules.
+	matcher *rules.Matcher
+
+	// rules are the rules in the order of evaluation.
+	rules []*Rule
+}
+
+// newRuleSet compiles the rules into a rule set.
+func newRuleSet(rs []*Rule) (set *ruleSet, err error) {
+	patterns := make([]string, 0, len(rs))
+	for _, r := range rs {
+		patterns = append(patterns, r.Pattern)
+	}
+
+	m, err := rules.NewMatcher(patterns)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create a new DNS proxy: %w", err)
+		return nil, fmt.Errorf("invalid rules: %w", err)
 	}
 
-	return srv, nil
+	return &ruleSet{
+		matcher: m,
+		rules:   rs,
+	}, nil
+}
+
+// SetRules atomically replaces the rules of the server.
+func (s *Server) SetRules(rs []*Rule) (err error) {
+	set, err := newRuleSet(rs)
+	if err != nil {
+		return err
+	}
+
+	s.ruleSet.Store(set)
+
+	return nil
 }
 
-// Start starts the DNS server.
-func (s *Server) Start() (err error) {
-	return s.proxy.Start(context.Background())
+// Start implements the [service.Interface] interface for *Server.
+func (s *Server) Start(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.startListeners(ctx)
+	if err != nil {
+		return errors.WithDeferred(err, s.shutdownListeners(ctx))
+	}
+
+	return nil
 }
 
-// Shutdown stops the DNS server.
+// Shutdown implements the [service.Interface] interface for *Server.
 func (s *Server) Shutdown(ctx context.Context) (err error) {
-	return s.proxy.Shutdown(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.shutdownListeners(ctx)
+	err = errors.WithDeferred(err, s.proxy.UpstreamConfig.Close())
+	if ups := s.settings.Load().upstream; ups != nil {
+		err = errors.WithDeferred(err, ups.Close())
+	}
+
+	return err
 }
 
-// Addr returns the address the proxy listens to for the specified DNS protocol.
+// Addr returns the address the server listens to for the specified DNS
+// protocol or nil if it is not started for it.
 func (s *Server) Addr(proto proxy.Proto) (addr net.Addr) {
-	return s.proxy.Addr(proto)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		if l.proto == proto {
+			return l.addr
+		}
+	}
+
+	return nil
 }
 
 // requestHandler handles DNS queries and makes a decision based on what
@@ -111,26 +351,39 @@ func (s *Server) requestHandler(_ *proxy.Proxy, ctx *proxy.DNSContext) (err erro
 		return nil
 	}
 
-	resp := s.overrideResp(ctx)
+	st := s.settings.Load()
+	resp := s.overrideResp(ctx, st)
 	if resp != nil {
 		ctx.Res = resp
 
 		return nil
 	}
 
+	if st.upstream != nil {
+		ctx.CustomUpstreamConfig = st.upstream
+	}
+
 	return s.proxy.Resolve(ctx)
 }
 
 // overrideResp checks if it is necessary to override the response. If it is,
 // returns the overridden response. Otherwise, returns nil.
-func (s *Server) overrideResp(ctx *proxy.DNSContext) (resp *dns.Msg) {
+func (s *Server) overrideResp(ctx *proxy.DNSContext, st *settings) (resp *dns.Msg) {
 	qHost := ctx.Req.Question[0].Name
 	hostname := strings.TrimRight(qHost, ".")
 	reqType := ctx.Req.Question[0].Qtype
 
 	log.Debug("[%d] %s %s", ctx.RequestID, dns.Type(reqType), hostname)
 
-	redirect := s.shouldRedirect(hostname)
+	rule := s.matchRule(hostname)
+	if rule != nil && rule.Action == ActionBlock {
+		metrics.QueriesTotal.WithLabelValues(string(ctx.Proto), "0").Inc()
+		metrics.BlockedQueriesTotal.WithLabelValues(string(ctx.Proto)).Inc()
+
+		return st.blockedResp(ctx)
+	}
+
+	redirect := rule != nil && rule.Action == ActionRedirect
 
 	redirectLabel := "0"
 	if redirect {
@@ -155,34 +408,14 @@ func (s *Server) overrideResp(ctx *proxy.DNSContext) (resp *dns.Msg) {
 	resp.Compress = true
 
 	switch {
-	case reqType == dns.TypeA && s.redirectAddrIPv4 != nil:
-		log.Debug("[%d] Override IPv4 to %s", ctx.RequestID, s.redirectAddrIPv4)
-
-		resp.Answer = []dns.RR{
-			&dns.A{
-				Hdr: dns.RR_Header{
-					Name:   qHost,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    defaultTTL,
-				},
-				A: s.redirectAddrIPv4,
-			},
-		}
-	case reqType == dns.TypeAAAA && s.redirectAddrIPv6 != nil:
-		log.Debug("[%d] Override IPv6 to %s", ctx.RequestID, s.redirectAddrIPv6)
-
-		resp.Answer = []dns.RR{
-			&dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   qHost,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    defaultTTL,
-				},
-				AAAA: s.redirectAddrIPv6,
-			},
-		}
+	case reqType == dns.TypeA && st.redirectAddrIPv4 != nil:
+		log.Debug("[%d] Override IPv4 to %s", ctx.RequestID, st.redirectAddrIPv4)
+
+		resp.Answer = []dns.RR{newAnswer(qHost, dns.TypeA, st.redirectAddrIPv4)}
+	case reqType == dns.TypeAAAA && st.redirectAddrIPv6 != nil:
+		log.Debug("[%d] Override IPv6 to %s", ctx.RequestID, st.redirectAddrIPv6)
+
+		resp.Answer = []dns.RR{newAnswer(qHost, dns.TypeAAAA, st.redirectAddrIPv6)}
 	default:
 		log.Debug("[%d] Return empty NOERROR response", ctx.RequestID)
 	}
@@ -190,13 +423,62 @@ func (s *Server) overrideResp(ctx *proxy.DNSContext) (resp *dns.Msg) {
 	return resp
 }
 
-// shouldRedirect checks if the hostname needs to be redirected.
-func (s *Server) shouldRedirect(hostname string) (ok bool) {
-	for _, pattern := range s.redirectDomains {
-		if wildcard.MatchSimple(pattern, hostname) {
-			return true
-		}
+// blockedResp returns the response to the query for a blocked domain.
+func (st *settings) blockedResp(ctx *proxy.DNSContext) (resp *dns.Msg) {
+	qHost := ctx.Req.Question[0].Name
+	reqType := ctx.Req.Question[0].Qtype
+
+	resp = new(dns.Msg)
+	resp.Compress = true
+
+	if st.blockMode != BlockModeNullIP {
+		log.Debug("[%d] Blocked, return NXDOMAIN", ctx.RequestID)
+
+		return resp.SetRcode(ctx.Req, dns.RcodeNameError)
+	}
+
+	resp.SetReply(ctx.Req)
+
+	switch reqType {
+	case dns.TypeA:
+		log.Debug("[%d] Blocked, return %s", ctx.RequestID, net.IPv4zero)
+
+		resp.Answer = []dns.RR{newAnswer(qHost, dns.TypeA, net.IPv4zero)}
+	case dns.TypeAAAA:
+		log.Debug("[%d] Blocked, return %s", ctx.RequestID, net.IPv6zero)
+
+		resp.Answer = []dns.RR{newAnswer(qHost, dns.TypeAAAA, net.IPv6zero)}
+	default:
+		log.Debug("[%d] Blocked, return empty NOERROR response", ctx.RequestID)
+	}
+
+	return resp
+}
+
+// newAnswer returns a type=A or type=AAAA resource record with the IP address.
+func newAnswer(qHost string, rrType uint16, ip net.IP) (rr dns.RR) {
+	hdr := dns.RR_Header{
+		Name:   qHost,
+		Rrtype: rrType,
+		Class:  dns.ClassINET,
+		Ttl:    defaultTTL,
+	}
+
+	if rrType == dns.TypeA {
+		return &dns.A{Hdr: hdr, A: ip}
+	}
+
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// matchRule returns the first rule that matches the hostname or nil if there
+// is none.
+func (s *Server) matchRule(hostname string) (r *Rule) {
+	set := s.ruleSet.Load()
+	i, ok := set.matcher.Match(hostname, nil)
+	if !ok {
+		return nil
 	}
 
-	return false
+	return set.rules[i]
 }
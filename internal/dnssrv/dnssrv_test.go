@@ -17,7 +17,9 @@ import (
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/ameshkov/snirelay/internal/sockets"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -84,7 +86,7 @@ func TestNew(t *testing.T) {
 
 			cfg := &dnssrv.Config{
 				Upstream:         u,
-				RedirectDomains:  tc.redirectDomains,
+				Rules:            newRedirectRules(tc.redirectDomains),
 				RedirectAddrIPv4: net.ParseIP(redirectIpv4),
 				TLSConfig:        tlsConfig,
 			}
@@ -104,7 +106,7 @@ func TestNew(t *testing.T) {
 			srv, err := dnssrv.New(cfg)
 			require.NoError(t, err)
 
-			err = srv.Start()
+			err = srv.Start(context.Background())
 			require.NoError(t, err)
 
 			defer func(srv *dnssrv.Server, ctx context.Context) {
@@ -172,6 +174,15 @@ func TestNew(t *testing.T) {
 	}
 }
 
+// newRedirectRules returns the rules that redirect the specified domains.
+func newRedirectRules(domains []string) (rules []*dnssrv.Rule) {
+	for _, d := range domains {
+		rules = append(rules, &dnssrv.Rule{Pattern: d, Action: dnssrv.ActionRedirect})
+	}
+
+	return rules
+}
+
 func newTLSConfig(t *testing.T) (conf *tls.Config, certPem []byte) {
 	t.Helper()
 
@@ -222,3 +233,299 @@ func newTLSConfig(t *testing.T) (conf *tls.Config, certPem []byte) {
 
 	return &tls.Config{Certificates: []tls.Certificate{cert}, ServerName: tlsServerName}, certPem
 }
+
+func TestNew_block(t *testing.T) {
+	testCases := []struct {
+		name      string
+		reqDomain string
+		blockMode dnssrv.BlockMode
+		wantRcode int
+		wantIPv4  string
+		wantIPv6  string
+	}{{
+		name:      "nxdomain",
+		reqDomain: "ads.example.com",
+		blockMode: dnssrv.BlockModeNXDOMAIN,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "default",
+		reqDomain: "ads.example.com",
+		blockMode: "",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "null_ip",
+		reqDomain: "ads.example.com",
+		blockMode: dnssrv.BlockModeNullIP,
+		wantRcode: dns.RcodeSuccess,
+		wantIPv4:  "0.0.0.0",
+		wantIPv6:  "::",
+	}, {
+		name:      "redirect",
+		reqDomain: "www.example.com",
+		blockMode: dnssrv.BlockModeNXDOMAIN,
+		wantRcode: dns.RcodeSuccess,
+		wantIPv4:  "127.0.0.1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := upstream.AddressToUpstream(relayUpstreamAddr, &upstream.Options{})
+			require.NoError(t, err)
+
+			srv, err := dnssrv.New(&dnssrv.Config{
+				Upstream: u,
+				Rules: []*dnssrv.Rule{{
+					Pattern: "ads.example.com",
+					Action:  dnssrv.ActionBlock,
+				}, {
+					Pattern: "!*.bank.example.com",
+				}, {
+					Pattern: "*.example.com",
+					Action:  dnssrv.ActionRedirect,
+				}},
+				BlockMode:        tc.blockMode,
+				RedirectAddrIPv4: net.ParseIP("127.0.0.1"),
+				UDPAddr:          &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, srv.Start(context.Background()))
+			t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+			testUpstream, err := upstream.AddressToUpstream(
+				srv.Addr(proxy.ProtoUDP).String(),
+				&upstream.Options{},
+			)
+			require.NoError(t, err)
+
+			for _, reqType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				req := &dns.Msg{
+					MsgHdr: dns.MsgHdr{
+						Id:               dns.Id(),
+						RecursionDesired: true,
+					},
+					Question: []dns.Question{
+						{Name: dns.Fqdn(tc.reqDomain), Qtype: reqType, Qclass: dns.ClassINET},
+					},
+				}
+
+				resp, exchErr := testUpstream.Exchange(req)
+				require.NoError(t, exchErr)
+				require.Equal(t, tc.wantRcode, resp.Rcode)
+
+				wantIP := tc.wantIPv4
+				if reqType == dns.TypeAAAA {
+					wantIP = tc.wantIPv6
+				}
+
+				if wantIP == "" {
+					require.Empty(t, resp.Answer)
+
+					continue
+				}
+
+				require.Len(t, resp.Answer, 1)
+
+				var ip net.IP
+				switch rr := resp.Answer[0].(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				}
+
+				require.Equal(t, wantIP, ip.String())
+			}
+		})
+	}
+
+	_, err := dnssrv.New(&dnssrv.Config{BlockMode: "invalid"})
+	require.Error(t, err)
+}
+
+// newTestUpstream starts a DNS server that answers all type=A queries with ip
+// and returns the upstream for it.
+func newTestUpstream(t *testing.T, ip string) (u upstream.Upstream) {
+	t.Helper()
+
+	u, err := upstream.AddressToUpstream(relayUpstreamAddr, &upstream.Options{})
+	require.NoError(t, err)
+
+	srv, err := dnssrv.New(&dnssrv.Config{
+		Upstream:         u,
+		Rules:            []*dnssrv.Rule{{Pattern: "*", Action: dnssrv.ActionRedirect}},
+		RedirectAddrIPv4: net.ParseIP(ip),
+		UDPAddr:          &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	u, err = upstream.AddressToUpstream(srv.Addr(proxy.ProtoUDP).String(), &upstream.Options{})
+	require.NoError(t, err)
+
+	return u
+}
+
+// exchangeA sends a type=A query for domain to u and returns the IP address
+// from the response.
+func exchangeA(t *testing.T, u upstream.Upstream, domain string) (ip string) {
+	t.Helper()
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{
+			{Name: dns.Fqdn(domain), Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		},
+	}
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	a, ok := resp.Answer[0].(*dns.A)
+	require.True(t, ok)
+
+	return a.A.String()
+}
+
+func TestServer_Reconfigure(t *testing.T) {
+	rules := []*dnssrv.Rule{{Pattern: "*.example.com", Action: dnssrv.ActionRedirect}}
+
+	srv, err := dnssrv.New(&dnssrv.Config{
+		Upstream:         newTestUpstream(t, "192.0.2.1"),
+		Rules:            rules,
+		RedirectAddrIPv4: net.ParseIP("127.0.0.1"),
+		UDPAddr:          &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	testUpstream, err := upstream.AddressToUpstream(
+		srv.Addr(proxy.ProtoUDP).String(),
+		&upstream.Options{},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, "127.0.0.1", exchangeA(t, testUpstream, "www.example.com"))
+	require.Equal(t, "192.0.2.1", exchangeA(t, testUpstream, "www.example.net"))
+
+	err = srv.Reconfigure(&dnssrv.Config{
+		Upstream:         newTestUpstream(t, "192.0.2.2"),
+		Rules:            rules,
+		RedirectAddrIPv4: net.ParseIP("127.0.0.2"),
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "127.0.0.2", exchangeA(t, testUpstream, "www.example.com"))
+	require.Equal(t, "192.0.2.2", exchangeA(t, testUpstream, "www.example.net"))
+
+	err = srv.Reconfigure(&dnssrv.Config{BlockMode: "invalid"})
+	require.Error(t, err)
+
+	require.Equal(t, "127.0.0.2", exchangeA(t, testUpstream, "www.example.com"))
+}
+
+// addrUpstream is an upstream.Upstream that reports addr as its address.
+type addrUpstream struct {
+	upstream.Upstream
+
+	addr string
+}
+
+// type check
+var _ upstream.Upstream = (*addrUpstream)(nil)
+
+// Address implements the [upstream.Upstream] interface for *addrUpstream.
+func (u *addrUpstream) Address() (addr string) {
+	return u.addr
+}
+
+func TestServer_Reconfigure_sameUpstream(t *testing.T) {
+	ups := newTestUpstream(t, "192.0.2.1")
+
+	srv, err := dnssrv.New(&dnssrv.Config{
+		Upstream:         ups,
+		RedirectAddrIPv4: net.ParseIP("127.0.0.1"),
+		UDPAddr:          &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	testUpstream, err := upstream.AddressToUpstream(
+		srv.Addr(proxy.ProtoUDP).String(),
+		&upstream.Options{},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, "192.0.2.1", exchangeA(t, testUpstream, "www.example.net"))
+
+	// The new upstream has the same address but answers differently, so the
+	// old answer means that the upstream has been kept.
+	err = srv.Reconfigure(&dnssrv.Config{
+		Upstream: &addrUpstream{
+			Upstream: newTestUpstream(t, "192.0.2.2"),
+			addr:     ups.Address(),
+		},
+		RedirectAddrIPv4: net.ParseIP("127.0.0.1"),
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "192.0.2.1", exchangeA(t, testUpstream, "www.example.net"))
+	require.Equal(t, "192.0.2.1", exchangeA(t, testUpstream, "www.example.org"))
+}
+
+func TestServer_Start_listenConfig(t *testing.T) {
+	socks, err := sockets.New()
+	require.NoError(t, err)
+
+	tlsConfig, _ := newTLSConfig(t)
+	localAddrUDP := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+	localAddrTCP := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}}
+
+	srv, err := dnssrv.New(&dnssrv.Config{
+		Upstream:         newTestUpstream(t, "192.0.2.1"),
+		RedirectAddrIPv4: net.ParseIP("127.0.0.1"),
+		UDPAddr:          localAddrUDP,
+		TCPAddr:          localAddrTCP,
+		TLSAddr:          localAddrTCP,
+		HTTPSAddr:        localAddrTCP,
+		QUICAddr:         localAddrUDP,
+		TLSConfig:        tlsConfig,
+		ListenConfig:     socks,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	// All sockets of the server are created by the set, so that they can be
+	// passed to a new process.
+	files, err := socks.Files()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	})
+
+	assert.Len(t, files, 5)
+
+	for _, proto := range []proxy.Proto{
+		proxy.ProtoUDP,
+		proxy.ProtoTCP,
+		proxy.ProtoTLS,
+		proxy.ProtoHTTPS,
+		proxy.ProtoQUIC,
+	} {
+		assert.NotNil(t, srv.Addr(proto), proto)
+	}
+}
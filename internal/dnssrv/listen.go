@@ -0,0 +1,308 @@
+package dnssrv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/ameshkov/snirelay/internal/ratelimit"
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+// httpsTimeout is the read header and write timeout of the DoH server.
+const httpsTimeout = 10 * time.Second
+
+// listener is a started DNS server listener.
+type listener struct {
+	// addr is the address the listener listens on.
+	addr net.Addr
+
+	// shutdown stops the listener and closes its socket.
+	shutdown func(ctx context.Context) (err error)
+
+	// proto is the DNS protocol served by the listener.
+	proto proxy.Proto
+}
+
+// startListeners creates the sockets with the listen config of the server and
+// starts serving the configured protocols on them.  s.mu is expected to be
+// locked.
+func (s *Server) startListeners(ctx context.Context) (err error) {
+	if s.udpAddr != nil {
+		err = s.startDNS(ctx, proxy.ProtoUDP, s.udpAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.tcpAddr != nil {
+		err = s.startDNS(ctx, proxy.ProtoTCP, s.tcpAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.tlsAddr != nil {
+		err = s.startDNS(ctx, proxy.ProtoTLS, s.tlsAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.httpsAddr != nil {
+		err = s.startHTTPS(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.quicAddr != nil {
+		err = s.startQUIC(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shutdownListeners stops all started listeners.  s.mu is expected to be
+// locked.
+func (s *Server) shutdownListeners(ctx context.Context) (err error) {
+	var errs []error
+	for _, l := range s.listeners {
+		shutdownErr := l.shutdown(ctx)
+		if shutdownErr != nil {
+			errs = append(errs, fmt.Errorf("%s://%s: %w", l.proto, l.addr, shutdownErr))
+		}
+	}
+
+	s.listeners = nil
+
+	return errors.Join(errs...)
+}
+
+// addListener records the started listener.  s.mu is expected to be locked.
+func (s *Server) addListener(
+	proto proxy.Proto,
+	addr net.Addr,
+	shutdown func(ctx context.Context) (err error),
+) {
+	log.Info("dnssrv: listening on %s://%s", proto, addr)
+
+	s.listeners = append(s.listeners, &listener{
+		addr:     addr,
+		shutdown: shutdown,
+		proto:    proto,
+	})
+}
+
+// startDNS starts the plain DNS or DoT server for proto on addr.
+func (s *Server) startDNS(ctx context.Context, proto proxy.Proto, addr net.Addr) (err error) {
+	srv := &dns.Server{
+		Handler: s.dnsHandler(proto),
+		// Pass all messages to the handler, which checks them the same way
+		// dnsproxy does.
+		MsgAcceptFunc: func(_ dns.Header) (action dns.MsgAcceptAction) {
+			return dns.MsgAccept
+		},
+	}
+
+	var laddr net.Addr
+	if proto == proxy.ProtoUDP {
+		var c net.PacketConn
+		c, err = s.listenConfig.ListenPacket(ctx, "udp", addr.String())
+		if err != nil {
+			return fmt.Errorf("listening on %s://%s: %w", proto, addr, err)
+		}
+
+		srv.PacketConn, laddr = c, c.LocalAddr()
+	} else {
+		var l net.Listener
+		l, err = s.listenConfig.Listen(ctx, "tcp", addr.String())
+		if err != nil {
+			return fmt.Errorf("listening on %s://%s: %w", proto, addr, err)
+		}
+
+		if proto == proxy.ProtoTLS {
+			l = tls.NewListener(l, s.tlsConfig)
+		}
+
+		srv.Listener, laddr = l, l.Addr()
+	}
+
+	err = serveDNS(srv)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("serving %s: %w", proto, err), closeSocket(srv))
+	}
+
+	s.addListener(proto, laddr, srv.ShutdownContext)
+
+	return nil
+}
+
+// serveDNS starts serving srv and waits until it is started.
+func serveDNS(srv *dns.Server) (err error) {
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ActivateAndServe()
+	}()
+
+	select {
+	case <-started:
+		return nil
+	case err = <-errCh:
+		return err
+	}
+}
+
+// closeSocket closes the socket of srv that has not been started.
+func closeSocket(srv *dns.Server) (err error) {
+	if srv.PacketConn != nil {
+		return srv.PacketConn.Close()
+	}
+
+	return srv.Listener.Close()
+}
+
+// startHTTPS starts the DoH server.  The queries are handled by the proxy,
+// which calls the request handler of the server.
+func (s *Server) startHTTPS(ctx context.Context) (err error) {
+	l, err := s.listenConfig.Listen(ctx, "tcp", s.httpsAddr.String())
+	if err != nil {
+		return fmt.Errorf("listening on %s://%s: %w", proxy.ProtoHTTPS, s.httpsAddr, err)
+	}
+
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+	srv := &http.Server{
+		Handler:           s.proxy,
+		ReadHeaderTimeout: httpsTimeout,
+		WriteTimeout:      httpsTimeout,
+	}
+
+	go func() {
+		serveErr := srv.Serve(tls.NewListener(l, tlsConfig))
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			log.Error("dnssrv: serving %s: %s", proxy.ProtoHTTPS, serveErr)
+		}
+	}()
+
+	s.addListener(proxy.ProtoHTTPS, l.Addr(), srv.Shutdown)
+
+	return nil
+}
+
+// dnsHandler returns the handler of the DNS queries received over proto by
+// package dns.
+func (s *Server) dnsHandler(proto proxy.Proto) (h dns.HandlerFunc) {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		addr := netutil.NetAddrToAddrPort(w.RemoteAddr())
+		resp := s.handle(proto, req, addr)
+		if resp == nil {
+			return
+		}
+
+		err := w.WriteMsg(resp)
+		if err != nil {
+			log.Debug("dnssrv: %s: writing response to %s: %s", proto, addr, err)
+		}
+	}
+}
+
+// handle processes the query req received over proto from addr and returns the
+// response.  resp is nil if the query must not be answered.  The queries are
+// checked the same way dnsproxy checks the ones it receives itself.
+func (s *Server) handle(proto proxy.Proto, req *dns.Msg, addr netip.AddrPort) (resp *dns.Msg) {
+	if req.Response {
+		log.Debug("dnssrv: %s: dropping response from %s", proto, addr)
+
+		return nil
+	}
+
+	// Only the plain DNS queries over UDP are rate limited, since the source
+	// address of the other ones is verified by the handshake.
+	if proto == proxy.ProtoUDP && s.rateLimited(addr.Addr()) {
+		log.Debug("dnssrv: rate limiting %s", addr)
+
+		return nil
+	}
+
+	if len(req.Question) != 1 {
+		log.Debug("dnssrv: %s: invalid number of questions %d", proto, len(req.Question))
+
+		return newReply(req, dns.RcodeServerFailure)
+	}
+
+	if q := req.Question[0]; isForbiddenARPA(q, addr.Addr()) {
+		log.Debug("dnssrv: %s: %s requests private arpa domain %q", proto, addr, q.Name)
+
+		return newReply(req, dns.RcodeNameError)
+	}
+
+	ctx := &proxy.DNSContext{
+		Proto:     proto,
+		Req:       req,
+		Addr:      addr,
+		RequestID: s.requestID.Add(1),
+	}
+
+	err := s.requestHandler(s.proxy, ctx)
+	if err != nil {
+		log.Debug("[%d] dnssrv: handling %s request: %s", ctx.RequestID, proto, err)
+	}
+
+	return ctx.Res
+}
+
+// newReply returns the response to req with the rcode, the same as the one
+// dnsproxy responds with.
+func newReply(req *dns.Msg, rcode int) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, rcode)
+	resp.RecursionAvailable = true
+
+	return resp
+}
+
+// isForbiddenARPA returns true if q is a PTR, SOA, or NS query for a locally
+// served address from a client with an address that is not locally served.
+// Like dnsproxy, the server does not resolve such queries, so that the names
+// from the private networks are not disclosed.
+func isForbiddenARPA(q dns.Question, client netip.Addr) (ok bool) {
+	switch q.Qtype {
+	case dns.TypePTR, dns.TypeSOA, dns.TypeNS:
+		// Go on.
+	default:
+		return false
+	}
+
+	pref, err := netutil.ExtractReversedAddr(q.Name)
+	if err != nil {
+		return false
+	}
+
+	return netutil.IsLocallyServed(pref.Addr()) && !netutil.IsLocallyServed(client.Unmap())
+}
+
+// rateLimited returns true if the query from addr must be dropped by the rate
+// limit.
+func (s *Server) rateLimited(addr netip.Addr) (limited bool) {
+	if s.rateLimit == 0 || s.rateLimitAllowlist.Has(addr.Unmap()) {
+		return false
+	}
+
+	return !s.rateLimiter.Allow(ratelimit.Subnet(addr), s.rateLimit, s.rateLimit, time.Now())
+}
@@ -0,0 +1,145 @@
+package dnssrv
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// answerUpstream is an upstream.Upstream that answers all queries with
+// NOERROR.
+type answerUpstream struct{}
+
+// type check
+var _ upstream.Upstream = answerUpstream{}
+
+// Exchange implements the [upstream.Upstream] interface for answerUpstream.
+func (answerUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return (&dns.Msg{}).SetReply(req), nil
+}
+
+// Address implements the [upstream.Upstream] interface for answerUpstream.
+func (answerUpstream) Address() (addr string) {
+	return "answer"
+}
+
+// Close implements the [upstream.Upstream] interface for answerUpstream.
+func (answerUpstream) Close() (err error) {
+	return nil
+}
+
+func TestServer_handle(t *testing.T) {
+	srv, err := New(&Config{
+		Upstream: answerUpstream{},
+	})
+	require.NoError(t, err)
+
+	var (
+		publicClient  = netip.MustParseAddrPort("1.2.3.4:53000")
+		privateClient = netip.MustParseAddrPort("192.168.0.2:53000")
+	)
+
+	newReq := func(qtype uint16, names ...string) (req *dns.Msg) {
+		req = &dns.Msg{}
+		req.Id = dns.Id()
+		for _, name := range names {
+			req.Question = append(req.Question, dns.Question{
+				Name:   name,
+				Qtype:  qtype,
+				Qclass: dns.ClassINET,
+			})
+		}
+
+		return req
+	}
+
+	response := newReq(dns.TypeA, "www.example.com.")
+	response.Response = true
+
+	testCases := []struct {
+		req       *dns.Msg
+		name      string
+		addr      netip.AddrPort
+		wantRcode int
+		wantNil   bool
+	}{{
+		req:       newReq(dns.TypeA, "www.example.com."),
+		name:      "valid",
+		addr:      publicClient,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		req:     response,
+		name:    "response",
+		addr:    publicClient,
+		wantNil: true,
+	}, {
+		req:       newReq(dns.TypeA),
+		name:      "no_questions",
+		addr:      publicClient,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		req:       newReq(dns.TypeA, "www.example.com.", "www.example.org."),
+		name:      "two_questions",
+		addr:      publicClient,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		req:       newReq(dns.TypePTR, "2.0.168.192.in-addr.arpa."),
+		name:      "private_ptr_public_client",
+		addr:      publicClient,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		req:       newReq(dns.TypeSOA, "168.192.in-addr.arpa."),
+		name:      "private_soa_public_client",
+		addr:      publicClient,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		req:       newReq(dns.TypeNS, "0.10.in-addr.arpa."),
+		name:      "private_ns_public_client",
+		addr:      publicClient,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		req:       newReq(dns.TypePTR, "2.0.168.192.in-addr.arpa."),
+		name:      "private_ptr_private_client",
+		addr:      privateClient,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		req:       newReq(dns.TypePTR, "2.0.168.192.in-addr.arpa."),
+		name:      "private_ptr_mapped_private_client",
+		addr:      netip.MustParseAddrPort("[::ffff:192.168.0.2]:53000"),
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		req:       newReq(dns.TypeA, "2.0.168.192.in-addr.arpa."),
+		name:      "private_a_public_client",
+		addr:      publicClient,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		req:       newReq(dns.TypePTR, "8.8.8.8.in-addr.arpa."),
+		name:      "public_ptr_public_client",
+		addr:      publicClient,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := srv.handle(proxy.ProtoUDP, tc.req, tc.addr)
+			if tc.wantNil {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.req.Id, resp.Id)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			if tc.wantRcode != dns.RcodeSuccess {
+				assert.True(t, resp.RecursionAvailable)
+			}
+		})
+	}
+}
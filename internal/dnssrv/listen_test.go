@@ -0,0 +1,176 @@
+package dnssrv_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/snirelay/internal/dnssrv"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProtoServer starts the DNS server serving all protocols on the loopback
+// interface, which redirects *.example.com to 127.0.0.2 and resolves other
+// domains with an upstream that answers with 192.0.2.1.  It returns the server
+// and the root CAs that verify its certificate.
+func newProtoServer(t *testing.T) (srv *dnssrv.Server, roots *x509.CertPool) {
+	t.Helper()
+
+	tlsConfig, caPem := newTLSConfig(t)
+	roots = x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+
+	localAddrUDP := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+	localAddrTCP := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}}
+
+	srv, err := dnssrv.New(&dnssrv.Config{
+		Upstream:         newTestUpstream(t, "192.0.2.1"),
+		Rules:            newRedirectRules([]string{"*.example.com"}),
+		RedirectAddrIPv4: net.ParseIP("127.0.0.2"),
+		UDPAddr:          localAddrUDP,
+		TCPAddr:          localAddrTCP,
+		TLSAddr:          localAddrTCP,
+		HTTPSAddr:        localAddrTCP,
+		QUICAddr:         localAddrUDP,
+		TLSConfig:        tlsConfig,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	return srv, roots
+}
+
+func TestServer_protocols(t *testing.T) {
+	srv, roots := newProtoServer(t)
+
+	addrs := map[proxy.Proto]string{
+		proxy.ProtoUDP:   fmt.Sprintf("udp://%s", srv.Addr(proxy.ProtoUDP)),
+		proxy.ProtoTCP:   fmt.Sprintf("tcp://%s", srv.Addr(proxy.ProtoTCP)),
+		proxy.ProtoTLS:   fmt.Sprintf("tls://%s", srv.Addr(proxy.ProtoTLS)),
+		proxy.ProtoHTTPS: fmt.Sprintf("https://%s/dns-query", srv.Addr(proxy.ProtoHTTPS)),
+		proxy.ProtoQUIC:  fmt.Sprintf("quic://%s", srv.Addr(proxy.ProtoQUIC)),
+	}
+
+	testCases := []struct {
+		req       *dns.Msg
+		name      string
+		wantAddr  string
+		wantRcode int
+	}{{
+		req:       newQuery(dns.TypeA, "www.example.com."),
+		name:      "redirect",
+		wantAddr:  "127.0.0.2",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		req:       newQuery(dns.TypeA, "www.example.net."),
+		name:      "resolve",
+		wantAddr:  "192.0.2.1",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		req:       newQuery(dns.TypeA, "www.example.com.", "www.example.net."),
+		name:      "two_questions",
+		wantAddr:  "",
+		wantRcode: dns.RcodeServerFailure,
+	}}
+
+	for proto, addr := range addrs {
+		u, err := upstream.AddressToUpstream(addr, &upstream.Options{RootCAs: roots})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = u.Close() })
+
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("%s_%s", proto, tc.name), func(t *testing.T) {
+				// The upstream may modify the request.
+				resp, exchErr := u.Exchange(tc.req.Copy())
+				require.NoError(t, exchErr)
+
+				assert.Equal(t, tc.wantRcode, resp.Rcode)
+				if tc.wantAddr == "" {
+					assert.Empty(t, resp.Answer)
+
+					return
+				}
+
+				require.Len(t, resp.Answer, 1)
+
+				a, ok := resp.Answer[0].(*dns.A)
+				require.True(t, ok)
+
+				assert.Equal(t, tc.wantAddr, a.A.String())
+			})
+		}
+	}
+}
+
+// newQuery returns a query of qtype with a question for each of names.
+func newQuery(qtype uint16, names ...string) (req *dns.Msg) {
+	req = &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+	}
+
+	for _, name := range names {
+		req.Question = append(req.Question, dns.Question{
+			Name:   name,
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		})
+	}
+
+	return req
+}
+
+func TestServer_dot(t *testing.T) {
+	srv, roots := newProtoServer(t)
+
+	client := &dns.Client{
+		Net: "tcp-tls",
+		TLSConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: tlsServerName,
+		},
+		Timeout: time.Second,
+	}
+
+	conn, err := client.Dial(srv.Addr(proxy.ProtoTLS).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	// Several queries are sent over the same connection.
+	for _, name := range []string{"www.example.com.", "www.example.net."} {
+		resp, _, exchErr := client.ExchangeWithConn(newQuery(dns.TypeA, name), conn)
+		require.NoError(t, exchErr)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+	}
+
+	// The responses are dropped, but the connection is kept.
+	msg := newQuery(dns.TypeA, "www.example.com.")
+	msg.Response = true
+	require.NoError(t, conn.WriteMsg(msg))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = conn.ReadMsg()
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	resp, _, err := client.ExchangeWithConn(newQuery(dns.TypeA, "www.example.com."), conn)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, "127.0.0.2", resp.Answer[0].(*dns.A).A.String())
+}
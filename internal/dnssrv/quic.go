@@ -0,0 +1,253 @@
+package dnssrv
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// quicNextProtos are the ALPN tokens of DoQ, the one of RFC 9250 and the ones
+// of the earlier drafts.
+var quicNextProtos = []string{proxy.NextProtoDQ, "doq-i02", "doq-i00", "dq"}
+
+const (
+	// quicIdleTimeout is the idle timeout of the DoQ connections.
+	quicIdleTimeout = 5 * time.Minute
+
+	// quicAddrValidatorCacheSize and quicAddrValidatorCacheTTL are the
+	// number of the client IPs that have been validated and the time they
+	// are not validated again.  They are the same as in dnsproxy.
+	quicAddrValidatorCacheSize = 1000
+	quicAddrValidatorCacheTTL  = 30 * time.Minute
+
+	// minDNSMsgSize is the size of the DNS message header.  Shorter queries
+	// are ignored.
+	minDNSMsgSize = 12
+)
+
+// DoQ error codes, see RFC 9250.
+const (
+	quicCodeNoError       quic.ApplicationErrorCode = 0
+	quicCodeInternalError quic.ApplicationErrorCode = 1
+	quicCodeProtocolError quic.ApplicationErrorCode = 2
+)
+
+// startQUIC starts the DoQ server.
+func (s *Server) startQUIC(ctx context.Context) (err error) {
+	c, err := s.listenConfig.ListenPacket(ctx, "udp", s.quicAddr.String())
+	if err != nil {
+		return fmt.Errorf("listening on %s://%s: %w", proxy.ProtoQUIC, s.quicAddr, err)
+	}
+
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = quicNextProtos
+
+	// The transport does not close the socket it has not created, so it is
+	// closed separately.
+	tr := &quic.Transport{
+		Conn:                c,
+		VerifySourceAddress: newQUICAddrValidator().requiresValidation,
+	}
+	l, err := tr.ListenEarly(tlsConfig, &quic.Config{
+		MaxIdleTimeout:     quicIdleTimeout,
+		MaxIncomingStreams: math.MaxUint16,
+		// RFC 9250 does not use unidirectional streams, so the clients are
+		// not allowed to open them.
+		MaxIncomingUniStreams: -1,
+		Allow0RTT:             true,
+	})
+	if err != nil {
+		err = fmt.Errorf("serving %s: %w", proxy.ProtoQUIC, err)
+
+		return errors.WithDeferred(err, errors.Join(tr.Close(), c.Close()))
+	}
+
+	go s.serveQUIC(l)
+
+	s.addListener(proxy.ProtoQUIC, c.LocalAddr(), func(_ context.Context) (err error) {
+		return errors.Join(l.Close(), tr.Close(), c.Close())
+	})
+
+	return nil
+}
+
+// serveQUIC accepts the DoQ connections until l is closed.
+func (s *Server) serveQUIC(l *quic.EarlyListener) {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			if !errors.Is(err, quic.ErrServerClosed) {
+				log.Error("dnssrv: accepting %s connection: %s", proxy.ProtoQUIC, err)
+			}
+
+			return
+		}
+
+		go s.serveQUICConn(conn)
+	}
+}
+
+// serveQUICConn handles the streams of conn, each of which carries a single
+// query, until conn is closed.
+func (s *Server) serveQUICConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			log.Debug("dnssrv: %s: accepting stream from %s: %s", proxy.ProtoQUIC, conn.RemoteAddr(), err)
+
+			closeQUICConn(conn, quicCodeNoError)
+
+			return
+		}
+
+		go s.serveQUICStream(conn, stream)
+	}
+}
+
+// serveQUICStream reads the query from stream, writes the response to it, and
+// closes it.
+func (s *Server) serveQUICStream(conn quic.Connection, stream quic.Stream) {
+	defer func() {
+		// Close only closes the write direction of the stream, which signals
+		// the client that the response is complete.
+		err := stream.Close()
+		if err != nil {
+			log.Debug("dnssrv: %s: closing stream: %s", proxy.ProtoQUIC, err)
+		}
+	}()
+
+	// The client indicates the end of the query by closing the stream.
+	buf, err := io.ReadAll(io.LimitReader(stream, 2+dns.MaxMsgSize))
+	if err != nil {
+		log.Debug("dnssrv: %s: reading query from %s: %s", proxy.ProtoQUIC, conn.RemoteAddr(), err)
+
+		return
+	}
+
+	if len(buf) < minDNSMsgSize {
+		log.Debug("dnssrv: %s: query from %s is too short", proxy.ProtoQUIC, conn.RemoteAddr())
+
+		return
+	}
+
+	// RFC 9250 prefixes the messages with their length, the earlier drafts
+	// do not.
+	msg, prefixed := buf, len(buf) > 2 && int(binary.BigEndian.Uint16(buf)) == len(buf)-2
+	if prefixed {
+		msg = buf[2:]
+	}
+
+	req := &dns.Msg{}
+	err = req.Unpack(msg)
+	if err != nil {
+		log.Debug("dnssrv: %s: unpacking query from %s: %s", proxy.ProtoQUIC, conn.RemoteAddr(), err)
+		closeQUICConn(conn, quicCodeProtocolError)
+
+		return
+	}
+
+	if hasTCPKeepalive(req) {
+		// RFC 9250 forbids the edns-tcp-keepalive option, since QUIC has its
+		// own idle timeout.
+		log.Debug("dnssrv: %s: query from %s has edns-tcp-keepalive", proxy.ProtoQUIC, conn.RemoteAddr())
+		closeQUICConn(conn, quicCodeProtocolError)
+
+		return
+	}
+
+	resp := s.handle(proxy.ProtoQUIC, req, netutil.NetAddrToAddrPort(conn.RemoteAddr()))
+	if resp == nil {
+		closeQUICConn(conn, quicCodeInternalError)
+
+		return
+	}
+
+	err = writeQUICResp(stream, resp, prefixed)
+	if err != nil {
+		log.Debug("dnssrv: %s: writing response to %s: %s", proxy.ProtoQUIC, conn.RemoteAddr(), err)
+	}
+}
+
+// writeQUICResp writes resp to w with the length prefix, if prefixed is true.
+func writeQUICResp(w io.Writer, resp *dns.Msg, prefixed bool) (err error) {
+	b, err := resp.Pack()
+	if err != nil {
+		return fmt.Errorf("packing response: %w", err)
+	}
+
+	if prefixed {
+		b = append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+	}
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// closeQUICConn closes conn with the DoQ error code.
+func closeQUICConn(conn quic.Connection, code quic.ApplicationErrorCode) {
+	err := conn.CloseWithError(code, "")
+	if err != nil {
+		log.Debug("dnssrv: %s: closing connection to %s: %s", proxy.ProtoQUIC, conn.RemoteAddr(), err)
+	}
+}
+
+// hasTCPKeepalive returns true if req has the edns-tcp-keepalive option.
+func hasTCPKeepalive(req *dns.Msg) (ok bool) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quicAddrValidator makes the clients prove that they own their addresses with
+// a Retry packet, unless their IP has been validated recently, the same way as
+// dnsproxy.  It protects from the amplification attacks with spoofed addresses.
+type quicAddrValidator struct {
+	// validated are the recently validated client IPs.
+	validated gcache.Cache
+}
+
+// newQUICAddrValidator returns a new validator of the DoQ client addresses.
+func newQUICAddrValidator() (v *quicAddrValidator) {
+	return &quicAddrValidator{
+		validated: gcache.New(quicAddrValidatorCacheSize).LRU().Build(),
+	}
+}
+
+// requiresValidation returns true if the client with addr must validate its
+// address.  addr is always a *net.UDPAddr.
+func (v *quicAddrValidator) requiresValidation(addr net.Addr) (ok bool) {
+	key := addr.(*net.UDPAddr).IP.String()
+	if v.validated.Has(key) {
+		return false
+	}
+
+	err := v.validated.SetWithExpire(key, struct{}{}, quicAddrValidatorCacheTTL)
+	if err != nil {
+		// Should not happen, since there is no serialization function.
+		log.Debug("dnssrv: %s: caching validated address: %s", proxy.ProtoQUIC, err)
+	}
+
+	return true
+}
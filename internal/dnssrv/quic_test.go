@@ -0,0 +1,205 @@
+package dnssrv_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// doqTimeout is the timeout of the DoQ exchanges in tests.
+const doqTimeout = 5 * time.Second
+
+// dialDoQ connects to the DoQ server at addr.  retried is set to true if the
+// server sends a Retry packet to validate the client address.
+func dialDoQ(
+	t *testing.T,
+	addr string,
+	roots *x509.CertPool,
+	retried *atomic.Bool,
+) (conn quic.Connection) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), doqTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+		RootCAs:    roots,
+		ServerName: tlsServerName,
+		NextProtos: []string{proxy.NextProtoDQ},
+	}, &quic.Config{
+		Tracer: func(
+			_ context.Context,
+			_ logging.Perspective,
+			_ quic.ConnectionID,
+		) (ct *logging.ConnectionTracer) {
+			return &logging.ConnectionTracer{
+				ReceivedRetry: func(_ *logging.Header) { retried.Store(true) },
+			}
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.CloseWithError(0, "") })
+
+	return conn
+}
+
+// exchangeDoQ sends the raw query b over a new stream of conn and returns the
+// raw response.
+func exchangeDoQ(t *testing.T, conn quic.Connection, b []byte) (resp []byte, err error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), doqTimeout)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, stream.SetDeadline(time.Now().Add(doqTimeout)))
+
+	_, err = stream.Write(b)
+	require.NoError(t, err)
+
+	// Closing the stream signals the end of the query.
+	require.NoError(t, stream.Close())
+
+	return io.ReadAll(stream)
+}
+
+// packQuery returns the wire format of req with the length prefix of RFC 9250,
+// if prefixed is true.
+func packQuery(t *testing.T, req *dns.Msg, prefixed bool) (b []byte) {
+	t.Helper()
+
+	b, err := req.Pack()
+	require.NoError(t, err)
+
+	if prefixed {
+		b = append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+	}
+
+	return b
+}
+
+// requireDoQCode requires that err is the DoQ error code the server closed the
+// connection with.
+func requireDoQCode(t *testing.T, err error, code quic.ApplicationErrorCode) {
+	t.Helper()
+
+	var appErr *quic.ApplicationError
+	require.ErrorAs(t, err, &appErr)
+
+	assert.True(t, appErr.Remote)
+	assert.Equal(t, code, appErr.ErrorCode)
+}
+
+func TestServer_doq(t *testing.T) {
+	srv, roots := newProtoServer(t)
+	addr := srv.Addr(proxy.ProtoQUIC).String()
+
+	t.Run("rfc9250", func(t *testing.T) {
+		conn := dialDoQ(t, addr, roots, &atomic.Bool{})
+
+		// Several queries are sent over the same connection.
+		for _, name := range []string{"www.example.com.", "mail.example.com."} {
+			req := newQuery(dns.TypeA, name)
+			req.Id = 0
+
+			b, err := exchangeDoQ(t, conn, packQuery(t, req, true))
+			require.NoError(t, err)
+			require.Greater(t, len(b), 2)
+			require.Equal(t, len(b)-2, int(binary.BigEndian.Uint16(b)))
+
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(b[2:]))
+			require.Len(t, resp.Answer, 1)
+
+			assert.Equal(t, "127.0.0.2", resp.Answer[0].(*dns.A).A.String())
+		}
+	})
+
+	t.Run("draft", func(t *testing.T) {
+		conn := dialDoQ(t, addr, roots, &atomic.Bool{})
+
+		b, err := exchangeDoQ(t, conn, packQuery(t, newQuery(dns.TypeA, "www.example.com."), false))
+		require.NoError(t, err)
+
+		// The earlier drafts do not prefix the messages.
+		resp := &dns.Msg{}
+		require.NoError(t, resp.Unpack(b))
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, "127.0.0.2", resp.Answer[0].(*dns.A).A.String())
+	})
+
+	t.Run("short", func(t *testing.T) {
+		conn := dialDoQ(t, addr, roots, &atomic.Bool{})
+
+		b, err := exchangeDoQ(t, conn, []byte{0, 4, 0, 0, 0, 0})
+		require.NoError(t, err)
+
+		assert.Empty(t, b)
+
+		// The connection is kept.
+		_, err = exchangeDoQ(t, conn, packQuery(t, newQuery(dns.TypeA, "www.example.com."), true))
+		require.NoError(t, err)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		conn := dialDoQ(t, addr, roots, &atomic.Bool{})
+
+		// The label of the question is longer than the rest of the message.
+		b := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 'a'}
+
+		_, err := exchangeDoQ(t, conn, b)
+		requireDoQCode(t, err, 2)
+	})
+
+	t.Run("tcp_keepalive", func(t *testing.T) {
+		conn := dialDoQ(t, addr, roots, &atomic.Bool{})
+
+		req := newQuery(dns.TypeA, "www.example.com.")
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+			Code: dns.EDNS0TCPKEEPALIVE,
+		})
+
+		_, err := exchangeDoQ(t, conn, packQuery(t, req, true))
+		requireDoQCode(t, err, 2)
+	})
+
+	t.Run("uni_stream", func(t *testing.T) {
+		conn := dialDoQ(t, addr, roots, &atomic.Bool{})
+
+		_, err := conn.OpenUniStream()
+		assert.Error(t, err)
+	})
+
+	t.Run("address_validation", func(t *testing.T) {
+		// Use another server, so that the address has not been validated
+		// yet.
+		valSrv, valRoots := newProtoServer(t)
+		valAddr := valSrv.Addr(proxy.ProtoQUIC).String()
+
+		retried := &atomic.Bool{}
+		dialDoQ(t, valAddr, valRoots, retried)
+		assert.True(t, retried.Load())
+
+		// The validated address is remembered.
+		retried.Store(false)
+		dialDoQ(t, valAddr, valRoots, retried)
+		assert.False(t, retried.Load())
+	})
+}
@@ -0,0 +1,148 @@
+package geosite
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the messages of the geosite.dat format:
+//
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message Domain {
+//	  Type type = 1;
+//	  string value = 2;
+//	  repeated Attribute attribute = 3;
+//	}
+//	message Attribute { string key = 1; ... }
+const (
+	fieldListEntry = 1
+
+	fieldSiteCode   = 1
+	fieldSiteDomain = 2
+
+	fieldDomainType  = 1
+	fieldDomainValue = 2
+	fieldDomainAttr  = 3
+
+	fieldAttrKey = 1
+)
+
+// parseDat parses the contents of a geosite.dat file.
+func parseDat(b []byte) (s *Sites, err error) {
+	s = &Sites{
+		lists: map[string][]*domain{},
+	}
+
+	err = walkFields(b, func(num protowire.Number, _ uint64, data []byte) (err error) {
+		if num != fieldListEntry {
+			return nil
+		}
+
+		return s.parseDatSite(data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parsing geosite.dat: %w", err)
+	}
+
+	return s, nil
+}
+
+// parseDatSite parses a GeoSite message and adds the list to s.
+func (s *Sites) parseDatSite(b []byte) (err error) {
+	var code string
+	var list []*domain
+	err = walkFields(b, func(num protowire.Number, _ uint64, data []byte) (err error) {
+		switch num {
+		case fieldSiteCode:
+			code = string(data)
+		case fieldSiteDomain:
+			var d *domain
+			d, err = parseDatDomain(data)
+			if err != nil {
+				return err
+			}
+
+			list = append(list, d)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	code = strings.ToLower(code)
+	s.lists[code] = append(s.lists[code], list...)
+
+	return nil
+}
+
+// parseDatDomain parses a Domain message.
+func parseDatDomain(b []byte) (d *domain, err error) {
+	d = &domain{}
+	err = walkFields(b, func(num protowire.Number, val uint64, data []byte) (err error) {
+		switch num {
+		case fieldDomainType:
+			if val > uint64(domainTypeFull) {
+				return fmt.Errorf("unknown domain type %d", val)
+			}
+
+			d.typ = domainType(val)
+		case fieldDomainValue:
+			d.value = string(data)
+		case fieldDomainAttr:
+			return walkFields(data, func(num protowire.Number, _ uint64, data []byte) (err error) {
+				if num == fieldAttrKey {
+					d.attrs = append(d.attrs, string(data))
+				}
+
+				return nil
+			})
+		}
+
+		return nil
+	})
+
+	return d, err
+}
+
+// walkFields calls f for every field of the protobuf message b.  val is the
+// value of varint fields and data is the contents of length-delimited ones.
+// Fields of other types are skipped.
+func walkFields(b []byte, f func(num protowire.Number, val uint64, data []byte) (err error)) (err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		var val uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			val, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		err = f(num, val, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
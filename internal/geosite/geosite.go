@@ -0,0 +1,123 @@
+// Package geosite loads the domain lists in the formats of the v2fly
+// domain-list-community project: the compiled geosite.dat files and the
+// source text files.
+package geosite
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// RefPrefix is the prefix of the references to geosite lists in patterns,
+// e.g. "geosite:netflix" or "geosite:category-ads-all@ads".
+const RefPrefix = "geosite:"
+
+// domainType is the type of a domain entry.  The values are the same as in
+// the geosite.dat format.
+type domainType uint8
+
+// Domain entry types.
+const (
+	// domainTypeKeyword matches domains that contain the value.
+	domainTypeKeyword domainType = 0
+
+	// domainTypeRegexp matches domains that match the regular expression.
+	domainTypeRegexp domainType = 1
+
+	// domainTypeDomain matches the domain and its subdomains.
+	domainTypeDomain domainType = 2
+
+	// domainTypeFull matches the domain only.
+	domainTypeFull domainType = 3
+)
+
+// domain is an entry of a geosite list.
+type domain struct {
+	// value is the domain, the keyword, or the regular expression.
+	value string
+
+	// attrs are the attributes of the entry without the "@" prefix.
+	attrs []string
+
+	// typ is the type of the entry.
+	typ domainType
+}
+
+// pattern returns the entry as a pattern in the syntax of package rules.
+func (d *domain) pattern() (p string) {
+	switch d.typ {
+	case domainTypeKeyword:
+		return "keyword:" + d.value
+	case domainTypeRegexp:
+		return "regexp:" + d.value
+	case domainTypeDomain:
+		return "domain:" + d.value
+	default:
+		return "full:" + d.value
+	}
+}
+
+// Sites is a set of geosite lists.
+type Sites struct {
+	// lists are the entries of the lists by their lowercased names.
+	lists map[string][]*domain
+}
+
+// Load loads the geosite lists from path.  If path is a directory, it is
+// considered the data directory of domain-list-community with a text file for
+// every list.  Otherwise, it is a compiled geosite.dat file.
+func Load(path string) (s *Sites, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return loadDir(path)
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDat(b)
+}
+
+// Patterns returns the patterns in the syntax of package rules for the
+// reference to a list, e.g. "netflix" or "category-ads-all@ads".  If the
+// reference has attributes, only the entries with all of them are returned.
+func (s *Sites) Patterns(ref string) (patterns []string, err error) {
+	name, attrStr, _ := strings.Cut(ref, "@")
+	list, ok := s.lists[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("geosite list %q not found", name)
+	}
+
+	var attrs []string
+	if attrStr != "" {
+		attrs = strings.Split(attrStr, "@")
+	}
+
+	for _, d := range list {
+		if hasAttrs(d, attrs) {
+			patterns = append(patterns, d.pattern())
+		}
+	}
+
+	return patterns, nil
+}
+
+// hasAttrs returns true if d has all attrs.
+func hasAttrs(d *domain, attrs []string) (ok bool) {
+	for _, a := range attrs {
+		if !slices.Contains(d.attrs, a) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,167 @@
+package geosite_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ameshkov/snirelay/internal/geosite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testDataDir is the domain-list-community data directory for tests.
+const testDataDir = "./testdata/data"
+
+// newTestDir copies the test data directory without the files with invalid
+// includes and returns its path.
+func newTestDir(t *testing.T) (dir string) {
+	t.Helper()
+
+	dir = t.TempDir()
+	for _, name := range []string{"netflix", "netflix-cdn", "category-ads"} {
+		b, err := os.ReadFile(filepath.Join(testDataDir, name))
+		require.NoError(t, err)
+
+		err = os.WriteFile(filepath.Join(dir, name), b, 0o600)
+		require.NoError(t, err)
+	}
+
+	return dir
+}
+
+func TestLoad_dir(t *testing.T) {
+	s, err := geosite.Load(newTestDir(t))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		ref     string
+		wantErr string
+		want    []string
+	}{{
+		ref: "netflix",
+		want: []string{
+			"domain:netflix.com",
+			"full:www.netflix.net",
+			"keyword:nflx",
+			`regexp:^nflx[a-z]+\.example$`,
+			"domain:nflxvideo.net",
+			"domain:nflxext.com",
+		},
+	}, {
+		ref:  "NETFLIX@cdn@ads",
+		want: []string{"domain:nflxext.com"},
+	}, {
+		ref: "category-ads",
+		want: []string{
+			"domain:ads.example.org",
+			"domain:nflxext.com",
+			"domain:nflxvideo.net",
+		},
+	}, {
+		ref:     "unknown",
+		wantErr: `geosite list "unknown" not found`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.ref, func(t *testing.T) {
+			patterns, pErr := s.Patterns(tc.ref)
+			if tc.wantErr != "" {
+				assert.EqualError(t, pErr, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, pErr)
+
+			assert.Equal(t, tc.want, patterns)
+		})
+	}
+}
+
+func TestLoad_dirInvalid(t *testing.T) {
+	_, err := geosite.Load(testDataDir)
+	assert.EqualError(t, err, "list broken: list missing: not found")
+
+	dir := newTestDir(t)
+	err = os.WriteFile(filepath.Join(dir, "cycle-a"), []byte("include:cycle-b\n"), 0o600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "cycle-b"), []byte("include:cycle-a\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = geosite.Load(dir)
+	assert.ErrorContains(t, err, "include cycle")
+
+	err = os.WriteFile(filepath.Join(dir, "cycle-b"), []byte("unknown:example.org\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = geosite.Load(dir)
+	assert.EqualError(t, err, `list cycle-b: line 1: unknown type "unknown"`)
+}
+
+// appendDomain appends a Domain message of the geosite.dat format to b.
+func appendDomain(b []byte, typ uint64, value string, attrs ...string) (res []byte) {
+	var d []byte
+	d = protowire.AppendTag(d, 1, protowire.VarintType)
+	d = protowire.AppendVarint(d, typ)
+	d = protowire.AppendTag(d, 2, protowire.BytesType)
+	d = protowire.AppendString(d, value)
+	for _, a := range attrs {
+		var attr []byte
+		attr = protowire.AppendTag(attr, 1, protowire.BytesType)
+		attr = protowire.AppendString(attr, a)
+		attr = protowire.AppendTag(attr, 2, protowire.VarintType)
+		attr = protowire.AppendVarint(attr, 1)
+
+		d = protowire.AppendTag(d, 3, protowire.BytesType)
+		d = protowire.AppendBytes(d, attr)
+	}
+
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+
+	return protowire.AppendBytes(b, d)
+}
+
+func TestLoad_dat(t *testing.T) {
+	var site []byte
+	site = protowire.AppendTag(site, 1, protowire.BytesType)
+	site = protowire.AppendString(site, "NETFLIX")
+	site = appendDomain(site, 0, "nflx")
+	site = appendDomain(site, 1, `^nflx\.example$`)
+	site = appendDomain(site, 2, "netflix.com", "cdn")
+	site = appendDomain(site, 3, "www.netflix.net")
+
+	var dat []byte
+	dat = protowire.AppendTag(dat, 1, protowire.BytesType)
+	dat = protowire.AppendBytes(dat, site)
+
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	err := os.WriteFile(path, dat, 0o600)
+	require.NoError(t, err)
+
+	s, err := geosite.Load(path)
+	require.NoError(t, err)
+
+	patterns, err := s.Patterns("netflix")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"keyword:nflx",
+		`regexp:^nflx\.example$`,
+		"domain:netflix.com",
+		"full:www.netflix.net",
+	}, patterns)
+
+	patterns, err = s.Patterns("netflix@cdn")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"domain:netflix.com"}, patterns)
+
+	err = os.WriteFile(path, dat[:len(dat)-1], 0o600)
+	require.NoError(t, err)
+
+	_, err = geosite.Load(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package geosite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// textList is a list from a domain-list-community text file before its
+// includes are resolved.
+type textList struct {
+	// domains are the entries of the list itself.
+	domains []*domain
+
+	// includes are the included lists.
+	includes []*include
+}
+
+// include is an "include:" line of a text file.
+type include struct {
+	// name is the lowercased name of the included list.
+	name string
+
+	// attrs are the attributes the included entries must have.
+	attrs []string
+
+	// noAttrs are the attributes the included entries must not have.
+	noAttrs []string
+}
+
+// match returns true if the entry included from the list matches the
+// attribute filters of inc.
+func (inc *include) match(d *domain) (ok bool) {
+	if !hasAttrs(d, inc.attrs) {
+		return false
+	}
+
+	for _, a := range inc.noAttrs {
+		if hasAttrs(d, []string{a}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadDir loads the lists from the text files in the data directory of
+// domain-list-community.  The name of a file is the name of its list.
+func loadDir(dir string) (s *Sites, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]*textList{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		name := e.Name()
+		raw[strings.ToLower(name)], err = readTextFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", name, err)
+		}
+	}
+
+	s = &Sites{
+		lists: make(map[string][]*domain, len(raw)),
+	}
+
+	for name := range raw {
+		_, err = s.resolve(raw, name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// readTextFile reads the text file with a list.
+func readTextFile(path string) (l *textList, err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return parseText(f)
+}
+
+// parseText parses a list in the domain-list-community text format.
+func parseText(r io.Reader) (l *textList, err error) {
+	l = &textList{}
+
+	sc := bufio.NewScanner(r)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		err = l.parseLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+
+	return l, sc.Err()
+}
+
+// parseLine parses the fields of a line of a text list and adds the result to
+// l.
+func (l *textList) parseLine(fields []string) (err error) {
+	var attrs []string
+	for _, f := range fields[1:] {
+		// Skip other tokens, such as affiliations starting with "&".
+		if a, ok := strings.CutPrefix(f, "@"); ok && a != "" {
+			attrs = append(attrs, a)
+		}
+	}
+
+	typ, value, ok := strings.Cut(fields[0], ":")
+	if !ok {
+		typ, value = "domain", fields[0]
+	}
+
+	if value == "" {
+		return fmt.Errorf("empty value in %q", fields[0])
+	}
+
+	d := &domain{
+		value: strings.ToLower(value),
+		attrs: attrs,
+	}
+
+	switch typ {
+	case "include":
+		l.includes = append(l.includes, newInclude(d.value, attrs))
+
+		return nil
+	case "domain":
+		d.typ = domainTypeDomain
+	case "full":
+		d.typ = domainTypeFull
+	case "keyword":
+		d.typ = domainTypeKeyword
+	case "regexp":
+		d.typ, d.value = domainTypeRegexp, value
+	default:
+		return fmt.Errorf("unknown type %q", typ)
+	}
+
+	l.domains = append(l.domains, d)
+
+	return nil
+}
+
+// newInclude returns an include of the list with the name and the attribute
+// filters, where "-attr" means that the entries must not have the attribute.
+func newInclude(name string, filters []string) (inc *include) {
+	inc = &include{
+		name: name,
+	}
+
+	for _, f := range filters {
+		if a, ok := strings.CutPrefix(f, "-"); ok {
+			inc.noAttrs = append(inc.noAttrs, a)
+		} else {
+			inc.attrs = append(inc.attrs, f)
+		}
+	}
+
+	return inc
+}
+
+// resolve returns the entries of the list with the name including the
+// entries of the included lists and stores them in s.  stack contains the
+// names of the lists that are being resolved and is used to detect cycles.
+func (s *Sites) resolve(
+	raw map[string]*textList,
+	name string,
+	stack []string,
+) (domains []*domain, err error) {
+	if resolved, ok := s.lists[name]; ok {
+		return resolved, nil
+	}
+
+	if slices.Contains(stack, name) {
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, name), " -> "))
+	}
+
+	l, ok := raw[name]
+	if !ok {
+		return nil, fmt.Errorf("list %s: not found", name)
+	}
+
+	domains = append(domains, l.domains...)
+	for _, inc := range l.includes {
+		var included []*domain
+		included, err = s.resolve(raw, inc.name, append(stack, name))
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", name, err)
+		}
+
+		for _, d := range included {
+			if inc.match(d) {
+				domains = append(domains, d)
+			}
+		}
+	}
+
+	s.lists[name] = domains
+
+	return domains, nil
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// aclRejectionsTotal is the total number of client connections rejected by the
+// client allowlists and denylists.
+var aclRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "acl_rejections_total",
+	Help:      "The total number of connections rejected by the client allowlists and denylists.",
+}, []string{"reason"})
+
+// ACLRejectionsInc increments the number of connections rejected for the
+// reason, which is "denylist", "allowlist", "rule_denylist", or
+// "rule_allowlist".
+func ACLRejectionsInc(reason string) {
+	aclRejectionsTotal.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ActiveConnectionsTotal is a gauge with the number of client connections the
+// relay is currently handling, including the ones that are not tunneled yet.
+var ActiveConnectionsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "active_conns_num",
+	Help:      "The number of client connections the relay is handling.",
+})
+
+// DrainingConnectionsTotal is a gauge with the number of connections the
+// relay is waiting for during shutdown.
+var DrainingConnectionsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "draining_conns_num",
+	Help:      "The number of connections the relay is waiting for during shutdown.",
+})
+
+// shutdownConnsTotal is the total number of connections that were active
+// when the relay was shutting down.
+var shutdownConnsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "shutdown_conns_total",
+	Help:      "The total number of connections active on shutdown by how they finished.",
+}, []string{"forced"})
+
+// ShutdownConnsAdd adds n to the number of connections that were active on
+// shutdown.  forced is true if the connections were closed after the grace
+// period has expired.
+func ShutdownConnsAdd(n int, forced bool) {
+	shutdownConnsTotal.WithLabelValues(boolLabel(forced)).Add(float64(n))
+}
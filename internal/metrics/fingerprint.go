@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxFingerprints is the maximum number of distinct JA4 fingerprints used as
+// label values of [tlsFingerprintsTotal].  Fingerprints seen after that are
+// counted as [fingerprintOther] so that the metric cardinality stays bounded.
+const maxFingerprints = 1000
+
+// fingerprintOther is the label value for fingerprints that exceed the
+// [maxFingerprints] limit.
+const fingerprintOther = "other"
+
+// tlsFingerprintsTotal is a counter with the number of TLS connections by
+// their JA4 fingerprint.
+var tlsFingerprintsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "tls_fingerprints_total",
+	Help:      "The total number of TLS connections by their JA4 fingerprint.",
+}, []string{"ja4", "blocked"})
+
+// fingerprintsMu protects fingerprints.
+var fingerprintsMu = &sync.Mutex{}
+
+// fingerprints is the set of JA4 fingerprints that are used as label values.
+var fingerprints = container.NewMapSet[string]()
+
+// TLSFingerprintsInc increments the number of connections with the JA4
+// fingerprint.  blocked is true if the connection was not allowed because of
+// its fingerprint.
+func TLSFingerprintsInc(ja4 string, blocked bool) {
+	blockedLabel := "0"
+	if blocked {
+		blockedLabel = "1"
+	}
+
+	tlsFingerprintsTotal.WithLabelValues(fingerprintLabel(ja4), blockedLabel).Inc()
+}
+
+// fingerprintLabel returns the label value for the fingerprint.
+func fingerprintLabel(ja4 string) (label string) {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+
+	if fingerprints.Has(ja4) {
+		return ja4
+	}
+
+	if fingerprints.Len() >= maxFingerprints {
+		return fingerprintOther
+	}
+
+	fingerprints.Add(ja4)
+
+	return ja4
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RateLimitedConnectionsTotal is the total number of client connections
+// rejected by the rate limit.
+var RateLimitedConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "ratelimited_conns_total",
+	Help:      "The total number of connections rejected by the rate limit.",
+})
+
+// limitRejectionsTotal is the total number of client connections rejected by
+// the connection limits.
+var limitRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "limit_rejections_total",
+	Help:      "The total number of connections rejected by the connection limits.",
+}, []string{"limit"})
+
+// LimitRejectionsInc increments the number of connections rejected by the
+// limit, which is "global", "client", "destination", or "quota".
+func LimitRejectionsInc(limit string) {
+	limitRejectionsTotal.WithLabelValues(limit).Inc()
+}
@@ -29,6 +29,14 @@ var QueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "The total number of DNS queries.",
 }, []string{"proto", "redirected"})
 
+// BlockedQueriesTotal is the total number of DNS queries for blocked domains.
+var BlockedQueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemDNS,
+	Name:      "blocked_queries_total",
+	Help:      "The total number of DNS queries for blocked domains.",
+}, []string{"proto"})
+
 // ConnectionsTotal is a gauge with the total number of active connections
 // to the service.
 var ConnectionsTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -38,6 +46,15 @@ var ConnectionsTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help:      "The total number of connections to the SNI relay service.",
 }, []string{"servername"})
 
+// BlockedConnectionsTotal is the total number of relay connections rejected
+// by block rules.
+var BlockedConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "blocked_conns_total",
+	Help:      "The total number of connections rejected by block rules.",
+})
+
 // BytesReceivedTotal is a counter that measures the number of bytes received
 // from a particular remote endpoint.
 var BytesReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
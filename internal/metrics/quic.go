@@ -0,0 +1,15 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// QUICFlowsDroppedTotal is the total number of new QUIC flows dropped because
+// the NAT table of the QUIC listener is full.
+var QUICFlowsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "quic_flows_dropped_total",
+	Help:      "The total number of new QUIC flows dropped because the NAT table is full.",
+})
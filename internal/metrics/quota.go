@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// QuotaClosedConnsTotal is the total number of tunneled connections closed
+// because the traffic quota of their client was exhausted.
+var QuotaClosedConnsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "quota_closed_conns_total",
+	Help:      "The total number of connections closed because the traffic quota was exhausted.",
+})
+
+// QuotaWriteErrorsTotal is the total number of failed writes of the traffic
+// usage to the quota database.
+var QuotaWriteErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "quota_write_errors_total",
+	Help:      "The total number of failed writes of the traffic usage to the quota database.",
+})
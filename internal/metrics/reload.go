@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RulesTotal is a gauge with the current number of domain rules including the
+// rules loaded from list files.
+var RulesTotal = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystemApp,
+	Name:      "rules_num",
+	Help:      "The current number of domain rules.",
+})
+
+// rulesReloadsTotal is the total number of reloads of the domain rules after
+// their list files have changed.
+var rulesReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemApp,
+	Name:      "rules_reloads_total",
+	Help:      "The total number of domain rules reloads.",
+}, []string{"success"})
+
+// configReloadsTotal is the total number of reloads of the configuration
+// file.
+var configReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemApp,
+	Name:      "config_reloads_total",
+	Help:      "The total number of configuration file reloads.",
+}, []string{"success"})
+
+// RulesReloadsInc increments the number of domain rules reloads.
+func RulesReloadsInc(success bool) {
+	rulesReloadsTotal.WithLabelValues(boolLabel(success)).Inc()
+}
+
+// ConfigReloadsInc increments the number of configuration file reloads.
+func ConfigReloadsInc(success bool) {
+	configReloadsTotal.WithLabelValues(boolLabel(success)).Inc()
+}
+
+// boolLabel returns the label value for v.
+func boolLabel(v bool) (label string) {
+	if v {
+		return "1"
+	}
+
+	return "0"
+}
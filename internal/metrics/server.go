@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/service"
+	"github.com/ameshkov/snirelay/internal/sockets"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server is the HTTP server that serves the prometheus metrics at /metrics
+// and the health check at /health-check.
+type Server struct {
+	// mu protects listener.
+	mu *sync.Mutex
+
+	// srv is the HTTP server with the metrics handlers.
+	srv *http.Server
+
+	// listenConfig creates the listening socket.
+	listenConfig sockets.ListenConfig
+
+	// listener is nil if the server is not started.
+	listener net.Listener
+}
+
+// type check
+var _ service.Interface = (*Server)(nil)
+
+// NewServer returns a new metrics server that listens on addr.  lc creates the
+// listening socket, if it is nil, a default [net.ListenConfig] is used.
+func NewServer(addr string, lc sockets.ListenConfig) (s *Server) {
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+
+	mux := &http.ServeMux{}
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health-check", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "OK")
+	})
+
+	return &Server{
+		mu:           &sync.Mutex{},
+		listenConfig: lc,
+		srv: &http.Server{
+			Addr:         addr,
+			Handler:      mux,
+			ReadTimeout:  time.Minute,
+			WriteTimeout: time.Minute,
+		},
+	}
+}
+
+// Start implements the [service.Interface] interface for *Server.  It returns
+// after the listener is bound and serves the requests in a separate
+// goroutine.
+func (s *Server) Start(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return fmt.Errorf("server is already started")
+	}
+
+	s.listener, err = s.listenConfig.Listen(ctx, "tcp", s.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", s.srv.Addr, err)
+	}
+
+	log.Info("metrics: listening on %s", s.listener.Addr())
+
+	go s.serve(s.listener)
+
+	return nil
+}
+
+// serve serves the requests accepted by l until the server is shut down.
+func (s *Server) serve(l net.Listener) {
+	defer log.OnPanic("metrics.serve")
+
+	err := s.srv.Serve(l)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Error("metrics: serving on %s: %s", l.Addr(), err)
+	}
+}
+
+// Shutdown implements the [service.Interface] interface for *Server.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	s.listener = nil
+
+	log.Info("metrics: shutting down")
+
+	return s.srv.Shutdown(ctx)
+}
+
+// Addr returns the address the server listens on.  It returns nil if the
+// server is not started.
+func (s *Server) Addr() (addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil)
+	assert.Nil(t, s.Addr())
+
+	require.NoError(t, s.Start(context.Background()))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return s.Shutdown(context.Background())
+	})
+
+	require.Error(t, s.Start(context.Background()))
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/health-check")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, resp.Body.Close)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "OK", string(body))
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.Nil(t, s.Addr())
+}
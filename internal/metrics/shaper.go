@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// shapedBytesTotal is the total number of bytes that passed through the
+// bandwidth limits.
+var shapedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "shaped_bytes_total",
+	Help:      "The total number of bytes that passed through the bandwidth limits.",
+}, []string{"direction"})
+
+// throttleSecondsTotal is the total time the tunnels waited for the bandwidth
+// limits.
+var throttleSecondsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "throttle_seconds_total",
+	Help:      "The total time the tunnels waited for the bandwidth limits.",
+}, []string{"direction"})
+
+// directionLabel returns the label of the traffic direction: "sent" for the
+// traffic from the client to the remote server and "received" for the
+// traffic from the remote server to the client.
+func directionLabel(sent bool) (label string) {
+	if sent {
+		return "sent"
+	}
+
+	return "received"
+}
+
+// ShapedBytesAdd adds n to the number of bytes that passed through the
+// bandwidth limits.  sent is true for the traffic from the client.
+func ShapedBytesAdd(n int, sent bool) {
+	shapedBytesTotal.WithLabelValues(directionLabel(sent)).Add(float64(n))
+}
+
+// ThrottleTimeAdd adds d to the time the tunnels waited for the bandwidth
+// limits.  sent is true for the traffic from the client.
+func ThrottleTimeAdd(d time.Duration, sent bool) {
+	throttleSecondsTotal.WithLabelValues(directionLabel(sent)).Add(d.Seconds())
+}
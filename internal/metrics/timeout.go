@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SniffTimeoutsTotal is the total number of client connections closed because
+// the server name was not received in time.
+var SniffTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "sniff_timeouts_total",
+	Help:      "The total number of connections closed because the server name was not received in time.",
+})
+
+// DialTimeoutsTotal is the total number of connections to remote servers that
+// were not established in time.
+var DialTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "dial_timeouts_total",
+	Help:      "The total number of connections to remote servers that were not established in time.",
+})
+
+// IdleTimeoutsTotal is the total number of tunneled connections closed
+// because they had no traffic for the idle timeout.
+var IdleTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "idle_timeouts_total",
+	Help:      "The total number of tunneled connections closed because they were idle.",
+})
+
+// LifetimeTimeoutsTotal is the total number of tunneled connections closed
+// because they reached the maximum lifetime.
+var LifetimeTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystemRelay,
+	Name:      "lifetime_timeouts_total",
+	Help:      "The total number of tunneled connections closed because they reached the maximum lifetime.",
+})
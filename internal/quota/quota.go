@@ -0,0 +1,432 @@
+// Package quota keeps track of the traffic of the relay clients in the daily
+// and monthly periods and persists it in a local bbolt database.
+package quota
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/service"
+	"github.com/ameshkov/snirelay/internal/metrics"
+	"go.etcd.io/bbolt"
+)
+
+// DefaultFlushInterval is the default interval between writing the usage to
+// the database.
+const DefaultFlushInterval = 10 * time.Second
+
+// openTimeout is the time a flush waits for the lock of the database file,
+// which another snirelay process may be holding during an upgrade.
+const openTimeout = 5 * time.Second
+
+// Prefixes of the names of the database buckets.  The bucket of a period
+// contains the number of bytes of each client key, as a big-endian uint64.
+const (
+	bucketPrefixDay   = "day/"
+	bucketPrefixMonth = "month/"
+)
+
+// Formats of the periods in the bucket names.  The periods are in UTC.
+const (
+	dayFormat   = time.DateOnly
+	monthFormat = "2006-01"
+)
+
+// Usage is the traffic of a client in the current periods, in bytes.
+type Usage struct {
+	// Daily is the traffic of the current UTC day.
+	Daily uint64
+
+	// Monthly is the traffic of the current UTC month.
+	Monthly uint64
+}
+
+// Config is the configuration of a *Store.
+type Config struct {
+	// Path is the path to the database file.  It is created if it does not
+	// exist.
+	Path string
+
+	// FlushInterval is the interval between writing the usage to the
+	// database.  If zero, DefaultFlushInterval is used.
+	FlushInterval time.Duration
+}
+
+// Store keeps track of the traffic of the clients identified by string keys.
+// The traffic is kept in memory and periodically added to the database, which
+// is only opened for the time of the write.  This way the database can be
+// shared with another snirelay process, e.g. during an upgrade.
+type Store struct {
+	// mu protects day, stored, pending, and flushing.
+	mu *sync.Mutex
+
+	// flushMu serializes the flushes.
+	flushMu *sync.Mutex
+
+	// done is closed to stop the flush loop.  It is nil if the store is not
+	// started.
+	done chan struct{}
+
+	// wg keeps track of the flush loop.
+	wg *sync.WaitGroup
+
+	// stored is the usage in the database as of the last flush.  Its daily
+	// values are of day.
+	stored map[string]Usage
+
+	// pending is the traffic that has not been written to the database yet,
+	// by day and key.
+	pending map[string]map[string]uint64
+
+	// flushing is the pending traffic that is being written to the database.
+	// It is nil if no flush is in progress.
+	flushing map[string]map[string]uint64
+
+	// path is the path to the database file.
+	path string
+
+	// day is the current UTC day in dayFormat.
+	day string
+
+	// flushInterval is the interval between the flushes.
+	flushInterval time.Duration
+}
+
+// type check
+var _ service.Interface = (*Store)(nil)
+
+// New returns a new *Store.  The database is read when the store is started.
+func New(conf *Config) (s *Store) {
+	flushInterval := conf.FlushInterval
+	if flushInterval == 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
+	return &Store{
+		mu:            &sync.Mutex{},
+		flushMu:       &sync.Mutex{},
+		wg:            &sync.WaitGroup{},
+		stored:        map[string]Usage{},
+		pending:       map[string]map[string]uint64{},
+		path:          conf.Path,
+		flushInterval: flushInterval,
+	}
+}
+
+// Start implements the [service.Interface] interface for *Store.  It reads the
+// usage from the database and starts writing it periodically.
+func (s *Store) Start(_ context.Context) (err error) {
+	if s.done != nil {
+		return fmt.Errorf("store is already started")
+	}
+
+	log.Info("quota: reading usage from %s", s.path)
+
+	err = s.flush(time.Now())
+	if err != nil {
+		return err
+	}
+
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+
+	go s.flushLoop()
+
+	return nil
+}
+
+// Shutdown implements the [service.Interface] interface for *Store.  It
+// stops the periodic writes and writes the remaining usage to the database.
+func (s *Store) Shutdown(_ context.Context) (err error) {
+	if s.done == nil {
+		return nil
+	}
+
+	close(s.done)
+	s.wg.Wait()
+	s.done = nil
+
+	log.Info("quota: writing usage to %s", s.path)
+
+	return s.flush(time.Now())
+}
+
+// flushLoop writes the usage to the database until s.done is closed.
+func (s *Store) flushLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.flush(time.Now())
+			if err != nil {
+				log.Error("quota: %s", err)
+				metrics.QuotaWriteErrorsTotal.Inc()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Add adds n bytes to the traffic of key at now and returns the resulting
+// usage.
+func (s *Store) Add(key string, n uint64, now time.Time) (u Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(now)
+
+	keys := s.pending[s.day]
+	if keys == nil {
+		keys = map[string]uint64{}
+		s.pending[s.day] = keys
+	}
+
+	keys[key] += n
+
+	return s.usage(key)
+}
+
+// Usage returns the usage of key at now.
+func (s *Store) Usage(key string, now time.Time) (u Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(now)
+
+	return s.usage(key)
+}
+
+// usage returns the stored usage of key with the traffic of the current
+// periods that has not been written yet.  s.mu must be locked.
+func (s *Store) usage(key string) (u Usage) {
+	u = s.stored[key]
+	u = s.addPending(u, s.pending, key)
+	u = s.addPending(u, s.flushing, key)
+
+	return u
+}
+
+// addPending returns u with the traffic of key from pending that belongs to
+// the current periods.  s.mu must be locked.
+func (s *Store) addPending(u Usage, pending map[string]map[string]uint64, key string) (res Usage) {
+	month := monthOf(s.day)
+	for day, keys := range pending {
+		if day == s.day {
+			u.Daily += keys[key]
+		}
+
+		if monthOf(day) == month {
+			u.Monthly += keys[key]
+		}
+	}
+
+	return u
+}
+
+// rotate resets the stored usage of the periods that have ended by now.  s.mu
+// must be locked.
+func (s *Store) rotate(now time.Time) {
+	day := now.UTC().Format(dayFormat)
+	if day == s.day {
+		return
+	}
+
+	if monthOf(day) != monthOf(s.day) {
+		clear(s.stored)
+	} else {
+		for key, u := range s.stored {
+			s.stored[key] = Usage{Monthly: u.Monthly}
+		}
+	}
+
+	s.day = day
+}
+
+// flush adds the pending traffic to the database, removes the periods that
+// have ended by now from it, and reads the usage of the current periods.  If
+// the database cannot be written, the traffic stays pending.
+func (s *Store) flush(now time.Time) (err error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	s.rotate(now)
+	day, pending := s.day, s.pending
+	s.pending, s.flushing = map[string]map[string]uint64{}, pending
+	s.mu.Unlock()
+
+	stored, err := s.write(day, pending)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flushing = nil
+	if err != nil {
+		s.restorePending(pending)
+
+		return fmt.Errorf("writing usage to %s: %w", s.path, err)
+	}
+
+	// The day may have changed during the write, in which case the usage
+	// read is outdated and is updated by the next flush.
+	if s.day == day {
+		s.stored = stored
+	}
+
+	return nil
+}
+
+// restorePending adds the traffic that has not been written back to the
+// pending one.  s.mu must be locked.
+func (s *Store) restorePending(pending map[string]map[string]uint64) {
+	for day, keys := range pending {
+		cur := s.pending[day]
+		if cur == nil {
+			s.pending[day] = keys
+
+			continue
+		}
+
+		for key, n := range keys {
+			cur[key] += n
+		}
+	}
+}
+
+// write opens the database, adds pending to it, removes the periods other than
+// day and its month, and returns the usage of the current periods.
+func (s *Store) write(
+	day string,
+	pending map[string]map[string]uint64,
+) (stored map[string]Usage, err error) {
+	db, err := bbolt.Open(s.path, 0o600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, db.Close()) }()
+
+	stored = map[string]Usage{}
+	err = db.Update(func(tx *bbolt.Tx) (txErr error) {
+		for pendingDay, keys := range pending {
+			txErr = addUsage(tx, bucketPrefixDay+pendingDay, keys)
+			if txErr != nil {
+				return txErr
+			}
+
+			txErr = addUsage(tx, bucketPrefixMonth+monthOf(pendingDay), keys)
+			if txErr != nil {
+				return txErr
+			}
+		}
+
+		txErr = removeEnded(tx, day)
+		if txErr != nil {
+			return txErr
+		}
+
+		readUsage(tx, bucketPrefixDay+day, func(key string, n uint64) {
+			u := stored[key]
+			u.Daily = n
+			stored[key] = u
+		})
+
+		readUsage(tx, bucketPrefixMonth+monthOf(day), func(key string, n uint64) {
+			u := stored[key]
+			u.Monthly = n
+			stored[key] = u
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// addUsage adds the traffic of keys to the bucket with the name.
+func addUsage(tx *bbolt.Tx, name string, keys map[string]uint64) (err error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return fmt.Errorf("creating bucket %q: %w", name, err)
+	}
+
+	for key, n := range keys {
+		k := []byte(key)
+		if v := b.Get(k); len(v) == 8 {
+			n += binary.BigEndian.Uint64(v)
+		}
+
+		err = b.Put(k, binary.BigEndian.AppendUint64(nil, n))
+		if err != nil {
+			return fmt.Errorf("writing usage of %q to bucket %q: %w", key, name, err)
+		}
+	}
+
+	return nil
+}
+
+// removeEnded removes the buckets of the periods other than day and its
+// month.
+func removeEnded(tx *bbolt.Tx, day string) (err error) {
+	current := []string{bucketPrefixDay + day, bucketPrefixMonth + monthOf(day)}
+
+	var ended []string
+	err = tx.ForEach(func(name []byte, _ *bbolt.Bucket) (_ error) {
+		n := string(name)
+		if n != current[0] && n != current[1] &&
+			(strings.HasPrefix(n, bucketPrefixDay) || strings.HasPrefix(n, bucketPrefixMonth)) {
+			ended = append(ended, n)
+		}
+
+		return nil
+	})
+	if err != nil {
+		// Should not happen, since the callback never returns an error.
+		return fmt.Errorf("listing buckets: %w", err)
+	}
+
+	for _, n := range ended {
+		err = tx.DeleteBucket([]byte(n))
+		if err != nil {
+			return fmt.Errorf("deleting bucket %q: %w", n, err)
+		}
+	}
+
+	return nil
+}
+
+// readUsage calls f for each key in the bucket with the name, if it exists.
+func readUsage(tx *bbolt.Tx, name string, f func(key string, n uint64)) {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return
+	}
+
+	// The callback never returns an error.
+	_ = b.ForEach(func(k, v []byte) (_ error) {
+		if len(v) == 8 {
+			f(string(k), binary.BigEndian.Uint64(v))
+		}
+
+		return nil
+	})
+}
+
+// monthOf returns the month of day in monthFormat.  day must be in dayFormat
+// or empty.
+func monthOf(day string) (month string) {
+	return day[:min(len(day), len(monthFormat))]
+}
@@ -0,0 +1,78 @@
+package quota
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	const key = "ip:192.0.2.1"
+
+	path := filepath.Join(t.TempDir(), "quotas.db")
+	day := time.Date(2024, time.May, 31, 12, 0, 0, 0, time.UTC)
+	nextDay := day.Add(24 * time.Hour)
+	sameMonth := day.Add(-24 * time.Hour)
+
+	// newStore returns a store of path that has read the database at now.
+	newStore := func(t *testing.T, now time.Time) (s *Store) {
+		t.Helper()
+
+		s = New(&Config{Path: path})
+		require.NoError(t, s.flush(now))
+
+		return s
+	}
+
+	s := newStore(t, sameMonth)
+	s.Add(key, 100, sameMonth)
+	require.NoError(t, s.flush(sameMonth))
+
+	s = newStore(t, day)
+	assert.Equal(t, Usage{Daily: 0, Monthly: 100}, s.Usage(key, day))
+	assert.Equal(t, Usage{Daily: 10, Monthly: 110}, s.Add(key, 10, day))
+
+	// Another process shares the database.
+	other := newStore(t, day)
+	other.Add(key, 5, day)
+	require.NoError(t, other.flush(day))
+
+	require.NoError(t, s.flush(day))
+	assert.Equal(t, Usage{Daily: 15, Monthly: 115}, s.Usage(key, day))
+	assert.Equal(t, Usage{}, s.Usage("ip:192.0.2.2", day))
+
+	// The traffic is pending until it is written.
+	s.Add(key, 1, day)
+	assert.Equal(t, Usage{Daily: 16, Monthly: 116}, s.Usage(key, day))
+
+	// The periods are reset in the next month.
+	assert.Equal(t, Usage{}, s.Usage(key, nextDay))
+
+	// The traffic of the previous day is written to its periods.
+	require.NoError(t, s.flush(nextDay))
+	assert.Equal(t, Usage{}, s.Usage(key, nextDay))
+
+	s = newStore(t, day)
+	assert.Equal(t, Usage{}, s.Usage(key, day), "ended periods must be removed")
+}
+
+func TestStore_startShutdown(t *testing.T) {
+	const key = "user:test"
+
+	path := filepath.Join(t.TempDir(), "quotas.db")
+	s := New(&Config{Path: path, FlushInterval: time.Hour})
+	require.NoError(t, s.Start(context.Background()))
+
+	s.Add(key, 42, time.Now())
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	s = New(&Config{Path: path})
+	require.NoError(t, s.Start(context.Background()))
+	t.Cleanup(func() { require.NoError(t, s.Shutdown(context.Background())) })
+
+	assert.Equal(t, uint64(42), s.Usage(key, time.Now()).Daily)
+}
@@ -0,0 +1,109 @@
+// Package ratelimit limits the rate of the requests from the client subnets.
+package ratelimit
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Prefix lengths of the client subnets the rate limit applies to.
+const (
+	SubnetLenIPv4 = 24
+	SubnetLenIPv6 = 56
+)
+
+// sweepInterval is the minimum interval between removing the full buckets
+// from the rate limiter.
+const sweepInterval = time.Minute
+
+// tokenBucket is the token bucket of a client subnet.
+type tokenBucket struct {
+	// updated is the time tokens were last updated.
+	updated time.Time
+
+	// tokens is the number of the available tokens at updated.
+	tokens float64
+}
+
+// Limiter limits the rate of the requests from the client subnets with token
+// buckets.
+type Limiter struct {
+	// mu protects buckets and swept.
+	mu *sync.Mutex
+
+	// buckets are the token buckets of the client subnets.  The buckets that
+	// are full are removed periodically, since they are the same as the new
+	// ones.
+	buckets map[netip.Prefix]*tokenBucket
+
+	// swept is the time the full buckets were last removed.
+	swept time.Time
+}
+
+// NewLimiter returns a new properly initialized *Limiter.
+func NewLimiter() (l *Limiter) {
+	return &Limiter{
+		mu:      &sync.Mutex{},
+		buckets: map[netip.Prefix]*tokenBucket{},
+	}
+}
+
+// Allow takes a token from the bucket of subnet at now.  The bucket is
+// refilled at rate tokens per second up to burst tokens.  ok is false if there
+// are no tokens available.
+func (l *Limiter) Allow(subnet netip.Prefix, rate, burst float64, now time.Time) (ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(rate, burst, now)
+	}
+
+	b, found := l.buckets[subnet]
+	if !found {
+		b = &tokenBucket{
+			tokens: burst,
+		}
+		l.buckets[subnet] = b
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// sweep removes the buckets that are full at now.  l.mu must be locked.
+func (l *Limiter) sweep(rate, burst float64, now time.Time) {
+	for subnet, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*rate >= burst {
+			delete(l.buckets, subnet)
+		}
+	}
+
+	l.swept = now
+}
+
+// Subnet returns the subnet of addr the rate limit applies to.
+func Subnet(addr netip.Addr) (subnet netip.Prefix) {
+	addr = addr.Unmap()
+
+	bits := SubnetLenIPv6
+	if addr.Is4() {
+		bits = SubnetLenIPv4
+	}
+
+	// The error is only returned for invalid addresses, the zero prefix is
+	// used for them.
+	subnet, _ = addr.Prefix(bits)
+
+	return subnet
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	l := NewLimiter()
+
+	const (
+		rate  = 2
+		burst = 3
+	)
+
+	subnet := netip.MustParsePrefix("192.0.2.0/24")
+	other := netip.MustParsePrefix("198.51.100.0/24")
+	now := time.Unix(0, 0)
+
+	for range burst {
+		assert.True(t, l.Allow(subnet, rate, burst, now))
+	}
+
+	assert.False(t, l.Allow(subnet, rate, burst, now))
+	assert.True(t, l.Allow(other, rate, burst, now))
+
+	// Half a second gives one token at the rate of two per second.
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow(subnet, rate, burst, now))
+	assert.False(t, l.Allow(subnet, rate, burst, now))
+
+	// The full buckets are removed.
+	now = now.Add(sweepInterval)
+	assert.True(t, l.Allow(subnet, rate, burst, now))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestSubnet(t *testing.T) {
+	testCases := []struct {
+		name string
+		addr netip.Addr
+		want netip.Prefix
+	}{{
+		name: "ipv4",
+		addr: netip.MustParseAddr("192.0.2.1"),
+		want: netip.MustParsePrefix("192.0.2.0/24"),
+	}, {
+		name: "ipv4_mapped",
+		addr: netip.MustParseAddr("::ffff:192.0.2.1"),
+		want: netip.MustParsePrefix("192.0.2.0/24"),
+	}, {
+		name: "ipv6",
+		addr: netip.MustParseAddr("2001:db8:1:2ff::1"),
+		want: netip.MustParsePrefix("2001:db8:1:200::/56"),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, Subnet(tc.addr))
+		})
+	}
+}
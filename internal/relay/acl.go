@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/metrics"
+)
+
+// Reasons of the client rejections by the allowlists and denylists used in
+// logs and metrics.
+const (
+	aclReasonDenylist      = "denylist"
+	aclReasonAllowlist     = "allowlist"
+	aclReasonRuleDenylist  = "rule_denylist"
+	aclReasonRuleAllowlist = "rule_allowlist"
+)
+
+// clientRejectReason returns the reason to reject the client with addr by the
+// global allowlist and denylist or an empty string if it is allowed.
+func (st *settings) clientRejectReason(addr netip.Addr) (reason string) {
+	return aclRejectReason(
+		st.clientAllowlist,
+		st.clientDenylist,
+		addr,
+		aclReasonDenylist,
+		aclReasonAllowlist,
+	)
+}
+
+// clientRejectReason returns the reason to reject the client with addr by the
+// allowlist and denylist of the rule or an empty string if it is allowed.
+func (r *Rule) clientRejectReason(addr netip.Addr) (reason string) {
+	return aclRejectReason(
+		r.ClientAllowlist,
+		r.ClientDenylist,
+		addr,
+		aclReasonRuleDenylist,
+		aclReasonRuleAllowlist,
+	)
+}
+
+// aclRejectReason returns denied if one of deny contains addr, notAllowed if
+// allow is not empty and none of it contains addr, and an empty string
+// otherwise.
+func aclRejectReason(
+	allow []netip.Prefix,
+	deny []netip.Prefix,
+	addr netip.Addr,
+	denied string,
+	notAllowed string,
+) (reason string) {
+	addr = addr.Unmap()
+	if containsAddr(deny, addr) {
+		return denied
+	}
+
+	if len(allow) > 0 && !containsAddr(allow, addr) {
+		return notAllowed
+	}
+
+	return ""
+}
+
+// clientRejected returns true if reason is not empty, in which case the
+// rejection of the client with clientAddr is logged and counted.
+func clientRejected(clientAddr net.Addr, reason string) (rejected bool) {
+	if reason == "" {
+		return false
+	}
+
+	log.Debug("relay: %s: client rejected by %s", clientAddr, reason)
+	metrics.ACLRejectionsInc(reason)
+
+	return true
+}
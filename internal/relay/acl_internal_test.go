@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings_clientRejectReason(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	testCases := []struct {
+		name  string
+		want  string
+		allow []netip.Prefix
+		deny  []netip.Prefix
+	}{{
+		name: "empty",
+		want: "",
+	}, {
+		name:  "allowed",
+		want:  "",
+		allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}, {
+		name:  "not_allowed",
+		want:  aclReasonAllowlist,
+		allow: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+	}, {
+		name: "denied",
+		want: aclReasonDenylist,
+		deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")},
+	}, {
+		name:  "denied_and_allowed",
+		want:  aclReasonDenylist,
+		allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		deny:  []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &settings{
+				clientAllowlist: tc.allow,
+				clientDenylist:  tc.deny,
+			}
+
+			assert.Equal(t, tc.want, st.clientRejectReason(addr))
+		})
+	}
+
+	t.Run("mapped", func(t *testing.T) {
+		st := &settings{
+			clientDenylist: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		}
+
+		mapped := netip.AddrFrom16(addr.As16())
+		assert.Equal(t, aclReasonDenylist, st.clientRejectReason(mapped))
+	})
+}
+
+func TestRule_clientRejectReason(t *testing.T) {
+	r := &Rule{
+		Pattern:         "*.example.org",
+		ClientAllowlist: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		ClientDenylist:  []netip.Prefix{netip.MustParsePrefix("192.0.2.128/25")},
+	}
+
+	assert.Empty(t, r.clientRejectReason(netip.MustParseAddr("192.0.2.1")))
+	assert.Equal(t, aclReasonRuleDenylist, r.clientRejectReason(netip.MustParseAddr("192.0.2.129")))
+	assert.Equal(
+		t,
+		aclReasonRuleAllowlist,
+		r.clientRejectReason(netip.MustParseAddr("198.51.100.1")),
+	)
+}
@@ -0,0 +1,403 @@
+package relay
+
+import (
+	"encoding/binary"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// TLS wire format constants that are used by the ClientHello parser.
+const (
+	// recordTypeHandshake is the TLS record content type for handshake
+	// messages.
+	recordTypeHandshake = 22
+
+	// recordHeaderLen is the length of the TLS record header: content type,
+	// legacy version and length.
+	recordHeaderLen = 5
+
+	// maxRecordLen is the maximum length of a TLS record payload we accept.
+	// RFC 8446 limits plaintext records to 2^14 bytes, but crypto/tls allows
+	// some slack, and so do we.
+	maxRecordLen = 16384 + 2048
+
+	// maxClientHelloLen is the maximum length of a ClientHello handshake
+	// message including its header that the relay is willing to reassemble.
+	// crypto/tls uses the same limit.
+	maxClientHelloLen = 65536
+
+	// maxPeekLen is the maximum number of bytes the relay reads while looking
+	// for the ClientHello.  It is larger than maxClientHelloLen to allow for
+	// the headers of fragmented records.
+	maxPeekLen = 2 * maxClientHelloLen
+
+	// handshakeTypeClientHello is the handshake message type of ClientHello.
+	handshakeTypeClientHello = 1
+
+	// handshakeHeaderLen is the length of the handshake message header:
+	// message type and uint24 length.
+	handshakeHeaderLen = 4
+
+	// randomLen is the length of the ClientHello random field.
+	randomLen = 32
+)
+
+// TLS extension types that are used by the ClientHello parser.
+const (
+	extServerName          uint16 = 0
+	extSupportedGroups     uint16 = 10
+	extSupportedPoints     uint16 = 11
+	extSignatureAlgorithms uint16 = 13
+	extALPN                uint16 = 16
+	extSupportedVersions   uint16 = 43
+)
+
+// serverNameTypeHostName is the only defined SNI name type, see RFC 6066.
+const serverNameTypeHostName = 0
+
+// Errors returned by the ClientHello parser.  They are constants so that
+// parsing never allocates.
+const (
+	errNotHandshake   errors.Error = "not a tls handshake record"
+	errNotClientHello errors.Error = "not a tls clienthello message"
+	errRecordTooLarge errors.Error = "tls record is too large"
+	errHelloTooLarge  errors.Error = "tls clienthello is too large"
+	errMalformed      errors.Error = "malformed tls clienthello"
+)
+
+// clientHello is a parsed TLS ClientHello message.  Every byte slice in it
+// points into the original message, so parsing does not allocate.  Use the
+// methods to get the decoded values.
+type clientHello struct {
+	// random is the 32-byte client random.
+	random []byte
+
+	// sessionID is the legacy session ID.
+	sessionID []byte
+
+	// rawCipherSuites is the list of big-endian uint16 cipher suites.
+	rawCipherSuites []byte
+
+	// compressionMethods is the list of legacy compression methods.
+	compressionMethods []byte
+
+	// rawExtensions is the whole extensions block, it is nil if the message
+	// has no extensions.
+	rawExtensions []byte
+
+	// rawServerName is the host_name from the server_name extension.
+	rawServerName []byte
+
+	// rawALPN is the ProtocolNameList from the ALPN extension.
+	rawALPN []byte
+
+	// rawSupportedVersions is the list of big-endian uint16 versions from
+	// the supported_versions extension.
+	rawSupportedVersions []byte
+
+	// rawSupportedGroups is the list of big-endian uint16 named groups from
+	// the supported_groups extension.
+	rawSupportedGroups []byte
+
+	// rawSupportedPoints is the list of EC point formats.
+	rawSupportedPoints []byte
+
+	// rawSignatureSchemes is the list of big-endian uint16 signature schemes
+	// from the signature_algorithms extension.
+	rawSignatureSchemes []byte
+
+	// vers is the legacy_version field of the ClientHello.
+	vers uint16
+}
+
+// parseClientHello parses the handshake message msg, which must include the
+// 4-byte handshake header, into hello.  It does not allocate and hello keeps
+// references to msg, so msg must not be modified while hello is in use.
+func parseClientHello(hello *clientHello, msg []byte) (err error) {
+	*hello = clientHello{}
+
+	if len(msg) < handshakeHeaderLen || msg[0] != handshakeTypeClientHello {
+		return errNotClientHello
+	}
+
+	msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg)-handshakeHeaderLen != msgLen {
+		return errMalformed
+	}
+
+	s := msg[handshakeHeaderLen:]
+
+	var ok bool
+	if hello.vers, s, ok = readUint16(s); !ok {
+		return errMalformed
+	}
+
+	if len(s) < randomLen {
+		return errMalformed
+	}
+	hello.random, s = s[:randomLen], s[randomLen:]
+
+	if hello.sessionID, s, ok = readUint8Prefixed(s); !ok {
+		return errMalformed
+	}
+
+	hello.rawCipherSuites, s, ok = readUint16Prefixed(s)
+	if !ok || len(hello.rawCipherSuites)%2 != 0 {
+		return errMalformed
+	}
+
+	if hello.compressionMethods, s, ok = readUint8Prefixed(s); !ok {
+		return errMalformed
+	}
+
+	if len(s) == 0 {
+		// Extensions are optional in TLS 1.2 and older.
+		return nil
+	}
+
+	if hello.rawExtensions, s, ok = readUint16Prefixed(s); !ok || len(s) != 0 {
+		return errMalformed
+	}
+
+	err = hello.parseExtensions()
+	if err != nil {
+		// Do not let the callers use partially parsed data.
+		*hello = clientHello{}
+	}
+
+	return err
+}
+
+// parseExtensions parses the extensions that clientHello keeps track of.
+// Unknown extensions are skipped.
+func (hello *clientHello) parseExtensions() (err error) {
+	s := hello.rawExtensions
+	for len(s) > 0 {
+		var extType uint16
+		var data []byte
+		var ok bool
+		if extType, s, ok = readUint16(s); !ok {
+			return errMalformed
+		}
+
+		if data, s, ok = readUint16Prefixed(s); !ok {
+			return errMalformed
+		}
+
+		switch extType {
+		case extServerName:
+			ok = hello.parseServerName(data)
+		case extALPN:
+			hello.rawALPN, ok = readWholeUint16Prefixed(data)
+			ok = ok && validALPN(hello.rawALPN)
+		case extSupportedVersions:
+			hello.rawSupportedVersions, ok = readWholeUint8Prefixed(data)
+			ok = ok && len(hello.rawSupportedVersions)%2 == 0
+		case extSupportedGroups:
+			hello.rawSupportedGroups, ok = readWholeUint16Prefixed(data)
+			ok = ok && len(hello.rawSupportedGroups)%2 == 0
+		case extSupportedPoints:
+			hello.rawSupportedPoints, ok = readWholeUint8Prefixed(data)
+		case extSignatureAlgorithms:
+			hello.rawSignatureSchemes, ok = readWholeUint16Prefixed(data)
+			ok = ok && len(hello.rawSignatureSchemes)%2 == 0
+		default:
+			ok = true
+		}
+
+		if !ok {
+			return errMalformed
+		}
+	}
+
+	return nil
+}
+
+// parseServerName parses the server_name extension data and saves the
+// host_name entry.  Like crypto/tls, it rejects empty names, more than one
+// host_name, and a host_name with a trailing dot, see RFC 6066.
+func (hello *clientHello) parseServerName(data []byte) (ok bool) {
+	list, ok := readWholeUint16Prefixed(data)
+	if !ok {
+		return false
+	}
+
+	for len(list) > 0 {
+		nameType := list[0]
+
+		var name []byte
+		if name, list, ok = readUint16Prefixed(list[1:]); !ok || len(name) == 0 {
+			return false
+		}
+
+		if nameType != serverNameTypeHostName {
+			continue
+		}
+
+		if hello.rawServerName != nil || name[len(name)-1] == '.' {
+			return false
+		}
+
+		hello.rawServerName = name
+	}
+
+	return true
+}
+
+// validALPN returns true if list is a well-formed ALPN ProtocolNameList.
+func validALPN(list []byte) (ok bool) {
+	for len(list) > 0 {
+		var proto []byte
+		if proto, list, ok = readUint8Prefixed(list); !ok || len(proto) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serverName returns the host name from the server_name extension or an empty
+// string if there is none.
+func (hello *clientHello) serverName() (name string) {
+	return string(hello.rawServerName)
+}
+
+// cipherSuites returns the cipher suites offered by the client.
+func (hello *clientHello) cipherSuites() (suites []uint16) {
+	return uint16List(hello.rawCipherSuites)
+}
+
+// supportedGroups returns the named groups from the supported_groups
+// extension.
+func (hello *clientHello) supportedGroups() (groups []uint16) {
+	return uint16List(hello.rawSupportedGroups)
+}
+
+// supportedPoints returns the EC point formats from the ec_point_formats
+// extension.
+func (hello *clientHello) supportedPoints() (points []uint8) {
+	if len(hello.rawSupportedPoints) == 0 {
+		return nil
+	}
+
+	return append([]uint8(nil), hello.rawSupportedPoints...)
+}
+
+// signatureSchemes returns the signature schemes from the
+// signature_algorithms extension.
+func (hello *clientHello) signatureSchemes() (schemes []uint16) {
+	return uint16List(hello.rawSignatureSchemes)
+}
+
+// alpnProtocols returns the protocols from the ALPN extension.
+func (hello *clientHello) alpnProtocols() (protos []string) {
+	for list, ok := hello.rawALPN, true; len(list) > 0 && ok; {
+		var proto []byte
+		proto, list, ok = readUint8Prefixed(list)
+		protos = append(protos, string(proto))
+	}
+
+	return protos
+}
+
+// supportedVersions returns the TLS versions supported by the client.  If
+// there is no supported_versions extension, the versions are derived from the
+// legacy version field the same way crypto/tls does.
+func (hello *clientHello) supportedVersions() (versions []uint16) {
+	if len(hello.rawSupportedVersions) > 0 {
+		return uint16List(hello.rawSupportedVersions)
+	}
+
+	for _, v := range []uint16{0x0304, 0x0303, 0x0302, 0x0301} {
+		if v <= hello.vers {
+			versions = append(versions, v)
+		}
+	}
+
+	return versions
+}
+
+// extensionTypes returns the types of all extensions in the order they were
+// sent by the client.
+func (hello *clientHello) extensionTypes() (types []uint16) {
+	s := hello.rawExtensions
+	for len(s) >= 2 {
+		extType := binary.BigEndian.Uint16(s)
+
+		var ok bool
+		if _, s, ok = readUint16Prefixed(s[2:]); !ok {
+			break
+		}
+
+		types = append(types, extType)
+	}
+
+	return types
+}
+
+// uint16List decodes b as a list of big-endian uint16 values.
+func uint16List(b []byte) (list []uint16) {
+	if len(b) < 2 {
+		return nil
+	}
+
+	list = make([]uint16, 0, len(b)/2)
+	for ; len(b) >= 2; b = b[2:] {
+		list = append(list, binary.BigEndian.Uint16(b))
+	}
+
+	return list
+}
+
+// readUint16 reads a big-endian uint16 from s.
+func readUint16(s []byte) (v uint16, rest []byte, ok bool) {
+	if len(s) < 2 {
+		return 0, s, false
+	}
+
+	return binary.BigEndian.Uint16(s), s[2:], true
+}
+
+// readUint8Prefixed reads a vector with a 1-byte length prefix from s.
+func readUint8Prefixed(s []byte) (v, rest []byte, ok bool) {
+	if len(s) < 1 {
+		return nil, s, false
+	}
+
+	n := int(s[0])
+	if len(s)-1 < n {
+		return nil, s, false
+	}
+
+	return s[1 : 1+n], s[1+n:], true
+}
+
+// readUint16Prefixed reads a vector with a 2-byte length prefix from s.
+func readUint16Prefixed(s []byte) (v, rest []byte, ok bool) {
+	if len(s) < 2 {
+		return nil, s, false
+	}
+
+	n := int(binary.BigEndian.Uint16(s))
+	if len(s)-2 < n {
+		return nil, s, false
+	}
+
+	return s[2 : 2+n], s[2+n:], true
+}
+
+// readWholeUint8Prefixed reads a non-empty vector with a 1-byte length prefix
+// that must occupy the whole s.
+func readWholeUint8Prefixed(s []byte) (v []byte, ok bool) {
+	v, s, ok = readUint8Prefixed(s)
+
+	return v, ok && len(s) == 0 && len(v) > 0
+}
+
+// readWholeUint16Prefixed reads a non-empty vector with a 2-byte length prefix
+// that must occupy the whole s.
+func readWholeUint16Prefixed(s []byte) (v []byte, ok bool) {
+	v, s, ok = readUint16Prefixed(s)
+
+	return v, ok && len(s) == 0 && len(v) > 0
+}
@@ -0,0 +1,605 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHello is a ClientHello record used in tests.
+type testHello struct {
+	name   string
+	record []byte
+}
+
+// newTestClientHello is a helper that makes crypto/tls generate a ClientHello
+// with the specified configuration and returns the TLS record containing it.
+func newTestClientHello(t testing.TB, conf *tls.Config) (record []byte) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+
+	go func() {
+		_ = tls.Client(clientConn, conf).Handshake()
+		_ = clientConn.Close()
+	}()
+
+	require.NoError(t, serverConn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	record = make([]byte, recordHeaderLen)
+	_, err := io.ReadFull(serverConn, record)
+	require.NoError(t, err)
+
+	payloadLen := int(record[3])<<8 | int(record[4])
+	record = append(record, make([]byte, payloadLen)...)
+	_, err = io.ReadFull(serverConn, record[recordHeaderLen:])
+	require.NoError(t, err)
+
+	return record
+}
+
+// loadTestHellos is a helper that returns the ClientHello records captured
+// from real-world clients and generated by crypto/tls.
+func loadTestHellos(t testing.TB) (hellos []testHello) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "clienthello_*.bin"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, f := range files {
+		var b []byte
+		b, err = os.ReadFile(f)
+		require.NoError(t, err)
+
+		hellos = append(hellos, testHello{name: filepath.Base(f), record: b})
+	}
+
+	confs := []struct {
+		conf *tls.Config
+		name string
+	}{{
+		name: "go_default",
+		conf: &tls.Config{ServerName: "example.org"},
+	}, {
+		name: "go_tls12_alpn",
+		conf: &tls.Config{
+			ServerName: "example.net",
+			MaxVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}, {
+		name: "go_tls10_only",
+		conf: &tls.Config{
+			ServerName: "example.com",
+			MinVersion: tls.VersionTLS10,
+			MaxVersion: tls.VersionTLS10,
+		},
+	}, {
+		name: "go_no_sni",
+		conf: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for _, c := range confs {
+		hellos = append(hellos, testHello{
+			name:   c.name,
+			record: newTestClientHello(t, c.conf),
+		})
+	}
+
+	return hellos
+}
+
+// stdClientHello parses the ClientHello from the specified records using
+// crypto/tls handshake, which is what the relay used to do before it got its
+// own parser.
+//
+// #nosec G402 -- Ignore the TLS MinVersion, the code is only for parsing.
+func stdClientHello(records []byte) (hello *tls.ClientHelloInfo, err error) {
+	err = tls.Server(readOnlyConn{reader: bytes.NewReader(records)}, &tls.Config{
+		GetConfigForClient: func(argHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *argHello
+
+			return nil, nil
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return nil, err
+	}
+
+	return hello, nil
+}
+
+// readOnlyConn implements net.Conn but overrides all it's methods so that
+// only reading could work.  The purpose is to make sure that the Handshake
+// method of [tls.Server] does not write any data to the underlying connection.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+// type check
+var _ net.Conn = (*readOnlyConn)(nil)
+
+// Read implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) Read(p []byte) (int, error) { return conn.reader.Read(p) }
+
+// Write implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) Write(_ []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// Close implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) Close() error { return nil }
+
+// LocalAddr implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) LocalAddr() net.Addr { return nil }
+
+// RemoteAddr implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) RemoteAddr() net.Addr { return nil }
+
+// SetDeadline implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) SetDeadline(_ time.Time) error { return nil }
+
+// SetReadDeadline implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) SetReadDeadline(_ time.Time) error { return nil }
+
+// SetWriteDeadline implements the net.Conn interface for *readOnlyConn.
+func (conn readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// wrapHandshake wraps the handshake message msg into TLS records.
+func wrapHandshake(msg []byte, maxPayload int) (records []byte) {
+	for len(msg) > 0 {
+		n := min(len(msg), maxPayload)
+		records = append(records, recordTypeHandshake, 0x03, 0x01, byte(n>>8), byte(n))
+		records = append(records, msg[:n]...)
+		msg = msg[n:]
+	}
+
+	return records
+}
+
+// newServerNameHello returns a minimal ClientHello message with a single
+// server_name extension with the data ext.
+func newServerNameHello(ext []byte) (msg []byte) {
+	exts := binary.BigEndian.AppendUint16(nil, extServerName)
+	exts = binary.BigEndian.AppendUint16(exts, uint16(len(ext)))
+	exts = append(exts, ext...)
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, randomLen)...)
+	// Empty session ID, TLS_AES_128_GCM_SHA256, and null compression.
+	body = append(body, 0, 0, 2, 0x13, 0x01, 1, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+
+	n := len(body)
+	msg = []byte{handshakeTypeClientHello, byte(n >> 16), byte(n >> 8), byte(n)}
+
+	return append(msg, body...)
+}
+
+// serverNameExt returns the server_name extension data with the names of the
+// types.
+func serverNameExt(types []uint8, names ...string) (ext []byte) {
+	var list []byte
+	for i, name := range names {
+		list = append(list, types[i])
+		list = binary.BigEndian.AppendUint16(list, uint16(len(name)))
+		list = append(list, name...)
+	}
+
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...)
+}
+
+// extensionData returns the data of the first extension of the type from the
+// extensions block exts.
+func extensionData(exts []byte, typ uint16) (data []byte, ok bool) {
+	for len(exts) > 0 {
+		var extType uint16
+		if extType, exts, ok = readUint16(exts); !ok {
+			return nil, false
+		}
+
+		if data, exts, ok = readUint16Prefixed(exts); !ok {
+			return nil, false
+		}
+
+		if extType == typ {
+			return data, true
+		}
+	}
+
+	return nil, false
+}
+
+// requireStdServerName is a helper that checks that crypto/tls accepts the
+// server_name extension of hello and reads the same server name from it.
+func requireStdServerName(t testing.TB, hello *clientHello) {
+	t.Helper()
+
+	ext, ok := extensionData(hello.rawExtensions, extServerName)
+	if !ok {
+		return
+	}
+
+	std, err := stdClientHello(wrapHandshake(newServerNameHello(ext), 16384))
+	require.NoError(t, err)
+	require.Equal(t, std.ServerName, hello.serverName())
+}
+
+// requireSameHello is a helper that checks that hello contains the same data
+// as the ClientHelloInfo std returned by crypto/tls.
+func requireSameHello(t testing.TB, std *tls.ClientHelloInfo, hello *clientHello) {
+	t.Helper()
+
+	require.Equal(t, std.ServerName, hello.serverName())
+	require.Equal(t, std.SupportedProtos, hello.alpnProtocols())
+	require.Equal(t, std.SupportedVersions, hello.supportedVersions())
+	require.Equal(t, std.SignatureSchemes, toSignatureSchemes(hello.signatureSchemes()))
+	require.Equal(t, std.SupportedCurves, toCurveIDs(hello.supportedGroups()))
+	require.Equal(t, std.SupportedPoints, hello.supportedPoints())
+
+	suites := hello.cipherSuites()
+	if len(std.CipherSuites) == 0 {
+		require.Empty(t, suites)
+	} else {
+		require.Equal(t, std.CipherSuites, suites)
+	}
+}
+
+// toSignatureSchemes converts a list of uint16 to a list of signature schemes.
+func toSignatureSchemes(list []uint16) (schemes []tls.SignatureScheme) {
+	for _, v := range list {
+		schemes = append(schemes, tls.SignatureScheme(v))
+	}
+
+	return schemes
+}
+
+// toCurveIDs converts a list of uint16 to a list of curve IDs.
+func toCurveIDs(list []uint16) (curves []tls.CurveID) {
+	for _, v := range list {
+		curves = append(curves, tls.CurveID(v))
+	}
+
+	return curves
+}
+
+func TestParseClientHello(t *testing.T) {
+	for _, h := range loadTestHellos(t) {
+		t.Run(h.name, func(t *testing.T) {
+			std, err := stdClientHello(h.record)
+			require.NoError(t, err)
+
+			hello := &clientHello{}
+			err = parseClientHello(hello, h.record[recordHeaderLen:])
+			require.NoError(t, err)
+
+			requireSameHello(t, std, hello)
+		})
+	}
+}
+
+func TestParseClientHello_values(t *testing.T) {
+	record := newTestClientHello(t, &tls.Config{
+		ServerName: "www.example.org",
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	hello := &clientHello{}
+	err := parseClientHello(hello, record[recordHeaderLen:])
+	require.NoError(t, err)
+
+	assert.Equal(t, "www.example.org", hello.serverName())
+	assert.Equal(t, []string{"h2", "http/1.1"}, hello.alpnProtocols())
+	assert.Equal(t, []uint16{tls.VersionTLS13, tls.VersionTLS12}, hello.supportedVersions())
+	assert.Contains(t, hello.extensionTypes(), extServerName)
+	assert.Contains(t, hello.extensionTypes(), extALPN)
+	assert.Len(t, hello.random, randomLen)
+}
+
+func TestParseClientHello_invalid(t *testing.T) {
+	record := newTestClientHello(t, &tls.Config{ServerName: "example.org"})
+	msg := record[recordHeaderLen:]
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		msg     []byte
+	}{{
+		name:    "empty",
+		msg:     nil,
+		wantErr: errNotClientHello,
+	}, {
+		name:    "server_hello",
+		msg:     append([]byte{2}, msg[1:]...),
+		wantErr: errNotClientHello,
+	}, {
+		name:    "truncated",
+		msg:     msg[:len(msg)-1],
+		wantErr: errMalformed,
+	}, {
+		name:    "only_header",
+		msg:     []byte{handshakeTypeClientHello, 0, 0, 0},
+		wantErr: errMalformed,
+	}, {
+		name:    "sni_trailing_dot",
+		msg:     newServerNameHello(serverNameExt([]uint8{0}, "example.org.")),
+		wantErr: errMalformed,
+	}, {
+		name:    "sni_empty",
+		msg:     newServerNameHello(serverNameExt([]uint8{0}, "")),
+		wantErr: errMalformed,
+	}, {
+		name:    "sni_empty_list",
+		msg:     newServerNameHello(serverNameExt(nil)),
+		wantErr: errMalformed,
+	}, {
+		name:    "sni_two_host_names",
+		msg:     newServerNameHello(serverNameExt([]uint8{0, 0}, "example.org", "example.net")),
+		wantErr: errMalformed,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := parseClientHello(&clientHello{}, tc.msg)
+			require.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	// Use a large ClientHello so that it does not fit into a single TCP
+	// segment, like the ones with post-quantum key shares.
+	record := newTestClientHello(t, &tls.Config{
+		ServerName: "example.org",
+		NextProtos: []string{"h2", strings.Repeat("x", 255), strings.Repeat("y", 255)},
+	})
+	msg := record[recordHeaderLen:]
+
+	const appData = "application data"
+
+	testCases := []struct {
+		newReader func(peeked []byte) (r io.Reader)
+		name      string
+		peeked    []byte
+	}{{
+		name:   "single_record",
+		peeked: record,
+	}, {
+		name:   "split_records",
+		peeked: wrapHandshake(msg, 100),
+	}, {
+		name:   "split_header",
+		peeked: wrapHandshake(msg, 3),
+	}, {
+		name:   "one_byte_records",
+		peeked: wrapHandshake(msg, 1),
+	}, {
+		name:   "one_byte_reads",
+		peeked: record,
+		newReader: func(peeked []byte) (r io.Reader) {
+			return iotest.OneByteReader(bytes.NewReader(peeked))
+		},
+	}, {
+		name:   "one_byte_reads_split_records",
+		peeked: wrapHandshake(msg, 7),
+		newReader: func(peeked []byte) (r io.Reader) {
+			return iotest.OneByteReader(bytes.NewReader(peeked))
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var src io.Reader = bytes.NewReader(tc.peeked)
+			if tc.newReader != nil {
+				src = tc.newReader(tc.peeked)
+			}
+
+			src = io.MultiReader(src, strings.NewReader(appData))
+
+			hello, r, err := peekClientHello(src)
+			require.NoError(t, err)
+
+			assert.Equal(t, "example.org", hello.serverName())
+			assert.Equal(t, "h2", hello.alpnProtocols()[0])
+
+			replayed, err := io.ReadAll(r)
+			require.NoError(t, err)
+
+			want := append(slices.Clone(tc.peeked), appData...)
+			assert.Equal(t, want, replayed)
+		})
+	}
+}
+
+func TestPeekClientHello_invalid(t *testing.T) {
+	record := newTestClientHello(t, &tls.Config{ServerName: "example.org"})
+	msg := record[recordHeaderLen:]
+
+	hugeMsg := []byte{handshakeTypeClientHello, 0x01, 0x00, 0x00}
+	hugeMsg = append(hugeMsg, make([]byte, 0x10000)...)
+
+	// largeMsg fits into maxClientHelloLen, but not when split into tiny
+	// records.
+	largeMsg := []byte{handshakeTypeClientHello, 0x00, 0xff, 0x00}
+	largeMsg = append(largeMsg, make([]byte, 0xff00)...)
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		peeked  []byte
+	}{{
+		name:    "not_tls",
+		peeked:  []byte("GET / HTTP/1.1\r\n\r\n"),
+		wantErr: errNotHandshake,
+	}, {
+		name:    "truncated",
+		peeked:  record[:len(record)-1],
+		wantErr: io.ErrUnexpectedEOF,
+	}, {
+		name:    "truncated_fragments",
+		peeked:  wrapHandshake(msg[:len(msg)-1], 100),
+		wantErr: io.EOF,
+	}, {
+		name: "interleaved_alert",
+		peeked: append(
+			wrapHandshake(msg[:100], 100),
+			[]byte{21, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}...,
+		),
+		wantErr: errNotHandshake,
+	}, {
+		name:    "empty_fragment",
+		peeked:  append([]byte{recordTypeHandshake, 0x03, 0x01, 0x00, 0x00}, record...),
+		wantErr: errMalformed,
+	}, {
+		name:    "not_client_hello",
+		peeked:  wrapHandshake(append([]byte{2}, msg[1:]...), 100),
+		wantErr: errNotClientHello,
+	}, {
+		name:    "too_large",
+		peeked:  wrapHandshake(hugeMsg, 16384),
+		wantErr: errHelloTooLarge,
+	}, {
+		name:    "too_many_records",
+		peeked:  wrapHandshake(largeMsg, 1),
+		wantErr: errHelloTooLarge,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := peekClientHello(bytes.NewReader(tc.peeked))
+			require.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestParseClientHello_serverName(t *testing.T) {
+	testCases := []struct {
+		name  string
+		want  string
+		types []uint8
+		names []string
+	}{{
+		name:  "host_name",
+		want:  "example.org",
+		types: []uint8{0},
+		names: []string{"example.org"},
+	}, {
+		name:  "other_type",
+		want:  "example.org",
+		types: []uint8{1, 0},
+		names: []string{"example.net.", "example.org"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hello := &clientHello{}
+			err := parseClientHello(hello, newServerNameHello(serverNameExt(tc.types, tc.names...)))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, hello.serverName())
+			requireStdServerName(t, hello)
+		})
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	for _, h := range loadTestHellos(f) {
+		f.Add(h.record[recordHeaderLen:])
+	}
+
+	f.Add(newServerNameHello(serverNameExt([]uint8{0}, "example.org")))
+	f.Add(newServerNameHello(serverNameExt([]uint8{0}, "example.org.")))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		hello := &clientHello{}
+		err := parseClientHello(hello, msg)
+
+		// Calling the accessors must never panic, even if parsing failed.
+		_ = hello.alpnProtocols()
+		_ = hello.extensionTypes()
+		_ = hello.supportedVersions()
+
+		std, stdErr := stdClientHello(wrapHandshake(msg, 16384))
+		if stdErr != nil {
+			// crypto/tls checks more than the parser does, but the server
+			// name must never be accepted by the parser alone.
+			if err == nil {
+				requireStdServerName(t, hello)
+			}
+
+			return
+		}
+
+		require.NoError(t, err)
+		requireSameHello(t, std, hello)
+	})
+}
+
+// errSink is a sink for error values returned from benchmarks.
+var errSink error
+
+// helloSink is a sink for ClientHello values returned from benchmarks.
+var helloSink *tls.ClientHelloInfo
+
+func BenchmarkParseClientHello(b *testing.B) {
+	for _, h := range loadTestHellos(b) {
+		b.Run(h.name, func(b *testing.B) {
+			msg := h.record[recordHeaderLen:]
+			hello := &clientHello{}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				errSink = parseClientHello(hello, msg)
+			}
+		})
+	}
+}
+
+func BenchmarkPeekClientHello(b *testing.B) {
+	record := newTestClientHello(b, &tls.Config{ServerName: "example.org"})
+	fragmented := wrapHandshake(record[recordHeaderLen:], 256)
+	r := bytes.NewReader(nil)
+
+	b.Run("parser", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			r.Reset(record)
+			_, _, errSink = peekClientHello(r)
+		}
+	})
+
+	b.Run("parser_fragmented", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			r.Reset(fragmented)
+			_, _, errSink = peekClientHello(r)
+		}
+	})
+
+	b.Run("crypto_tls", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			helloSink, errSink = stdClientHello(record)
+		}
+	})
+}
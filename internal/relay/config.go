@@ -3,6 +3,10 @@ package relay
 import (
 	"net/netip"
 	"net/url"
+	"time"
+
+	"github.com/ameshkov/snirelay/internal/quota"
+	"github.com/ameshkov/snirelay/internal/sockets"
 )
 
 // Config represents the SNI relay server configuration.
@@ -18,11 +22,139 @@ type Config struct {
 	// to.
 	ListenPortTLS uint16
 
+	// ListenPortQUIC is the port the SNI relay expects to receive QUIC
+	// (HTTP/3) traffic to.  If zero, the QUIC listener is disabled.  QUIC
+	// cannot be used together with ProxyURL.
+	ListenPortQUIC uint16
+
+	// ProxyProtocolPlain enables reading the PROXY protocol header on the
+	// plain HTTP listener.
+	ProxyProtocolPlain bool
+
+	// ProxyProtocolTLS enables reading the PROXY protocol header on the TLS
+	// listener.
+	ProxyProtocolTLS bool
+
+	// ProxyProtocolTrusted is a list of networks the PROXY protocol header is
+	// accepted from.  Connections from other addresses are handled as direct
+	// ones, so they cannot spoof the client address.
+	ProxyProtocolTrusted []netip.Prefix
+
 	// ProxyURL is the proxy server address (optional).
 	ProxyURL *url.URL
 
-	// RedirectDomains is a list of wildcards the relay server can reroute.
-	// If the incoming connection is not from this list, the connection will
-	// not be accepted.
-	RedirectDomains []string
+	// Rules is an ordered list of rules that control what connections the
+	// relay server can reroute.  The first matching rule is used.  If the
+	// incoming connection does not match any of them, the connection will not
+	// be accepted.
+	Rules []*Rule
+
+	// FingerprintAllowlist is a list of JA3 or JA4 fingerprints.  If not
+	// empty, only TLS connections with one of these fingerprints are accepted.
+	FingerprintAllowlist []string
+
+	// FingerprintDenylist is a list of JA3 or JA4 fingerprints.  TLS
+	// connections with these fingerprints are not accepted.
+	FingerprintDenylist []string
+
+	// ClientAllowlist is a list of client networks.  If not empty, only
+	// connections from these networks are accepted.
+	ClientAllowlist []netip.Prefix
+
+	// ClientDenylist is a list of client networks.  Connections from these
+	// networks are not accepted.
+	ClientDenylist []netip.Prefix
+
+	// SniffTimeout is the time the client is given to send the PROXY protocol
+	// header and the TLS ClientHello or the HTTP request headers.  If zero,
+	// defaultSniffTimeout is used.
+	SniffTimeout time.Duration
+
+	// DialTimeout is the time the relay is given to connect to the remote
+	// server, including the proxy handshake.  If zero, defaultDialTimeout is
+	// used.
+	DialTimeout time.Duration
+
+	// IdleTimeout is the time after which a tunneled connection without any
+	// traffic in either direction is closed.  If zero, idle connections are
+	// not closed.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the time after which a tunneled connection is closed
+	// regardless of its traffic.  If zero, the lifetime is not limited.
+	MaxLifetime time.Duration
+
+	// MaxConns is the maximum number of concurrent client connections.  If
+	// zero, the number is not limited.
+	MaxConns int
+
+	// MaxConnsPerClient is the maximum number of concurrent connections from
+	// a client subnet.  If zero, the number is not limited.
+	MaxConnsPerClient int
+
+	// ClientSubnetV4 and ClientSubnetV6 are the prefix lengths of the client
+	// subnets MaxConnsPerClient applies to.  If zero, 32 and 64 are used.
+	ClientSubnetV4 int
+	ClientSubnetV6 int
+
+	// MaxConnsPerDestination is the maximum number of concurrent connections
+	// to a remote host.  If zero, the number is not limited.
+	MaxConnsPerDestination int
+
+	// MaxQUICFlows is the maximum number of entries in the NAT table of the
+	// QUIC listener, including the flows that are being sniffed or have been
+	// rejected.  When it is reached, the datagrams that would create new flows
+	// are dropped.  If zero, defaultMaxQUICFlows is used.
+	MaxQUICFlows int
+
+	// RateLimit is the maximum number of new connections per second from a
+	// client subnet, /24 for IPv4 and /56 for IPv6.  If zero, the rate is not
+	// limited.
+	RateLimit int
+
+	// RateLimitBurst is the number of new connections from a client subnet
+	// allowed at once.  If zero, RateLimit is used.
+	RateLimitBurst int
+
+	// RateLimitAllowlist is a list of networks excluded from rate limiting.
+	RateLimitAllowlist []netip.Prefix
+
+	// BandwidthPerConn is the maximum rate, in bytes per second, of the
+	// traffic in each direction of a TCP connection.  If zero, the rate is
+	// not limited.
+	BandwidthPerConn int64
+
+	// BandwidthPerClient is the maximum rate, in bytes per second, of the
+	// traffic in each direction of all TCP connections from a client IP.  If
+	// zero, the rate is not limited.
+	BandwidthPerClient int64
+
+	// Quotas keeps track of the traffic of the clients.  If nil, the traffic
+	// quotas are disabled.  It is not changed by Reconfigure, and the caller
+	// must start it before the server and shut it down after the server.
+	Quotas *quota.Store
+
+	// QuotaDaily and QuotaMonthly are the maximum traffic, in bytes, in both
+	// directions of all TCP connections and QUIC flows from a client IP in a
+	// UTC day and month.  If zero, the traffic is not limited.  A client with
+	// an exhausted quota cannot open new connections and QUIC flows.
+	QuotaDaily   int64
+	QuotaMonthly int64
+
+	// QuotaUsers are the clients identified by their networks.  The first
+	// user whose networks contain the client IP is used instead of the IP.
+	QuotaUsers []*QuotaUser
+
+	// QuotaCutExisting makes the relay close the connections and the QUIC
+	// flows of a client when its quota is exhausted.
+	QuotaCutExisting bool
+
+	// ListenConfig creates the listening sockets.  If nil, a default
+	// [net.ListenConfig] is used.
+	ListenConfig sockets.ListenConfig
+
+	// ShutdownGracePeriod is the time Shutdown waits for the active
+	// connections to finish before closing them.  If zero, they are closed
+	// right away.
+	ShutdownGracePeriod time.Duration
 }
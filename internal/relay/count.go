@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficCounter counts the traffic of a tunneled connection as it is relayed,
+// so that the metrics and the quotas see the traffic of long-lived
+// connections before they are closed.
+type trafficCounter struct {
+	// srv is the server the traffic is counted by.
+	srv *Server
+
+	// c is the tunneled connection.
+	c *activeConn
+
+	// clientIP is the address of the client.
+	clientIP netip.Addr
+
+	// quotaKey is the key of the client in the quota store.
+	quotaKey string
+}
+
+// add adds n bytes to metric and to the quota usage of the client.
+func (tc *trafficCounter) add(n int64, metric prometheus.Counter) {
+	metric.Add(float64(n))
+	tc.srv.addQuotaUsage(tc.c, tc.clientIP, tc.quotaKey, n)
+}
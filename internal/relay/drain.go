@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/metrics"
+)
+
+// activeConn is a client connection that is being handled by the relay.
+type activeConn struct {
+	// mu protects remote and closed.
+	mu *sync.Mutex
+
+	// client is the accepted client connection.
+	client net.Conn
+
+	// remote is the connection to the remote server.  It is nil until the
+	// relay connects to it.
+	remote net.Conn
+
+	// done is closed when the connection is force-closed.
+	done chan struct{}
+
+	// closed is true if the connection has been force-closed.
+	closed bool
+}
+
+// setRemote sets the connection to the remote server.  ok is false if c has
+// already been force-closed, in which case remote must be closed by the
+// caller.
+func (c *activeConn) setRemote(remote net.Conn) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.remote = remote
+
+	return true
+}
+
+// close closes the client connection and the connection to the remote server,
+// if any.
+func (c *activeConn) close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+
+	err = c.client.Close()
+	if c.remote != nil {
+		err = errors.WithDeferred(err, c.remote.Close())
+	}
+
+	return err
+}
+
+// trackConn starts tracking the accepted client connection conn.  It must not
+// be called after the listeners are closed.
+func (s *Server) trackConn(conn net.Conn) (c *activeConn) {
+	c = &activeConn{
+		mu:     &sync.Mutex{},
+		client: conn,
+		done:   make(chan struct{}),
+	}
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	s.conns[c] = struct{}{}
+	s.connsWG.Add(1)
+	metrics.ActiveConnectionsTotal.Inc()
+
+	return c
+}
+
+// untrackConn stops tracking c after it has been handled.
+func (s *Server) untrackConn(c *activeConn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, c)
+	s.connsWG.Done()
+	metrics.ActiveConnectionsTotal.Dec()
+
+	if s.draining {
+		metrics.DrainingConnectionsTotal.Dec()
+	}
+}
+
+// trackFlow starts tracking the accepted QUIC flow f, so that it is drained on
+// shutdown the same way as the client connections.  ok is false if the server
+// is draining, in which case f must be rejected.  f.mu is expected to be
+// locked.
+func (s *Server) trackFlow(f *quicFlow) (ok bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.activeFlows++
+	s.connsWG.Add(1)
+	f.tracked = true
+
+	return true
+}
+
+// untrackFlow stops tracking f if it is tracked.  f.mu is expected to be
+// locked.
+func (s *Server) untrackFlow(f *quicFlow) {
+	if !f.tracked {
+		return
+	}
+
+	f.tracked = false
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	s.activeFlows--
+	s.connsWG.Done()
+
+	if s.draining {
+		metrics.DrainingConnectionsTotal.Dec()
+	}
+}
+
+// drainConns waits for the active connections and QUIC flows to finish for
+// the grace period and then closes the remaining ones.  The TCP listeners must
+// be closed and the accept loops must have exited.
+func (s *Server) drainConns(ctx context.Context) (err error) {
+	s.connsMu.Lock()
+	s.draining = true
+	active := len(s.conns) + s.activeFlows
+	metrics.DrainingConnectionsTotal.Set(float64(active))
+	s.connsMu.Unlock()
+
+	defer func() {
+		s.connsMu.Lock()
+		defer s.connsMu.Unlock()
+
+		s.draining = false
+		metrics.DrainingConnectionsTotal.Set(0)
+	}()
+
+	if active == 0 {
+		return nil
+	}
+
+	log.Info("relay: draining %d connections for up to %s", active, s.shutdownGracePeriod)
+
+	graceCtx, cancel := context.WithTimeout(ctx, s.shutdownGracePeriod)
+	defer cancel()
+
+	if waitGroup(graceCtx, s.connsWG) {
+		log.Info("relay: all %d connections finished", active)
+		metrics.ShutdownConnsAdd(active, false)
+
+		return nil
+	}
+
+	forced := s.closeConns() + s.closeFlows()
+	log.Info(
+		"relay: grace period expired, %d connections finished, %d force-closed",
+		active-forced,
+		forced,
+	)
+
+	metrics.ShutdownConnsAdd(active-forced, false)
+	metrics.ShutdownConnsAdd(forced, true)
+
+	if !waitGroup(ctx, s.connsWG) {
+		return fmt.Errorf("waiting for closed connections: %w", ctx.Err())
+	}
+
+	return nil
+}
+
+// closeConns force-closes all active connections and returns their number.
+// It does not include the QUIC flows, see closeFlows.
+func (s *Server) closeConns() (n int) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for c := range s.conns {
+		err := c.close()
+		if err != nil {
+			log.Debug("relay: force-closing connection from %s: %s", c.client.RemoteAddr(), err)
+		}
+	}
+
+	return len(s.conns)
+}
+
+// waitGroup waits for wg until ctx is done.  ok is false if ctx is done
+// before wg.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) (ok bool) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,200 @@
+package relay
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fingerprint contains the TLS fingerprints of a client computed from its
+// ClientHello.
+type fingerprint struct {
+	// ja3 is the JA3 fingerprint, an MD5 hash of the JA3 string.
+	ja3 string
+
+	// ja4 is the JA4 fingerprint.
+	ja4 string
+}
+
+// newFingerprint computes the fingerprints of the ClientHello.  quic is true if
+// the ClientHello was received in a QUIC Initial packet.
+func newFingerprint(hello *clientHello, quic bool) (fp fingerprint) {
+	// #nosec G401 -- JA3 is defined as an MD5 hash, it is not used for
+	// security purposes.
+	ja3Sum := md5.Sum([]byte(ja3String(hello)))
+
+	return fingerprint{
+		ja3: hex.EncodeToString(ja3Sum[:]),
+		ja4: ja4String(hello, quic),
+	}
+}
+
+// isGREASE returns true if v is one of the reserved GREASE values, see
+// RFC 8701.
+func isGREASE(v uint16) (ok bool) {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns list with GREASE values removed.
+func withoutGREASE(list []uint16) (res []uint16) {
+	return slices.DeleteFunc(list, isGREASE)
+}
+
+// ja3String returns the JA3 string of the ClientHello, which has the following
+// format:
+//
+//	SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+//
+// All the values are decimal and the list elements are separated with "-".
+// GREASE values are ignored.
+func ja3String(hello *clientHello) (s string) {
+	b := &strings.Builder{}
+
+	b.WriteString(strconv.Itoa(int(hello.vers)))
+	b.WriteByte(',')
+	writeDecList(b, withoutGREASE(hello.cipherSuites()))
+	b.WriteByte(',')
+	writeDecList(b, withoutGREASE(hello.extensionTypes()))
+	b.WriteByte(',')
+	writeDecList(b, withoutGREASE(hello.supportedGroups()))
+	b.WriteByte(',')
+	for i, p := range hello.rawSupportedPoints {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+
+		b.WriteString(strconv.Itoa(int(p)))
+	}
+
+	return b.String()
+}
+
+// writeDecList writes the list of decimal values separated with "-" to b.
+func writeDecList(b *strings.Builder, list []uint16) {
+	for i, v := range list {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+// ja4Versions maps TLS versions to their JA4 representations.
+var ja4Versions = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0002: "s2",
+	0xfeff: "d1",
+	0xfefd: "d2",
+	0xfefc: "d3",
+}
+
+// ja4String returns the JA4 fingerprint of the ClientHello.  quic is true if
+// the ClientHello was received over QUIC.  See
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md.
+func ja4String(hello *clientHello, quic bool) (s string) {
+	proto := 't'
+	if quic {
+		proto = 'q'
+	}
+
+	vers := hello.vers
+	if len(hello.rawSupportedVersions) > 0 {
+		vers = slices.Max(append(withoutGREASE(hello.supportedVersions()), 0))
+	}
+
+	verStr, ok := ja4Versions[vers]
+	if !ok {
+		verStr = "00"
+	}
+
+	sni := 'i'
+	if len(hello.rawServerName) > 0 {
+		sni = 'd'
+	}
+
+	suites := withoutGREASE(hello.cipherSuites())
+	exts := withoutGREASE(hello.extensionTypes())
+
+	ja4a := fmt.Sprintf(
+		"%c%s%c%02d%02d%s",
+		proto,
+		verStr,
+		sni,
+		min(len(suites), 99),
+		min(len(exts), 99),
+		ja4ALPN(hello),
+	)
+
+	slices.Sort(suites)
+
+	exts = slices.DeleteFunc(exts, func(v uint16) (ok bool) {
+		return v == extServerName || v == extALPN
+	})
+	slices.Sort(exts)
+
+	ja4c := hexList(exts)
+	if sigs := hello.signatureSchemes(); len(sigs) > 0 && len(exts) > 0 {
+		ja4c += "_" + hexList(sigs)
+	}
+
+	return ja4a + "_" + ja4Hash(suites, hexList(suites)) + "_" + ja4Hash(exts, ja4c)
+}
+
+// ja4ALPN returns the ALPN part of the JA4 fingerprint: the first and the last
+// characters of the first ALPN protocol or "00" if there is none.
+func ja4ALPN(hello *clientHello) (s string) {
+	protos := hello.alpnProtocols()
+	if len(protos) == 0 {
+		return "00"
+	}
+
+	p := protos[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		h := hex.EncodeToString([]byte(p))
+		first, last = h[0], h[len(h)-1]
+	}
+
+	return string([]byte{first, last})
+}
+
+// isAlnum returns true if c is an ASCII letter or digit.
+func isAlnum(c byte) (ok bool) {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// hexList returns the list of values as 4-digit hex numbers separated with
+// commas.
+func hexList(list []uint16) (s string) {
+	b := &strings.Builder{}
+	for i, v := range list {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		_, _ = fmt.Fprintf(b, "%04x", v)
+	}
+
+	return b.String()
+}
+
+// ja4Hash returns the first 12 characters of the hex-encoded SHA256 hash of
+// s, or "000000000000" if list is empty.
+func ja4Hash(list []uint16, s string) (h string) {
+	if len(list) == 0 {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFingerprint(t *testing.T) {
+	testCases := []struct {
+		file    string
+		wantJA3 string
+		wantJA4 string
+	}{{
+		file:    "clienthello_curl.bin",
+		wantJA3: "0149f47eabf9a20d0893e2a44e5a6323",
+		wantJA4: "t13d3112h2_e8f1e7e78f70_b26ce05bbdd6",
+	}, {
+		file:    "clienthello_openssl.bin",
+		wantJA3: "5a1edc7f170af1014fc65c994878e63c",
+		wantJA4: "t13d3111h2_e8f1e7e78f70_1f22a2ca17c4",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			record, err := os.ReadFile(filepath.Join("testdata", tc.file))
+			require.NoError(t, err)
+
+			hello := &clientHello{}
+			err = parseClientHello(hello, record[recordHeaderLen:])
+			require.NoError(t, err)
+
+			fp := newFingerprint(hello, false)
+			assert.Equal(t, tc.wantJA3, fp.ja3)
+			assert.Equal(t, tc.wantJA4, fp.ja4)
+		})
+	}
+}
+
+func TestJA4String_grease(t *testing.T) {
+	// A minimal TLS 1.3 ClientHello with GREASE values in cipher suites,
+	// extensions and supported versions, and without SNI and ALPN.
+	msg := []byte{
+		handshakeTypeClientHello, 0x00, 0x00, 0x00,
+		// Legacy version.
+		0x03, 0x03,
+	}
+	msg = append(msg, make([]byte, randomLen)...)
+	msg = append(msg,
+		// Empty session ID.
+		0x00,
+		// Cipher suites: GREASE, TLS_AES_128_GCM_SHA256.
+		0x00, 0x04, 0x0a, 0x0a, 0x13, 0x01,
+		// Compression methods: null.
+		0x01, 0x00,
+		// Extensions.
+		0x00, 0x11,
+		// GREASE extension.
+		0x1a, 0x1a, 0x00, 0x00,
+		// supported_versions: GREASE, TLS 1.3.
+		0x00, 0x2b, 0x00, 0x05, 0x04, 0x2a, 0x2a, 0x03, 0x04,
+		// extended_master_secret.
+		0x00, 0x17, 0x00, 0x00,
+	)
+	msg[3] = byte(len(msg) - handshakeHeaderLen)
+
+	hello := &clientHello{}
+	err := parseClientHello(hello, msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "771,4865,43-23,,", ja3String(hello))
+	wantJA4 := "t13i010200_" +
+		ja4Hash([]uint16{1}, "1301") + "_" +
+		ja4Hash([]uint16{1}, "0017,002b")
+	assert.Equal(t, wantJA4, ja4String(hello, false))
+}
+
+func TestSettings_fingerprintAllowed(t *testing.T) {
+	fp := fingerprint{ja3: "ja3", ja4: "ja4"}
+
+	testCases := []struct {
+		name  string
+		allow []string
+		deny  []string
+		want  bool
+	}{{
+		name: "empty",
+		want: true,
+	}, {
+		name:  "allowed_ja3",
+		allow: []string{"ja3"},
+		want:  true,
+	}, {
+		name:  "allowed_ja4",
+		allow: []string{"ja4"},
+		want:  true,
+	}, {
+		name:  "not_allowed",
+		allow: []string{"other"},
+		want:  false,
+	}, {
+		name: "denied",
+		deny: []string{"ja4"},
+		want: false,
+	}, {
+		name:  "denied_and_allowed",
+		allow: []string{"ja3"},
+		deny:  []string{"ja4"},
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &settings{
+				fingerprintAllowlist: container.NewMapSet(tc.allow...),
+				fingerprintDenylist:  container.NewMapSet(tc.deny...),
+			}
+
+			assert.Equal(t, tc.want, st.fingerprintAllowed(fp))
+		})
+	}
+}
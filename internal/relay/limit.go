@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/metrics"
+)
+
+// Names of the connection limits used in logs and metrics.
+const (
+	limitGlobal      = "global"
+	limitClient      = "client"
+	limitDestination = "destination"
+	limitQuota       = "quota"
+)
+
+// Default prefix lengths of the client subnets the per-client limit applies
+// to.
+const (
+	defaultClientSubnetV4 = 32
+	defaultClientSubnetV6 = 64
+)
+
+// rejectTimeout is the time a rejected TLS client is given to receive the
+// alert.
+const rejectTimeout = time.Second
+
+// alertInternalError is the fatal TLS internal_error alert record sent to the
+// TLS clients rejected by the connection limits.
+var alertInternalError = []byte{
+	// Content type: alert.
+	0x15,
+	// Legacy record version: TLS 1.2.
+	0x03, 0x03,
+	// Length.
+	0x00, 0x02,
+	// Alert level: fatal.
+	0x02,
+	// Alert description: internal_error.
+	0x50,
+}
+
+// connCounter counts the active connections by key and limits their number.
+type connCounter[K comparable] struct {
+	// mu protects counts.
+	mu *sync.Mutex
+
+	// counts are the numbers of the active connections by key.  The keys
+	// without connections are removed.
+	counts map[K]int
+}
+
+// newConnCounter returns a new properly initialized *connCounter.
+func newConnCounter[K comparable]() (c *connCounter[K]) {
+	return &connCounter[K]{
+		mu:     &sync.Mutex{},
+		counts: map[K]int{},
+	}
+}
+
+// acquire adds a connection with the key unless there are already maxConns of
+// them.  If maxConns is zero, the number is not limited.  If ok is true,
+// release must be called with the same key when the connection is closed.
+func (c *connCounter[K]) acquire(key K, maxConns int) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if maxConns > 0 && c.counts[key] >= maxConns {
+		return false
+	}
+
+	c.counts[key]++
+
+	return true
+}
+
+// release removes a connection with the key.
+func (c *connCounter[K]) release(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+	} else {
+		c.counts[key]--
+	}
+}
+
+// limits are the counters of the connection limits.
+type limits struct {
+	global      *connCounter[struct{}]
+	clients     *connCounter[netip.Prefix]
+	destination *connCounter[string]
+}
+
+// newLimits returns new properly initialized *limits.
+func newLimits() (l *limits) {
+	return &limits{
+		global:      newConnCounter[struct{}](),
+		clients:     newConnCounter[netip.Prefix](),
+		destination: newConnCounter[string](),
+	}
+}
+
+// clientSubnet returns the subnet of addr the per-client limit applies to.
+func (st *settings) clientSubnet(addr netip.Addr) (subnet netip.Prefix) {
+	addr = addr.Unmap()
+
+	bits := st.clientSubnetV6
+	if addr.Is4() {
+		bits = st.clientSubnetV4
+	}
+
+	// The error is only returned for invalid addresses and the prefix lengths
+	// are validated, so the zero prefix is used for the former.
+	subnet, _ = addr.Prefix(bits)
+
+	return subnet
+}
+
+// rejectConn counts the connection rejected by the limit or by the traffic
+// quota and, if it is a TLS connection, sends the internal_error alert to the
+// client.  The caller must close conn.
+func rejectConn(conn net.Conn, plainHTTP bool, limit string) {
+	if limit == limitQuota {
+		log.Debug("relay: %s: traffic quota exhausted", conn.RemoteAddr())
+	} else {
+		log.Debug("relay: %s: %s connection limit reached", conn.RemoteAddr(), limit)
+	}
+
+	metrics.LimitRejectionsInc(limit)
+
+	if plainHTTP {
+		return
+	}
+
+	err := conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if err == nil {
+		_, err = conn.Write(alertInternalError)
+	}
+
+	if err != nil {
+		log.Debug("relay: %s: sending alert: %s", conn.RemoteAddr(), err)
+
+		return
+	}
+
+	// Close the connection gracefully so that the unread data from the
+	// client do not make the kernel reset it before the alert is received.
+	if cw, ok := conn.(closeWriter); ok {
+		_ = cw.CloseWrite()
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
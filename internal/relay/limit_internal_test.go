@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnCounter(t *testing.T) {
+	c := newConnCounter[string]()
+
+	assert.True(t, c.acquire("a", 2))
+	assert.True(t, c.acquire("a", 2))
+	assert.False(t, c.acquire("a", 2))
+	assert.True(t, c.acquire("b", 2))
+
+	c.release("a")
+	assert.True(t, c.acquire("a", 2))
+
+	// Zero means no limit.
+	assert.True(t, c.acquire("a", 0))
+
+	for range 3 {
+		c.release("a")
+	}
+	c.release("b")
+
+	assert.Empty(t, c.counts)
+}
+
+func TestSettings_clientSubnet(t *testing.T) {
+	st := &settings{
+		clientSubnetV4: 24,
+		clientSubnetV6: 56,
+	}
+
+	testCases := []struct {
+		name string
+		addr netip.Addr
+		want netip.Prefix
+	}{{
+		name: "ipv4",
+		addr: netip.MustParseAddr("192.0.2.1"),
+		want: netip.MustParsePrefix("192.0.2.0/24"),
+	}, {
+		name: "ipv4_mapped",
+		addr: netip.MustParseAddr("::ffff:192.0.2.1"),
+		want: netip.MustParsePrefix("192.0.2.0/24"),
+	}, {
+		name: "ipv6",
+		addr: netip.MustParseAddr("2001:db8:1:2:3::1"),
+		want: netip.MustParsePrefix("2001:db8:1::/56"),
+	}, {
+		name: "invalid",
+		addr: netip.Addr{},
+		want: netip.Prefix{},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, st.clientSubnet(tc.addr))
+		})
+	}
+}
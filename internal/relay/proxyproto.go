@@ -0,0 +1,378 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// PROXY protocol constants, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+const (
+	// proxyV1Prefix is the prefix of the PROXY protocol v1 header.
+	proxyV1Prefix = "PROXY "
+
+	// proxyV1MaxLen is the maximum length of the v1 header including CRLF.
+	proxyV1MaxLen = 107
+
+	// proxyV2HeaderLen is the length of the fixed part of the v2 header.
+	proxyV2HeaderLen = 16
+
+	// proxyV2MaxLen is the maximum length of the v2 header snirelay accepts.
+	// It is enough for addresses and a reasonable number of TLVs.
+	proxyV2MaxLen = 4096
+
+	// proxyMinReadLen is the number of bytes enough to tell the v1 header from
+	// the v2 one.
+	proxyMinReadLen = 8
+
+	// proxyV2Version is the version in the high nibble of the 13th byte.
+	proxyV2Version = 0x20
+
+	// proxyV2CmdLocal is the LOCAL command, the connection was established by
+	// the proxy itself, e.g. for health checks.
+	proxyV2CmdLocal = 0x00
+
+	// proxyV2CmdProxy is the PROXY command.
+	proxyV2CmdProxy = 0x01
+
+	// proxyV2FamilyTCP4 and proxyV2FamilyTCP6 are the address families and
+	// protocols of TCP over IPv4 and IPv6.
+	proxyV2FamilyTCP4 = 0x11
+	proxyV2FamilyTCP6 = 0x21
+
+	// proxyV2TypeAuthority is the type of the TLV with the host name the
+	// client connected to.
+	proxyV2TypeAuthority = 0x02
+)
+
+// proxyV2Signature is the signature of the PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolVersion is the version of the PROXY protocol header the relay
+// sends to the remote server.
+type ProxyProtocolVersion uint8
+
+// Supported ProxyProtocolVersion values.
+const (
+	// ProxyProtocolNone means that no header is sent.
+	ProxyProtocolNone ProxyProtocolVersion = iota
+
+	// ProxyProtocolV1 is the human-readable PROXY protocol v1.
+	ProxyProtocolV1
+
+	// ProxyProtocolV2 is the binary PROXY protocol v2.  The header also
+	// contains the server name in the PP2_TYPE_AUTHORITY TLV.
+	ProxyProtocolV2
+)
+
+// Errors returned by the PROXY protocol parser.
+const (
+	errProxyMissing   errors.Error = "no proxy protocol header"
+	errProxyMalformed errors.Error = "malformed proxy protocol header"
+	errProxyTooLarge  errors.Error = "proxy protocol header is too large"
+)
+
+// proxyHeader is a parsed PROXY protocol header.
+type proxyHeader struct {
+	// srcAddr is the address of the client.  It is not valid if the header
+	// has the LOCAL command or an unknown address family, in which case the
+	// address of the peer must be used.
+	srcAddr netip.AddrPort
+
+	// dstAddr is the address the client connected to.
+	dstAddr netip.AddrPort
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header from the reader.
+// newReader returns the bytes that were read after the header and then the
+// rest of the data from the reader.
+func readProxyHeader(reader io.Reader) (hdr *proxyHeader, newReader io.Reader, err error) {
+	buf := make([]byte, proxyV2MaxLen)
+	n, err := io.ReadAtLeast(reader, buf, proxyMinReadLen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading proxy protocol header: %w", err)
+	}
+
+	var hdrLen int
+	switch {
+	case bytes.HasPrefix(buf, []byte(proxyV1Prefix)):
+		hdr, hdrLen, n, err = readProxyV1(reader, buf, n)
+	case bytes.HasPrefix(proxyV2Signature, buf[:proxyMinReadLen]):
+		hdr, hdrLen, n, err = readProxyV2(reader, buf, n)
+	default:
+		return nil, nil, errProxyMissing
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hdr, newPrefixedReader(buf[hdrLen:n], reader), nil
+}
+
+// readProxyV1 reads the rest of the v1 header into buf, n is the number of
+// bytes that have already been read.  hdrLen is the length of the header.
+func readProxyV1(
+	reader io.Reader,
+	buf []byte,
+	n int,
+) (hdr *proxyHeader, hdrLen, newN int, err error) {
+	for {
+		if i := bytes.Index(buf[:n], []byte("\r\n")); i >= 0 {
+			hdrLen = i + 2
+
+			break
+		}
+
+		if n >= proxyV1MaxLen {
+			return nil, 0, 0, errProxyTooLarge
+		}
+
+		var m int
+		m, err = reader.Read(buf[n:proxyV1MaxLen])
+		n += m
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("reading proxy protocol header: %w", err)
+		}
+	}
+
+	if hdrLen > proxyV1MaxLen {
+		return nil, 0, 0, errProxyTooLarge
+	}
+
+	hdr, err = parseProxyV1(string(buf[len(proxyV1Prefix) : hdrLen-2]))
+
+	return hdr, hdrLen, n, err
+}
+
+// parseProxyV1 parses the v1 header line without the "PROXY " prefix and the
+// trailing CRLF.
+func parseProxyV1(line string) (hdr *proxyHeader, err error) {
+	fields := strings.Split(line, " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return &proxyHeader{}, nil
+	case "TCP4", "TCP6":
+		// Go on.
+	default:
+		return nil, fmt.Errorf("%w: bad protocol %q", errProxyMalformed, fields[0])
+	}
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: bad number of fields", errProxyMalformed)
+	}
+
+	hdr = &proxyHeader{}
+	hdr.srcAddr, err = parseProxyV1Addr(fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.dstAddr, err = parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.srcAddr.Addr().Is4() != (fields[0] == "TCP4") {
+		return nil, fmt.Errorf("%w: address family mismatch", errProxyMalformed)
+	}
+
+	return hdr, nil
+}
+
+// parseProxyV1Addr parses the address and the port from the v1 header.
+func parseProxyV1Addr(addrStr, portStr string) (addrPort netip.AddrPort, err error) {
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return addrPort, fmt.Errorf("%w: %w", errProxyMalformed, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return addrPort, fmt.Errorf("%w: %w", errProxyMalformed, err)
+	}
+
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// readProxyV2 reads the rest of the v2 header into buf, n is the number of
+// bytes that have already been read.  hdrLen is the length of the header.
+func readProxyV2(
+	reader io.Reader,
+	buf []byte,
+	n int,
+) (hdr *proxyHeader, hdrLen, newN int, err error) {
+	if n < proxyV2HeaderLen {
+		var m int
+		m, err = io.ReadAtLeast(reader, buf[n:], proxyV2HeaderLen-n)
+		n += m
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("reading proxy protocol header: %w", err)
+		}
+	}
+
+	if !bytes.HasPrefix(buf, proxyV2Signature) {
+		return nil, 0, 0, errProxyMissing
+	}
+
+	hdrLen = proxyV2HeaderLen + int(binary.BigEndian.Uint16(buf[14:]))
+	if hdrLen > len(buf) {
+		return nil, 0, 0, errProxyTooLarge
+	}
+
+	if n < hdrLen {
+		var m int
+		m, err = io.ReadAtLeast(reader, buf[n:], hdrLen-n)
+		n += m
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("reading proxy protocol header: %w", err)
+		}
+	}
+
+	hdr, err = parseProxyV2(buf[:hdrLen])
+
+	return hdr, hdrLen, n, err
+}
+
+// parseProxyV2 parses the whole v2 header.
+func parseProxyV2(b []byte) (hdr *proxyHeader, err error) {
+	verCmd, family := b[12], b[13]
+	if verCmd&0xf0 != proxyV2Version {
+		return nil, fmt.Errorf("%w: bad version %#x", errProxyMalformed, verCmd>>4)
+	}
+
+	hdr = &proxyHeader{}
+	switch verCmd & 0x0f {
+	case proxyV2CmdLocal:
+		return hdr, nil
+	case proxyV2CmdProxy:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("%w: bad command %#x", errProxyMalformed, verCmd&0x0f)
+	}
+
+	addrs := b[proxyV2HeaderLen:]
+	switch family {
+	case proxyV2FamilyTCP4:
+		if len(addrs) < 12 {
+			return nil, fmt.Errorf("%w: short ipv4 addresses", errProxyMalformed)
+		}
+
+		hdr.srcAddr = netip.AddrPortFrom(
+			netip.AddrFrom4([4]byte(addrs[0:4])),
+			binary.BigEndian.Uint16(addrs[8:]),
+		)
+		hdr.dstAddr = netip.AddrPortFrom(
+			netip.AddrFrom4([4]byte(addrs[4:8])),
+			binary.BigEndian.Uint16(addrs[10:]),
+		)
+	case proxyV2FamilyTCP6:
+		if len(addrs) < 36 {
+			return nil, fmt.Errorf("%w: short ipv6 addresses", errProxyMalformed)
+		}
+
+		hdr.srcAddr = netip.AddrPortFrom(
+			netip.AddrFrom16([16]byte(addrs[0:16])).Unmap(),
+			binary.BigEndian.Uint16(addrs[32:]),
+		)
+		hdr.dstAddr = netip.AddrPortFrom(
+			netip.AddrFrom16([16]byte(addrs[16:32])).Unmap(),
+			binary.BigEndian.Uint16(addrs[34:]),
+		)
+	default:
+		// Other families, e.g. UDP or UNIX sockets, are not relevant for
+		// snirelay, so the address of the peer is used.
+	}
+
+	return hdr, nil
+}
+
+// appendProxyHeader appends the PROXY protocol header of the specified version
+// to b.  src is the address of the client, dst is the address the client
+// connected to.  If the address families differ, IPv4 addresses are mapped to
+// IPv6 ones.
+func appendProxyHeader(
+	b []byte,
+	version ProxyProtocolVersion,
+	src netip.AddrPort,
+	dst netip.AddrPort,
+	serverName string,
+) (res []byte) {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	ipv4 := srcIP.Is4() && dstIP.Is4()
+	if !ipv4 {
+		srcIP = netip.AddrFrom16(srcIP.As16())
+		dstIP = netip.AddrFrom16(dstIP.As16())
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+
+		return fmt.Appendf(
+			b,
+			"%s%s %s %s %d %d\r\n",
+			proxyV1Prefix,
+			proto,
+			srcIP,
+			dstIP,
+			src.Port(),
+			dst.Port(),
+		)
+	case ProxyProtocolV2:
+		return appendProxyV2(b, srcIP, dstIP, src.Port(), dst.Port(), serverName)
+	default:
+		return b
+	}
+}
+
+// appendProxyV2 appends the PROXY protocol v2 header with the PROXY command to
+// b.  srcIP and dstIP must have the same address family.
+func appendProxyV2(
+	b []byte,
+	srcIP netip.Addr,
+	dstIP netip.Addr,
+	srcPort uint16,
+	dstPort uint16,
+	serverName string,
+) (res []byte) {
+	family := byte(proxyV2FamilyTCP6)
+	if srcIP.Is4() {
+		family = proxyV2FamilyTCP4
+	}
+
+	addrsLen := 2*len(srcIP.AsSlice()) + 4
+
+	// Server names are never longer than 253 characters, but check anyway to
+	// keep the TLV length correct.
+	tlvLen := 0
+	if serverName != "" && len(serverName) <= 0xffff-3-addrsLen {
+		tlvLen = 3 + len(serverName)
+	}
+
+	b = append(b, proxyV2Signature...)
+	b = append(b, proxyV2Version|proxyV2CmdProxy, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(addrsLen+tlvLen))
+	b = append(b, srcIP.AsSlice()...)
+	b = append(b, dstIP.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	b = binary.BigEndian.AppendUint16(b, dstPort)
+
+	if tlvLen > 0 {
+		b = append(b, proxyV2TypeAuthority)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(serverName)))
+		b = append(b, serverName...)
+	}
+
+	return b
+}
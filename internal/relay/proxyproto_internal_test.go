@@ -0,0 +1,234 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	const payload = "GET / HTTP/1.1\r\n"
+
+	v2Header := func(cmd, family byte, addrs []byte) (b []byte) {
+		b = append(b, proxyV2Signature...)
+		b = append(b, proxyV2Version|cmd, family, 0, byte(len(addrs)))
+
+		return append(b, addrs...)
+	}
+
+	testCases := []struct {
+		wantSrc netip.AddrPort
+		wantDst netip.AddrPort
+		name    string
+		header  []byte
+	}{{
+		wantSrc: netip.MustParseAddrPort("192.0.2.1:56324"),
+		wantDst: netip.MustParseAddrPort("198.51.100.1:443"),
+		name:    "v1_tcp4",
+		header:  []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+	}, {
+		wantSrc: netip.MustParseAddrPort("[2001:db8::1]:56324"),
+		wantDst: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		name:    "v1_tcp6",
+		header:  []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+	}, {
+		name:   "v1_unknown",
+		header: []byte("PROXY UNKNOWN\r\n"),
+	}, {
+		wantSrc: netip.MustParseAddrPort("192.0.2.1:56324"),
+		wantDst: netip.MustParseAddrPort("198.51.100.1:443"),
+		name:    "v2_tcp4",
+		header: v2Header(proxyV2CmdProxy, proxyV2FamilyTCP4, []byte{
+			192, 0, 2, 1,
+			198, 51, 100, 1,
+			0xdc, 0x04,
+			0x01, 0xbb,
+		}),
+	}, {
+		wantSrc: netip.MustParseAddrPort("[2001:db8::1]:56324"),
+		wantDst: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		name:    "v2_tcp6",
+		header: v2Header(proxyV2CmdProxy, proxyV2FamilyTCP6, []byte{
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0xdc, 0x04,
+			0x01, 0xbb,
+		}),
+	}, {
+		wantSrc: netip.MustParseAddrPort("192.0.2.1:56324"),
+		wantDst: netip.MustParseAddrPort("198.51.100.1:443"),
+		name:    "v2_tcp4_tlv",
+		header: v2Header(proxyV2CmdProxy, proxyV2FamilyTCP4, []byte{
+			192, 0, 2, 1,
+			198, 51, 100, 1,
+			0xdc, 0x04,
+			0x01, 0xbb,
+			// PP2_TYPE_AUTHORITY with "a.b".
+			0x02, 0x00, 0x03, 'a', '.', 'b',
+		}),
+	}, {
+		name:   "v2_local",
+		header: v2Header(proxyV2CmdLocal, 0, nil),
+	}}
+
+	for _, tc := range testCases {
+		data := append(bytes.Clone(tc.header), payload...)
+
+		readers := map[string]func() io.Reader{
+			"whole": func() io.Reader { return bytes.NewReader(data) },
+			"one_byte": func() io.Reader {
+				return iotest.OneByteReader(bytes.NewReader(data))
+			},
+		}
+
+		for rName, newReader := range readers {
+			t.Run(tc.name+"_"+rName, func(t *testing.T) {
+				hdr, r, err := readProxyHeader(newReader())
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.wantSrc, hdr.srcAddr)
+				assert.Equal(t, tc.wantDst, hdr.dstAddr)
+
+				rest, err := io.ReadAll(r)
+				require.NoError(t, err)
+
+				assert.Equal(t, payload, string(rest))
+			})
+		}
+	}
+}
+
+func TestReadProxyHeader_invalid(t *testing.T) {
+	testCases := []struct {
+		wantErr error
+		name    string
+		data    string
+	}{{
+		wantErr: errProxyMissing,
+		name:    "no_header",
+		data:    "GET / HTTP/1.1\r\n\r\n",
+	}, {
+		wantErr: errProxyMalformed,
+		name:    "v1_bad_proto",
+		data:    "PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n",
+	}, {
+		wantErr: errProxyMalformed,
+		name:    "v1_bad_addr",
+		data:    "PROXY TCP4 192.0.2 198.51.100.1 1 2\r\n",
+	}, {
+		wantErr: errProxyMalformed,
+		name:    "v1_family_mismatch",
+		data:    "PROXY TCP6 192.0.2.1 198.51.100.1 1 2\r\n",
+	}, {
+		wantErr: errProxyMalformed,
+		name:    "v1_bad_port",
+		data:    "PROXY TCP4 192.0.2.1 198.51.100.1 1 65536\r\n",
+	}, {
+		wantErr: errProxyTooLarge,
+		name:    "v1_too_long",
+		data:    "PROXY TCP4 " + string(bytes.Repeat([]byte{'1'}, proxyV1MaxLen)) + "\r\n",
+	}, {
+		wantErr: errProxyMalformed,
+		name:    "v2_bad_version",
+		data:    string(proxyV2Signature) + "\x11\x11\x00\x00",
+	}, {
+		wantErr: errProxyMalformed,
+		name:    "v2_short_addrs",
+		data:    string(proxyV2Signature) + "\x21\x11\x00\x04\x01\x02\x03\x04",
+	}, {
+		wantErr: errProxyTooLarge,
+		name:    "v2_too_large",
+		data:    string(proxyV2Signature) + "\x21\x11\xff\xff",
+	}, {
+		wantErr: io.EOF,
+		name:    "v2_truncated",
+		data:    string(proxyV2Signature) + "\x21\x11\x00\x0c\x01",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := readProxyHeader(bytes.NewReader([]byte(tc.data)))
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestSettings_proxyProtocolTrustedAddr(t *testing.T) {
+	st := &settings{
+		proxyProtocolTrusted: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("2001:db8::/32"),
+		},
+	}
+
+	assert.True(t, st.proxyProtocolTrustedAddr(netip.MustParseAddr("10.1.2.3")))
+	assert.True(t, st.proxyProtocolTrustedAddr(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, st.proxyProtocolTrustedAddr(netip.MustParseAddr("192.0.2.1")))
+}
+
+func TestAppendProxyHeader(t *testing.T) {
+	const serverName = "www.example.org"
+
+	testCases := []struct {
+		src     netip.AddrPort
+		dst     netip.AddrPort
+		wantSrc netip.AddrPort
+		wantDst netip.AddrPort
+		name    string
+		wantV1  string
+	}{{
+		src:     netip.MustParseAddrPort("192.0.2.1:56324"),
+		dst:     netip.MustParseAddrPort("198.51.100.1:443"),
+		wantSrc: netip.MustParseAddrPort("192.0.2.1:56324"),
+		wantDst: netip.MustParseAddrPort("198.51.100.1:443"),
+		name:    "ipv4",
+		wantV1:  "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+	}, {
+		src:     netip.MustParseAddrPort("[2001:db8::1]:56324"),
+		dst:     netip.MustParseAddrPort("[2001:db8::2]:443"),
+		wantSrc: netip.MustParseAddrPort("[2001:db8::1]:56324"),
+		wantDst: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		name:    "ipv6",
+		wantV1:  "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+	}, {
+		src:     netip.MustParseAddrPort("192.0.2.1:56324"),
+		dst:     netip.MustParseAddrPort("[2001:db8::2]:443"),
+		wantSrc: netip.MustParseAddrPort("192.0.2.1:56324"),
+		wantDst: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		name:    "mixed",
+		wantV1:  "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name+"_v1", func(t *testing.T) {
+			b := appendProxyHeader(nil, ProxyProtocolV1, tc.src, tc.dst, serverName)
+			assert.Equal(t, tc.wantV1, string(b))
+		})
+
+		t.Run(tc.name+"_v2", func(t *testing.T) {
+			b := appendProxyHeader(nil, ProxyProtocolV2, tc.src, tc.dst, serverName)
+
+			tlv := append([]byte{proxyV2TypeAuthority, 0, byte(len(serverName))}, serverName...)
+			require.True(t, bytes.HasSuffix(b, tlv))
+
+			hdr, r, err := readProxyHeader(bytes.NewReader(b))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantSrc, hdr.srcAddr)
+			assert.Equal(t, tc.wantDst, hdr.dstAddr)
+
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+
+			assert.Empty(t, rest)
+		})
+	}
+
+	b := appendProxyHeader(nil, ProxyProtocolNone, testCases[0].src, testCases[0].dst, serverName)
+	assert.Empty(t, b)
+}
@@ -0,0 +1,440 @@
+package relay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUIC versions the relay is able to decrypt Initial packets of.
+const (
+	// quicVersion1 is QUIC version 1, see RFC 9000.
+	quicVersion1 uint32 = 0x00000001
+
+	// quicVersion2 is QUIC version 2, see RFC 9369.
+	quicVersion2 uint32 = 0x6b3343cf
+)
+
+// QUIC frame types that can be found in client Initial packets.
+const (
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameACK             = 0x02
+	quicFrameACKECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+)
+
+const (
+	// quicMaxConnIDLen is the maximum length of a QUIC connection ID.
+	quicMaxConnIDLen = 20
+
+	// quicSampleLen is the length of the header protection sample.
+	quicSampleLen = 16
+
+	// quicMaxPNLen is the maximum length of the packet number field.
+	quicMaxPNLen = 4
+)
+
+// Errors returned by the QUIC Initial packet parser.
+const (
+	errQUICNotLongHeader errors.Error = "not a quic long header packet"
+	errQUICVersion       errors.Error = "unsupported quic version"
+	errQUICMalformed     errors.Error = "malformed quic packet"
+	errQUICDecrypt       errors.Error = "failed to decrypt quic initial packet"
+	errQUICFrame         errors.Error = "unexpected frame in quic initial packet"
+)
+
+// quicInitialSalts are the salts used to derive Initial secrets for the
+// supported QUIC versions.
+var quicInitialSalts = map[uint32][]byte{
+	quicVersion1: {
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	},
+	quicVersion2: {
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	},
+}
+
+// quicKeys are the client Initial packet protection keys.
+type quicKeys struct {
+	aead cipher.AEAD
+	hp   cipher.Block
+	iv   []byte
+}
+
+// newQUICKeys derives the client Initial keys from the Destination
+// Connection ID of the first client Initial packet, see RFC 9001, Section 5.2.
+func newQUICKeys(version uint32, dcid []byte) (keys *quicKeys, err error) {
+	salt, ok := quicInitialSalts[version]
+	if !ok {
+		return nil, errQUICVersion
+	}
+
+	labelPrefix := "quic "
+	if version == quicVersion2 {
+		labelPrefix = "quicv2 "
+	}
+
+	initialSecret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+
+	key := hkdfExpandLabel(clientSecret, labelPrefix+"key", 16)
+	hpKey := hkdfExpandLabel(clientSecret, labelPrefix+"hp", 16)
+
+	keys = &quicKeys{
+		iv: hkdfExpandLabel(clientSecret, labelPrefix+"iv", 12),
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.hp, err = aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from RFC 8446, Section 7.1,
+// with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) (out []byte) {
+	const prefix = "tls13 "
+
+	info := make([]byte, 0, 2+1+len(prefix)+len(label)+1)
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(prefix)+len(label)))
+	info = append(info, prefix...)
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out = make([]byte, length)
+	_, err := hkdf.Expand(sha256.New, secret, info).Read(out)
+	if err != nil {
+		// Should never happen, since the length is small.
+		panic(err)
+	}
+
+	return out
+}
+
+// quicLongHeader contains the fields of a QUIC long header packet that the
+// relay needs.
+type quicLongHeader struct {
+	// dcid is the Destination Connection ID.
+	dcid []byte
+
+	// packet is the whole packet including the header.
+	packet []byte
+
+	// pnOffset is the offset of the packet number field in packet.
+	pnOffset int
+
+	// version is the QUIC version.
+	version uint32
+
+	// initial is true if this is an Initial packet.
+	initial bool
+}
+
+// parseQUICLongHeader parses the first QUIC packet of the datagram.  rest is
+// the remainder of the datagram that may contain coalesced packets.
+func parseQUICLongHeader(datagram []byte) (hdr *quicLongHeader, rest []byte, err error) {
+	if len(datagram) < 7 || datagram[0]&0x80 == 0 {
+		return nil, nil, errQUICNotLongHeader
+	}
+
+	hdr = &quicLongHeader{
+		version: binary.BigEndian.Uint32(datagram[1:]),
+	}
+
+	if _, ok := quicInitialSalts[hdr.version]; !ok {
+		return nil, nil, errQUICVersion
+	}
+
+	pktType := datagram[0] >> 4 & 0x03
+	if hdr.version == quicVersion2 {
+		hdr.initial = pktType == 0b01
+	} else {
+		hdr.initial = pktType == 0b00
+	}
+
+	s := datagram[5:]
+
+	var scid []byte
+	var ok bool
+	hdr.dcid, s, ok = readUint8Prefixed(s)
+	if !ok || len(hdr.dcid) > quicMaxConnIDLen {
+		return nil, nil, errQUICMalformed
+	}
+
+	scid, s, ok = readUint8Prefixed(s)
+	if !ok || len(scid) > quicMaxConnIDLen {
+		return nil, nil, errQUICMalformed
+	}
+
+	if hdr.initial {
+		var tokenLen uint64
+		if tokenLen, s, ok = readVarint(s); !ok || uint64(len(s)) < tokenLen {
+			return nil, nil, errQUICMalformed
+		}
+
+		s = s[tokenLen:]
+	}
+
+	var length uint64
+	if length, s, ok = readVarint(s); !ok || uint64(len(s)) < length {
+		return nil, nil, errQUICMalformed
+	}
+
+	hdr.pnOffset = len(datagram) - len(s)
+	end := hdr.pnOffset + int(length)
+	hdr.packet = datagram[:end]
+
+	return hdr, datagram[end:], nil
+}
+
+// decryptQUICInitial removes the header protection and decrypts the Initial
+// packet described by hdr.  The packet is copied, so the datagram remains
+// unchanged.  payload contains the packet frames.
+func decryptQUICInitial(hdr *quicLongHeader, keys *quicKeys) (payload []byte, err error) {
+	pkt := slices.Clone(hdr.packet)
+	if len(pkt) < hdr.pnOffset+quicMaxPNLen+quicSampleLen {
+		return nil, errQUICMalformed
+	}
+
+	sample := pkt[hdr.pnOffset+quicMaxPNLen : hdr.pnOffset+quicMaxPNLen+quicSampleLen]
+
+	var mask [aes.BlockSize]byte
+	keys.hp.Encrypt(mask[:], sample)
+
+	pkt[0] ^= mask[0] & 0x0f
+	pnLen := int(pkt[0]&0x03) + 1
+
+	var pn uint64
+	for i := range pnLen {
+		pkt[hdr.pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(pkt[hdr.pnOffset+i])
+	}
+
+	// The packet numbers of the first client packets are small, so there is
+	// no need to reconstruct the full packet number.
+	nonce := slices.Clone(keys.iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	headerLen := hdr.pnOffset + pnLen
+	payload, err = keys.aead.Open(pkt[headerLen:headerLen], nonce, pkt[headerLen:], pkt[:headerLen])
+	if err != nil {
+		return nil, errQUICDecrypt
+	}
+
+	return payload, nil
+}
+
+// quicCryptoFrame is a CRYPTO frame.
+type quicCryptoFrame struct {
+	data   []byte
+	offset uint64
+}
+
+// parseQUICInitialFrames parses the frames of a client Initial packet and
+// returns the CRYPTO frames.  Other frames that are allowed in Initial
+// packets are skipped.
+func parseQUICInitialFrames(payload []byte) (frames []quicCryptoFrame, err error) {
+	s := payload
+	for len(s) > 0 {
+		frameType := s[0]
+		s = s[1:]
+
+		var ok bool
+		switch frameType {
+		case quicFramePadding, quicFramePing:
+			ok = true
+		case quicFrameACK, quicFrameACKECN:
+			s, ok = skipQUICACK(s, frameType == quicFrameACKECN)
+		case quicFrameCrypto:
+			var f quicCryptoFrame
+			f, s, ok = readQUICCryptoFrame(s)
+			frames = append(frames, f)
+		case quicFrameConnectionClose:
+			// The client closes the connection, there is nothing to relay.
+			return nil, errQUICFrame
+		default:
+			return nil, errQUICFrame
+		}
+
+		if !ok {
+			return nil, errQUICMalformed
+		}
+	}
+
+	return frames, nil
+}
+
+// readQUICCryptoFrame reads the CRYPTO frame without the type byte from s.
+func readQUICCryptoFrame(s []byte) (f quicCryptoFrame, rest []byte, ok bool) {
+	var length uint64
+	if f.offset, s, ok = readVarint(s); !ok {
+		return f, nil, false
+	}
+
+	if length, s, ok = readVarint(s); !ok || uint64(len(s)) < length {
+		return f, nil, false
+	}
+
+	f.data = s[:length]
+
+	return f, s[length:], true
+}
+
+// skipQUICACK skips the ACK frame without the type byte, see RFC 9000,
+// Section 19.3.
+func skipQUICACK(s []byte, ecn bool) (rest []byte, ok bool) {
+	var rangeCount uint64
+
+	// Largest Acknowledged, ACK Delay, ACK Range Count, First ACK Range.
+	for i := range 4 {
+		var v uint64
+		if v, s, ok = readVarint(s); !ok {
+			return nil, false
+		}
+
+		if i == 2 {
+			rangeCount = v
+		}
+	}
+
+	// Each ACK Range consists of Gap and ACK Range Length.
+	n := rangeCount * 2
+	if ecn {
+		// ECT0, ECT1 and ECN-CE counts.
+		n += 3
+	}
+
+	for range n {
+		if _, s, ok = readVarint(s); !ok {
+			return nil, false
+		}
+	}
+
+	return s, true
+}
+
+// readVarint reads a QUIC variable-length integer from s, see RFC 9000,
+// Section 16.
+func readVarint(s []byte) (v uint64, rest []byte, ok bool) {
+	if len(s) == 0 {
+		return 0, nil, false
+	}
+
+	n := 1 << (s[0] >> 6)
+	if len(s) < n {
+		return 0, nil, false
+	}
+
+	v = uint64(s[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(s[i])
+	}
+
+	return v, s[n:], true
+}
+
+// quicCryptoStream reassembles the data of CRYPTO frames that may arrive out
+// of order and in several packets.
+type quicCryptoStream struct {
+	// buf is the stream data, some parts of it may not be received yet.
+	buf []byte
+
+	// ranges are the sorted non-overlapping ranges of buf that were received.
+	ranges []quicRange
+}
+
+// quicRange is a range of the CRYPTO stream, end is exclusive.
+type quicRange struct {
+	start int
+	end   int
+}
+
+// write adds the data of the CRYPTO frame to the stream.
+func (s *quicCryptoStream) write(f quicCryptoFrame) (err error) {
+	if f.offset+uint64(len(f.data)) > maxClientHelloLen {
+		return errHelloTooLarge
+	}
+
+	if len(f.data) == 0 {
+		return nil
+	}
+
+	start := int(f.offset)
+	end := start + len(f.data)
+	if end > len(s.buf) {
+		s.buf = append(s.buf, make([]byte, end-len(s.buf))...)
+	}
+
+	copy(s.buf[start:end], f.data)
+
+	s.ranges = append(s.ranges, quicRange{start: start, end: end})
+	slices.SortFunc(s.ranges, func(a, b quicRange) (res int) {
+		return a.start - b.start
+	})
+
+	merged := s.ranges[:1]
+	for _, r := range s.ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end {
+			last.end = max(last.end, r.end)
+		} else {
+			merged = append(merged, r)
+		}
+	}
+
+	s.ranges = merged
+
+	return nil
+}
+
+// clientHello returns the ClientHello handshake message once it is fully
+// received, otherwise it returns nil.
+func (s *quicCryptoStream) clientHello() (msg []byte, err error) {
+	if len(s.ranges) == 0 || s.ranges[0].start != 0 {
+		return nil, nil
+	}
+
+	data := s.buf[:s.ranges[0].end]
+	if len(data) < handshakeHeaderLen {
+		return nil, nil
+	}
+
+	if data[0] != handshakeTypeClientHello {
+		return nil, errNotClientHello
+	}
+
+	msgLen := handshakeHeaderLen + (int(data[1])<<16 | int(data[2])<<8 | int(data[3]))
+	if msgLen > maxClientHelloLen {
+		return nil, errHelloTooLarge
+	}
+
+	if len(data) < msgLen {
+		return nil, nil
+	}
+
+	return data[:msgLen], nil
+}
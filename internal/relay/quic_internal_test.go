@@ -0,0 +1,237 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mustHex decodes the hex string and panics on error.
+func mustHex(s string) (b []byte) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestHKDFExpandLabel(t *testing.T) {
+	// The test vectors are from RFC 9001, Appendix A.1.
+	initialSecret := mustHex("7db5df06e7a69e432496adedb00851923595221596ae2ae9fb8115c1e9ed0a44")
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+
+	assert.Equal(
+		t,
+		"c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea",
+		hex.EncodeToString(clientSecret),
+	)
+	assert.Equal(
+		t,
+		"1f369613dd76d5467730efcbe3b1a22d",
+		hex.EncodeToString(hkdfExpandLabel(clientSecret, "quic key", 16)),
+	)
+	assert.Equal(
+		t,
+		"fa044b2f42a3fd3b46fb255c",
+		hex.EncodeToString(hkdfExpandLabel(clientSecret, "quic iv", 12)),
+	)
+	assert.Equal(
+		t,
+		"9f50449e04a0e810283a1e9933adedd2",
+		hex.EncodeToString(hkdfExpandLabel(clientSecret, "quic hp", 16)),
+	)
+}
+
+func TestNewQUICKeys(t *testing.T) {
+	dcid := mustHex("8394c8f03e515708")
+
+	testCases := []struct {
+		name    string
+		wantIV  string
+		version uint32
+	}{{
+		name:    "v1",
+		wantIV:  "fa044b2f42a3fd3b46fb255c",
+		version: quicVersion1,
+	}, {
+		name:    "v2",
+		wantIV:  "91f73e2351d8fa91660e909f",
+		version: quicVersion2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := newQUICKeys(tc.version, dcid)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantIV, hex.EncodeToString(keys.iv))
+		})
+	}
+
+	_, err := newQUICKeys(0xff00001d, dcid)
+	assert.ErrorIs(t, err, errQUICVersion)
+}
+
+// captureQUICInitial makes quic-go connect to a local UDP socket and returns
+// the datagrams it sends until the handshake times out.
+func captureQUICInitial(t *testing.T, version quic.Version, serverName string) (datagrams [][]byte) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	go func() {
+		_, _ = quic.DialAddr(
+			ctx,
+			conn.LocalAddr().String(),
+			&tls.Config{ServerName: serverName, NextProtos: []string{"h3"}},
+			&quic.Config{Versions: []quic.Version{version}},
+		)
+	}()
+
+	buf := make([]byte, maxUDPDatagramLen)
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+
+		n, rErr := conn.Read(buf)
+		if rErr != nil {
+			break
+		}
+
+		datagrams = append(datagrams, append([]byte(nil), buf[:n]...))
+	}
+
+	require.NotEmpty(t, datagrams)
+
+	return datagrams
+}
+
+func TestQUICFlow_readClientHello(t *testing.T) {
+	const serverName = "www.example.org"
+
+	testCases := []struct {
+		name    string
+		version quic.Version
+	}{{
+		name:    "v1",
+		version: quic.Version1,
+	}, {
+		name:    "v2",
+		version: quic.Version2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			datagrams := captureQUICInitial(t, tc.version, serverName)
+
+			hdr, _, err := parseQUICLongHeader(datagrams[0])
+			require.NoError(t, err)
+			require.True(t, hdr.initial)
+
+			keys, err := newQUICKeys(hdr.version, hdr.dcid)
+			require.NoError(t, err)
+
+			f := &quicFlow{
+				keys:   keys,
+				crypto: &quicCryptoStream{},
+			}
+
+			var msg []byte
+			for _, d := range datagrams {
+				orig := append([]byte(nil), d...)
+
+				msg, err = f.readClientHello(d)
+				require.NoError(t, err)
+
+				// The datagram must be relayed unchanged.
+				require.Equal(t, orig, d)
+
+				if msg != nil {
+					break
+				}
+			}
+
+			require.NotNil(t, msg)
+
+			hello := &clientHello{}
+			require.NoError(t, parseClientHello(hello, msg))
+
+			assert.Equal(t, serverName, hello.serverName())
+			assert.Equal(t, []string{"h3"}, hello.alpnProtocols())
+			assert.Regexp(t, `^q13d`, newFingerprint(hello, true).ja4)
+		})
+	}
+}
+
+func TestQUICCryptoStream(t *testing.T) {
+	msg := []byte{handshakeTypeClientHello, 0, 0, 6, 1, 2, 3, 4, 5, 6}
+
+	s := &quicCryptoStream{}
+
+	require.NoError(t, s.write(quicCryptoFrame{data: msg[6:], offset: 6}))
+	got, err := s.clientHello()
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	require.NoError(t, s.write(quicCryptoFrame{data: msg[:3], offset: 0}))
+	got, err = s.clientHello()
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Overlapping frame.
+	require.NoError(t, s.write(quicCryptoFrame{data: msg[2:7], offset: 2}))
+	got, err = s.clientHello()
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	err = s.write(quicCryptoFrame{data: []byte{1}, offset: maxClientHelloLen})
+	assert.ErrorIs(t, err, errHelloTooLarge)
+
+	s = &quicCryptoStream{}
+	require.NoError(t, s.write(quicCryptoFrame{data: []byte{2, 0, 0, 0}}))
+	_, err = s.clientHello()
+	assert.ErrorIs(t, err, errNotClientHello)
+}
+
+func TestParseQUICLongHeader_invalid(t *testing.T) {
+	testCases := []struct {
+		wantErr  error
+		name     string
+		datagram []byte
+	}{{
+		wantErr:  errQUICNotLongHeader,
+		name:     "short_header",
+		datagram: []byte{0x40, 0, 0, 0, 1, 0, 0},
+	}, {
+		wantErr:  errQUICVersion,
+		name:     "unknown_version",
+		datagram: []byte{0xc0, 0xff, 0, 0, 0x1d, 0, 0},
+	}, {
+		wantErr:  errQUICMalformed,
+		name:     "truncated",
+		datagram: []byte{0xc0, 0, 0, 0, 1, 8, 0},
+	}, {
+		wantErr:  errQUICMalformed,
+		name:     "bad_length",
+		datagram: []byte{0xc0, 0, 0, 0, 1, 0, 0, 0, 0x10},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseQUICLongHeader(tc.datagram)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
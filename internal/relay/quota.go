@@ -0,0 +1,170 @@
+package relay
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/ameshkov/snirelay/internal/quota"
+)
+
+// Prefixes of the keys of the clients in the quota store.
+const (
+	quotaKeyPrefixIP   = "ip:"
+	quotaKeyPrefixUser = "user:"
+)
+
+// QuotaUser is a client identified by its networks.  The traffic of all its
+// addresses is counted together and limited by its own quotas.
+type QuotaUser struct {
+	// Name is the unique name of the user.  The usage is stored by it, so
+	// changing it resets the usage.
+	Name string
+
+	// Networks are the networks of the user.
+	Networks []netip.Prefix
+
+	// Daily and Monthly are the maximum traffic of the user, in bytes, in a
+	// UTC day and month.  If zero, the traffic is not limited.
+	Daily   int64
+	Monthly int64
+}
+
+// quotaLimits are the traffic quotas of a client in bytes.  Zero values mean
+// no limit.
+type quotaLimits struct {
+	daily   uint64
+	monthly uint64
+}
+
+// exhausted returns true if u has reached one of the limits.
+func (l quotaLimits) exhausted(u quota.Usage) (ok bool) {
+	return l.daily > 0 && u.Daily >= l.daily || l.monthly > 0 && u.Monthly >= l.monthly
+}
+
+// quotaClient returns the key of the client with addr in the quota store and
+// its quotas.  The users are identified by their networks, the other clients
+// by their IP addresses.
+func (st *settings) quotaClient(addr netip.Addr) (key string, l quotaLimits) {
+	addr = addr.Unmap()
+	for _, u := range st.quotaUsers {
+		if containsAddr(u.Networks, addr) {
+			return quotaKeyPrefixUser + u.Name, quotaLimits{
+				daily:   uint64(u.Daily),
+				monthly: uint64(u.Monthly),
+			}
+		}
+	}
+
+	return quotaKeyPrefixIP + addr.String(), st.quotaLimits
+}
+
+// quotaExhausted returns true if the client with addr must not open new
+// connections since its quota is exhausted.
+func (s *Server) quotaExhausted(st *settings, addr netip.Addr) (ok bool) {
+	if s.quotas == nil {
+		return false
+	}
+
+	key, l := st.quotaClient(addr)
+
+	return l.exhausted(s.quotas.Usage(key, time.Now()))
+}
+
+// addQuotaUsage adds n bytes of the traffic of c to the usage of the client
+// with addr and the key.  If the quota of the client gets exhausted and the
+// existing connections must be cut, all its connections, including c, are
+// closed.
+func (s *Server) addQuotaUsage(c *activeConn, addr netip.Addr, key string, n int64) {
+	if s.quotas == nil || n <= 0 {
+		return
+	}
+
+	st := s.settings.Load()
+	u := s.quotas.Add(key, uint64(n), time.Now())
+	if !st.quotaCutExisting {
+		return
+	}
+
+	// The limits are taken from the current settings, since they may have
+	// been reloaded since the connection was opened.
+	_, l := st.quotaClient(addr)
+	if !l.exhausted(u) {
+		return
+	}
+
+	closed := s.quotaConns.closeAll(key)
+	if closed > 0 {
+		log.Debug("relay: quota of %s is exhausted, closed %d connections", key, closed)
+		metrics.QuotaClosedConnsTotal.Add(float64(closed))
+	}
+}
+
+// quotaConns are the tunneled connections by the keys of their clients in the
+// quota store.
+type quotaConns struct {
+	// mu protects conns.
+	mu *sync.Mutex
+
+	// conns are the connections by key.  The keys without connections are
+	// removed.
+	conns map[string]map[*activeConn]struct{}
+}
+
+// newQuotaConns returns a new properly initialized *quotaConns.
+func newQuotaConns() (qc *quotaConns) {
+	return &quotaConns{
+		mu:    &sync.Mutex{},
+		conns: map[string]map[*activeConn]struct{}{},
+	}
+}
+
+// add adds c with the key.  remove must be called with the same key when the
+// tunnel is finished.
+func (qc *quotaConns) add(key string, c *activeConn) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	conns := qc.conns[key]
+	if conns == nil {
+		conns = map[*activeConn]struct{}{}
+		qc.conns[key] = conns
+	}
+
+	conns[c] = struct{}{}
+}
+
+// remove removes c with the key.
+func (qc *quotaConns) remove(key string, c *activeConn) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	conns := qc.conns[key]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(qc.conns, key)
+	}
+}
+
+// closeAll closes the connections with the key and returns their number.  The
+// closed connections are removed, so that the data they have already read is
+// not counted as closing them again.
+func (qc *quotaConns) closeAll(key string) (n int) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	for c := range qc.conns[key] {
+		err := c.close()
+		if err != nil {
+			log.Debug("relay: closing connection from %s: %s", c.client.RemoteAddr(), err)
+		}
+
+		n++
+	}
+
+	delete(qc.conns, key)
+
+	return n
+}
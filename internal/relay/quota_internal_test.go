@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/ameshkov/snirelay/internal/quota"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings_quotaClient(t *testing.T) {
+	st := &settings{
+		quotaLimits: quotaLimits{daily: 100},
+		quotaUsers: []*QuotaUser{{
+			Name:     "partner",
+			Networks: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			Monthly:  1000,
+		}},
+	}
+
+	testCases := []struct {
+		name      string
+		addr      netip.Addr
+		wantKey   string
+		wantLimit quotaLimits
+	}{{
+		name:      "ip",
+		addr:      netip.MustParseAddr("198.51.100.1"),
+		wantKey:   "ip:198.51.100.1",
+		wantLimit: quotaLimits{daily: 100},
+	}, {
+		name:      "user",
+		addr:      netip.MustParseAddr("192.0.2.1"),
+		wantKey:   "user:partner",
+		wantLimit: quotaLimits{monthly: 1000},
+	}, {
+		name:      "user_mapped",
+		addr:      netip.MustParseAddr("::ffff:192.0.2.2"),
+		wantKey:   "user:partner",
+		wantLimit: quotaLimits{monthly: 1000},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, l := st.quotaClient(tc.addr)
+			assert.Equal(t, tc.wantKey, key)
+			assert.Equal(t, tc.wantLimit, l)
+		})
+	}
+}
+
+func TestQuotaLimits_exhausted(t *testing.T) {
+	l := quotaLimits{daily: 10, monthly: 100}
+
+	assert.False(t, l.exhausted(quota.Usage{Daily: 9, Monthly: 99}))
+	assert.True(t, l.exhausted(quota.Usage{Daily: 10, Monthly: 10}))
+	assert.True(t, l.exhausted(quota.Usage{Daily: 0, Monthly: 100}))
+	assert.False(t, quotaLimits{}.exhausted(quota.Usage{Daily: 1000, Monthly: 1000}))
+}
@@ -0,0 +1,18 @@
+package relay
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/ameshkov/snirelay/internal/ratelimit"
+)
+
+// rateLimited returns true if the new connection from addr must be rejected
+// by the rate limit.
+func (s *Server) rateLimited(st *settings, addr netip.Addr) (limited bool) {
+	if st.rateLimit == 0 || st.rateLimitAllowed(addr) {
+		return false
+	}
+
+	return !s.rateLimiter.Allow(ratelimit.Subnet(addr), st.rateLimit, st.rateLimitBurst, time.Now())
+}
@@ -2,29 +2,28 @@
 package relay
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/IGLOU-EU/go-wildcard"
-
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/service"
 	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/ameshkov/snirelay/internal/quota"
+	"github.com/ameshkov/snirelay/internal/ratelimit"
+	"github.com/ameshkov/snirelay/internal/sockets"
 	"github.com/getsentry/sentry-go"
-	"golang.org/x/net/proxy"
 )
 
 const (
-	// readTimeout is the default timeout for a connection read deadline.
-	//
-	// TODO(ameshkov): Consider making configurable.
-	readTimeout = 60 * time.Second
-
 	// remotePortPlain is the port the proxy will be connecting for plain
 	// HTTP connections.
 	remotePortPlain = 80
@@ -37,9 +36,13 @@ const (
 // Server implements all the relay logic, listens for incoming connections and
 // redirects them to the proper server.
 type Server struct {
-	redirectDomains []string
+	// ruleSet are the current rules.  It is replaced as a whole by SetRules.
+	ruleSet *atomic.Pointer[ruleSet]
+
+	// settings are the current settings that can be changed at runtime.  It
+	// is replaced as a whole by Reconfigure.
+	settings *atomic.Pointer[settings]
 
-	dialer          proxy.Dialer
 	listenAddrPlain *net.TCPAddr
 	listenerPlain   net.Listener
 	plainAddr       net.Addr
@@ -47,31 +50,117 @@ type Server struct {
 	listenerTLS     net.Listener
 	tlsAddr         net.Addr
 
-	// mu protects started and listeners.
+	// listenConfig creates the listening sockets.
+	listenConfig sockets.ListenConfig
+
+	// listenAddrQUIC is nil if the QUIC listener is disabled.
+	listenAddrQUIC *net.UDPAddr
+	listenerQUIC   *net.UDPConn
+
+	// quicDone is closed by closeQUIC to stop the sweep loop of the QUIC
+	// listener.
+	quicDone chan struct{}
+
+	// flows is the NAT table of the QUIC listener.
+	flows map[netip.AddrPort]*quicFlow
+
+	// flowsMu protects flows and quicHandedOff.
+	flowsMu *sync.Mutex
+
+	// mu protects started, stopping, and listeners.  It is not held while
+	// the connections are drained.
 	mu *sync.Mutex
 
-	// wg keeps track of the active connections.
+	// wg keeps track of the TCP accept loops.
 	wg *sync.WaitGroup
 
+	// quicWG keeps track of the QUIC read and sweep loops and the goroutines
+	// of the QUIC flows.
+	quicWG *sync.WaitGroup
+
+	// conns are the active client connections.
+	conns map[*activeConn]struct{}
+
+	// connsMu protects conns, activeFlows, and draining.
+	connsMu *sync.Mutex
+
+	// connsWG keeps track of the handlers of the active client connections
+	// and of the accepted QUIC flows.
+	connsWG *sync.WaitGroup
+
+	// activeFlows is the number of the accepted QUIC flows.
+	activeFlows int
+
+	// limits are the counters of the connection limits.
+	limits *limits
+
+	// rateLimiter limits the rate of the new connections from the clients.
+	rateLimiter *ratelimit.Limiter
+
+	// clientsBandwidth are the bandwidth limits of the client IPs.
+	clientsBandwidth *sharedBandwidth[netip.Addr]
+
+	// rulesBandwidth are the bandwidth limits of the rules by their
+	// bandwidth keys.
+	rulesBandwidth *sharedBandwidth[string]
+
+	// quotas keeps track of the traffic of the clients.  It is nil if the
+	// traffic quotas are disabled.
+	quotas *quota.Store
+
+	// quotaConns are the tunneled connections by the keys of their clients in
+	// quotas.
+	quotaConns *quotaConns
+
+	// shutdownGracePeriod is the time Shutdown waits for the active
+	// connections before closing them.
+	shutdownGracePeriod time.Duration
+
 	started bool
+
+	// stopping is true while Shutdown drains the connections, so that the
+	// server is not started again before the QUIC listener is closed.
+	stopping bool
+
+	// draining is true while Shutdown waits for the active connections and
+	// QUIC flows.
+	draining bool
+
+	// quicHandedOff is true if the QUIC listener is no longer read, see
+	// handOffQUIC.
+	quicHandedOff bool
 }
 
-// type check.
-var _ io.Closer = (*Server)(nil)
+// type check
+var _ service.Interface = (*Server)(nil)
 
 // NewServer creates a new instance of *Server.
 func NewServer(cfg *Config) (s *Server, err error) {
 	s = &Server{
-		redirectDomains: cfg.RedirectDomains,
-		wg:              &sync.WaitGroup{},
-		mu:              &sync.Mutex{},
+		ruleSet:  &atomic.Pointer[ruleSet]{},
+		settings: &atomic.Pointer[settings]{},
+		flows:    map[netip.AddrPort]*quicFlow{},
+		flowsMu:  &sync.Mutex{},
+		wg:       &sync.WaitGroup{},
+		quicWG:   &sync.WaitGroup{},
+		mu:       &sync.Mutex{},
+		conns:    map[*activeConn]struct{}{},
+		connsMu:  &sync.Mutex{},
+		connsWG:  &sync.WaitGroup{},
+		limits:   newLimits(),
+
+		rateLimiter:      ratelimit.NewLimiter(),
+		clientsBandwidth: newSharedBandwidth[netip.Addr](),
+		rulesBandwidth:   newSharedBandwidth[string](),
+		quotas:           cfg.Quotas,
+		quotaConns:       newQuotaConns(),
+
+		shutdownGracePeriod: cfg.ShutdownGracePeriod,
 	}
 
-	if cfg.ProxyURL != nil {
-		s.dialer, err = proxy.FromURL(cfg.ProxyURL, s.dialer)
-		if err != nil {
-			return nil, fmt.Errorf("invalid proxy: %w", err)
-		}
+	s.listenConfig = cfg.ListenConfig
+	if s.listenConfig == nil {
+		s.listenConfig = &net.ListenConfig{}
 	}
 
 	s.listenAddrPlain = &net.TCPAddr{
@@ -84,9 +173,63 @@ func NewServer(cfg *Config) (s *Server, err error) {
 		Port: int(cfg.ListenPortTLS),
 	}
 
+	if cfg.ListenPortQUIC != 0 {
+		s.listenAddrQUIC = &net.UDPAddr{
+			IP:   cfg.ListenAddr.AsSlice(),
+			Port: int(cfg.ListenPortQUIC),
+		}
+	}
+
+	err = s.Reconfigure(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
+// Reconfigure atomically replaces the rules and the settings of the server
+// that can be changed at runtime: the fingerprint lists, the PROXY protocol
+// settings, the proxy, the timeouts, and the limits.  The listen address and
+// ports and the quota store of cfg are ignored, since changing them requires
+// restarting the server.
+// Connections that are already relayed are not affected.
+func (s *Server) Reconfigure(cfg *Config) (err error) {
+	apply, err := s.PrepareReconfigure(cfg)
+	if err != nil {
+		return err
+	}
+
+	apply()
+
+	return nil
+}
+
+// PrepareReconfigure validates cfg and returns the function that applies it
+// the same way as Reconfigure.  Nothing is changed until apply is called, so
+// that the configurations of several servers can be validated before any of
+// them is applied.
+func (s *Server) PrepareReconfigure(cfg *Config) (apply func(), err error) {
+	if s.listenAddrQUIC != nil && cfg.ProxyURL != nil {
+		return nil, errors.Error("quic cannot be relayed through a proxy")
+	}
+
+	rs, err := newRuleSet(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+
+	st, err := newSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		s.ruleSet.Store(rs)
+		s.settings.Store(st)
+	}, nil
+}
+
 // AddrTLS returns the address where the server listens for TLS traffic.
 func (s *Server) AddrTLS() (addr net.Addr) {
 	s.mu.Lock()
@@ -111,8 +254,22 @@ func (s *Server) AddrPlain() (addr net.Addr) {
 	return s.plainAddr
 }
 
-// Start starts the relay server.
-func (s *Server) Start() (err error) {
+// SetRules atomically replaces the rules of the server.  Connections that are
+// already relayed are not affected.
+func (s *Server) SetRules(rs []*Rule) (err error) {
+	set, err := newRuleSet(rs)
+	if err != nil {
+		return fmt.Errorf("invalid rules: %w", err)
+	}
+
+	s.ruleSet.Store(set)
+
+	return nil
+}
+
+// Start implements the [service.Interface] interface for *Server.  If one of
+// the listeners cannot be started, the ones started before it are closed.
+func (s *Server) Start(ctx context.Context) (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -120,20 +277,29 @@ func (s *Server) Start() (err error) {
 
 	if s.started {
 		return fmt.Errorf("server is already started")
+	} else if s.stopping {
+		return fmt.Errorf("server is shutting down")
 	}
 
-	s.listenerPlain, err = net.ListenTCP("tcp", s.listenAddrPlain)
+	s.listenerPlain, err = s.listenConfig.Listen(ctx, "tcp", s.listenAddrPlain.String())
 	if err != nil {
 		return fmt.Errorf("failed to serve plain HTTP: %w", err)
 	}
 	s.plainAddr = s.listenerPlain.Addr()
 
-	s.listenerTLS, err = net.ListenTCP("tcp", s.listenAddrTLS)
+	s.listenerTLS, err = s.listenConfig.Listen(ctx, "tcp", s.listenAddrTLS.String())
 	if err != nil {
-		return fmt.Errorf("failed to serve TLS: %w", err)
+		err = fmt.Errorf("failed to serve TLS: %w", err)
+
+		return errors.WithDeferred(err, s.listenerPlain.Close())
 	}
 	s.tlsAddr = s.listenerTLS.Addr()
 
+	err = s.startQUIC(ctx)
+	if err != nil {
+		return errors.WithDeferred(err, errors.Join(s.listenerPlain.Close(), s.listenerTLS.Close()))
+	}
+
 	s.wg.Add(2)
 
 	go s.acceptLoop(s.listenerPlain, true)
@@ -161,7 +327,7 @@ func (s *Server) acceptLoop(l net.Listener, plainHTTP bool) {
 		}
 
 		if err == nil {
-			go s.handleConn(conn, plainHTTP)
+			go s.handleConn(s.trackConn(conn), plainHTTP)
 		} else {
 			// TODO(ameshkov): There is a risk of a busy loop, consider fixing.
 			log.Debug("relay: error accepting conn: %v", err)
@@ -186,10 +352,11 @@ func handlePanicAndRecover() {
 }
 
 // handleConn handles incoming connection.
-func (s *Server) handleConn(conn net.Conn, plainHTTP bool) {
+func (s *Server) handleConn(c *activeConn, plainHTTP bool) {
+	defer s.untrackConn(c)
 	defer handlePanicAndRecover()
 
-	hErr := s.handleRelayConn(conn, plainHTTP)
+	hErr := s.handleRelayConn(c, plainHTTP)
 	if hErr != nil {
 		log.Error("relay: failed to handle conn: %v", hErr)
 
@@ -197,30 +364,60 @@ func (s *Server) handleConn(conn net.Conn, plainHTTP bool) {
 	}
 }
 
-// remoteAddrForServerName creates a remote address string depending on the
-// protocol.
-func remoteAddrForServerName(serverName string, plainHTTP bool) (remoteAddr string) {
-	if plainHTTP {
-		return netutil.JoinHostPort(serverName, remotePortPlain)
-	}
-
-	return netutil.JoinHostPort(serverName, remotePortTLS)
-}
-
 // handleRelayConn handles the network connection, peeks SNI and tunnels
 // traffic.
-func (s *Server) handleRelayConn(conn net.Conn, plainHTTP bool) (err error) {
+func (s *Server) handleRelayConn(c *activeConn, plainHTTP bool) (err error) {
+	conn := c.client
 	defer log.OnCloserError(conn, log.DEBUG)
 
 	log.Debug("relay: accepting new connection from %s", conn.RemoteAddr())
 
-	if err = conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+	st := s.settings.Load()
+	if !s.limits.global.acquire(struct{}{}, st.maxConns) {
+		rejectConn(conn, plainHTTP, limitGlobal)
+
+		return nil
+	}
+	defer s.limits.global.release(struct{}{})
+
+	if err = conn.SetReadDeadline(time.Now().Add(st.sniffTimeout)); err != nil {
 		return fmt.Errorf("failed to set read deadline: %w", err)
 	}
 
-	serverName, connReader, err := peekServerName(conn, plainHTTP)
+	clientAddr, connReader, err := s.readClientAddr(conn, plainHTTP)
 	if err != nil {
-		return fmt.Errorf("failed to peek server name: %w", err)
+		return sniffError(fmt.Errorf("failed to read proxy protocol header: %w", err))
+	}
+
+	clientIP := netutil.NetAddrToAddrPort(clientAddr).Addr()
+	if clientRejected(clientAddr, st.clientRejectReason(clientIP)) {
+		return nil
+	}
+
+	if s.rateLimited(st, clientIP) {
+		log.Debug("relay: %s: rate limit exceeded", clientAddr)
+		metrics.RateLimitedConnectionsTotal.Inc()
+
+		return nil
+	}
+
+	if s.quotaExhausted(st, clientIP) {
+		rejectConn(conn, plainHTTP, limitQuota)
+
+		return nil
+	}
+
+	subnet := st.clientSubnet(clientIP)
+	if !s.limits.clients.acquire(subnet, st.maxConnsPerClient) {
+		rejectConn(conn, plainHTTP, limitClient)
+
+		return nil
+	}
+	defer s.limits.clients.release(subnet)
+
+	serverName, hello, connReader, err := peekServerName(connReader, plainHTTP)
+	if err != nil {
+		return sniffError(fmt.Errorf("failed to peek server name: %w", err))
 	}
 
 	log.Debug("relay: peeked server name is %q", serverName)
@@ -229,9 +426,8 @@ func (s *Server) handleRelayConn(conn net.Conn, plainHTTP bool) (err error) {
 		return fmt.Errorf("failed to remove read deadline: %w", err)
 	}
 
-	if !s.canAccept(serverName) {
-		log.Debug("relay: relaying %s is not allowed", serverName)
-
+	rule := s.acceptServerName(clientAddr, serverName, hello, false)
+	if rule == nil {
 		return nil
 	}
 
@@ -242,22 +438,97 @@ func (s *Server) handleRelayConn(conn net.Conn, plainHTTP bool) (err error) {
 		return nil
 	}
 
-	remoteAddr := remoteAddrForServerName(serverName, plainHTTP)
+	remoteAddr := rule.remoteAddr(serverName, plainHTTP)
+
+	// The remote address is always valid, so the host is never empty.
+	remoteHost, _, _ := netutil.SplitHostPort(remoteAddr)
+	if !s.limits.destination.acquire(remoteHost, st.maxConnsPerDestination) {
+		rejectConn(conn, plainHTTP, limitDestination)
+
+		return nil
+	}
+	defer s.limits.destination.release(remoteHost)
+
 	log.Debug("relay: connecting to %s", remoteAddr)
 
-	return s.handleConnToRemoteServer(conn, connReader, remoteAddr)
+	var header []byte
+	if rule.ProxyProtocol != ProxyProtocolNone {
+		header = appendProxyHeader(
+			nil,
+			rule.ProxyProtocol,
+			netutil.NetAddrToAddrPort(clientAddr),
+			netutil.NetAddrToAddrPort(conn.LocalAddr()),
+			serverName,
+		)
+	}
+
+	return s.handleConnToRemoteServer(c, connReader, clientAddr, rule, remoteAddr, header)
+}
+
+// sniffError counts err if it is caused by the sniff timeout.  Such errors are
+// expected for idle clients, so nil is returned for them.
+func sniffError(err error) (res error) {
+	if !isTimeout(err) {
+		return err
+	}
+
+	metrics.SniffTimeoutsTotal.Inc()
+	log.Debug("relay: sniff timeout: %s", err)
+
+	return nil
+}
+
+// readClientAddr returns the address of the client.  If the PROXY protocol is
+// enabled for the listener and conn comes from a trusted address, the client
+// address is read from the PROXY protocol header, and connReader contains the
+// data after it.  Otherwise, it is the remote address of conn.
+func (s *Server) readClientAddr(
+	conn net.Conn,
+	plainHTTP bool,
+) (clientAddr net.Addr, connReader io.Reader, err error) {
+	clientAddr = conn.RemoteAddr()
+
+	st := s.settings.Load()
+	if plainHTTP && !st.proxyProtocolPlain || !plainHTTP && !st.proxyProtocolTLS {
+		return clientAddr, conn, nil
+	}
+
+	peerAddr := netutil.NetAddrToAddrPort(clientAddr).Addr().Unmap()
+	if !st.proxyProtocolTrustedAddr(peerAddr) {
+		log.Debug("relay: %s is not trusted to send proxy protocol header", clientAddr)
+
+		return clientAddr, conn, nil
+	}
+
+	hdr, connReader, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hdr.srcAddr.IsValid() {
+		clientAddr = net.TCPAddrFromAddrPort(hdr.srcAddr)
+
+		log.Debug("relay: %s: proxy protocol client address %s", conn.RemoteAddr(), clientAddr)
+	}
+
+	return clientAddr, connReader, nil
 }
 
 // connect opens a connection to the specified remote address.  By default, it
 // tries to bind to the same network interface it received the source connection
 // from if this is a public IP.  The reason for that is that the server may
 // have multiple IP addresses, and it may be required to control which of them
-// is used.
+// is used.  The connection must be established within the dial timeout.
 func (s *Server) connect(localAddr net.Addr, remoteAddr string) (conn net.Conn, err error) {
-	if s.dialer != nil {
+	st := s.settings.Load()
+
+	ctx, cancel := context.WithTimeout(context.Background(), st.dialTimeout)
+	defer cancel()
+
+	if st.dialer != nil {
 		// If a proxy dialer is set it does not matter what network interface
 		// is used.
-		return s.dialer.Dial("tcp", remoteAddr)
+		return dialContext(ctx, st.dialer, remoteAddr)
 	}
 
 	// snirelay only works with TCP so there is no need to check for other
@@ -277,22 +548,38 @@ func (s *Server) connect(localAddr net.Addr, remoteAddr string) (conn net.Conn,
 		LocalAddr: bindAddr,
 	}
 
-	return dialer.Dial("tcp", remoteAddr)
+	return dialer.DialContext(ctx, "tcp", remoteAddr)
 }
 
-// handleConnToRemoteServer connects to the remote address remoteAddr and then
-// tunnels traffic from the client connection conn.
+// handleConnToRemoteServer connects to the remote address remoteAddr, sends
+// proxyHeader to it if it is not empty, and then tunnels traffic from the
+// client connection of c that matches the rule.
 func (s *Server) handleConnToRemoteServer(
-	conn net.Conn,
+	c *activeConn,
 	connReader io.Reader,
+	clientAddr net.Addr,
+	rule *Rule,
 	remoteAddr string,
+	proxyHeader []byte,
 ) (err error) {
+	conn := c.client
+
 	var remoteConn net.Conn
 	remoteConn, err = s.connect(conn.LocalAddr(), remoteAddr)
 	if err != nil {
+		if isTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
+			metrics.DialTimeoutsTotal.Inc()
+		}
+
 		return fmt.Errorf("failed to connect to %s: %w", remoteAddr, err)
 	}
 
+	if !c.setRemote(remoteConn) {
+		log.Debug("relay: connection to %s closed on shutdown", remoteAddr)
+
+		return remoteConn.Close()
+	}
+
 	metrics.ConnectionsTotal.WithLabelValues(remoteAddr).Inc()
 	defer func() {
 		metrics.ConnectionsTotal.WithLabelValues(remoteAddr).Dec()
@@ -301,8 +588,39 @@ func (s *Server) handleConnToRemoteServer(
 		log.OnCloserError(remoteConn, log.DEBUG)
 	}()
 
-	clientAddr := netutil.NetAddrToAddrPort(conn.RemoteAddr())
-	metrics.RelayUsersCountUpdate(clientAddr.Addr())
+	clientIP := netutil.NetAddrToAddrPort(clientAddr).Addr()
+	metrics.RelayUsersCountUpdate(clientIP)
+
+	if len(proxyHeader) > 0 {
+		_, err = remoteConn.Write(proxyHeader)
+		if err != nil {
+			return fmt.Errorf("failed to send proxy protocol header to %s: %w", remoteAddr, err)
+		}
+	}
+
+	st := s.settings.Load()
+	quotaKey, _ := st.quotaClient(clientIP)
+	s.quotaConns.add(quotaKey, c)
+	defer s.quotaConns.remove(quotaKey, c)
+
+	timer := newConnTimer(c, st.idleTimeout, st.maxLifetime)
+	defer timer.stop()
+
+	shaper := s.newConnShaper(st, c, clientIP, rule)
+	defer shaper.release()
+
+	counter := &trafficCounter{
+		srv:      s,
+		c:        c,
+		clientIP: clientIP,
+		quotaKey: quotaKey,
+	}
+	sentMetric := metrics.BytesSentTotal.WithLabelValues(remoteAddr)
+	receivedMetric := metrics.BytesReceivedTotal.WithLabelValues(remoteAddr)
+
+	// The idle timeout and the quotas need the traffic to be seen as soon as
+	// it is relayed.  The byte metrics may lag by up to a splice chunk.
+	eager := st.idleTimeout > 0 || s.quotas != nil
 
 	startTime := time.Now()
 
@@ -311,20 +629,28 @@ func (s *Server) handleConnToRemoteServer(
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	log.Debug("relay: start tunneling %s<->%s", remoteAddr, conn.RemoteAddr())
+	log.Debug("relay: start tunneling %s<->%s", remoteAddr, clientAddr)
 
 	var bytesReceived, bytesSent int64
 
 	go func() {
 		defer wg.Done()
 
-		bytesReceived = s.tunnel(conn, remoteConn)
+		r := shaper.receivedReader(remoteConn)
+		bytesReceived = s.tunnel(conn, r, eager, func(n int64) {
+			timer.touch()
+			counter.add(n, receivedMetric)
+		})
 	}()
 
 	go func() {
 		defer wg.Done()
 
-		bytesSent = s.tunnel(remoteConn, connReader)
+		r := shaper.sentReader(connReader)
+		bytesSent = s.tunnel(remoteConn, r, eager, func(n int64) {
+			timer.touch()
+			counter.add(n, sentMetric)
+		})
 	}()
 
 	wg.Wait()
@@ -339,9 +665,6 @@ func (s *Server) handleConnToRemoteServer(
 		elapsed,
 	)
 
-	metrics.BytesSentTotal.WithLabelValues(remoteAddr).Add(float64(bytesSent))
-	metrics.BytesReceivedTotal.WithLabelValues(remoteAddr).Add(float64(bytesReceived))
-
 	return nil
 }
 
@@ -351,9 +674,14 @@ type closeWriter interface {
 	CloseWrite() error
 }
 
-// copy copies data from src to dst and signals that the work is done via the
-// wg wait group.
-func (s *Server) tunnel(dst net.Conn, src io.Reader) (written int64) {
+// tunnel copies data from src to dst, see copyConn, and then closes dst for
+// writing.  count is called with the number of bytes as they are written.
+func (s *Server) tunnel(
+	dst net.Conn,
+	src io.Reader,
+	eager bool,
+	count func(n int64),
+) (written int64) {
 	defer func() {
 		// In the case of *tcp.Conn and *tls.Conn we should call CloseWriter, so
 		// we're using closeWriter interface to check for that function
@@ -366,7 +694,7 @@ func (s *Server) tunnel(dst net.Conn, src io.Reader) (written int64) {
 		}
 	}()
 
-	written, err := io.Copy(dst, src)
+	written, err := copyConn(dst, src, count, eager)
 	if err != nil {
 		log.Debug("relay: finished copying due to %v", err)
 	}
@@ -374,36 +702,150 @@ func (s *Server) tunnel(dst net.Conn, src io.Reader) (written int64) {
 	return written
 }
 
-// Close implements the io.Closer interface for *Server.
-func (s *Server) Close() (err error) {
+// Shutdown implements the [service.Interface] interface for *Server.  It
+// closes the TCP listeners, waits for the active connections and QUIC flows
+// for the shutdown grace period, and then closes the remaining ones.  The QUIC
+// listener is no longer read while draining, so that the new process it has
+// been passed to during an upgrade receives the new flows, and the accepted
+// flows are relayed through their own sockets, see handOffQUIC.  The address
+// methods return nil while draining.  It returns an error if ctx is done before
+// all of them are closed.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	log.Info("relay: closing")
+	log.Info("relay: shutting down")
 
 	if !s.started {
+		s.mu.Unlock()
+
 		return nil
 	}
 
+	s.started = false
+	s.stopping = true
+
 	plainErr := s.listenerPlain.Close()
 	tlsErr := s.listenerTLS.Close()
 
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.stopping = false
+	}()
+
+	handOffErr := s.handOffQUIC()
+
 	log.Info("relay: waiting until connections stop processing")
 
-	s.wg.Wait()
+	var waitErr error
+	if waitGroup(ctx, s.wg) {
+		waitErr = s.drainConns(ctx)
+	} else {
+		waitErr = fmt.Errorf("waiting for listeners: %w", ctx.Err())
+	}
 
-	log.Info("relay: closed")
+	quicErr := s.closeQUIC(ctx)
+	if waitErr == nil && quicErr == nil {
+		log.Info("relay: shut down")
+	}
+
+	return errors.Join(plainErr, tlsErr, handOffErr, quicErr, waitErr)
+}
+
+// matchRule returns the first rule that matches the connection to the server
+// name or nil if there is none.  hello is nil for plain HTTP connections.
+func (s *Server) matchRule(serverName string, hello *clientHello) (r *Rule) {
+	set := s.ruleSet.Load()
+	i, ok := set.matcher.Match(serverName, func(i int) (ok bool) {
+		return set.rules[i].matchConditions(hello)
+	})
+	if !ok {
+		return nil
+	}
 
-	return errors.Join(plainErr, tlsErr)
+	return set.rules[i]
 }
 
-// canAccept checks if relay can accept connection to this hostname.
-func (s *Server) canAccept(hostname string) (ok bool) {
-	for _, pattern := range s.redirectDomains {
-		if wildcard.MatchSimple(pattern, hostname) {
-			return true
+// acceptServerName checks the client's fingerprint and returns the rule that
+// allows relaying the connection from clientAddr to serverName or nil if the
+// connection must not be accepted.  The client lists of the rule are checked as
+// well.  hello is nil for plain HTTP connections, quic is true if hello was
+// received over QUIC.
+func (s *Server) acceptServerName(
+	clientAddr net.Addr,
+	serverName string,
+	hello *clientHello,
+	quic bool,
+) (r *Rule) {
+	var fp fingerprint
+	if hello != nil {
+		fp = newFingerprint(hello, quic)
+
+		allowed := s.settings.Load().fingerprintAllowed(fp)
+		metrics.TLSFingerprintsInc(fp.ja4, !allowed)
+		if !allowed {
+			log.Debug("relay: fingerprint %s (ja3 %s) is not allowed", fp.ja4, fp.ja3)
+
+			return nil
 		}
 	}
 
-	return false
+	r = s.matchRule(serverName, hello)
+	logMatch(clientAddr, serverName, hello, fp, r)
+	if r == nil {
+		log.Debug("relay: relaying %s is not allowed", serverName)
+
+		return nil
+	} else if r.Block {
+		log.Debug("relay: %s is blocked by rule %q", serverName, r.Pattern)
+		metrics.BlockedConnectionsTotal.Inc()
+
+		return nil
+	}
+
+	clientIP := netutil.NetAddrToAddrPort(clientAddr).Addr()
+	if clientRejected(clientAddr, r.clientRejectReason(clientIP)) {
+		return nil
+	}
+
+	return r
+}
+
+// logMatch writes the attributes of the connection that were used for rule
+// matching to the debug log.
+func logMatch(
+	clientAddr net.Addr,
+	serverName string,
+	hello *clientHello,
+	fp fingerprint,
+	r *Rule,
+) {
+	if log.GetLevel() < log.DEBUG {
+		return
+	}
+
+	pattern := ""
+	if r != nil {
+		pattern = r.Pattern
+	}
+
+	if hello == nil {
+		log.Debug("relay: %s: host %q, matched rule %q", clientAddr, serverName, pattern)
+
+		return
+	}
+
+	log.Debug(
+		"relay: %s: sni %q, alpn %q, versions %s, ja3 %s, ja4 %s, matched rule %q",
+		clientAddr,
+		serverName,
+		hello.alpnProtocols(),
+		formatVersions(hello.supportedVersions()),
+		fp.ja3,
+		fp.ja4,
+		pattern,
+	)
 }
@@ -2,14 +2,24 @@ package relay_test
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/snirelay/internal/quota"
 	"github.com/ameshkov/snirelay/internal/relay"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/things-go/go-socks5"
 )
@@ -84,21 +94,28 @@ func TestNewServer(t *testing.T) {
 				}
 			}
 
+			var rules []*relay.Rule
+			for _, d := range tc.redirectDomains {
+				rules = append(rules, &relay.Rule{Pattern: d})
+			}
+
 			cfg := &relay.Config{
-				ListenAddr:      netutil.IPv4Localhost(),
-				ListenPort:      0,
-				ListenPortTLS:   0,
-				ProxyURL:        proxyURL,
-				RedirectDomains: tc.redirectDomains,
+				ListenAddr:    netutil.IPv4Localhost(),
+				ListenPort:    0,
+				ListenPortTLS: 0,
+				ProxyURL:      proxyURL,
+				Rules:         rules,
 			}
 
 			r, err := relay.NewServer(cfg)
 			require.NoError(t, err)
 
-			err = r.Start()
+			err = r.Start(context.Background())
 			require.NoError(t, err)
 
-			defer log.OnCloserError(r, log.ERROR)
+			testutil.CleanupAndRequireSuccess(t, func() (err error) {
+				return r.Shutdown(context.Background())
+			})
 
 			var addr net.Addr
 			if tc.plainHTTP {
@@ -134,3 +151,452 @@ func TestNewServer(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_rewrite(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	backend.EnableHTTP2 = false
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+
+	plainBackend := httptest.NewServer(backend.Config.Handler)
+	t.Cleanup(plainBackend.Close)
+
+	tlsPort := netutil.NetAddrToAddrPort(backend.Listener.Addr()).Port()
+	plainPort := netutil.NetAddrToAddrPort(plainBackend.Listener.Addr()).Port()
+
+	r, err := relay.NewServer(&relay.Config{
+		ListenAddr: netutil.IPv4Localhost(),
+		Rules: []*relay.Rule{{
+			Pattern:   "*.example.org",
+			Target:    "127.0.0.1",
+			PortPlain: plainPort,
+			PortTLS:   tlsPort,
+		}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, r.Start(context.Background()))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return r.Shutdown(context.Background())
+	})
+
+	testCases := []struct {
+		addr net.Addr
+		name string
+		url  string
+	}{{
+		addr: r.AddrPlain(),
+		name: "plain",
+		url:  "http://www.example.org/",
+	}, {
+		addr: r.AddrTLS(),
+		name: "tls",
+		url:  "https://www.example.org/",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := http.Client{
+				Transport: &http.Transport{
+					DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+						return net.Dial("tcp", tc.addr.String())
+					},
+					TLSClientConfig: &tls.Config{
+						// The test server certificate is issued for
+						// example.com.
+						InsecureSkipVerify: true,
+					},
+				},
+			}
+
+			resp, err := client.Get(tc.url)
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, resp.Body.Close)
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, "www.example.org", string(body))
+		})
+	}
+}
+
+// newEchoBackend starts a TCP server that sends back everything it receives
+// and returns its port.
+func newEchoBackend(t *testing.T) (port uint16) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return netutil.NetAddrToAddrPort(l.Addr()).Port()
+}
+
+// newRelay starts a relay server with cfg that relays www.example.org to an
+// echo backend.  The listen address and the rules of cfg are overwritten.
+func newRelay(t *testing.T, cfg *relay.Config) (r *relay.Server) {
+	t.Helper()
+
+	cfg.ListenAddr = netutil.IPv4Localhost()
+	cfg.Rules = []*relay.Rule{{
+		Pattern:   "*.example.org",
+		Target:    "127.0.0.1",
+		PortPlain: newEchoBackend(t),
+	}}
+
+	r, err := relay.NewServer(cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Start(context.Background()))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return r.Shutdown(context.Background())
+	})
+
+	return r
+}
+
+// newTunnel starts a relay server with cfg and opens a tunnel through it to an
+// echo backend.
+func newTunnel(t *testing.T, cfg *relay.Config) (r *relay.Server, conn net.Conn) {
+	t.Helper()
+
+	r = newRelay(t, cfg)
+
+	conn, err := net.Dial("tcp", r.AddrPlain().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		// The connection may have been closed by the test.
+		_ = conn.Close()
+
+		return nil
+	})
+
+	req := "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n"
+	requireEcho(t, conn, req)
+
+	return r, conn
+}
+
+// requireEcho writes msg to conn and requires that it is sent back.
+func requireEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	_, err := io.WriteString(conn, msg)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, msg, string(buf))
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	const testTimeout = 5 * time.Second
+
+	t.Run("drained", func(t *testing.T) {
+		r, conn := newTunnel(t, &relay.Config{ShutdownGracePeriod: time.Minute})
+		relayAddr := r.AddrPlain().String()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- r.Shutdown(context.Background())
+		}()
+
+		require.Eventually(t, func() (ok bool) {
+			c, err := net.Dial("tcp", relayAddr)
+			if err == nil {
+				_ = c.Close()
+			}
+
+			return err != nil
+		}, testTimeout, 10*time.Millisecond)
+
+		// The addresses are available while the relay is draining.
+		addrCh := make(chan net.Addr, 1)
+		go func() {
+			addrCh <- r.AddrPlain()
+		}()
+
+		addr, ok := testutil.RequireReceive(t, addrCh, testTimeout)
+		require.True(t, ok)
+		assert.Nil(t, addr)
+
+		// The tunnel keeps working while the relay is draining.
+		requireEcho(t, conn, "ping")
+
+		require.NoError(t, conn.Close())
+
+		err, ok := testutil.RequireReceive(t, errCh, testTimeout)
+		require.True(t, ok)
+		require.NoError(t, err)
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		r, conn := newTunnel(t, &relay.Config{ShutdownGracePeriod: 100 * time.Millisecond})
+
+		start := time.Now()
+		require.NoError(t, r.Shutdown(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		_, err := conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		r, _ := newTunnel(t, &relay.Config{ShutdownGracePeriod: time.Minute})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		t.Cleanup(cancel)
+
+		err := r.Shutdown(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestServer_timeouts(t *testing.T) {
+	const (
+		timeout     = 200 * time.Millisecond
+		testTimeout = 5 * time.Second
+	)
+
+	// requireClosed requires that conn is closed by the relay after at least
+	// minTime since start.
+	requireClosed := func(t *testing.T, conn net.Conn, start time.Time, minTime time.Duration) {
+		t.Helper()
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		_, err := conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+
+		assert.GreaterOrEqual(t, time.Since(start), minTime)
+	}
+
+	t.Run("sniff", func(t *testing.T) {
+		r := newRelay(t, &relay.Config{SniffTimeout: timeout})
+
+		start := time.Now()
+		conn, err := net.Dial("tcp", r.AddrPlain().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		requireClosed(t, conn, start, timeout)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		_, conn := newTunnel(t, &relay.Config{IdleTimeout: timeout})
+
+		// The traffic in either direction keeps the tunnel open.
+		start := time.Now()
+		for range 4 {
+			time.Sleep(timeout / 2)
+			requireEcho(t, conn, "ping")
+		}
+
+		// Four pings every half of the timeout, then the timeout itself.
+		requireClosed(t, conn, start, 3*timeout)
+	})
+
+	t.Run("max_lifetime", func(t *testing.T) {
+		start := time.Now()
+		_, conn := newTunnel(t, &relay.Config{MaxLifetime: timeout})
+
+		require.Eventually(t, func() (ok bool) {
+			_, err := io.WriteString(conn, "ping")
+			if err != nil {
+				return true
+			}
+
+			_, err = io.ReadFull(conn, make([]byte, 4))
+
+			return err != nil
+		}, testTimeout, timeout/10)
+
+		assert.GreaterOrEqual(t, time.Since(start), timeout)
+	})
+}
+
+func TestServer_limits(t *testing.T) {
+	const testTimeout = 5 * time.Second
+
+	t.Run("destination", func(t *testing.T) {
+		r, _ := newTunnel(t, &relay.Config{MaxConnsPerDestination: 1})
+
+		conn, err := net.Dial("tcp", r.AddrPlain().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n")
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		r, _ := newTunnel(t, &relay.Config{RateLimit: 1})
+
+		conn, err := net.Dial("tcp", r.AddrPlain().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("rate_allowlist", func(t *testing.T) {
+		r, _ := newTunnel(t, &relay.Config{
+			RateLimit:          1,
+			RateLimitAllowlist: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		})
+
+		conn, err := net.Dial("tcp", r.AddrPlain().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		requireEcho(t, conn, "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n")
+	})
+
+	t.Run("global_tls_alert", func(t *testing.T) {
+		r, _ := newTunnel(t, &relay.Config{MaxConns: 1})
+
+		conn, err := net.Dial("tcp", r.AddrTLS().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(testTimeout)))
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "www.example.org"})
+		err = tlsConn.Handshake()
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "internal error")
+	})
+}
+
+func TestServer_clientLists(t *testing.T) {
+	const testTimeout = 5 * time.Second
+
+	req := "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n"
+
+	cfg := &relay.Config{
+		ClientDenylist: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}
+	r := newRelay(t, cfg)
+
+	conn, err := net.Dial("tcp", r.AddrPlain().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	_, err = io.WriteString(conn, req)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// The lists are applied without a restart.
+	cfg.ClientDenylist = nil
+	cfg.ClientAllowlist = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	require.NoError(t, r.Reconfigure(cfg))
+
+	conn, err = net.Dial("tcp", r.AddrPlain().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	requireEcho(t, conn, req)
+}
+
+func TestServer_quotas(t *testing.T) {
+	const (
+		req         = "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n"
+		testTimeout = 5 * time.Second
+	)
+
+	// newQuotas returns a started quota store with a temporary database.
+	newQuotas := func(t *testing.T) (q *quota.Store) {
+		t.Helper()
+
+		q = quota.New(&quota.Config{Path: filepath.Join(t.TempDir(), "quotas.db")})
+		require.NoError(t, q.Start(context.Background()))
+		testutil.CleanupAndRequireSuccess(t, func() (err error) {
+			return q.Shutdown(context.Background())
+		})
+
+		return q
+	}
+
+	// The traffic is counted in chunks when it is spliced, so the messages are
+	// larger than them.
+	const msgLen = 256 * 1024
+
+	t.Run("exhausted", func(t *testing.T) {
+		r, conn := newTunnel(t, &relay.Config{
+			Quotas:     newQuotas(t),
+			QuotaDaily: msgLen,
+		})
+
+		requireEcho(t, conn, strings.Repeat("a", msgLen))
+
+		c, err := net.Dial("tcp", r.AddrPlain().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, c.Close)
+
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		_, err = c.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+
+		// The existing tunnel is not cut.
+		requireEcho(t, conn, "ping")
+	})
+
+	t.Run("cut_existing", func(t *testing.T) {
+		r, conn := newTunnel(t, &relay.Config{
+			Quotas:           newQuotas(t),
+			QuotaMonthly:     msgLen,
+			QuotaCutExisting: true,
+		})
+
+		other, err := net.Dial("tcp", r.AddrPlain().String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, other.Close)
+
+		requireEcho(t, other, req)
+
+		// The traffic is counted while the tunnel is open.  The connection
+		// may be closed before all data is written.
+		_, _ = other.Write(make([]byte, 2*msgLen))
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"cmp"
+	"crypto/tls"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/ameshkov/snirelay/internal/rules"
+)
+
+// Rule is a relay rule that controls which connections the relay accepts.
+// Rules are evaluated in order and the first matching one wins, see package
+// rules.
+type Rule struct {
+	// Pattern is a pattern for server names this rule applies to in the
+	// syntax of package rules.  If it starts with "!", the rule is an
+	// exception, and server names that match it are not accepted unless an
+	// earlier rule matches them.
+	Pattern string
+
+	// Block makes the relay reject the connections that match the rule.
+	Block bool
+
+	// ALPN is a list of ALPN protocols.  If not empty, the rule only matches
+	// TLS connections that offer at least one of them.
+	ALPN []string
+
+	// TLSVersions is a list of TLS versions.  If not empty, the rule only
+	// matches TLS connections that support at least one of them.
+	TLSVersions []uint16
+
+	// CipherSuites is a list of TLS cipher suites.  If not empty, the rule
+	// only matches TLS connections that offer at least one of them.
+	CipherSuites []uint16
+
+	// ProxyProtocol is the version of the PROXY protocol header sent to the
+	// remote server before the client data.  It is only used for TCP
+	// connections.
+	ProxyProtocol ProxyProtocolVersion
+
+	// Target is the host the relay connects to instead of the server name.  If
+	// empty, the server name is used.
+	Target string
+
+	// PortPlain is the port of the remote server for plain HTTP connections.
+	// If zero, port 80 is used.
+	PortPlain uint16
+
+	// PortTLS is the port of the remote server for TLS and QUIC connections.
+	// If zero, port 443 is used.
+	PortTLS uint16
+
+	// Bandwidth is the maximum rate, in bytes per second, of the traffic in
+	// each direction of all TCP connections that match the rule.  If zero,
+	// the rate is not limited.
+	Bandwidth int64
+
+	// ClientAllowlist is a list of client networks.  If not empty, the
+	// connections from other clients that match the rule are rejected.
+	ClientAllowlist []netip.Prefix
+
+	// ClientDenylist is a list of client networks.  The connections from
+	// these clients that match the rule are rejected.
+	ClientDenylist []netip.Prefix
+
+	// Source identifies the configuration rule this rule has been created
+	// from, e.g. the list file.  The rules with the same source share the
+	// Bandwidth limit.  If empty, Pattern is used.
+	Source string
+}
+
+// bandwidthKey returns the key of the bandwidth limit shared by the rules
+// created from the same configuration rule.
+func (r *Rule) bandwidthKey() (key string) {
+	return cmp.Or(r.Source, r.Pattern)
+}
+
+// ruleSet is an immutable list of relay rules with the compiled matcher for
+// their patterns.
+type ruleSet struct {
+	// matcher matches server names against the patterns of rules.
+	matcher *rules.Matcher
+
+	// rules are the relay rules in the order of evaluation.
+	rules []*Rule
+}
+
+// newRuleSet compiles the rules into a rule set.
+func newRuleSet(rs []*Rule) (set *ruleSet, err error) {
+	patterns := make([]string, 0, len(rs))
+	for _, r := range rs {
+		patterns = append(patterns, r.Pattern)
+	}
+
+	m, err := rules.NewMatcher(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ruleSet{
+		matcher: m,
+		rules:   rs,
+	}, nil
+}
+
+// hasTLSConditions returns true if the rule checks ClientHello attributes.
+func (r *Rule) hasTLSConditions() (ok bool) {
+	return len(r.ALPN) > 0 || len(r.TLSVersions) > 0 || len(r.CipherSuites) > 0
+}
+
+// matchConditions returns true if the ClientHello satisfies the conditions of
+// the rule.  hello is nil for plain HTTP connections, and these never match
+// rules that have TLS conditions.
+func (r *Rule) matchConditions(hello *clientHello) (ok bool) {
+	if !r.hasTLSConditions() {
+		return true
+	}
+
+	if hello == nil {
+		return false
+	}
+
+	return matchAny(r.ALPN, hello.alpnProtocols()) &&
+		matchAny(r.TLSVersions, hello.supportedVersions()) &&
+		matchAny(r.CipherSuites, hello.cipherSuites())
+}
+
+// remoteAddr returns the address of the remote server the connection to
+// serverName must be relayed to.
+func (r *Rule) remoteAddr(serverName string, plainHTTP bool) (addr string) {
+	host := serverName
+	if r.Target != "" {
+		host = r.Target
+	}
+
+	port := r.PortTLS
+	if plainHTTP {
+		port = r.PortPlain
+	}
+
+	if port == 0 {
+		port = remotePortTLS
+		if plainHTTP {
+			port = remotePortPlain
+		}
+	}
+
+	return netutil.JoinHostPort(host, port)
+}
+
+// matchAny returns true if want is empty or if got has at least one of the
+// elements of want.
+func matchAny[T comparable](want, got []T) (ok bool) {
+	if len(want) == 0 {
+		return true
+	}
+
+	for _, v := range got {
+		if slices.Contains(want, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatVersions returns a human-readable representation of the list of TLS
+// versions.
+func formatVersions(versions []uint16) (s string) {
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		names = append(names, tls.VersionName(v))
+	}
+
+	return "[" + strings.Join(names, ", ") + "]"
+}
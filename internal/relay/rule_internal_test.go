@@ -0,0 +1,265 @@
+package relay
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRulesServer returns a server with the specified rules for testing rule
+// matching.
+func newRulesServer(t *testing.T, rules ...*Rule) (s *Server) {
+	t.Helper()
+
+	s, err := NewServer(&Config{Rules: rules})
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestServer_matchRule(t *testing.T) {
+	record := newTestClientHello(t, &tls.Config{
+		ServerName: "www.example.org",
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	hello := &clientHello{}
+	err := parseClientHello(hello, record[recordHeaderLen:])
+	require.NoError(t, err)
+
+	testCases := []struct {
+		rule      *Rule
+		name      string
+		plainHTTP bool
+		want      bool
+	}{{
+		name: "pattern",
+		rule: &Rule{Pattern: "*.example.org"},
+		want: true,
+	}, {
+		name: "pattern_mismatch",
+		rule: &Rule{Pattern: "example.org"},
+		want: false,
+	}, {
+		name: "alpn",
+		rule: &Rule{Pattern: "*", ALPN: []string{"acme-tls/1", "h2"}},
+		want: true,
+	}, {
+		name: "alpn_mismatch",
+		rule: &Rule{Pattern: "*", ALPN: []string{"acme-tls/1"}},
+		want: false,
+	}, {
+		name: "tls_versions",
+		rule: &Rule{Pattern: "*", TLSVersions: []uint16{tls.VersionTLS13}},
+		want: true,
+	}, {
+		name: "tls_versions_mismatch",
+		rule: &Rule{Pattern: "*", TLSVersions: []uint16{tls.VersionTLS10, tls.VersionTLS11}},
+		want: false,
+	}, {
+		name: "cipher_suites",
+		rule: &Rule{Pattern: "*", CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256}},
+		want: true,
+	}, {
+		name: "cipher_suites_mismatch",
+		rule: &Rule{Pattern: "*", CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}},
+		want: false,
+	}, {
+		name: "all_conditions",
+		rule: &Rule{
+			Pattern:      "www.example.org",
+			ALPN:         []string{"h2"},
+			TLSVersions:  []uint16{tls.VersionTLS12},
+			CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256},
+		},
+		want: true,
+	}, {
+		name:      "plain_http",
+		rule:      &Rule{Pattern: "*"},
+		plainHTTP: true,
+		want:      true,
+	}, {
+		name:      "plain_http_tls_conditions",
+		rule:      &Rule{Pattern: "*", ALPN: []string{"h2"}},
+		plainHTTP: true,
+		want:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := hello
+			if tc.plainHTTP {
+				h = nil
+			}
+
+			s := newRulesServer(t, tc.rule)
+			assert.Equal(t, tc.want, s.matchRule("www.example.org", h) != nil)
+		})
+	}
+}
+
+func TestRule_remoteAddr(t *testing.T) {
+	testCases := []struct {
+		rule      *Rule
+		name      string
+		wantPlain string
+		wantTLS   string
+	}{{
+		rule:      &Rule{},
+		name:      "default",
+		wantPlain: "www.example.org:80",
+		wantTLS:   "www.example.org:443",
+	}, {
+		rule:      &Rule{Target: "backend.internal"},
+		name:      "target",
+		wantPlain: "backend.internal:80",
+		wantTLS:   "backend.internal:443",
+	}, {
+		rule:      &Rule{Target: "backend.internal", PortTLS: 8443},
+		name:      "target_tls_port",
+		wantPlain: "backend.internal:80",
+		wantTLS:   "backend.internal:8443",
+	}, {
+		rule:      &Rule{Target: "2001:db8::1", PortPlain: 8080, PortTLS: 8443},
+		name:      "target_ipv6",
+		wantPlain: "[2001:db8::1]:8080",
+		wantTLS:   "[2001:db8::1]:8443",
+	}, {
+		rule:      &Rule{PortPlain: 8080},
+		name:      "plain_port",
+		wantPlain: "www.example.org:8080",
+		wantTLS:   "www.example.org:443",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantPlain, tc.rule.remoteAddr("www.example.org", true))
+			assert.Equal(t, tc.wantTLS, tc.rule.remoteAddr("www.example.org", false))
+		})
+	}
+}
+
+func TestServer_matchRule_order(t *testing.T) {
+	h2Rule := &Rule{Pattern: "*.example.org", ALPN: []string{"h2"}, PortTLS: 8443}
+	blockRule := &Rule{Pattern: "ads.example.org", Block: true}
+	exceptionRule := &Rule{Pattern: "!*.bank.example.org"}
+	relayRule := &Rule{Pattern: "*.example.org"}
+
+	s := newRulesServer(t, h2Rule, blockRule, exceptionRule, relayRule)
+
+	testCases := []struct {
+		want       *Rule
+		name       string
+		serverName string
+		alpn       []string
+	}{{
+		want:       h2Rule,
+		name:       "first_match",
+		serverName: "ads.example.org",
+		alpn:       []string{"h2"},
+	}, {
+		want:       blockRule,
+		name:       "conditions_mismatch",
+		serverName: "ads.example.org",
+		alpn:       []string{"http/1.1"},
+	}, {
+		want:       nil,
+		name:       "exception",
+		serverName: "www.bank.example.org",
+		alpn:       []string{"http/1.1"},
+	}, {
+		want:       h2Rule,
+		name:       "before_exception",
+		serverName: "www.bank.example.org",
+		alpn:       []string{"h2"},
+	}, {
+		want:       relayRule,
+		name:       "after_exception",
+		serverName: "www.example.org",
+		alpn:       []string{"http/1.1"},
+	}, {
+		want:       nil,
+		name:       "no_match",
+		serverName: "www.example.net",
+		alpn:       []string{"h2"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			record := newTestClientHello(t, &tls.Config{
+				ServerName: tc.serverName,
+				NextProtos: tc.alpn,
+			})
+
+			hello := &clientHello{}
+			err := parseClientHello(hello, record[recordHeaderLen:])
+			require.NoError(t, err)
+
+			assert.Same(t, tc.want, s.matchRule(tc.serverName, hello))
+		})
+	}
+}
+
+func TestServer_SetRules(t *testing.T) {
+	oldRule := &Rule{Pattern: "*.example.org"}
+	s := newRulesServer(t, oldRule)
+
+	assert.Equal(t, oldRule, s.matchRule("www.example.org", nil))
+	assert.Nil(t, s.matchRule("www.example.net", nil))
+
+	newRule := &Rule{Pattern: "domain:example.net"}
+	require.NoError(t, s.SetRules([]*Rule{newRule}))
+
+	assert.Nil(t, s.matchRule("www.example.org", nil))
+	assert.Equal(t, newRule, s.matchRule("www.example.net", nil))
+
+	err := s.SetRules([]*Rule{{Pattern: "regexp:("}})
+	require.Error(t, err)
+
+	assert.Equal(t, newRule, s.matchRule("www.example.net", nil))
+}
+
+func TestServer_Reconfigure(t *testing.T) {
+	oldRule := &Rule{Pattern: "*.example.org"}
+	s := newRulesServer(t, oldRule)
+
+	fp := fingerprint{ja4: "t13d1516h2"}
+	assert.True(t, s.settings.Load().fingerprintAllowed(fp))
+
+	newRule := &Rule{Pattern: "domain:example.net"}
+	err := s.Reconfigure(&Config{
+		Rules:               []*Rule{newRule},
+		FingerprintDenylist: []string{"t13d1516h2"},
+	})
+	require.NoError(t, err)
+
+	assert.Nil(t, s.matchRule("www.example.org", nil))
+	assert.Equal(t, newRule, s.matchRule("www.example.net", nil))
+	assert.False(t, s.settings.Load().fingerprintAllowed(fp))
+
+	err = s.Reconfigure(&Config{Rules: []*Rule{{Pattern: "regexp:("}}})
+	require.Error(t, err)
+
+	assert.Equal(t, newRule, s.matchRule("www.example.net", nil))
+	assert.False(t, s.settings.Load().fingerprintAllowed(fp))
+}
+
+func TestServer_PrepareReconfigure(t *testing.T) {
+	oldRule := &Rule{Pattern: "*.example.org"}
+	s := newRulesServer(t, oldRule)
+
+	newRule := &Rule{Pattern: "domain:example.net"}
+	apply, err := s.PrepareReconfigure(&Config{Rules: []*Rule{newRule}})
+	require.NoError(t, err)
+
+	// Nothing is changed until the configuration is applied.
+	assert.Equal(t, oldRule, s.matchRule("www.example.org", nil))
+
+	apply()
+
+	assert.Nil(t, s.matchRule("www.example.org", nil))
+	assert.Equal(t, newRule, s.matchRule("www.example.net", nil))
+}
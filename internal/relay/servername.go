@@ -3,37 +3,36 @@ package relay
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"time"
+	"slices"
 )
 
 // peekServerName peeks on the first bytes from the reader and tries to parse
 // the remote server name.  Depending on whether this is a TLS or a plain HTTP
-// connection it will use different ways of parsing.
+// connection it will use different ways of parsing.  hello is only returned
+// for TLS connections.
 func peekServerName(
 	reader io.Reader,
 	plainHTTP bool,
-) (serverName string, newReader io.Reader, err error) {
+) (serverName string, hello *clientHello, newReader io.Reader, err error) {
 	if plainHTTP {
 		serverName, newReader, err = peekHTTPHost(reader)
 		if err != nil {
-			return "", nil, err
-		}
-	} else {
-		var clientHello *tls.ClientHelloInfo
-		clientHello, newReader, err = peekClientHello(reader)
-		if err != nil {
-			return "", nil, err
+			return "", nil, nil, err
 		}
 
-		serverName = clientHello.ServerName
+		return serverName, nil, newReader, nil
+	}
+
+	hello, newReader, err = peekClientHello(reader)
+	if err != nil {
+		return "", nil, nil, err
 	}
 
-	return serverName, newReader, nil
+	return hello.serverName(), hello, newReader, nil
 }
 
 // peekHTTPHost peeks on the first bytes from the reader and tries to parse the
@@ -48,7 +47,7 @@ func peekHTTPHost(reader io.Reader) (host string, newReader io.Reader, err error
 		return "", nil, fmt.Errorf("sniproxy: failed to read http request: %w", err)
 	}
 
-	return r.Host, io.MultiReader(peekedBytes, reader), nil
+	return r.Host, newPrefixedReader(peekedBytes.Bytes(), reader), nil
 }
 
 // peekClientHello peeks on the first bytes from the reader and tries to parse
@@ -56,68 +55,82 @@ func peekHTTPHost(reader io.Reader) (host string, newReader io.Reader, err error
 // and a new reader that contains unmodified data.
 func peekClientHello(
 	reader io.Reader,
-) (hello *tls.ClientHelloInfo, newReader io.Reader, err error) {
-	peekedBytes := new(bytes.Buffer)
-	hello, err = readClientHello(io.TeeReader(reader, peekedBytes))
+) (hello *clientHello, newReader io.Reader, err error) {
+	peeked, msg, err := readClientHelloRecords(reader)
 	if err != nil {
 		return nil, nil, fmt.Errorf("sniproxy: failed to read ClientHello: %w", err)
 	}
 
-	return hello, io.MultiReader(peekedBytes, reader), nil
-}
-
-// readClientHello reads client hello information from the specified reader.
-//
-// #nosec G402 -- Ignore the TLS MinVersion, the code is only for parsing.
-//
-// TODO(ameshkov): This method is very ineffective, consider parsing.
-func readClientHello(reader io.Reader) (hello *tls.ClientHelloInfo, err error) {
-	err = tls.Server(readOnlyConn{reader: reader}, &tls.Config{
-		GetConfigForClient: func(argHello *tls.ClientHelloInfo) (*tls.Config, error) {
-			hello = new(tls.ClientHelloInfo)
-			*hello = *argHello
-
-			return nil, nil
-		},
-	}).Handshake()
-
-	if hello == nil {
-		return nil, err
+	hello = &clientHello{}
+	err = parseClientHello(hello, msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sniproxy: failed to parse ClientHello: %w", err)
 	}
 
-	return hello, nil
-}
-
-// readOnlyConn implements net.Conn but overrides all it's methods so that
-// only reading could work.  The purpose is to make sure that the Handshake
-// method of [tls.Server] does not write any data to the underlying connection.
-type readOnlyConn struct {
-	reader io.Reader
+	return hello, newPrefixedReader(peeked, reader), nil
 }
 
-// type check
-var _ net.Conn = (*readOnlyConn)(nil)
+// readClientHelloRecords reads TLS records from the reader until it gets the
+// whole ClientHello handshake message, which may be fragmented into several
+// records.  peeked contains the exact bytes read from the reader, msg is the
+// reassembled handshake message including its header.
+func readClientHelloRecords(reader io.Reader) (peeked, msg []byte, err error) {
+	var hdr [recordHeaderLen]byte
+
+	// msgLen is the length of the handshake message including the header, -1
+	// until the header is received.
+	msgLen := -1
+	for msgLen < 0 || len(msg) < msgLen {
+		if _, err = io.ReadFull(reader, hdr[:]); err != nil {
+			return nil, nil, err
+		}
 
-// Read implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) Read(p []byte) (int, error) { return conn.reader.Read(p) }
+		if hdr[0] != recordTypeHandshake {
+			return nil, nil, errNotHandshake
+		}
 
-// Write implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) Write(_ []byte) (int, error) { return 0, io.ErrClosedPipe }
+		recordLen := int(binary.BigEndian.Uint16(hdr[3:]))
+		if recordLen > maxRecordLen {
+			return nil, nil, errRecordTooLarge
+		}
 
-// Close implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) Close() error { return nil }
+		if len(peeked)+recordHeaderLen+recordLen > maxPeekLen {
+			return nil, nil, errHelloTooLarge
+		}
 
-// LocalAddr implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) LocalAddr() net.Addr { return nil }
+		start := len(peeked) + recordHeaderLen
+		peeked = slices.Grow(peeked, recordHeaderLen+recordLen)
+		peeked = append(peeked, hdr[:]...)
+		peeked = peeked[:start+recordLen]
+		if _, err = io.ReadFull(reader, peeked[start:]); err != nil {
+			return nil, nil, err
+		}
 
-// RemoteAddr implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) RemoteAddr() net.Addr { return nil }
+		fragment := peeked[start:]
+		switch {
+		case len(fragment) == 0:
+			// RFC 8446 prohibits zero-length fragments of handshake messages.
+			return nil, nil, errMalformed
+		case start == recordHeaderLen:
+			// Avoid copying in the most common case when the whole message
+			// fits into the first record.  Limit the capacity so that the
+			// next append never writes into peeked.
+			msg = fragment[:len(fragment):len(fragment)]
+		default:
+			msg = append(msg, fragment...)
+		}
 
-// SetDeadline implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) SetDeadline(_ time.Time) error { return nil }
+		if msgLen < 0 && len(msg) >= handshakeHeaderLen {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, nil, errNotClientHello
+			}
 
-// SetReadDeadline implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) SetReadDeadline(_ time.Time) error { return nil }
+			msgLen = handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if msgLen > maxClientHelloLen {
+				return nil, nil, errHelloTooLarge
+			}
+		}
+	}
 
-// SetWriteDeadline implements the net.Conn interface for *readOnlyConn.
-func (conn readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
+	return peeked, msg[:msgLen], nil
+}
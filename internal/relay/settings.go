@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/container"
+	"golang.org/x/net/proxy"
+)
+
+// settings are the settings of the relay server that can be changed at
+// runtime.  settings must not be modified after creation.
+type settings struct {
+	// fingerprintAllowlist is the set of allowed JA3 and JA4 fingerprints.
+	// If empty, all fingerprints not in fingerprintDenylist are allowed.
+	fingerprintAllowlist *container.MapSet[string]
+
+	// fingerprintDenylist is the set of denied JA3 and JA4 fingerprints.
+	fingerprintDenylist *container.MapSet[string]
+
+	// clientAllowlist are the networks of the allowed clients.  If empty, all
+	// clients not in clientDenylist are allowed.
+	clientAllowlist []netip.Prefix
+
+	// clientDenylist are the networks of the denied clients.
+	clientDenylist []netip.Prefix
+
+	// dialer is the proxy dialer.  If nil, remote servers are connected to
+	// directly.
+	dialer proxy.Dialer
+
+	// proxyProtocolTrusted are the networks PROXY protocol headers are
+	// accepted from.
+	proxyProtocolTrusted []netip.Prefix
+
+	// proxyProtocolPlain and proxyProtocolTLS are true if the PROXY protocol
+	// header is expected on the plain HTTP and TLS listeners.
+	proxyProtocolPlain bool
+	proxyProtocolTLS   bool
+
+	// sniffTimeout, dialTimeout, idleTimeout, and maxLifetime are the
+	// timeouts of the client connections, see [Config].
+	sniffTimeout time.Duration
+	dialTimeout  time.Duration
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+
+	// maxConns, maxConnsPerClient, and maxConnsPerDestination are the
+	// connection limits, see [Config].
+	maxConns               int
+	maxConnsPerClient      int
+	maxConnsPerDestination int
+
+	// maxQUICFlows is the maximum number of entries in the QUIC NAT table.
+	maxQUICFlows int
+
+	// clientSubnetV4 and clientSubnetV6 are the prefix lengths of the client
+	// subnets the per-client limit applies to.
+	clientSubnetV4 int
+	clientSubnetV6 int
+
+	// rateLimit and rateLimitBurst are the rate, in connections per second,
+	// and the burst of the token buckets of the client subnets.  If rateLimit
+	// is zero, the rate is not limited.
+	rateLimit      float64
+	rateLimitBurst float64
+
+	// rateLimitAllowlist are the networks excluded from rate limiting.
+	rateLimitAllowlist []netip.Prefix
+
+	// bandwidthPerConn and bandwidthPerClient are the rates, in bytes per
+	// second, of the traffic in each direction of a connection and of all
+	// connections from a client IP.  Zero means no limit.
+	bandwidthPerConn   float64
+	bandwidthPerClient float64
+
+	// quotaLimits are the traffic quotas of a client IP.
+	quotaLimits quotaLimits
+
+	// quotaUsers are the clients identified by their networks.
+	quotaUsers []*QuotaUser
+
+	// quotaCutExisting is true if the connections of a client are closed when
+	// its quota is exhausted.
+	quotaCutExisting bool
+}
+
+// newSettings returns the runtime settings from cfg.
+func newSettings(cfg *Config) (st *settings, err error) {
+	st = &settings{
+		fingerprintAllowlist: container.NewMapSet(cfg.FingerprintAllowlist...),
+		fingerprintDenylist:  container.NewMapSet(cfg.FingerprintDenylist...),
+		clientAllowlist:      cfg.ClientAllowlist,
+		clientDenylist:       cfg.ClientDenylist,
+		proxyProtocolTrusted: cfg.ProxyProtocolTrusted,
+		proxyProtocolPlain:   cfg.ProxyProtocolPlain,
+		proxyProtocolTLS:     cfg.ProxyProtocolTLS,
+		sniffTimeout:         cmp.Or(cfg.SniffTimeout, defaultSniffTimeout),
+		dialTimeout:          cmp.Or(cfg.DialTimeout, defaultDialTimeout),
+		idleTimeout:          cfg.IdleTimeout,
+		maxLifetime:          cfg.MaxLifetime,
+
+		maxConns:               cfg.MaxConns,
+		maxConnsPerClient:      cfg.MaxConnsPerClient,
+		maxConnsPerDestination: cfg.MaxConnsPerDestination,
+		maxQUICFlows:           cmp.Or(cfg.MaxQUICFlows, defaultMaxQUICFlows),
+		clientSubnetV4:         cmp.Or(cfg.ClientSubnetV4, defaultClientSubnetV4),
+		clientSubnetV6:         cmp.Or(cfg.ClientSubnetV6, defaultClientSubnetV6),
+
+		rateLimit:          float64(cfg.RateLimit),
+		rateLimitBurst:     float64(cmp.Or(cfg.RateLimitBurst, cfg.RateLimit)),
+		rateLimitAllowlist: cfg.RateLimitAllowlist,
+
+		bandwidthPerConn:   float64(cfg.BandwidthPerConn),
+		bandwidthPerClient: float64(cfg.BandwidthPerClient),
+
+		quotaLimits: quotaLimits{
+			daily:   uint64(cfg.QuotaDaily),
+			monthly: uint64(cfg.QuotaMonthly),
+		},
+		quotaUsers:       cfg.QuotaUsers,
+		quotaCutExisting: cfg.QuotaCutExisting,
+	}
+
+	if cfg.ProxyURL != nil {
+		st.dialer, err = proxy.FromURL(cfg.ProxyURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+	}
+
+	return st, nil
+}
+
+// fingerprintAllowed returns true if the TLS client with the fingerprint fp is
+// allowed to use the relay.
+func (st *settings) fingerprintAllowed(fp fingerprint) (ok bool) {
+	if st.fingerprintDenylist.Has(fp.ja3) || st.fingerprintDenylist.Has(fp.ja4) {
+		return false
+	}
+
+	if st.fingerprintAllowlist.Len() == 0 {
+		return true
+	}
+
+	return st.fingerprintAllowlist.Has(fp.ja3) || st.fingerprintAllowlist.Has(fp.ja4)
+}
+
+// proxyProtocolTrustedAddr returns true if addr is allowed to send PROXY
+// protocol headers.
+func (st *settings) proxyProtocolTrustedAddr(addr netip.Addr) (ok bool) {
+	return containsAddr(st.proxyProtocolTrusted, addr)
+}
+
+// rateLimitAllowed returns true if addr is excluded from rate limiting.
+func (st *settings) rateLimitAllowed(addr netip.Addr) (ok bool) {
+	return containsAddr(st.rateLimitAllowlist, addr.Unmap())
+}
+
+// containsAddr returns true if one of prefixes contains addr.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) (ok bool) {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,279 @@
+package relay
+
+import (
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/snirelay/internal/metrics"
+)
+
+// maxChunkSize is the maximum number of bytes a *shapedReader reads at once.
+const maxChunkSize = 32 * 1024
+
+// byteBucket is a token bucket that limits the rate of the traffic.  Its
+// capacity is the traffic of one second.
+type byteBucket struct {
+	// mu protects all fields.
+	mu *sync.Mutex
+
+	// updated is the time tokens were last updated.
+	updated time.Time
+
+	// tokens is the number of bytes that can be sent at updated.  It is
+	// negative if the bytes taken have to be waited for.
+	tokens float64
+
+	// rate is the rate in bytes per second.
+	rate float64
+}
+
+// newByteBucket returns a new full *byteBucket with the rate in bytes per
+// second.
+func newByteBucket(rate float64) (b *byteBucket) {
+	return &byteBucket{
+		mu:      &sync.Mutex{},
+		updated: time.Now(),
+		tokens:  rate,
+		rate:    rate,
+	}
+}
+
+// take takes n bytes from the bucket at now and returns the time to wait
+// before sending them.
+func (b *byteBucket) take(n int, now time.Time) (wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// setRate sets the rate of the bucket in bytes per second.
+func (b *byteBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = rate
+}
+
+// bandwidth are the token buckets for both directions of the traffic.
+type bandwidth struct {
+	// sent limits the traffic from the client to the remote server.
+	sent *byteBucket
+
+	// received limits the traffic from the remote server to the client.
+	received *byteBucket
+}
+
+// newBandwidth returns the new buckets with the rate in bytes per second.
+func newBandwidth(rate float64) (bw *bandwidth) {
+	return &bandwidth{
+		sent:     newByteBucket(rate),
+		received: newByteBucket(rate),
+	}
+}
+
+// sharedBandwidthEntry is the bandwidth limit shared by the connections with
+// the same key.
+type sharedBandwidthEntry struct {
+	bw   *bandwidth
+	refs int
+}
+
+// sharedBandwidth are the bandwidth limits shared by the connections with the
+// same key, e.g. the client IP.
+type sharedBandwidth[K comparable] struct {
+	// mu protects entries.
+	mu *sync.Mutex
+
+	// entries are the limits of the keys that have active connections.
+	entries map[K]*sharedBandwidthEntry
+}
+
+// newSharedBandwidth returns a new properly initialized *sharedBandwidth.
+func newSharedBandwidth[K comparable]() (s *sharedBandwidth[K]) {
+	return &sharedBandwidth[K]{
+		mu:      &sync.Mutex{},
+		entries: map[K]*sharedBandwidthEntry{},
+	}
+}
+
+// acquire returns the limit of key with the rate in bytes per second, the
+// rate of the existing limit is updated.  release must be called with the
+// same key when the connection is closed.
+func (s *sharedBandwidth[K]) acquire(key K, rate float64) (bw *bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &sharedBandwidthEntry{
+			bw: newBandwidth(rate),
+		}
+		s.entries[key] = e
+	} else {
+		e.bw.sent.setRate(rate)
+		e.bw.received.setRate(rate)
+	}
+
+	e.refs++
+
+	return e.bw
+}
+
+// release releases the limit of key.
+func (s *sharedBandwidth[K]) release(key K) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[key]
+	e.refs--
+	if e.refs == 0 {
+		delete(s.entries, key)
+	}
+}
+
+// connShaper limits the bandwidth of a tunneled connection.
+type connShaper struct {
+	// done is closed when the connection is force-closed.
+	done <-chan struct{}
+
+	// release releases the shared limits.
+	release func()
+
+	// sent and received are the buckets that limit the traffic in each
+	// direction.
+	sent     []*byteBucket
+	received []*byteBucket
+
+	// chunk is the maximum number of bytes read at once.  It is the number of
+	// bytes the bucket with the lowest rate allows in a second, so that the
+	// waits stay short.
+	chunk int
+}
+
+// newConnShaper returns the shaper for the connection c from clientIP that
+// matches the rule r.  sh.release must be called when the tunnel is finished.
+func (s *Server) newConnShaper(
+	st *settings,
+	c *activeConn,
+	clientIP netip.Addr,
+	r *Rule,
+) (sh *connShaper) {
+	sh = &connShaper{
+		done:    c.done,
+		release: func() {},
+		chunk:   maxChunkSize,
+	}
+
+	if rate := st.bandwidthPerConn; rate > 0 {
+		sh.add(newBandwidth(rate), rate)
+	}
+
+	if rate := st.bandwidthPerClient; rate > 0 {
+		sh.add(s.clientsBandwidth.acquire(clientIP, rate), rate)
+		sh.release = func() { s.clientsBandwidth.release(clientIP) }
+	}
+
+	if rate := float64(r.Bandwidth); rate > 0 {
+		key := r.bandwidthKey()
+		sh.add(s.rulesBandwidth.acquire(key, rate), rate)
+
+		releaseClient := sh.release
+		sh.release = func() {
+			releaseClient()
+			s.rulesBandwidth.release(key)
+		}
+	}
+
+	return sh
+}
+
+// add adds the buckets of bw with the rate in bytes per second to sh.
+func (sh *connShaper) add(bw *bandwidth, rate float64) {
+	sh.sent = append(sh.sent, bw.sent)
+	sh.received = append(sh.received, bw.received)
+	sh.chunk = max(min(sh.chunk, int(rate)), 1)
+}
+
+// sentReader returns the reader of the data sent by the client.  It returns r
+// itself if the traffic is not limited.
+func (sh *connShaper) sentReader(r io.Reader) (sr io.Reader) {
+	return sh.reader(r, sh.sent, true)
+}
+
+// receivedReader returns the reader of the data received from the remote
+// server.  It returns r itself if the traffic is not limited.
+func (sh *connShaper) receivedReader(r io.Reader) (sr io.Reader) {
+	return sh.reader(r, sh.received, false)
+}
+
+// reader returns r wrapped into a *shapedReader with the buckets.
+func (sh *connShaper) reader(r io.Reader, buckets []*byteBucket, sent bool) (sr io.Reader) {
+	if len(buckets) == 0 {
+		return r
+	}
+
+	return &shapedReader{
+		reader:  r,
+		done:    sh.done,
+		buckets: buckets,
+		chunk:   sh.chunk,
+		sent:    sent,
+	}
+}
+
+// shapedReader is an [io.Reader] that waits after each read until the buckets
+// allow sending the data that has been read.
+type shapedReader struct {
+	reader  io.Reader
+	done    <-chan struct{}
+	buckets []*byteBucket
+	chunk   int
+	sent    bool
+}
+
+// type check
+var _ io.Reader = (*shapedReader)(nil)
+
+// Read implements the [io.Reader] interface for *shapedReader.
+func (r *shapedReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p[:min(len(p), r.chunk)])
+	if n == 0 {
+		return n, err
+	}
+
+	now := time.Now()
+
+	var wait time.Duration
+	for _, b := range r.buckets {
+		wait = max(wait, b.take(n, now))
+	}
+
+	metrics.ShapedBytesAdd(n, r.sent)
+	if wait == 0 {
+		return n, err
+	}
+
+	metrics.ThrottleTimeAdd(wait, r.sent)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-r.done:
+		// The connection has been closed, so the data cannot be sent anyway.
+	}
+
+	return n, err
+}
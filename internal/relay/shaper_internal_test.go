@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteBucket_take(t *testing.T) {
+	b := newByteBucket(1000)
+	now := b.updated
+
+	assert.Zero(t, b.take(1000, now))
+	assert.Equal(t, 500*time.Millisecond, b.take(500, now))
+
+	// The debt is paid off in half a second.
+	now = now.Add(500 * time.Millisecond)
+	assert.Zero(t, b.take(0, now))
+
+	// The bucket does not hold more than a second of traffic.
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Second, b.take(2000, now))
+}
+
+func TestSharedBandwidth(t *testing.T) {
+	s := newSharedBandwidth[netip.Addr]()
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	bw := s.acquire(addr, 1000)
+	assert.Same(t, bw, s.acquire(addr, 2000))
+	assert.Equal(t, 2000.0, bw.sent.rate)
+
+	s.release(addr)
+	require.Len(t, s.entries, 1)
+
+	s.release(addr)
+	assert.Empty(t, s.entries)
+}
+
+func TestShapedReader(t *testing.T) {
+	const rate = 100_000
+
+	sh := &connShaper{
+		done:  make(chan struct{}),
+		chunk: maxChunkSize,
+	}
+	sh.add(newBandwidth(rate), rate)
+
+	// The first second of traffic is sent right away, so the rest takes half
+	// a second.
+	data := make([]byte, rate*3/2)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, sh.sentReader(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(len(data)), n)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	// The other direction has its own bucket.
+	r := sh.receivedReader(bytes.NewReader(data[:rate]))
+
+	start = time.Now()
+	_, err = io.Copy(io.Discard, r)
+	require.NoError(t, err)
+
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestShapedReader_done(t *testing.T) {
+	done := make(chan struct{})
+	sh := &connShaper{
+		done:  done,
+		chunk: maxChunkSize,
+	}
+	sh.add(newBandwidth(1), 1)
+
+	r := sh.sentReader(bytes.NewReader(make([]byte, 10)))
+
+	// The first byte is in the bucket.
+	_, err := r.Read(make([]byte, 10))
+	require.NoError(t, err)
+
+	close(done)
+
+	start := time.Now()
+	n, err := r.Read(make([]byte, 10))
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, n)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// defaultSniffTimeout is the default time the client is given to send the
+	// data the server name is peeked from.
+	defaultSniffTimeout = 60 * time.Second
+
+	// defaultDialTimeout is the default time the relay is given to connect to
+	// the remote server.
+	defaultDialTimeout = 30 * time.Second
+)
+
+// dialContext connects to addr using dialer.  ctx is only used if dialer
+// supports it, which is true for [*net.Dialer] and the SOCKS5 dialer.
+func dialContext(
+	ctx context.Context,
+	dialer proxy.Dialer,
+	addr string,
+) (conn net.Conn, err error) {
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, "tcp", addr)
+	}
+
+	return dialer.Dial("tcp", addr)
+}
+
+// connTimer closes a tunneled connection when it has had no traffic for the
+// idle timeout or when it has been open for the maximum lifetime.
+type connTimer struct {
+	// c is the connection closed on timeout.
+	c *activeConn
+
+	// mu protects idleTimer and lifetimeTimer.
+	mu *sync.Mutex
+
+	// idleTimer is nil if the idle timeout is disabled.
+	idleTimer *time.Timer
+
+	// lifetimeTimer is nil if the lifetime is not limited.
+	lifetimeTimer *time.Timer
+
+	// lastActive is the Unix time in nanoseconds when the data was last
+	// relayed in either direction.
+	lastActive *atomic.Int64
+
+	// done is set when either the connection is closed on timeout or the
+	// timer is stopped.
+	done *atomic.Bool
+
+	// idle is the idle timeout.
+	idle time.Duration
+}
+
+// newConnTimer starts the timers for c.  Zero idle or lifetime disables the
+// corresponding timer.  t.stop must be called when the tunnel is finished.
+func newConnTimer(c *activeConn, idle, lifetime time.Duration) (t *connTimer) {
+	t = &connTimer{
+		c:          c,
+		mu:         &sync.Mutex{},
+		lastActive: &atomic.Int64{},
+		done:       &atomic.Bool{},
+		idle:       idle,
+	}
+
+	t.lastActive.Store(time.Now().UnixNano())
+
+	// Lock the timer so that the callbacks do not see the fields unset.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if idle > 0 {
+		t.idleTimer = time.AfterFunc(idle, t.checkIdle)
+	}
+
+	if lifetime > 0 {
+		t.lifetimeTimer = time.AfterFunc(lifetime, func() {
+			t.expire("max lifetime", metrics.LifetimeTimeoutsTotal)
+		})
+	}
+
+	return t
+}
+
+// touch marks the tunnel as active.  It is called by the traffic counters of
+// the tunnel instead of wrapping its readers, so that the data can still be
+// spliced.
+func (t *connTimer) touch() {
+	if t.idle > 0 {
+		t.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// checkIdle closes the connection if it has been idle for the idle timeout
+// and otherwise schedules the next check.
+func (t *connTimer) checkIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idleFor := time.Since(time.Unix(0, t.lastActive.Load()))
+	if left := t.idle - idleFor; left > 0 {
+		t.idleTimer.Reset(left)
+
+		return
+	}
+
+	t.expire("idle timeout", metrics.IdleTimeoutsTotal)
+}
+
+// expire closes the connection due to the reason unless it has already been
+// closed or the timer has been stopped.  counter is the metric of the reason.
+func (t *connTimer) expire(reason string, counter prometheus.Counter) {
+	if !t.done.CompareAndSwap(false, true) {
+		return
+	}
+
+	counter.Inc()
+	log.Debug("relay: closing connection from %s: %s", t.c.client.RemoteAddr(), reason)
+
+	err := t.c.close()
+	if err != nil {
+		log.Debug("relay: closing connection from %s: %s", t.c.client.RemoteAddr(), err)
+	}
+}
+
+// stop stops the timers.
+func (t *connTimer) stop() {
+	t.done.Store(true)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+	}
+
+	if t.lifetimeTimer != nil {
+		t.lifetimeTimer.Stop()
+	}
+}
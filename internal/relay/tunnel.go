@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"io"
+	"net"
+
+	"github.com/AdguardTeam/golibs/syncutil"
+)
+
+const (
+	// tunnelBufferSize is the size of the buffers the data is copied with
+	// when it cannot be spliced.  It is the same as the one of [io.Copy].
+	tunnelBufferSize = 32 * 1024
+
+	// spliceChunkSize is the maximum number of bytes spliced at once.  The
+	// traffic is counted after each chunk, so it must be small enough for
+	// the counters to be updated regularly for fast connections.  It is the
+	// default capacity of a pipe on Linux.
+	spliceChunkSize = 64 * 1024
+)
+
+// tunnelBuffers are the buffers the data is copied with when it cannot be
+// spliced.
+var tunnelBuffers = syncutil.NewSlicePool[byte](tunnelBufferSize)
+
+// prefixedReader is an [io.Reader] that returns prefix and then the data from
+// reader.  Unlike [io.MultiReader], it exposes both of them, so that the tunnel
+// can write prefix and then copy the data from the underlying connection
+// directly.
+type prefixedReader struct {
+	// reader is the reader the data is read from after prefix.
+	reader io.Reader
+
+	// prefix are the remaining bytes that have been read from reader before.
+	prefix []byte
+}
+
+// type check
+var _ io.Reader = (*prefixedReader)(nil)
+
+// newPrefixedReader returns the reader of prefix followed by the data from
+// reader.  If reader is a *prefixedReader itself, they are merged, so that the
+// underlying reader is always accessible.
+func newPrefixedReader(prefix []byte, reader io.Reader) (r *prefixedReader) {
+	if pr, ok := reader.(*prefixedReader); ok {
+		return &prefixedReader{
+			reader: pr.reader,
+			prefix: append(prefix, pr.prefix...),
+		}
+	}
+
+	return &prefixedReader{
+		reader: reader,
+		prefix: prefix,
+	}
+}
+
+// Read implements the [io.Reader] interface for *prefixedReader.
+func (r *prefixedReader) Read(p []byte) (n int, err error) {
+	if len(r.prefix) == 0 {
+		return r.reader.Read(p)
+	}
+
+	n = copy(p, r.prefix)
+	r.prefix = r.prefix[n:]
+
+	return n, nil
+}
+
+// copyConn copies the data from src to dst until either EOF is reached on src
+// or an error occurs, and calls count with the number of bytes after each
+// write.  If src is a *prefixedReader, its prefix is written first.  The data
+// is spliced if both dst and the underlying reader of src are TCP connections
+// and the system supports it.  Otherwise, it is copied with a buffer from
+// tunnelBuffers.
+//
+// If eager is true, the spliced data is counted as soon as it is relayed.
+// Otherwise, it may be counted in chunks of up to spliceChunkSize, which is
+// cheaper, but the traffic of slow connections is only seen later.
+func copyConn(
+	dst net.Conn,
+	src io.Reader,
+	count func(n int64),
+	eager bool,
+) (written int64, err error) {
+	if pr, ok := src.(*prefixedReader); ok {
+		src = pr.reader
+
+		if len(pr.prefix) > 0 {
+			var n int
+			n, err = dst.Write(pr.prefix)
+			written += int64(n)
+			count(int64(n))
+			pr.prefix = nil
+
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	var n int64
+	tcpDst, dstOK := dst.(*net.TCPConn)
+	tcpSrc, srcOK := src.(*net.TCPConn)
+	if spliceSupported && dstOK && srcOK {
+		n, err = spliceConn(tcpDst, tcpSrc, count, eager)
+	} else {
+		n, err = copyBuffered(dst, src, count)
+	}
+
+	return written + n, err
+}
+
+// spliceConn copies the data from src to dst in chunks of up to
+// spliceChunkSize using [*net.TCPConn.ReadFrom], which splices the data from
+// another TCP connection and from an [*io.LimitedReader] over one.  If eager is
+// true, each chunk is the data received by the time it is spliced, see
+// readableSizer.
+func spliceConn(
+	dst *net.TCPConn,
+	src *net.TCPConn,
+	count func(n int64),
+	eager bool,
+) (written int64, err error) {
+	var sizer *readableSizer
+	if eager {
+		sizer, err = newReadableSizer(src)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	lr := &io.LimitedReader{R: src}
+	for {
+		lr.N = spliceChunkSize
+		if sizer != nil {
+			// On EOF and errors, ReadFrom reports them itself.
+			avail, availErr := sizer.readableLen()
+			if availErr == nil && avail > 0 {
+				lr.N = int64(min(avail, spliceChunkSize))
+			}
+		}
+
+		var n int64
+		n, err = dst.ReadFrom(lr)
+		written += n
+		if n > 0 {
+			count(n)
+		}
+
+		// ReadFrom only returns less than the limit on EOF or on error.
+		if err != nil || lr.N > 0 {
+			return written, err
+		}
+	}
+}
+
+// copyBuffered copies the data from src to dst using a buffer from
+// tunnelBuffers.
+func copyBuffered(dst io.Writer, src io.Reader, count func(n int64)) (written int64, err error) {
+	bufPtr := tunnelBuffers.Get()
+	defer tunnelBuffers.Put(bufPtr)
+
+	buf := *bufPtr
+	for {
+		nr, readErr := src.Read(buf)
+		if nr > 0 {
+			nw, writeErr := dst.Write(buf[:nr])
+			written += int64(nw)
+			count(int64(nw))
+
+			switch {
+			case writeErr != nil:
+				return written, writeErr
+			case nw != nr:
+				return written, io.ErrShortWrite
+			}
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		} else if readErr != nil {
+			return written, readErr
+		}
+	}
+}
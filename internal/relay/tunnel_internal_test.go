@@ -0,0 +1,234 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPrefixedReader(t *testing.T) {
+	underlying := strings.NewReader("data")
+
+	inner := newPrefixedReader([]byte("header "), underlying)
+	_, err := inner.Read(make([]byte, 3))
+	require.NoError(t, err)
+
+	r := newPrefixedReader([]byte("hello "), inner)
+	assert.Same(t, underlying, r.reader)
+
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello der data", string(got))
+}
+
+// newTCPPair returns the client and the server ends of a TCP connection over
+// the loopback interface.
+func newTCPPair(tb testing.TB) (client, server *net.TCPConn) {
+	tb.Helper()
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(tb, err)
+	defer func() { require.NoError(tb, l.Close()) }()
+
+	client, err = net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	require.NoError(tb, err)
+
+	server, err = l.AcceptTCP()
+	require.NoError(tb, err)
+
+	return client, server
+}
+
+// runCopy copies data through a pair of TCP connections with copyFunc, which
+// copies from the server end of the first pair to the client end of the
+// second one.  The data received on the other end is written to sink.
+func runCopy(
+	tb testing.TB,
+	data []byte,
+	sink io.Writer,
+	copyFunc func(dst net.Conn, src *net.TCPConn) (err error),
+) {
+	tb.Helper()
+
+	srcClient, src := newTCPPair(tb)
+	dst, dstServer := newTCPPair(tb)
+
+	go func() {
+		_, _ = srcClient.Write(data)
+		_ = srcClient.Close()
+	}()
+
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+
+		_, _ = io.Copy(sink, dstServer)
+		_ = dstServer.Close()
+	}()
+
+	require.NoError(tb, copyFunc(dst, src))
+	require.NoError(tb, dst.CloseWrite())
+	require.NoError(tb, src.Close())
+
+	<-recvDone
+	require.NoError(tb, dst.Close())
+}
+
+func TestCopyConn(t *testing.T) {
+	prefix := []byte("peeked ClientHello")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*spliceChunkSize/16+1)
+	want := append(bytes.Clone(prefix), data...)
+
+	testCases := []struct {
+		wrap  func(r io.Reader) (wrapped io.Reader)
+		name  string
+		eager bool
+	}{{
+		wrap:  func(r io.Reader) (wrapped io.Reader) { return r },
+		name:  "raw",
+		eager: false,
+	}, {
+		wrap:  func(r io.Reader) (wrapped io.Reader) { return r },
+		name:  "raw_eager",
+		eager: true,
+	}, {
+		wrap:  func(r io.Reader) (wrapped io.Reader) { return struct{ io.Reader }{r} },
+		name:  "wrapped",
+		eager: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var counted int64
+			var copied int64
+			got := &bytes.Buffer{}
+			runCopy(t, data, got, func(dst net.Conn, src *net.TCPConn) (err error) {
+				r := newPrefixedReader(bytes.Clone(prefix), tc.wrap(src))
+				copied, err = copyConn(dst, r, func(n int64) { counted += n }, tc.eager)
+
+				return err
+			})
+
+			assert.Equal(t, want, got.Bytes())
+			assert.Equal(t, int64(len(want)), copied)
+			assert.Equal(t, copied, counted)
+		})
+	}
+
+	t.Run("slow", func(t *testing.T) {
+		const testTimeout = 5 * time.Second
+
+		srcClient, src := newTCPPair(t)
+		testutil.CleanupAndRequireSuccess(t, src.Close)
+
+		dst, dstServer := newTCPPair(t)
+		testutil.CleanupAndRequireSuccess(t, dst.Close)
+		testutil.CleanupAndRequireSuccess(t, dstServer.Close)
+
+		countCh := make(chan int64, 1)
+		copyDone := make(chan struct{})
+		go func() {
+			defer close(copyDone)
+
+			_, _ = copyConn(dst, src, func(n int64) { countCh <- n }, true)
+		}()
+
+		// The data is counted before a whole chunk is received.
+		_, err := srcClient.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		n, _ := testutil.RequireReceive(t, countCh, testTimeout)
+		assert.Equal(t, int64(4), n)
+
+		require.NoError(t, srcClient.Close())
+		testutil.RequireReceive(t, copyDone, testTimeout)
+	})
+
+	t.Run("closed_dst", func(t *testing.T) {
+		dst, dstServer := newTCPPair(t)
+		testutil.CleanupAndRequireSuccess(t, dstServer.Close)
+		require.NoError(t, dst.Close())
+
+		_, err := copyConn(dst, newPrefixedReader(prefix, strings.NewReader("")), func(_ int64) {}, false)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+}
+
+// BenchmarkCopyConn compares copying the data from a TCP connection after the
+// peeked bytes with io.Copy and io.MultiReader, the way the tunnel did it
+// before, with copyConn splicing the data and copying it with the pooled
+// buffers.  The cpu-ns/op metric is the CPU time of the copying thread, which
+// is what the relay spends, unlike the throughput, which also depends on the
+// ends of the connections.
+func BenchmarkCopyConn(b *testing.B) {
+	prefix := make([]byte, 512)
+	data := make([]byte, 64<<20)
+
+	benchCases := []struct {
+		copyFunc func(dst net.Conn, src *net.TCPConn) (err error)
+		name     string
+	}{{
+		copyFunc: func(dst net.Conn, src *net.TCPConn) (err error) {
+			_, err = io.Copy(dst, io.MultiReader(bytes.NewReader(prefix), src))
+
+			return err
+		},
+		name: "io_copy_multireader",
+	}, {
+		copyFunc: func(dst net.Conn, src *net.TCPConn) (err error) {
+			_, err = copyConn(dst, newPrefixedReader(prefix, src), func(_ int64) {}, false)
+
+			return err
+		},
+		name: "copy_conn",
+	}, {
+		copyFunc: func(dst net.Conn, src *net.TCPConn) (err error) {
+			_, err = copyConn(dst, newPrefixedReader(prefix, src), func(_ int64) {}, true)
+
+			return err
+		},
+		name: "copy_conn_eager",
+	}, {
+		copyFunc: func(dst net.Conn, src *net.TCPConn) (err error) {
+			r := newPrefixedReader(prefix, struct{ io.Reader }{src})
+			_, err = copyConn(dst, r, func(_ int64) {}, false)
+
+			return err
+		},
+		name: "copy_conn_buffered",
+	}}
+
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			var cpu time.Duration
+			copyFunc := func(dst net.Conn, src *net.TCPConn) (err error) {
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+
+				start := threadCPUTime(b)
+				err = bc.copyFunc(dst, src)
+				cpu += threadCPUTime(b) - start
+
+				return err
+			}
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				runCopy(b, data, io.Discard, copyFunc)
+			}
+
+			b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
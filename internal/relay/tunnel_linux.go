@@ -0,0 +1,94 @@
+//go:build linux
+
+package relay
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSupported is true if [*net.TCPConn.ReadFrom] moves the data from
+// another TCP connection with splice(2), without copying it to the user space.
+const spliceSupported = true
+
+// readableSizer waits until there is data to read from a TCP connection and
+// returns its length.  [*net.TCPConn.ReadFrom] only returns once it has spliced
+// as much data as it has been asked for, so the tunnel asks for the data that
+// is already received and sees the traffic of slow connections right away.
+//
+// The raw connection and the read callback are reused, so that sizing a chunk
+// takes a single ioctl(2) when the data is already there.
+type readableSizer struct {
+	// rc is the raw connection of the TCP connection.
+	rc syscall.RawConn
+
+	// read is the callback passed to rc.Read.  It is s.sizeFD, bound once.
+	read func(fd uintptr) (done bool)
+
+	// err is the error of the last system call.
+	err error
+
+	// n is the length of the readable data.
+	n int
+
+	// peekBuf is the buffer the connection is peeked with to tell EOF from
+	// no data.
+	peekBuf [1]byte
+}
+
+// newReadableSizer returns a new sizer for the data received on c.
+func newReadableSizer(c *net.TCPConn) (s *readableSizer, err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	s = &readableSizer{
+		rc: rc,
+	}
+	s.read = s.sizeFD
+
+	return s, nil
+}
+
+// readableLen waits until there is data to read and returns its length.  n is
+// zero on EOF.
+func (s *readableSizer) readableLen() (n int, err error) {
+	s.n, s.err = 0, nil
+
+	err = s.rc.Read(s.read)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.n, s.err
+}
+
+// sizeFD sets the length of the data readable from fd.  If there is none, fd
+// is peeked, since the poller only reports the connection as readable again
+// after a read has failed with EAGAIN.
+func (s *readableSizer) sizeFD(fd uintptr) (done bool) {
+	s.n, s.err = unix.IoctlGetInt(int(fd), unix.SIOCINQ)
+	if s.err != nil || s.n > 0 {
+		return true
+	}
+
+	var peeked int
+	peeked, _, s.err = unix.Recvfrom(int(fd), s.peekBuf[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	switch {
+	case s.err == unix.EAGAIN:
+		s.err = nil
+
+		return false
+	case s.err != nil, peeked == 0:
+		// On EOF and errors, ReadFrom reports them itself.
+		return true
+	default:
+		// The data has been received after the ioctl(2).
+		s.n, s.err = unix.IoctlGetInt(int(fd), unix.SIOCINQ)
+
+		return true
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// threadCPUTime returns the CPU time used by the current thread.
+func threadCPUTime(tb testing.TB) (d time.Duration) {
+	tb.Helper()
+
+	var ru unix.Rusage
+	require.NoError(tb, unix.Getrusage(unix.RUSAGE_THREAD, &ru))
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package relay
+
+import "net"
+
+// spliceSupported is true if [*net.TCPConn.ReadFrom] moves the data from
+// another TCP connection with splice(2), without copying it to the user space.
+// Elsewhere, it copies the data with a new buffer each time, so the pooled
+// buffers are used instead.
+const spliceSupported = false
+
+// readableSizer is not used, since the data is never spliced.
+type readableSizer struct{}
+
+// newReadableSizer is not used, since the data is never spliced.
+func newReadableSizer(_ *net.TCPConn) (s *readableSizer, err error) {
+	return &readableSizer{}, nil
+}
+
+// readableLen is not used, since the data is never spliced.
+func (s *readableSizer) readableLen() (n int, err error) {
+	return 0, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+// threadCPUTime is not supported, so the CPU time is not reported.
+func threadCPUTime(_ testing.TB) (d time.Duration) {
+	return 0
+}
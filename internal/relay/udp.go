@@ -0,0 +1,911 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/ameshkov/snirelay/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// quicFlowTimeout is the time after which a QUIC flow without any traffic
+	// in either direction is removed from the NAT table.
+	quicFlowTimeout = 60 * time.Second
+
+	// quicRejectedFlowTimeout is the time after which a rejected QUIC flow
+	// without any traffic is removed from the NAT table.  It only has to
+	// outlast the retransmissions of the first client packets.
+	quicRejectedFlowTimeout = 5 * time.Second
+
+	// defaultMaxQUICFlows is the default maximum number of entries in the NAT
+	// table.
+	defaultMaxQUICFlows = 10_000
+
+	// quicSweepInterval is how often the NAT table is checked for idle flows.
+	quicSweepInterval = 5 * time.Second
+
+	// maxUDPDatagramLen is the maximum size of a UDP datagram.
+	maxUDPDatagramLen = 65535
+)
+
+// quicFlowState is the state of a QUIC flow.
+type quicFlowState uint8
+
+const (
+	// quicFlowSniffing means that the ClientHello is not received yet.
+	quicFlowSniffing quicFlowState = iota
+
+	// quicFlowConnecting means that the flow is accepted and the relay is
+	// connecting to the remote server.
+	quicFlowConnecting
+
+	// quicFlowRelaying means that datagrams are relayed to the remote server.
+	quicFlowRelaying
+
+	// quicFlowRejected means that datagrams of the flow are dropped until it
+	// times out.
+	quicFlowRejected
+
+	// quicFlowClosed means that the flow is removed from the NAT table.
+	quicFlowClosed
+)
+
+// quicFlow is an entry of the QUIC NAT table, i.e. datagrams from a single
+// client address.
+type quicFlow struct {
+	// keys are the Initial keys derived from the Destination Connection ID of
+	// the first client Initial packet.
+	keys *quicKeys
+
+	// remote is the connection to the remote server.  It is set in the
+	// quicFlowRelaying state.
+	remote *net.UDPConn
+
+	// client is the socket connected to the client.  It is set when the flow
+	// is handed off, see Server.handOffQUIC, after which the datagrams are
+	// exchanged with the client through it instead of the QUIC listener.
+	client atomic.Pointer[net.UDPConn]
+
+	// mu protects the fields below, except for the atomic ones.
+	mu *sync.Mutex
+
+	// crypto is the reassembled CRYPTO stream of Initial packets.
+	crypto *quicCryptoStream
+
+	// remoteAddr is the address of the remote server.
+	remoteAddr string
+
+	// pending are the datagrams received before the connection to the
+	// remote server was established.
+	pending [][]byte
+
+	// lastActive is the time of the last datagram in either direction in Unix
+	// nanoseconds.
+	lastActive atomic.Int64
+
+	// bytesSent is the number of bytes sent to the remote server.
+	bytesSent atomic.Int64
+
+	// bytesReceived is the number of bytes received from the remote server.
+	bytesReceived atomic.Int64
+
+	// clientAddr is the address of the client.
+	clientAddr netip.AddrPort
+
+	// quotaKey is the key of the client in the quota store.
+	quotaKey string
+
+	// subnet and remoteHost are the keys of the connection limits acquired
+	// by the flow, see Server.acquireFlowLimits.
+	subnet     netip.Prefix
+	remoteHost string
+
+	// created is the time the flow was added to the NAT table.
+	created time.Time
+
+	// pendingLen is the total length of pending.
+	pendingLen int
+
+	state quicFlowState
+
+	// tracked is true if the flow is accepted and tracked for draining, see
+	// Server.trackFlow.
+	tracked bool
+
+	// limited is true if the flow holds the connection limits.
+	limited bool
+}
+
+// touch updates the time of the last activity of the flow.
+func (f *quicFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+// addSent counts n bytes sent to the remote server.  The metrics are updated
+// right away, so that the traffic of long-lived flows is seen before they are
+// closed.
+func (f *quicFlow) addSent(n int) {
+	f.bytesSent.Add(int64(n))
+	metrics.BytesSentTotal.WithLabelValues(f.remoteAddr).Add(float64(n))
+}
+
+// addReceived counts n bytes received from the remote server, see addSent.
+func (f *quicFlow) addReceived(n int) {
+	f.bytesReceived.Add(int64(n))
+	metrics.BytesReceivedTotal.WithLabelValues(f.remoteAddr).Add(float64(n))
+}
+
+// addFlowQuotaUsage adds n bytes of the traffic of the flow to the usage of its
+// client.  The flows of a client with an exhausted quota are closed by
+// sweepFlows.
+func (s *Server) addFlowQuotaUsage(f *quicFlow, n int) {
+	if s.quotas == nil || n <= 0 {
+		return
+	}
+
+	s.quotas.Add(f.quotaKey, uint64(n), time.Now())
+}
+
+// AddrQUIC returns the address where the server listens for QUIC traffic.  It
+// returns nil if the QUIC listener is disabled.
+func (s *Server) AddrQUIC() (addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started || s.listenerQUIC == nil {
+		return nil
+	}
+
+	return s.listenerQUIC.LocalAddr()
+}
+
+// startQUIC starts the QUIC listener if it is enabled.  s.mu is expected to be
+// locked.
+func (s *Server) startQUIC(ctx context.Context) (err error) {
+	if s.listenAddrQUIC == nil {
+		return nil
+	}
+
+	conn, err := s.listenConfig.ListenPacket(ctx, "udp", s.listenAddrQUIC.String())
+	if err != nil {
+		return fmt.Errorf("failed to serve QUIC: %w", err)
+	}
+
+	// The type is always *net.UDPConn for the "udp" network, including the
+	// inherited sockets.
+	s.listenerQUIC = conn.(*net.UDPConn)
+	s.quicDone = make(chan struct{})
+
+	s.flowsMu.Lock()
+	s.quicHandedOff = false
+	s.flowsMu.Unlock()
+
+	s.quicWG.Add(2)
+
+	go s.readLoopQUIC()
+	go s.sweepLoopQUIC(s.quicDone)
+
+	log.Info("relay: listening for QUIC on %s", s.listenerQUIC.LocalAddr())
+
+	return nil
+}
+
+// handOffQUIC stops reading the QUIC listener, so that all datagrams sent to
+// it are read by the process it has been passed to during an upgrade.  The
+// accepted flows are moved to their own sockets connected to the clients, which
+// receive the datagrams of the clients instead of the listener, and the other
+// flows are closed.  If the sockets cannot share the address of the listener,
+// it is kept and read until closeQUIC.  It must only be called by Shutdown
+// after the server has been stopped.
+func (s *Server) handOffQUIC() (err error) {
+	if s.listenerQUIC == nil {
+		return nil
+	}
+
+	rc, err := s.listenerQUIC.SyscallConn()
+	if err == nil {
+		err = setQUICReuse(rc)
+	}
+
+	if err != nil {
+		log.Info("relay: quic: keeping listener while draining: %v", err)
+
+		return nil
+	}
+
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+
+	s.quicHandedOff = true
+	for addr, f := range s.flows {
+		if !s.connectClient(f) {
+			s.closeFlow(f)
+			delete(s.flows, addr)
+		}
+	}
+
+	log.Info("relay: quic: handed off listener, relaying %d flows", len(s.flows))
+
+	return s.listenerQUIC.Close()
+}
+
+// connectClient moves the accepted flow to its own socket connected to the
+// client, see handOffQUIC.  ok is false if the flow is not accepted or the
+// socket cannot be created, in which case the flow must be closed.  s.flowsMu
+// is expected to be locked.
+func (s *Server) connectClient(f *quicFlow) (ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.state != quicFlowConnecting && f.state != quicFlowRelaying {
+		return false
+	}
+
+	dialer := &net.Dialer{
+		LocalAddr: s.listenerQUIC.LocalAddr(),
+		Control: func(_, _ string, c syscall.RawConn) (err error) {
+			return setQUICReuse(c)
+		},
+	}
+
+	c, err := dialer.Dial("udp", f.clientAddr.String())
+	if err != nil {
+		log.Debug("relay: quic: %s: connecting to client: %v", f.clientAddr, err)
+
+		return false
+	}
+
+	client := c.(*net.UDPConn)
+	f.client.Store(client)
+
+	s.quicWG.Add(1)
+	go s.relayFromClient(f, client)
+
+	return true
+}
+
+// relayFromClient relays datagrams from the client socket of the handed-off
+// flow until it is closed.
+func (s *Server) relayFromClient(f *quicFlow, client *net.UDPConn) {
+	defer s.quicWG.Done()
+	defer handlePanicAndRecover()
+
+	buf := make([]byte, maxUDPDatagramLen)
+	for {
+		n, addr, err := client.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Connected sockets also report the ICMP errors, which must not
+			// stop the flow.
+			log.Debug("relay: quic: reading from %s: %v", f.clientAddr, err)
+
+			continue
+		}
+
+		// The datagrams of other clients may be received before the socket
+		// is connected.
+		if addr != f.clientAddr {
+			continue
+		}
+
+		s.handleFlowDatagram(f, buf[:n])
+	}
+}
+
+// closeQUIC closes the QUIC listener, unless it has been handed off, and the
+// remaining flows and waits for their goroutines until ctx is done.  It must
+// only be called by Shutdown after the server has been stopped.
+func (s *Server) closeQUIC(ctx context.Context) (err error) {
+	if s.listenerQUIC == nil {
+		return nil
+	}
+
+	s.flowsMu.Lock()
+	handedOff := s.quicHandedOff
+	s.flowsMu.Unlock()
+
+	if !handedOff {
+		err = s.listenerQUIC.Close()
+	}
+
+	close(s.quicDone)
+	s.closeFlows()
+
+	if !waitGroup(ctx, s.quicWG) {
+		err = errors.Join(err, fmt.Errorf("waiting for quic flows: %w", ctx.Err()))
+	}
+
+	return err
+}
+
+// closeFlows removes all flows from the NAT table and returns the number of
+// the accepted ones among them.
+func (s *Server) closeFlows() (n int) {
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+
+	for addr, f := range s.flows {
+		if s.closeFlow(f) {
+			n++
+		}
+
+		delete(s.flows, addr)
+	}
+
+	return n
+}
+
+// readLoopQUIC runs the infinite read loop for QUIC traffic.
+func (s *Server) readLoopQUIC() {
+	defer s.quicWG.Done()
+	defer handlePanicAndRecover()
+
+	buf := make([]byte, maxUDPDatagramLen)
+	for {
+		n, clientAddr, err := s.listenerQUIC.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Info("relay: exiting quic read loop as it has been closed")
+
+				return
+			}
+
+			log.Debug("relay: error reading quic datagram: %v", err)
+
+			continue
+		}
+
+		s.handleDatagram(buf[:n], clientAddr)
+	}
+}
+
+// sweepLoopQUIC removes the expired flows from the NAT table every
+// quicSweepInterval until done is closed.
+func (s *Server) sweepLoopQUIC(done <-chan struct{}) {
+	defer s.quicWG.Done()
+	defer handlePanicAndRecover()
+
+	ticker := time.NewTicker(quicSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweepFlows()
+		case <-done:
+			return
+		}
+	}
+}
+
+// isTimeout returns true if err is a network timeout error.
+func isTimeout(err error) (ok bool) {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// handleDatagram handles the datagram received from the client.  datagram is
+// only valid until the function returns.
+func (s *Server) handleDatagram(datagram []byte, clientAddr netip.AddrPort) {
+	f := s.flow(datagram, clientAddr)
+	if f == nil {
+		return
+	}
+
+	s.handleFlowDatagram(f, datagram)
+}
+
+// handleFlowDatagram handles the datagram received from the client of the
+// flow.  datagram is only valid until the function returns.
+func (s *Server) handleFlowDatagram(f *quicFlow, datagram []byte) {
+	f.touch()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch f.state {
+	case quicFlowSniffing:
+		s.sniffDatagram(f, datagram)
+	case quicFlowConnecting:
+		f.addPending(datagram)
+	case quicFlowRelaying:
+		n, err := f.remote.Write(datagram)
+		if err != nil {
+			log.Debug("relay: quic: writing to %s: %v", f.remoteAddr, err)
+		}
+
+		f.addSent(n)
+		s.addFlowQuotaUsage(f, n)
+	default:
+		// Drop the datagram.
+	}
+}
+
+// flow returns the NAT table entry for clientAddr.  If there is none, it
+// creates a new one if datagram looks like the first client Initial packet.
+func (s *Server) flow(datagram []byte, clientAddr netip.AddrPort) (f *quicFlow) {
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+
+	f, ok := s.flows[clientAddr]
+	if ok {
+		return f
+	} else if s.quicHandedOff {
+		// The listener is read by another process now.
+		return nil
+	}
+
+	hdr, _, err := parseQUICLongHeader(datagram)
+	if err != nil || !hdr.initial {
+		log.Debug("relay: quic: dropping datagram from %s: not an initial packet", clientAddr)
+
+		return nil
+	}
+
+	st := s.settings.Load()
+	if len(s.flows) >= st.maxQUICFlows {
+		log.Debug("relay: quic: dropping datagram from %s: too many flows", clientAddr)
+		metrics.QUICFlowsDroppedTotal.Inc()
+
+		return nil
+	}
+
+	reason := st.clientRejectReason(clientAddr.Addr())
+	if clientRejected(net.UDPAddrFromAddrPort(clientAddr), reason) {
+		return s.addRejectedFlow(clientAddr)
+	}
+
+	if s.rateLimited(st, clientAddr.Addr()) {
+		log.Debug("relay: quic: %s: rate limit exceeded", clientAddr)
+		metrics.RateLimitedConnectionsTotal.Inc()
+
+		return s.addRejectedFlow(clientAddr)
+	}
+
+	if s.quotaExhausted(st, clientAddr.Addr()) {
+		log.Debug("relay: quic: %s: traffic quota exhausted", clientAddr)
+		metrics.LimitRejectionsInc(limitQuota)
+
+		return s.addRejectedFlow(clientAddr)
+	}
+
+	keys, err := newQUICKeys(hdr.version, hdr.dcid)
+	if err != nil {
+		log.Debug("relay: quic: dropping datagram from %s: %v", clientAddr, err)
+
+		return nil
+	}
+
+	quotaKey, _ := st.quotaClient(clientAddr.Addr())
+	f = &quicFlow{
+		keys:       keys,
+		mu:         &sync.Mutex{},
+		crypto:     &quicCryptoStream{},
+		created:    time.Now(),
+		quotaKey:   quotaKey,
+		clientAddr: clientAddr,
+	}
+	s.flows[clientAddr] = f
+
+	log.Debug("relay: quic: new flow from %s", clientAddr)
+
+	return f
+}
+
+// addRejectedFlow adds a rejected flow for clientAddr to the NAT table, so that
+// the retransmitted Initial packets are dropped without being counted again.
+// s.flowsMu is expected to be locked.
+func (s *Server) addRejectedFlow(clientAddr netip.AddrPort) (f *quicFlow) {
+	f = &quicFlow{
+		mu:         &sync.Mutex{},
+		created:    time.Now(),
+		clientAddr: clientAddr,
+		state:      quicFlowRejected,
+	}
+	s.flows[clientAddr] = f
+
+	return f
+}
+
+// addPending adds a copy of the datagram to the datagrams waiting for the
+// connection to the remote server.  f.mu is expected to be locked.
+func (f *quicFlow) addPending(datagram []byte) {
+	if f.pendingLen+len(datagram) > maxPeekLen {
+		log.Debug("relay: quic: %s: too many pending datagrams", f.clientAddr)
+
+		f.state = quicFlowRejected
+		f.pending = nil
+
+		return
+	}
+
+	f.pending = append(f.pending, append([]byte(nil), datagram...))
+	f.pendingLen += len(datagram)
+}
+
+// sniffDatagram decrypts the Initial packets of the datagram and, once the
+// ClientHello is received, decides whether the flow must be relayed.  f.mu is
+// expected to be locked.
+func (s *Server) sniffDatagram(f *quicFlow, datagram []byte) {
+	f.addPending(datagram)
+	if f.state != quicFlowSniffing {
+		return
+	}
+
+	msg, err := f.readClientHello(datagram)
+	if err != nil {
+		log.Debug("relay: quic: %s: %v", f.clientAddr, err)
+
+		f.state = quicFlowRejected
+		f.pending = nil
+
+		return
+	} else if msg == nil {
+		// Wait for more packets.
+		return
+	}
+
+	hello := &clientHello{}
+	err = parseClientHello(hello, msg)
+	if err != nil {
+		log.Debug("relay: quic: %s: parsing client hello: %v", f.clientAddr, err)
+
+		f.state = quicFlowRejected
+		f.pending = nil
+
+		return
+	}
+
+	serverName := hello.serverName()
+	clientAddr := net.UDPAddrFromAddrPort(f.clientAddr)
+	var rule *Rule
+	if serverName != "" {
+		rule = s.acceptServerName(clientAddr, serverName, hello, true)
+	}
+
+	if rule == nil {
+		f.state = quicFlowRejected
+		f.pending = nil
+
+		return
+	}
+
+	remoteAddr := rule.remoteAddr(serverName, false)
+	if limit := s.acquireFlowLimits(f, remoteAddr); limit != "" {
+		log.Debug("relay: quic: %s: %s connection limit reached", f.clientAddr, limit)
+		metrics.LimitRejectionsInc(limit)
+
+		f.state = quicFlowRejected
+		f.pending = nil
+
+		return
+	}
+
+	if !s.trackFlow(f) {
+		log.Debug("relay: quic: %s: rejecting new flow while shutting down", f.clientAddr)
+
+		s.releaseFlowLimits(f)
+		f.state = quicFlowRejected
+		f.pending = nil
+
+		return
+	}
+
+	f.state = quicFlowConnecting
+	f.remoteAddr = remoteAddr
+
+	s.quicWG.Add(1)
+	go s.connectFlow(f)
+}
+
+// acquireFlowLimits acquires the global, per-client, and per-destination
+// connection limits for the flow to remoteAddr.  limit is the name of the
+// limit reached or an empty string if all of them are acquired, in which case
+// releaseFlowLimits must be called when the flow is closed.  f.mu is expected
+// to be locked.
+func (s *Server) acquireFlowLimits(f *quicFlow, remoteAddr string) (limit string) {
+	st := s.settings.Load()
+	if !s.limits.global.acquire(struct{}{}, st.maxConns) {
+		return limitGlobal
+	}
+
+	subnet := st.clientSubnet(f.clientAddr.Addr())
+	if !s.limits.clients.acquire(subnet, st.maxConnsPerClient) {
+		s.limits.global.release(struct{}{})
+
+		return limitClient
+	}
+
+	// The remote address is always valid, so the host is never empty.
+	remoteHost, _, _ := netutil.SplitHostPort(remoteAddr)
+	if !s.limits.destination.acquire(remoteHost, st.maxConnsPerDestination) {
+		s.limits.clients.release(subnet)
+		s.limits.global.release(struct{}{})
+
+		return limitDestination
+	}
+
+	f.subnet, f.remoteHost, f.limited = subnet, remoteHost, true
+
+	return ""
+}
+
+// releaseFlowLimits releases the connection limits held by the flow, if any.
+// f.mu is expected to be locked.
+func (s *Server) releaseFlowLimits(f *quicFlow) {
+	if !f.limited {
+		return
+	}
+
+	s.limits.destination.release(f.remoteHost)
+	s.limits.clients.release(f.subnet)
+	s.limits.global.release(struct{}{})
+
+	f.limited = false
+}
+
+// readClientHello reads the CRYPTO frames from the Initial packets of the
+// datagram and returns the ClientHello message if it is complete.  msg is nil
+// if more packets are required.  f.mu is expected to be locked.
+func (f *quicFlow) readClientHello(datagram []byte) (msg []byte, err error) {
+	for rest := datagram; len(rest) > 0; {
+		var hdr *quicLongHeader
+		hdr, rest, err = parseQUICLongHeader(rest)
+		if err != nil {
+			// Either padding after the coalesced packets or a short header
+			// packet, none of them may contain the ClientHello.
+			break
+		}
+
+		if !hdr.initial {
+			continue
+		}
+
+		var payload []byte
+		payload, err = decryptQUICInitial(hdr, f.keys)
+		if err != nil {
+			return nil, err
+		}
+
+		var frames []quicCryptoFrame
+		frames, err = parseQUICInitialFrames(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fr := range frames {
+			if err = f.crypto.write(fr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f.crypto.clientHello()
+}
+
+// connectFlow connects to the remote server of the flow, sends the pending
+// datagrams, and relays the responses back to the client.
+func (s *Server) connectFlow(f *quicFlow) {
+	defer s.quicWG.Done()
+	defer handlePanicAndRecover()
+
+	log.Debug("relay: quic: connecting to %s", f.remoteAddr)
+
+	remote, err := s.connectUDP(f.remoteAddr)
+
+	f.mu.Lock()
+	if err != nil || f.state != quicFlowConnecting {
+		if err != nil {
+			log.Debug("relay: quic: failed to connect to %s: %v", f.remoteAddr, err)
+
+			f.state = quicFlowRejected
+			f.pending = nil
+			s.untrackFlow(f)
+			s.releaseFlowLimits(f)
+		} else {
+			log.OnCloserError(remote, log.DEBUG)
+		}
+
+		f.mu.Unlock()
+
+		return
+	}
+
+	f.remote = remote
+	f.state = quicFlowRelaying
+
+	metrics.ConnectionsTotal.WithLabelValues(f.remoteAddr).Inc()
+	metrics.RelayUsersCountUpdate(f.clientAddr.Addr())
+
+	for _, d := range f.pending {
+		n, wErr := remote.Write(d)
+		if wErr != nil {
+			log.Debug("relay: quic: writing to %s: %v", f.remoteAddr, wErr)
+		}
+
+		f.addSent(n)
+		s.addFlowQuotaUsage(f, n)
+	}
+
+	f.pending = nil
+	f.pendingLen = 0
+	f.mu.Unlock()
+
+	s.relayFromRemote(f)
+}
+
+// connectUDP opens a UDP socket connected to the remote address.
+//
+// TODO(ameshkov): Bind to the local IP address the datagram was received on,
+// the same way as connect does for TCP.
+func (s *Server) connectUDP(remoteAddr string) (conn *net.UDPConn, err error) {
+	dialer := &net.Dialer{
+		Timeout: s.settings.Load().dialTimeout,
+	}
+
+	c, err := dialer.Dial("udp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.(*net.UDPConn), nil
+}
+
+// relayFromRemote relays datagrams from the remote server of the flow to the
+// client until the connection to the remote server is closed.
+func (s *Server) relayFromRemote(f *quicFlow) {
+	buf := make([]byte, maxUDPDatagramLen)
+	for {
+		n, err := f.remote.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debug("relay: quic: reading from %s: %v", f.remoteAddr, err)
+			}
+
+			return
+		}
+
+		f.touch()
+		f.addReceived(n)
+		s.addFlowQuotaUsage(f, n)
+
+		if client := f.client.Load(); client != nil {
+			_, err = client.Write(buf[:n])
+		} else {
+			_, err = s.listenerQUIC.WriteToUDPAddrPort(buf[:n], f.clientAddr)
+		}
+
+		if err != nil {
+			log.Debug("relay: quic: writing to %s: %v", f.clientAddr, err)
+		}
+	}
+}
+
+// sweepFlows removes the flows that had no traffic for their timeout or have
+// reached the sniff timeout or the maximum lifetime.
+func (s *Server) sweepFlows() {
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+
+	st := s.settings.Load()
+	now := time.Now()
+	for addr, f := range s.flows {
+		if f.expired(st, now, s.flowQuotaExhausted(st, f, now)) {
+			s.closeFlow(f)
+			delete(s.flows, addr)
+		}
+	}
+}
+
+// flowQuotaExhausted returns true if the quota of the client of the flow is
+// exhausted and its existing connections must be cut.
+func (s *Server) flowQuotaExhausted(st *settings, f *quicFlow, now time.Time) (ok bool) {
+	if s.quotas == nil || !st.quotaCutExisting {
+		return false
+	}
+
+	// The limits are taken from the current settings, since they may have
+	// been reloaded since the flow was created.
+	_, l := st.quotaClient(f.clientAddr.Addr())
+
+	return l.exhausted(s.quotas.Usage(f.quotaKey, now))
+}
+
+// expired returns true if the flow must be removed from the NAT table by now.
+// The flows without traffic are removed after quicFlowTimeout or the idle
+// timeout, whichever is shorter, and the rejected ones after
+// quicRejectedFlowTimeout, so that they do not fill the NAT table.  The
+// accepted flows are also removed if quotaExhausted is true.
+func (f *quicFlow) expired(st *settings, now time.Time, quotaExhausted bool) (ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	idleFor := now.Sub(time.Unix(0, f.lastActive.Load()))
+	age := now.Sub(f.created)
+
+	switch f.state {
+	case quicFlowSniffing:
+		if age >= st.sniffTimeout {
+			return f.expire("sniff timeout", metrics.SniffTimeoutsTotal)
+		}
+	case quicFlowConnecting, quicFlowRelaying:
+		if quotaExhausted {
+			return f.expire("quota exhausted", metrics.QuotaClosedConnsTotal)
+		}
+
+		if st.maxLifetime > 0 && age >= st.maxLifetime {
+			return f.expire("max lifetime", metrics.LifetimeTimeoutsTotal)
+		}
+
+		if st.idleTimeout > 0 && st.idleTimeout < quicFlowTimeout && idleFor >= st.idleTimeout {
+			return f.expire("idle timeout", metrics.IdleTimeoutsTotal)
+		}
+	case quicFlowRejected:
+		return idleFor >= quicRejectedFlowTimeout
+	}
+
+	return idleFor >= quicFlowTimeout
+}
+
+// expire logs and counts the removal of the flow due to the reason and returns
+// true.  counter is the metric of the reason.  f.mu is expected to be locked.
+func (f *quicFlow) expire(reason string, counter prometheus.Counter) (ok bool) {
+	counter.Inc()
+	log.Debug("relay: quic: closing flow from %s: %s", f.clientAddr, reason)
+
+	return true
+}
+
+// closeFlow closes the connection to the remote server of the flow and
+// records its metrics.  accepted is true if the flow has been accepted and
+// not rejected since.  s.flowsMu is expected to be locked.
+func (s *Server) closeFlow(f *quicFlow) (accepted bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	accepted = f.tracked
+	s.untrackFlow(f)
+	s.releaseFlowLimits(f)
+
+	state := f.state
+	f.state = quicFlowClosed
+	f.pending = nil
+
+	if client := f.client.Load(); client != nil {
+		log.OnCloserError(client, log.DEBUG)
+	}
+
+	if state != quicFlowRelaying {
+		return accepted
+	}
+
+	log.OnCloserError(f.remote, log.DEBUG)
+
+	sent, received := f.bytesSent.Load(), f.bytesReceived.Load()
+
+	log.Debug(
+		"relay: quic: finished relaying %s<->%s. received %d, sent %d",
+		f.remoteAddr,
+		f.clientAddr,
+		received,
+		sent,
+	)
+
+	metrics.ConnectionsTotal.WithLabelValues(f.remoteAddr).Dec()
+
+	return accepted
+}
@@ -0,0 +1,421 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/ameshkov/snirelay/internal/quota"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_handleDatagram(t *testing.T) {
+	s, err := NewServer(&Config{
+		ListenAddr:     netip.MustParseAddr("127.0.0.1"),
+		ListenPortQUIC: 0,
+		Rules:          []*Rule{{Pattern: "*.example.org"}},
+	})
+	require.NoError(t, err)
+
+	clientAddr := netip.MustParseAddrPort("127.0.0.1:12345")
+
+	t.Run("not_quic", func(t *testing.T) {
+		s.handleDatagram([]byte("not a quic packet"), clientAddr)
+
+		assert.Empty(t, s.flows)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		for _, d := range captureQUICInitial(t, quic.Version1, "www.example.net") {
+			s.handleDatagram(d, clientAddr)
+		}
+
+		require.Contains(t, s.flows, clientAddr)
+
+		f := s.flows[clientAddr]
+		assert.Equal(t, quicFlowRejected, f.state)
+		assert.Empty(t, f.pending)
+
+		// The rejected flows are removed before the other ones.
+		f.lastActive.Store(time.Now().Add(-2 * quicRejectedFlowTimeout).UnixNano())
+		s.sweepFlows()
+
+		assert.Empty(t, s.flows)
+	})
+}
+
+func TestServer_flow_maxFlows(t *testing.T) {
+	s, err := NewServer(&Config{
+		ListenAddr:   netip.MustParseAddr("127.0.0.1"),
+		Rules:        []*Rule{{Pattern: "*.example.org"}},
+		MaxQUICFlows: 1,
+	})
+	require.NoError(t, err)
+
+	datagrams := captureQUICInitial(t, quic.Version1, "www.example.net")
+	first := netip.MustParseAddrPort("127.0.0.1:12345")
+	second := netip.MustParseAddrPort("127.0.0.1:12346")
+
+	s.handleDatagram(datagrams[0], first)
+	require.Contains(t, s.flows, first)
+
+	s.handleDatagram(datagrams[0], second)
+	assert.NotContains(t, s.flows, second)
+	assert.Len(t, s.flows, 1)
+}
+
+func TestServer_flow_rateLimit(t *testing.T) {
+	s, err := NewServer(&Config{
+		ListenAddr:     netip.MustParseAddr("127.0.0.1"),
+		Rules:          []*Rule{{Pattern: "*.example.org"}},
+		RateLimit:      1,
+		RateLimitBurst: 1,
+	})
+	require.NoError(t, err)
+
+	datagrams := captureQUICInitial(t, quic.Version1, "www.example.org")
+	first := netip.MustParseAddrPort("127.0.0.1:12345")
+	second := netip.MustParseAddrPort("127.0.0.1:12346")
+
+	require.NotNil(t, s.flow(datagrams[0], first))
+	assert.Equal(t, quicFlowSniffing, s.flows[first].state)
+
+	require.NotNil(t, s.flow(datagrams[0], second))
+	assert.Equal(t, quicFlowRejected, s.flows[second].state)
+}
+
+func TestServer_flow_quota(t *testing.T) {
+	q := quota.New(&quota.Config{Path: filepath.Join(t.TempDir(), "quotas.db")})
+	s, err := NewServer(&Config{
+		ListenAddr:       netip.MustParseAddr("127.0.0.1"),
+		Rules:            []*Rule{{Pattern: "*.example.org"}},
+		Quotas:           q,
+		QuotaDaily:       1,
+		QuotaCutExisting: true,
+	})
+	require.NoError(t, err)
+
+	datagrams := captureQUICInitial(t, quic.Version1, "www.example.org")
+	first := netip.MustParseAddrPort("127.0.0.1:12345")
+	second := netip.MustParseAddrPort("127.0.0.1:12346")
+
+	f := s.flow(datagrams[0], first)
+	require.NotNil(t, f)
+	require.Equal(t, quicFlowSniffing, f.state)
+
+	st := s.settings.Load()
+	now := time.Now()
+	assert.False(t, s.flowQuotaExhausted(st, f, now))
+
+	s.addFlowQuotaUsage(f, len(datagrams[0]))
+	assert.True(t, s.flowQuotaExhausted(st, f, now))
+
+	require.NotNil(t, s.flow(datagrams[0], second))
+	assert.Equal(t, quicFlowRejected, s.flows[second].state)
+}
+
+func TestServer_acquireFlowLimits(t *testing.T) {
+	s, err := NewServer(&Config{
+		ListenAddr:             netip.MustParseAddr("127.0.0.1"),
+		MaxConns:               2,
+		MaxConnsPerDestination: 1,
+	})
+	require.NoError(t, err)
+
+	newFlow := func(port uint16) (f *quicFlow) {
+		return &quicFlow{
+			mu:         &sync.Mutex{},
+			clientAddr: netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port),
+			state:      quicFlowSniffing,
+		}
+	}
+
+	first := newFlow(1)
+	require.Empty(t, s.acquireFlowLimits(first, "www.example.org:443"))
+	assert.True(t, first.limited)
+
+	assert.Equal(t, limitDestination, s.acquireFlowLimits(newFlow(2), "www.example.org:443"))
+
+	second := newFlow(3)
+	require.Empty(t, s.acquireFlowLimits(second, "www.example.net:443"))
+
+	assert.Equal(t, limitGlobal, s.acquireFlowLimits(newFlow(4), "www.example.com:443"))
+
+	// Closing the flow releases its limits, but only once.
+	s.closeFlow(first)
+	s.closeFlow(first)
+	assert.False(t, first.limited)
+
+	assert.Empty(t, s.acquireFlowLimits(newFlow(5), "www.example.org:443"))
+	assert.Equal(t, limitGlobal, s.acquireFlowLimits(newFlow(6), "www.example.com:443"))
+}
+
+func TestQUICFlow_expired(t *testing.T) {
+	st := &settings{
+		sniffTimeout: 10 * time.Second,
+		idleTimeout:  30 * time.Second,
+		maxLifetime:  time.Hour,
+	}
+
+	now := time.Now()
+
+	testCases := []struct {
+		name           string
+		age            time.Duration
+		idleFor        time.Duration
+		state          quicFlowState
+		quotaExhausted bool
+		wantExpire     bool
+	}{{
+		name:       "sniffing",
+		age:        time.Second,
+		idleFor:    time.Second,
+		state:      quicFlowSniffing,
+		wantExpire: false,
+	}, {
+		name:       "sniff_timeout",
+		age:        st.sniffTimeout,
+		idleFor:    time.Second,
+		state:      quicFlowSniffing,
+		wantExpire: true,
+	}, {
+		name:       "relaying",
+		age:        time.Minute,
+		idleFor:    time.Second,
+		state:      quicFlowRelaying,
+		wantExpire: false,
+	}, {
+		name:       "idle_timeout",
+		age:        time.Minute,
+		idleFor:    st.idleTimeout,
+		state:      quicFlowRelaying,
+		wantExpire: true,
+	}, {
+		name:       "max_lifetime",
+		age:        st.maxLifetime,
+		idleFor:    time.Second,
+		state:      quicFlowRelaying,
+		wantExpire: true,
+	}, {
+		name:           "quota_exhausted",
+		age:            time.Minute,
+		idleFor:        time.Second,
+		state:          quicFlowRelaying,
+		quotaExhausted: true,
+		wantExpire:     true,
+	}, {
+		name:           "quota_exhausted_sniffing",
+		age:            time.Second,
+		idleFor:        time.Second,
+		state:          quicFlowSniffing,
+		quotaExhausted: true,
+		wantExpire:     false,
+	}, {
+		name:       "rejected",
+		age:        time.Minute,
+		idleFor:    quicRejectedFlowTimeout,
+		state:      quicFlowRejected,
+		wantExpire: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &quicFlow{
+				mu:      &sync.Mutex{},
+				created: now.Add(-tc.age),
+				state:   tc.state,
+			}
+			f.lastActive.Store(now.Add(-tc.idleFor).UnixNano())
+
+			assert.Equal(t, tc.wantExpire, f.expired(st, now, tc.quotaExhausted))
+		})
+	}
+}
+
+func TestServer_drainConns_flows(t *testing.T) {
+	s, err := NewServer(&Config{
+		ListenAddr:          netip.MustParseAddr("127.0.0.1"),
+		ShutdownGracePeriod: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	clientAddr := netip.MustParseAddrPort("127.0.0.1:12345")
+	f := &quicFlow{
+		mu:         &sync.Mutex{},
+		clientAddr: clientAddr,
+		state:      quicFlowConnecting,
+	}
+	s.flows[clientAddr] = f
+
+	require.True(t, s.trackFlow(f))
+	require.Equal(t, 1, s.activeFlows)
+
+	require.NoError(t, s.drainConns(context.Background()))
+
+	assert.Empty(t, s.flows)
+	assert.Zero(t, s.activeFlows)
+	assert.Equal(t, quicFlowClosed, f.state)
+
+	s.draining = true
+	assert.False(t, s.trackFlow(&quicFlow{mu: &sync.Mutex{}}))
+	assert.Zero(t, s.activeFlows)
+}
+
+func TestServer_AddrQUIC(t *testing.T) {
+	s, err := NewServer(&Config{
+		ListenAddr:     netip.MustParseAddr("127.0.0.1"),
+		ListenPortQUIC: 0,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Start(context.Background()))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return s.Shutdown(context.Background())
+	})
+
+	assert.Nil(t, s.AddrQUIC())
+
+	s, err = NewServer(&Config{
+		ListenAddr:     netip.MustParseAddr("127.0.0.1"),
+		ListenPortQUIC: 1,
+	})
+	require.NoError(t, err)
+
+	// Replace the port with any free one.
+	s.listenAddrQUIC = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+
+	require.NoError(t, s.Start(context.Background()))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return s.Shutdown(context.Background())
+	})
+
+	assert.IsType(t, &net.UDPAddr{}, s.AddrQUIC())
+}
+
+func TestServer_handOffQUIC(t *testing.T) {
+	const timeout = time.Second
+
+	s, err := NewServer(&Config{
+		ListenAddr:          netip.MustParseAddr("127.0.0.1"),
+		ListenPortQUIC:      1,
+		Rules:               []*Rule{{Pattern: "*.example.org"}},
+		ShutdownGracePeriod: time.Minute,
+	})
+	require.NoError(t, err)
+
+	// Replace the port with any free one.
+	s.listenAddrQUIC = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+
+	require.NoError(t, s.Start(context.Background()))
+	listenerAddr := s.AddrQUIC()
+
+	newUDPConn := func() (c *net.UDPConn) {
+		c, lErr := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		require.NoError(t, lErr)
+		testutil.CleanupAndRequireSuccess(t, c.Close)
+
+		return c
+	}
+
+	// next is the copy of the listener passed to the new process during an
+	// upgrade.
+	file, err := s.listenerQUIC.File()
+	require.NoError(t, err)
+
+	next, err := net.FilePacketConn(file)
+	require.NoError(t, file.Close())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, next.Close)
+
+	// Add a flow relayed to remote the same way connectFlow does.
+	remote, client := newUDPConn(), newUDPConn()
+	remoteConn, err := net.DialUDP("udp", nil, remote.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	f := &quicFlow{
+		remote:     remoteConn,
+		mu:         &sync.Mutex{},
+		remoteAddr: remote.LocalAddr().String(),
+		clientAddr: clientAddr,
+		state:      quicFlowRelaying,
+	}
+
+	s.flowsMu.Lock()
+	s.flows[clientAddr] = f
+	s.flowsMu.Unlock()
+
+	require.True(t, s.trackFlow(f))
+
+	s.quicWG.Add(1)
+	go func() {
+		defer s.quicWG.Done()
+
+		s.relayFromRemote(f)
+	}()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// The listener is closed before flowsMu is unlocked.
+	require.Eventually(t, func() (ok bool) {
+		s.flowsMu.Lock()
+		defer s.flowsMu.Unlock()
+
+		return s.quicHandedOff
+	}, timeout, time.Millisecond)
+
+	buf := make([]byte, maxUDPDatagramLen)
+	requireRead := func(c net.PacketConn, want string) (from net.Addr) {
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(timeout)))
+
+		n, from, rErr := c.ReadFrom(buf)
+		require.NoError(t, rErr)
+		require.Equal(t, want, string(buf[:n]))
+
+		return from
+	}
+
+	t.Run("new_flow", func(t *testing.T) {
+		initial := captureQUICInitial(t, quic.Version1, "www.example.org")[0]
+		newClient := newUDPConn()
+		newClientAddr := newClient.LocalAddr().(*net.UDPAddr).AddrPort()
+
+		_, err = newClient.WriteTo(initial, listenerAddr)
+		require.NoError(t, err)
+
+		requireRead(next, string(initial))
+
+		s.flowsMu.Lock()
+		defer s.flowsMu.Unlock()
+
+		assert.NotContains(t, s.flows, newClientAddr)
+	})
+
+	t.Run("existing_flow", func(t *testing.T) {
+		_, err = client.WriteTo([]byte("ping"), listenerAddr)
+		require.NoError(t, err)
+
+		from := requireRead(remote, "ping")
+
+		_, err = remote.WriteTo([]byte("pong"), from)
+		require.NoError(t, err)
+
+		from = requireRead(client, "pong")
+		assert.Equal(t, listenerAddr.String(), from.String())
+	})
+
+	assert.Equal(t, 1, s.closeFlows())
+
+	err, _ = testutil.RequireReceive(t, shutdownErr, timeout)
+	require.NoError(t, err)
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package relay
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// setQUICReuse allows the client sockets of the handed-off QUIC flows and the
+// QUIC listener to be bound to the same address, see handOffQUIC.  On Linux,
+// SO_REUSEADDR is enough for that, and the datagrams of a client are received
+// by the socket connected to it rather than by the listener.
+func setQUICReuse(c syscall.RawConn) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
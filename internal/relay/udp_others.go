@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package relay
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// setQUICReuse returns an error, since the QUIC listener cannot be handed off
+// on this platform, see handOffQUIC.
+func setQUICReuse(_ syscall.RawConn) (err error) {
+	return errors.ErrUnsupported
+}
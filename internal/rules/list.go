@@ -0,0 +1,160 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ListFormat is the format of a list file with domains.
+type ListFormat string
+
+// Supported list formats.
+const (
+	// ListFormatPlain is a list with one pattern per line in the same syntax
+	// as the patterns of domain rules.  Lines starting with "#" are comments.
+	ListFormatPlain ListFormat = "plain"
+
+	// ListFormatHosts is the hosts file format: an IP address followed by
+	// host names.  Every host name matches exactly, host names without dots,
+	// e.g. "localhost", are ignored.
+	ListFormatHosts ListFormat = "hosts"
+
+	// ListFormatDnsmasq is the dnsmasq configuration format, e.g.
+	// "address=/example.org/0.0.0.0" or "server=/example.org/1.1.1.1".
+	// Every domain matches together with its subdomains.
+	ListFormatDnsmasq ListFormat = "dnsmasq"
+
+	// ListFormatAdblock is the adblock filter format.  Only the basic rules
+	// "||example.org^", which match the domain together with its subdomains,
+	// and the exceptions "@@||example.org^" are supported, other rules are
+	// ignored.
+	ListFormatAdblock ListFormat = "adblock"
+)
+
+// maxListLineLen is the maximum length of a line in a list file.
+const maxListLineLen = 64 * 1024
+
+// ParseList reads the list in the specified format from r and returns the
+// patterns it contains in the syntax of NewMatcher.  Lines that cannot be
+// converted to patterns are ignored.
+func ParseList(r io.Reader, format ListFormat) (patterns []string, err error) {
+	var parseLine func(line string) (res []string)
+	switch format {
+	case ListFormatPlain, "":
+		parseLine = parsePlainLine
+	case ListFormatHosts:
+		parseLine = parseHostsLine
+	case ListFormatDnsmasq:
+		parseLine = parseDnsmasqLine
+	case ListFormatAdblock:
+		parseLine = parseAdblockLine
+	default:
+		return nil, fmt.Errorf("unsupported list format %q", format)
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxListLineLen)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		patterns = append(patterns, parseLine(line)...)
+	}
+
+	return patterns, s.Err()
+}
+
+// parsePlainLine returns the pattern from the line of a plain list.
+func parsePlainLine(line string) (res []string) {
+	return []string{line}
+}
+
+// parseHostsLine returns the patterns for the host names from the line of a
+// hosts file.
+func parseHostsLine(line string) (res []string) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil
+	}
+
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return nil
+	}
+
+	for _, host := range fields[1:] {
+		if strings.Contains(host, ".") && isDomain(host) {
+			res = append(res, prefixFull+host)
+		}
+	}
+
+	return res
+}
+
+// parseDnsmasqLine returns the patterns for the domains from the line of a
+// dnsmasq configuration file.
+func parseDnsmasqLine(line string) (res []string) {
+	_, value, ok := strings.Cut(line, "=")
+	if !ok || !strings.HasPrefix(value, "/") {
+		return nil
+	}
+
+	domains := strings.Split(value, "/")
+
+	// The first element is empty and the last one is the value of the
+	// option.
+	for _, d := range domains[1 : len(domains)-1] {
+		if isDomain(d) {
+			res = append(res, prefixDomain+d)
+		}
+	}
+
+	return res
+}
+
+// parseAdblockLine returns the pattern from the line of an adblock filter.
+func parseAdblockLine(line string) (res []string) {
+	exception := ""
+	if rest, ok := strings.CutPrefix(line, "@@"); ok {
+		line, exception = rest, ExceptionPrefix
+	}
+
+	d, ok := strings.CutPrefix(line, "||")
+	if !ok {
+		return nil
+	}
+
+	d, ok = strings.CutSuffix(d, "^")
+	if !ok || !isDomain(d) {
+		return nil
+	}
+
+	return []string{exception + prefixDomain + d}
+}
+
+// isDomain returns true if s is a valid domain name and not an IP address.
+func isDomain(s string) (ok bool) {
+	s = strings.TrimSuffix(s, ".")
+	if _, err := netip.ParseAddr(s); err == nil {
+		return false
+	}
+
+	if netutil.ValidateDomainName(s) != nil {
+		return false
+	}
+
+	for _, r := range s {
+		if r != '.' && r != '_' && !netutil.IsValidHostInnerRune(r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,84 @@
+package rules_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ameshkov/snirelay/internal/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseList(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format rules.ListFormat
+		data   string
+		want   []string
+	}{{
+		name:   "plain",
+		format: rules.ListFormatPlain,
+		data: `# Comment.
+example.org
+
+*.example.net
+!full:www.example.net
+`,
+		want: []string{"example.org", "*.example.net", "!full:www.example.net"},
+	}, {
+		name:   "hosts",
+		format: rules.ListFormatHosts,
+		data: `# Comment.
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.org tracker.example.org # Inline comment.
+::1 ip6-localhost
+not-an-ip example.org
+0.0.0.0 bad_host!.example.org
+`,
+		want: []string{"full:ads.example.org", "full:tracker.example.org"},
+	}, {
+		name:   "dnsmasq",
+		format: rules.ListFormatDnsmasq,
+		data: `# Comment.
+address=/ads.example.org/0.0.0.0
+server=/example.net/example.com/1.1.1.1
+local=/example.info/
+cache-size=1000
+address=/#/0.0.0.0
+`,
+		want: []string{
+			"domain:ads.example.org",
+			"domain:example.net",
+			"domain:example.com",
+			"domain:example.info",
+		},
+	}, {
+		name:   "adblock",
+		format: rules.ListFormatAdblock,
+		data: `[Adblock Plus 2.0]
+! Comment.
+||ads.example.org^
+@@||good.example.org^
+||tracker.example.org^$third-party
+/banner/*
+example.net
+`,
+		want: []string{"domain:ads.example.org", "!domain:good.example.org"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patterns, err := rules.ParseList(strings.NewReader(tc.data), tc.format)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, patterns)
+
+			_, err = rules.NewMatcher(patterns)
+			assert.NoError(t, err)
+		})
+	}
+
+	_, err := rules.ParseList(strings.NewReader(""), "unknown")
+	assert.EqualError(t, err, `unsupported list format "unknown"`)
+}
@@ -0,0 +1,274 @@
+// Package rules implements matching host names against ordered lists of
+// domain rules that is shared by the DNS server and the relay.
+//
+// The rules are evaluated in order and the first matching rule wins.  A
+// pattern that starts with "!" is an exception: if a host name matches it,
+// the evaluation stops and the host name is considered not matched by any
+// rule.
+//
+// The following pattern types are supported:
+//
+//   - "full:example.org" matches example.org only.
+//   - "domain:example.org" matches example.org and all its subdomains.
+//   - "regexp:^ads?\." matches host names that match the regular expression.
+//   - "keyword:example" matches host names that contain "example".
+//   - "*.example.org" matches all subdomains of example.org, but not
+//     example.org itself.
+//   - "example.org" without wildcards matches example.org only.
+//   - Other patterns are wildcards where "*" matches any number of
+//     characters, e.g. "*" or "ads*.example.org".
+//
+// Both patterns and host names are normalized: they are converted to lower
+// case and the trailing dot is removed.  Patterns other than wildcards,
+// regular expressions, and keywords are compiled into a suffix trie, so
+// matching does not depend on their number.
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/IGLOU-EU/go-wildcard"
+)
+
+// ExceptionPrefix is the prefix of exception patterns.
+const ExceptionPrefix = "!"
+
+// Prefixes of the pattern types.
+const (
+	prefixFull    = "full:"
+	prefixDomain  = "domain:"
+	prefixRegexp  = "regexp:"
+	prefixKeyword = "keyword:"
+)
+
+// Matcher matches host names against an ordered list of patterns.  It is safe
+// for concurrent use.
+type Matcher struct {
+	// root is the root of the suffix trie.
+	root *node
+
+	// linear are the patterns that cannot be put into the trie in the order
+	// of their indexes.
+	linear []*linearPattern
+
+	// exceptions contains true for the indexes of exception patterns.
+	exceptions []bool
+}
+
+// node is a node of the suffix trie.  The path from the root to the node is
+// the sequence of domain labels starting with the top-level domain.
+type node struct {
+	// children are the nodes of the subdomains by their labels.
+	children map[string]*node
+
+	// exact are the indexes of patterns that match the domain of the node.
+	exact []int
+
+	// subdomains are the indexes of patterns that match subdomains of the
+	// domain of the node.
+	subdomains []int
+}
+
+// linearPattern is a pattern that is checked against every host name.
+type linearPattern struct {
+	// re is the regular expression, if the pattern is a regexp.
+	re *regexp.Regexp
+
+	// wildcard is the wildcard, if the pattern is neither a regexp nor a
+	// keyword.
+	wildcard string
+
+	// keyword is the keyword, if the pattern is a keyword.
+	keyword string
+
+	// idx is the index of the pattern.
+	idx int
+}
+
+// match returns true if the host name matches the pattern.
+func (p *linearPattern) match(hostname string) (ok bool) {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(hostname)
+	case p.keyword != "":
+		return strings.Contains(hostname, p.keyword)
+	}
+
+	return wildcard.MatchSimple(p.wildcard, hostname)
+}
+
+// NewMatcher compiles the patterns into a matcher.  The indexes passed to the
+// accept function of Match are indexes in patterns.
+func NewMatcher(patterns []string) (m *Matcher, err error) {
+	m = &Matcher{
+		root:       &node{},
+		exceptions: make([]bool, len(patterns)),
+	}
+
+	for i, p := range patterns {
+		p, m.exceptions[i] = strings.CutPrefix(p, ExceptionPrefix)
+		err = m.add(i, p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern at index %d: %w", i, err)
+		}
+	}
+
+	return m, nil
+}
+
+// add compiles the pattern with the index i and adds it to m.
+func (m *Matcher) add(i int, p string) (err error) {
+	if re, ok := strings.CutPrefix(p, prefixRegexp); ok {
+		lp := &linearPattern{idx: i}
+		lp.re, err = regexp.Compile(re)
+		if err != nil {
+			return err
+		}
+
+		m.linear = append(m.linear, lp)
+
+		return nil
+	}
+
+	p = normalize(p)
+
+	var exact, subdomains bool
+	switch {
+	case strings.HasPrefix(p, prefixKeyword):
+		kw := p[len(prefixKeyword):]
+		if kw == "" {
+			return fmt.Errorf("empty pattern")
+		}
+
+		m.linear = append(m.linear, &linearPattern{keyword: kw, idx: i})
+
+		return nil
+	case strings.HasPrefix(p, prefixFull):
+		p, exact = p[len(prefixFull):], true
+	case strings.HasPrefix(p, prefixDomain):
+		p, exact, subdomains = p[len(prefixDomain):], true, true
+	case strings.HasPrefix(p, "*.") && !strings.ContainsAny(p[2:], "*?"):
+		p, subdomains = p[2:], true
+	case !strings.ContainsAny(p, "*?"):
+		exact = true
+	default:
+		m.linear = append(m.linear, &linearPattern{wildcard: p, idx: i})
+
+		return nil
+	}
+
+	if p == "" {
+		return fmt.Errorf("empty pattern")
+	}
+
+	n := m.root.insert(p)
+	if exact {
+		n.exact = append(n.exact, i)
+	}
+
+	if subdomains {
+		n.subdomains = append(n.subdomains, i)
+	}
+
+	return nil
+}
+
+// insert returns the node for the domain creating it and its parents if
+// necessary.
+func (n *node) insert(domain string) (res *node) {
+	res = n
+	for rest := domain; rest != ""; {
+		var label string
+		label, rest = lastLabel(rest)
+
+		child, ok := res.children[label]
+		if !ok {
+			if res.children == nil {
+				res.children = map[string]*node{}
+			}
+
+			child = &node{}
+			res.children[label] = child
+		}
+
+		res = child
+	}
+
+	return res
+}
+
+// lastLabel splits the domain into the last label and the rest of the domain.
+func lastLabel(domain string) (label, rest string) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return domain, ""
+	}
+
+	return domain[i+1:], domain[:i]
+}
+
+// normalize converts the host name to lower case and removes the trailing dot.
+func normalize(hostname string) (res string) {
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
+
+// maxStackCandidates is the number of candidate indexes that Match can keep
+// without allocating.
+const maxStackCandidates = 16
+
+// Match returns the index of the first pattern that matches hostname and for
+// which accept returns true.  accept is only called for patterns that are not
+// exceptions, and may be nil, in which case any matching pattern is accepted.
+// ok is false if no pattern matches or if an exception matches first.
+func (m *Matcher) Match(hostname string, accept func(i int) (ok bool)) (i int, ok bool) {
+	hostname = normalize(hostname)
+
+	var buf [maxStackCandidates]int
+	candidates := m.candidates(buf[:0], hostname)
+	if len(candidates) > 1 {
+		slices.Sort(candidates)
+	}
+
+	for _, i = range candidates {
+		if m.exceptions[i] {
+			return -1, false
+		}
+
+		if accept == nil || accept(i) {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+// candidates appends the indexes of all patterns that match hostname to buf.
+func (m *Matcher) candidates(buf []int, hostname string) (res []int) {
+	res = buf
+
+	n := m.root
+	for rest := hostname; n != nil; {
+		if rest == "" {
+			res = append(res, n.exact...)
+
+			break
+		}
+
+		res = append(res, n.subdomains...)
+
+		var label string
+		label, rest = lastLabel(rest)
+		n = n.children[label]
+	}
+
+	for _, p := range m.linear {
+		if p.match(hostname) {
+			res = append(res, p.idx)
+		}
+	}
+
+	return res
+}
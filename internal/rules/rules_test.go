@@ -0,0 +1,233 @@
+package rules_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/IGLOU-EU/go-wildcard"
+	"github.com/ameshkov/snirelay/internal/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	m, err := rules.NewMatcher([]string{
+		"ads.example.org",
+		"!*.bank.example.org",
+		"*.example.org",
+		"*",
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		hostname string
+		accept   func(i int) (ok bool)
+		wantIdx  int
+		wantOK   bool
+	}{{
+		name:     "first_match",
+		hostname: "ads.example.org",
+		wantIdx:  0,
+		wantOK:   true,
+	}, {
+		name:     "case_insensitive",
+		hostname: "ADS.Example.ORG",
+		wantIdx:  0,
+		wantOK:   true,
+	}, {
+		name:     "exception",
+		hostname: "www.bank.example.org",
+		wantIdx:  -1,
+		wantOK:   false,
+	}, {
+		name:     "wildcard",
+		hostname: "www.example.org",
+		wantIdx:  2,
+		wantOK:   true,
+	}, {
+		name:     "not_accepted",
+		hostname: "ads.example.org",
+		accept:   func(i int) (ok bool) { return i != 0 },
+		wantIdx:  2,
+		wantOK:   true,
+	}, {
+		name:     "catch_all",
+		hostname: "example.net",
+		wantIdx:  3,
+		wantOK:   true,
+	}, {
+		name:     "none_accepted",
+		hostname: "example.net",
+		accept:   func(_ int) (ok bool) { return false },
+		wantIdx:  -1,
+		wantOK:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			i, ok := m.Match(tc.hostname, tc.accept)
+			assert.Equal(t, tc.wantIdx, i)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+}
+
+func TestMatcher_Match_patterns(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{{
+		pattern: "example.org",
+		match:   []string{"example.org", "Example.ORG.", "example.org."},
+		noMatch: []string{"www.example.org", "example.org.uk", "anexample.org"},
+	}, {
+		pattern: "full:Example.org",
+		match:   []string{"example.org"},
+		noMatch: []string{"www.example.org"},
+	}, {
+		pattern: "domain:example.org",
+		match:   []string{"example.org", "www.example.org", "a.b.example.org"},
+		noMatch: []string{"anexample.org", "example.net", "org"},
+	}, {
+		pattern: "*.example.org",
+		match:   []string{"www.example.org", "a.b.example.org"},
+		noMatch: []string{"example.org", "anexample.org"},
+	}, {
+		pattern: "*example.org",
+		match:   []string{"example.org", "anexample.org", "www.example.org"},
+		noMatch: []string{"example.net"},
+	}, {
+		pattern: "ads*.example.org",
+		match:   []string{"ads.example.org", "ads1.example.org"},
+		noMatch: []string{"www.example.org"},
+	}, {
+		pattern: "keyword:Example",
+		match:   []string{"example.org", "www.anexample.net"},
+		noMatch: []string{"examp.le"},
+	}, {
+		pattern: "*",
+		match:   []string{"example.org", "org"},
+	}, {
+		pattern: `regexp:^ads?[0-9]*\.`,
+		match:   []string{"ad.example.org", "ads12.example.net"},
+		noMatch: []string{"bads.example.org"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			m, err := rules.NewMatcher([]string{tc.pattern})
+			require.NoError(t, err)
+
+			for _, h := range tc.match {
+				_, ok := m.Match(h, nil)
+				assert.Truef(t, ok, "%s must match", h)
+			}
+
+			for _, h := range tc.noMatch {
+				_, ok := m.Match(h, nil)
+				assert.Falsef(t, ok, "%s must not match", h)
+			}
+		})
+	}
+}
+
+func TestNewMatcher_invalid(t *testing.T) {
+	testCases := []struct {
+		name     string
+		patterns []string
+		wantErr  string
+	}{{
+		name:     "empty",
+		patterns: []string{"*", "!"},
+		wantErr:  "pattern at index 1: empty pattern",
+	}, {
+		name:     "empty_domain",
+		patterns: []string{"domain:"},
+		wantErr:  "pattern at index 0: empty pattern",
+	}, {
+		name:     "bad_regexp",
+		patterns: []string{"regexp:("},
+		wantErr:  "pattern at index 0: error parsing regexp: missing closing ): `(`",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := rules.NewMatcher(tc.patterns)
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+// newBenchPatterns returns n patterns of different types for benchmarks.
+func newBenchPatterns(n int) (patterns []string) {
+	patterns = make([]string, 0, n)
+	for i := range n {
+		switch i % 3 {
+		case 0:
+			patterns = append(patterns, fmt.Sprintf("domain%d.example", i))
+		case 1:
+			patterns = append(patterns, fmt.Sprintf("*.domain%d.example", i))
+		default:
+			patterns = append(patterns, fmt.Sprintf("domain:domain%d.example", i))
+		}
+	}
+
+	return patterns
+}
+
+// boolSink is a sink for bool values returned from benchmarks.
+var boolSink bool
+
+func BenchmarkMatcher_Match(b *testing.B) {
+	const n = 100_000
+
+	m, err := rules.NewMatcher(append(newBenchPatterns(n), "*"))
+	require.NoError(b, err)
+
+	testCases := []struct {
+		name     string
+		hostname string
+	}{{
+		name:     "exact",
+		hostname: "domain0.example",
+	}, {
+		name:     "subdomain",
+		hostname: "www.domain99998.example",
+	}, {
+		name:     "fallback",
+		hostname: "not.listed.example",
+	}}
+
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				_, boolSink = m.Match(tc.hostname, nil)
+			}
+		})
+	}
+
+	// The linear scan over wildcards that was used before the trie, as the
+	// baseline.
+	wildcards := newBenchPatterns(n)
+	for i, p := range wildcards {
+		wildcards[i] = strings.TrimPrefix(p, "domain:")
+	}
+
+	b.Run("linear_subdomain", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			for _, p := range wildcards {
+				boolSink = wildcard.MatchSimple(p, "www.domain99998.example")
+				if boolSink {
+					break
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package sockets
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// setNonblock puts the socket c into non-blocking mode.
+func setNonblock(c syscall.Conn) (err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = syscall.SetNonblock(int(fd), true)
+	})
+
+	return errors.WithDeferred(opErr, err)
+}
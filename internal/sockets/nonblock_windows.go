@@ -0,0 +1,13 @@
+//go:build windows
+
+package sockets
+
+import (
+	"syscall"
+)
+
+// setNonblock does nothing on Windows, since the sockets cannot be passed to
+// another process there.
+func setNonblock(_ syscall.Conn) (err error) {
+	return nil
+}
@@ -0,0 +1,352 @@
+// Package sockets manages the listening sockets that snirelay can inherit from
+// systemd socket activation or from the previous snirelay process during an
+// upgrade.
+package sockets
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// Environment variables with the inherited sockets.
+const (
+	// EnvListenFDs is the number of the sockets passed by the previous
+	// snirelay process.
+	EnvListenFDs = "SNIRELAY_LISTEN_FDS"
+
+	// envSystemdFDs is the number of the sockets passed by systemd.
+	envSystemdFDs = "LISTEN_FDS"
+
+	// envSystemdPID is the PID of the process the systemd sockets are
+	// passed to.
+	envSystemdPID = "LISTEN_PID"
+
+	// envSystemdFDNames are the names of the systemd sockets.  They are not
+	// used, the sockets are matched by their addresses.
+	envSystemdFDNames = "LISTEN_FDNAMES"
+)
+
+// FirstFD is the first file descriptor of the inherited sockets.  The sockets
+// are passed as consecutive file descriptors starting from it.
+const FirstFD = 3
+
+// ListenConfig creates listening sockets.  [*net.ListenConfig] and [*Set]
+// implement it.
+type ListenConfig interface {
+	// Listen announces on the local network address.  See
+	// [net.ListenConfig.Listen].
+	Listen(ctx context.Context, network, address string) (l net.Listener, err error)
+
+	// ListenPacket announces on the local network address.  See
+	// [net.ListenConfig.ListenPacket].
+	ListenPacket(ctx context.Context, network, address string) (c net.PacketConn, err error)
+}
+
+// type check
+var _ ListenConfig = (*net.ListenConfig)(nil)
+
+// filer is a socket that can be duplicated as a file.  The listeners and the
+// packet connections of package net implement it.
+type filer interface {
+	syscall.Conn
+
+	File() (f *os.File, err error)
+}
+
+// Set is a set of listening sockets.  It returns the inherited sockets when
+// their addresses are requested and creates the other ones.  All sockets
+// returned by it can be passed to another process.
+type Set struct {
+	// mu protects all fields.
+	mu *sync.Mutex
+
+	// listeners are the inherited stream sockets that are not used yet.
+	listeners []net.Listener
+
+	// packetConns are the inherited datagram sockets that are not used yet.
+	packetConns []net.PacketConn
+
+	// used are the sockets returned by Listen and ListenPacket.
+	used []filer
+}
+
+// type check
+var _ ListenConfig = (*Set)(nil)
+
+// New returns a set with the sockets inherited from systemd or from the
+// previous snirelay process, if any.  The environment variables describing
+// them are unset so that they are not passed to child processes.
+func New() (s *Set, err error) {
+	n, err := inheritedNum()
+	if err != nil {
+		return nil, err
+	}
+
+	s = &Set{
+		mu: &sync.Mutex{},
+	}
+
+	for fd := FirstFD; fd < FirstFD+n; fd++ {
+		err = s.addFD(uintptr(fd))
+		if err != nil {
+			return nil, errors.WithDeferred(err, s.CloseUnused())
+		}
+	}
+
+	return s, nil
+}
+
+// inheritedNum returns the number of the inherited sockets and unsets the
+// environment variables.
+func inheritedNum() (n int, err error) {
+	defer func() {
+		for _, key := range []string{EnvListenFDs, envSystemdFDs, envSystemdPID, envSystemdFDNames} {
+			err = errors.WithDeferred(err, os.Unsetenv(key))
+		}
+	}()
+
+	if v := os.Getenv(EnvListenFDs); v != "" {
+		return parseNum(EnvListenFDs, v)
+	}
+
+	v := os.Getenv(envSystemdFDs)
+	if v == "" {
+		return 0, nil
+	}
+
+	// systemd sets LISTEN_PID to make sure that the sockets are not used by
+	// the processes that inherit the environment.
+	if pid := os.Getenv(envSystemdPID); pid != strconv.Itoa(os.Getpid()) {
+		log.Debug("sockets: %s=%s is not for this process", envSystemdPID, pid)
+
+		return 0, nil
+	}
+
+	return parseNum(envSystemdFDs, v)
+}
+
+// parseNum parses the value of the environment variable key with the number
+// of sockets.
+func parseNum(key, v string) (n int, err error) {
+	n, err = strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	} else if n < 0 {
+		return 0, fmt.Errorf("%s: negative value %d", key, n)
+	}
+
+	return n, nil
+}
+
+// addFD adds the inherited socket with the file descriptor fd to s.
+func (s *Set) addFD(fd uintptr) (err error) {
+	f := os.NewFile(fd, fmt.Sprintf("inherited socket %d", fd))
+	if f == nil {
+		return fmt.Errorf("invalid file descriptor %d", fd)
+	}
+
+	// Both net.FileListener and net.FilePacketConn duplicate the descriptor.
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	l, lErr := net.FileListener(f)
+	if lErr == nil {
+		log.Info("sockets: inherited %s listener on %s", l.Addr().Network(), l.Addr())
+		s.listeners = append(s.listeners, l)
+
+		return nil
+	}
+
+	c, cErr := net.FilePacketConn(f)
+	if cErr == nil {
+		log.Info("sockets: inherited %s socket on %s", c.LocalAddr().Network(), c.LocalAddr())
+		s.packetConns = append(s.packetConns, c)
+
+		return nil
+	}
+
+	return fmt.Errorf("file descriptor %d: %w", fd, errors.Join(lErr, cErr))
+}
+
+// Listen implements the [ListenConfig] interface for *Set.  It returns the
+// inherited listener with the address, if there is one.
+func (s *Set) Listen(ctx context.Context, network, address string) (l net.Listener, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want, wantOK := parseAddr(address)
+	for i, inherited := range s.listeners {
+		if wantOK && matches(network, want, inherited.Addr()) {
+			log.Debug("sockets: using inherited listener on %s", inherited.Addr())
+
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			s.used = append(s.used, inherited.(filer))
+
+			return inherited, nil
+		}
+	}
+
+	lc := &net.ListenConfig{}
+	l, err = lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := l.(filer); ok {
+		s.used = append(s.used, f)
+	}
+
+	return l, nil
+}
+
+// ListenPacket implements the [ListenConfig] interface for *Set.  It returns
+// the inherited socket with the address, if there is one.
+func (s *Set) ListenPacket(
+	ctx context.Context,
+	network string,
+	address string,
+) (c net.PacketConn, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want, wantOK := parseAddr(address)
+	for i, inherited := range s.packetConns {
+		if wantOK && matches(network, want, inherited.LocalAddr()) {
+			log.Debug("sockets: using inherited socket on %s", inherited.LocalAddr())
+
+			s.packetConns = append(s.packetConns[:i], s.packetConns[i+1:]...)
+			s.used = append(s.used, inherited.(filer))
+
+			return inherited, nil
+		}
+	}
+
+	lc := &net.ListenConfig{}
+	c, err = lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := c.(filer); ok {
+		s.used = append(s.used, f)
+	}
+
+	return c, nil
+}
+
+// Files returns the duplicates of the used sockets to pass them to another
+// process.  The caller must close them.  Passing them to [os.StartProcess]
+// puts the sockets into blocking mode, so [Set.RestoreNonblock] must be called
+// after that.
+func (s *Set) Files() (files []*os.File, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.used {
+		var f *os.File
+		f, err = u.File()
+		if err != nil {
+			for _, f = range files {
+				err = errors.WithDeferred(err, f.Close())
+			}
+
+			return nil, fmt.Errorf("duplicating socket: %w", err)
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// RestoreNonblock puts the used sockets back into non-blocking mode after
+// their duplicates have been passed to another process.
+func (s *Set) RestoreNonblock() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, u := range s.used {
+		errs = append(errs, setNonblock(u))
+	}
+
+	return errors.Join(errs...)
+}
+
+// CloseUnused closes the inherited sockets that have not been used, so that
+// their ports are released.
+func (s *Set) CloseUnused() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, l := range s.listeners {
+		log.Info("sockets: closing unused inherited listener on %s", l.Addr())
+		errs = append(errs, l.Close())
+	}
+
+	for _, c := range s.packetConns {
+		log.Info("sockets: closing unused inherited socket on %s", c.LocalAddr())
+		errs = append(errs, c.Close())
+	}
+
+	s.listeners, s.packetConns = nil, nil
+
+	return errors.Join(errs...)
+}
+
+// parseAddr parses the address passed to Listen or ListenPacket.  ok is false
+// if it cannot match any inherited socket, e.g. if the port is zero.
+func parseAddr(address string) (ap netip.AddrPort, ok bool) {
+	host, port, err := netutil.SplitHostPort(address)
+	if err != nil || port == 0 {
+		return netip.AddrPort{}, false
+	}
+
+	addr := netip.IPv6Unspecified()
+	if host != "" {
+		addr, err = netip.ParseAddr(host)
+		if err != nil {
+			return netip.AddrPort{}, false
+		}
+	}
+
+	return netip.AddrPortFrom(addr.Unmap(), port), true
+}
+
+// matches returns true if the inherited socket with the address have can be
+// used for the network and the address want.  An unspecified address matches
+// any other unspecified one, since systemd binds to "[::]" by default.
+func matches(network string, want netip.AddrPort, have net.Addr) (ok bool) {
+	haveAP := netutil.NetAddrToAddrPort(have)
+	if haveAP.Port() != want.Port() || !sameNetwork(network, have.Network()) {
+		return false
+	}
+
+	wantAddr, haveAddr := want.Addr(), haveAP.Addr().Unmap()
+
+	return wantAddr == haveAddr || wantAddr.IsUnspecified() && haveAddr.IsUnspecified()
+}
+
+// sameNetwork returns true if the network passed to Listen or ListenPacket,
+// e.g. "tcp4", is the same protocol as the network of the socket address,
+// e.g. "tcp".
+func sameNetwork(network, addrNetwork string) (ok bool) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return addrNetwork == "tcp"
+	case "udp", "udp4", "udp6":
+		return addrNetwork == "udp"
+	default:
+		return false
+	}
+}
@@ -0,0 +1,156 @@
+package sockets
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddr(t *testing.T) {
+	testCases := []struct {
+		name    string
+		address string
+		want    netip.AddrPort
+		wantOK  bool
+	}{{
+		name:    "ipv4",
+		address: "127.0.0.1:443",
+		want:    netip.MustParseAddrPort("127.0.0.1:443"),
+		wantOK:  true,
+	}, {
+		name:    "ipv6",
+		address: "[::1]:443",
+		want:    netip.MustParseAddrPort("[::1]:443"),
+		wantOK:  true,
+	}, {
+		name:    "mapped",
+		address: "[::ffff:127.0.0.1]:443",
+		want:    netip.MustParseAddrPort("127.0.0.1:443"),
+		wantOK:  true,
+	}, {
+		name:    "empty_host",
+		address: ":443",
+		want:    netip.MustParseAddrPort("[::]:443"),
+		wantOK:  true,
+	}, {
+		name:    "zero_port",
+		address: "127.0.0.1:0",
+		wantOK:  false,
+	}, {
+		name:    "hostname",
+		address: "localhost:443",
+		wantOK:  false,
+	}, {
+		name:    "bad",
+		address: "127.0.0.1",
+		wantOK:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseAddr(tc.address)
+			require.Equal(t, tc.wantOK, ok)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: net.IPv6zero, Port: 443}
+
+	testCases := []struct {
+		have    net.Addr
+		name    string
+		network string
+		want    netip.AddrPort
+		wantOK  bool
+	}{{
+		have:    tcpAddr,
+		name:    "unspecified",
+		network: "tcp",
+		want:    netip.MustParseAddrPort("0.0.0.0:443"),
+		wantOK:  true,
+	}, {
+		have:    &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443},
+		name:    "mapped",
+		network: "tcp4",
+		want:    netip.MustParseAddrPort("127.0.0.1:443"),
+		wantOK:  true,
+	}, {
+		have:    tcpAddr,
+		name:    "other_port",
+		network: "tcp",
+		want:    netip.MustParseAddrPort("[::]:80"),
+		wantOK:  false,
+	}, {
+		have:    tcpAddr,
+		name:    "other_addr",
+		network: "tcp",
+		want:    netip.MustParseAddrPort("127.0.0.1:443"),
+		wantOK:  false,
+	}, {
+		have:    tcpAddr,
+		name:    "other_network",
+		network: "udp",
+		want:    netip.MustParseAddrPort("[::]:443"),
+		wantOK:  false,
+	}, {
+		have:    &net.UDPAddr{IP: net.IPv6zero, Port: 443},
+		name:    "udp",
+		network: "udp6",
+		want:    netip.MustParseAddrPort("[::]:443"),
+		wantOK:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantOK, matches(tc.network, tc.want, tc.have))
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Set{
+		mu:        &sync.Mutex{},
+		listeners: []net.Listener{inherited, unused},
+	}
+
+	l, err := s.Listen(ctx, "tcp", inherited.Addr().String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	assert.Same(t, inherited, l)
+
+	created, err := s.ListenPacket(ctx, "udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, created.Close)
+
+	files, err := s.Files()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	for _, f := range files {
+		require.NoError(t, f.Close())
+	}
+
+	require.NoError(t, s.RestoreNonblock())
+	require.NoError(t, s.CloseUnused())
+
+	_, err = unused.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}